@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+const (
+	kActivityPubAccept = `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+	// the most objects fetched for one thread, posts, replies pages and
+	// authors together
+	kActivityPubMaxObjects = 500
+	// objects larger than this aren't read
+	kActivityPubMaxBytes = 10 << 20
+)
+
+// ActivityPubFetcher fetches posts from the server they were written on, as
+// ActivityPub objects, so saving doesn't depend on our instance knowing the
+// post. Notes, Articles and Questions (polls) are saved, from Mastodon and
+// other software alike.
+// IDs, and URLs that can't be fetched this way, go to the fallback.
+type ActivityPubFetcher struct {
+	// http.DefaultClient when nil
+	client *http.Client
+	// resolves the requested post to its status ID on our server, so it is
+	// indexed as when saved by ID; the post keeps its URI as ID when nil
+	mClient  *mdon.Client
+	fallback Fetcher
+	mode     ThreadMode
+}
+
+func (af *ActivityPubFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
+	if !strings.HasPrefix(idOrUrl, "https://") {
+		return af.fallback.Fetch(ctx, idOrUrl)
+	}
+	thread, err := af.fetchThread(ctx, idOrUrl)
+	if err != nil {
+		log.Printf("failed to fetch %s from its server, searching for it instead: %v", idOrUrl, err)
+		return af.fallback.Fetch(ctx, idOrUrl)
+	}
+	af.localID(ctx, thread)
+	return thread, nil
+}
+
+// localID gives the requested post of the thread its status ID on our
+// server, the ID MastodonFetcher and saving by ID use, and its visibility and
+// edit history, which ActivityPub doesn't publish. A post our server can't
+// resolve keeps its URI as ID.
+func (af *ActivityPubFetcher) localID(ctx context.Context, thread []*SavedStatus) {
+	if af.mClient == nil {
+		return
+	}
+	post := requestedStatus(thread)
+	status, err := resolveMastodonStatus(ctx, af.mClient, post.URI)
+	if err != nil {
+		log.Printf("failed to find %s on our server, saving it by its URI: %v", post.URI, err)
+		return
+	}
+	for _, ss := range thread {
+		if ss.InReplyToID == post.ID {
+			ss.InReplyToID = string(status.ID)
+		}
+	}
+	post.ID = string(status.ID)
+
+	status, err = af.mClient.GetStatus(ctx, status.ID)
+	if err != nil {
+		log.Printf("failed to fetch %s from our server: %v", post.ID, err)
+		return
+	}
+	post.Visibility = status.Visibility
+	if edits := mastodonEdits(ctx, af.mClient, status); len(edits) > 0 {
+		post.Edits = edits
+	}
+}
+
+// apObject is the part of an ActivityPub object or activity that is saved.
+// Fields that may be a link, an object or a list of either are decoded later.
+type apObject struct {
+	ID           string            `json:"id"`
+	Type         string            `json:"type"`
+	Name         string            `json:"name"`
+	Content      string            `json:"content"`
+	ContentMap   map[string]string `json:"contentMap"`
+	URL          json.RawMessage   `json:"url"`
+	Published    string            `json:"published"`
+	AttributedTo json.RawMessage   `json:"attributedTo"`
+	InReplyTo    json.RawMessage   `json:"inReplyTo"`
+	Object       json.RawMessage   `json:"object"`
+	Attachment   json.RawMessage   `json:"attachment"`
+	Tag          json.RawMessage   `json:"tag"`
+	Replies      json.RawMessage   `json:"replies"`
+	// the content warning
+	Summary   string `json:"summary"`
+	Sensitive bool   `json:"sensitive"`
+	Updated   string `json:"updated"`
+
+	// actors
+	PreferredUsername string `json:"preferredUsername"`
+
+	// polls, with the votes of an option as the total of its replies
+	OneOf       json.RawMessage `json:"oneOf"`
+	AnyOf       json.RawMessage `json:"anyOf"`
+	EndTime     string          `json:"endTime"`
+	Closed      json.RawMessage `json:"closed"`
+	VotersCount int64           `json:"votersCount"`
+
+	// collections and their pages
+	TotalItems   int64           `json:"totalItems"`
+	First        json.RawMessage `json:"first"`
+	Next         json.RawMessage `json:"next"`
+	Items        json.RawMessage `json:"items"`
+	OrderedItems json.RawMessage `json:"orderedItems"`
+
+	// attachments, tags and links
+	MediaType string          `json:"mediaType"`
+	Href      string          `json:"href"`
+	Blurhash  string          `json:"blurhash"`
+	Width     int64           `json:"width"`
+	Height    int64           `json:"height"`
+	Icon      json.RawMessage `json:"icon"`
+}
+
+// apThread fetches the objects of one thread.
+type apThread struct {
+	af *ActivityPubFetcher
+	// objects left to fetch
+	budget int
+	actors map[string]*apObject
+}
+
+func (af *ActivityPubFetcher) fetchThread(ctx context.Context, postURL string) ([]*SavedStatus, error) {
+	at := &apThread{af: af, budget: kActivityPubMaxObjects, actors: make(map[string]*apObject)}
+	object, err := at.post(ctx, postURL)
+	if err != nil {
+		return nil, err
+	}
+	post, err := at.saved(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	post.Requested = true
+
+	var ancestors []*SavedStatus
+	for parent := post.InReplyToID; parent != ""; {
+		object, err := at.post(ctx, parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", parent, err)
+		}
+		ancestor, err := at.saved(ctx, object)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append([]*SavedStatus{ancestor}, ancestors...)
+		parent = ancestor.InReplyToID
+	}
+	if af.mode == ThreadAncestors || af.mode == "" {
+		return append(ancestors, post), nil
+	}
+
+	descendants, err := at.replies(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	return buildThread(ancestors, post, descendants, af.mode), nil
+}
+
+// replies returns the replies below object, depth first.
+func (at *apThread) replies(ctx context.Context, object *apObject) ([]*SavedStatus, error) {
+	var result []*SavedStatus
+	if len(object.Replies) == 0 || string(object.Replies) == "null" {
+		return nil, nil
+	}
+	page, err := at.embedded(ctx, object.Replies)
+	if err != nil {
+		return nil, err
+	}
+	if page != nil && len(page.First) > 0 {
+		page, err = at.embedded(ctx, page.First)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for page != nil {
+		items := append(apList(page.Items), apList(page.OrderedItems)...)
+		for _, item := range items {
+			reply, err := at.embedded(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			if reply == nil || !apIsPost(reply.Type) {
+				continue
+			}
+			status, err := at.saved(ctx, reply)
+			if err != nil {
+				return nil, err
+			}
+			below, err := at.replies(ctx, reply)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, status)
+			result = append(result, below...)
+		}
+		if len(page.Next) == 0 || string(page.Next) == "null" {
+			break
+		}
+		page, err = at.embedded(ctx, page.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// post fetches a Note, Article or Question, unwrapping the activity that
+// created it.
+func (at *apThread) post(ctx context.Context, id string) (*apObject, error) {
+	object, err := at.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if object.Type == "Create" || object.Type == "Update" {
+		if object, err = at.embedded(ctx, object.Object); err != nil {
+			return nil, err
+		}
+		if object == nil {
+			return nil, fmt.Errorf("%s has no object", id)
+		}
+	}
+	if !apIsPost(object.Type) {
+		return nil, fmt.Errorf("%s is a %s, not a post", id, object.Type)
+	}
+	return object, nil
+}
+
+// embedded returns an object given inline or fetches it by its ID, nil for
+// none. Objects given inline with only their ID are fetched too.
+func (at *apThread) embedded(ctx context.Context, raw json.RawMessage) (*apObject, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return at.get(ctx, id)
+	}
+	var object apObject
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	if object.Type == "" && object.ID != "" {
+		return at.get(ctx, object.ID)
+	}
+	return &object, nil
+}
+
+// get fetches the object with id from its server.
+func (at *apThread) get(ctx context.Context, id string) (*apObject, error) {
+	if at.budget <= 0 {
+		return nil, fmt.Errorf("thread has more than %d objects", kActivityPubMaxObjects)
+	}
+	at.budget--
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("can't fetch %s", id)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", kActivityPubAccept)
+	client := at.af.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", id, resp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType != "application/activity+json" && contentType != "application/ld+json" {
+		return nil, fmt.Errorf("%s isn't an ActivityPub object, it is %s", id, contentType)
+	}
+	var object apObject
+	if err := json.NewDecoder(io.LimitReader(resp.Body, kActivityPubMaxBytes)).Decode(&object); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", id, err)
+	}
+	return &object, nil
+}
+
+// apIsPost reports whether objects of type are saved as posts.
+func apIsPost(objectType string) bool {
+	return objectType == "Note" || objectType == "Article" || objectType == "Question"
+}
+
+// saved maps a Note, Article or Question to a saved status, fetching its
+// author.
+func (at *apThread) saved(ctx context.Context, object *apObject) (*SavedStatus, error) {
+	content := object.Content
+	language := ""
+	for lang, c := range object.ContentMap {
+		if content == "" {
+			content = c
+		}
+		// which of several languages the content is in isn't known
+		if len(object.ContentMap) == 1 {
+			language = lang
+		}
+	}
+	if object.Type == "Article" && object.Name != "" {
+		content = "<p><strong>" + html.EscapeString(object.Name) + "</strong></p>" + content
+	}
+	ss := &SavedStatus{
+		ID:          object.ID,
+		URI:         object.ID,
+		Content:     contentPolicy.Sanitize(content),
+		URL:         apURL(object.URL, "text/html"),
+		InReplyToID: apID(object.InReplyTo),
+		SpoilerText: html.UnescapeString(stripTagsPolicy.Sanitize(object.Summary)),
+		Sensitive:   object.Sensitive,
+		Language:    language,
+	}
+	if ss.URL == "" {
+		ss.URL = object.ID
+	}
+	if object.Published != "" {
+		published, err := time.Parse(time.RFC3339, object.Published)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publication date of %s: %w", object.ID, err)
+		}
+		ss.CreatedAt = published
+	}
+	if updated, err := time.Parse(time.RFC3339, object.Updated); err == nil {
+		ss.EditedAt = updated
+	}
+	if object.Type == "Question" {
+		ss.Poll = apPoll(object)
+	}
+
+	actorID := apID(object.AttributedTo)
+	if actorID == "" {
+		return nil, fmt.Errorf("%s has no author", object.ID)
+	}
+	actor, ok := at.actors[actorID]
+	if !ok {
+		var err error
+		if actor, err = at.get(ctx, actorID); err != nil {
+			return nil, fmt.Errorf("failed to fetch the author of %s: %w", object.ID, err)
+		}
+		at.actors[actorID] = actor
+	}
+	ss.Account.Username = actor.PreferredUsername
+	ss.Account.DisplayName = actor.Name
+	ss.Account.Acct = actor.PreferredUsername
+	ss.Account.URL = apURL(actor.URL, "text/html")
+	if ss.Account.URL == "" {
+		ss.Account.URL = actorID
+	}
+	ss.Account.Avatar = apURL(actor.Icon, "")
+	ss.Account.Note = contentPolicy.Sanitize(actor.Summary)
+	if u, err := url.Parse(actorID); err == nil {
+		ss.Account.Acct += "@" + u.Host
+	}
+
+	for _, raw := range apList(object.Tag) {
+		var tag apObject
+		if err := json.Unmarshal(raw, &tag); err != nil {
+			continue
+		}
+		switch tag.Type {
+		case "Hashtag":
+			ss.Tags = append(ss.Tags, struct{ Name string }{Name: strings.TrimPrefix(tag.Name, "#")})
+		case "Emoji":
+			ss.Emojis = append(ss.Emojis, SavedEmoji{
+				Shortcode: strings.Trim(tag.Name, ":"),
+				URL:       apURL(tag.Icon, ""),
+			})
+		}
+	}
+	for _, raw := range apList(object.Attachment) {
+		var attachment apObject
+		if err := json.Unmarshal(raw, &attachment); err != nil {
+			continue
+		}
+		mediaURL := apURL(attachment.URL, "")
+		if mediaURL == "" {
+			mediaURL = attachment.Href
+		}
+		if mediaURL == "" {
+			continue
+		}
+		ss.MediaAttachments = append(ss.MediaAttachments, SavedMedia{
+			URL:       mediaURL,
+			RemoteURL: mediaURL,
+			Type:      apMediaType(attachment.MediaType),
+			AltText:   attachment.Name,
+			Blurhash:  attachment.Blurhash,
+			Width:     attachment.Width,
+			Height:    attachment.Height,
+		})
+	}
+	return ss, nil
+}
+
+// apPoll maps the options of a Question and their votes.
+func apPoll(question *apObject) *SavedPoll {
+	poll := &SavedPoll{VotersCount: question.VotersCount}
+	options := apList(question.OneOf)
+	if len(apList(question.AnyOf)) > 0 {
+		options = apList(question.AnyOf)
+		poll.Multiple = true
+	}
+	for _, raw := range options {
+		var option apObject
+		if err := json.Unmarshal(raw, &option); err != nil {
+			continue
+		}
+		var replies apObject
+		json.Unmarshal(option.Replies, &replies)
+		poll.Options = append(poll.Options, SavedPollOption{Title: option.Name, VotesCount: replies.TotalItems})
+		poll.VotesCount += replies.TotalItems
+	}
+	// closed is the time the poll closed, or true
+	closed := len(question.Closed) > 0 && string(question.Closed) != "null" && string(question.Closed) != "false"
+	if end, err := time.Parse(time.RFC3339, question.EndTime); err == nil {
+		poll.ExpiresAt = end
+		closed = closed || end.Before(time.Now())
+	}
+	poll.Expired = closed
+	return poll
+}
+
+// apMediaType is the kind of media of a MIME type, as Mastodon names it.
+func apMediaType(mediaType string) string {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	switch kind {
+	case "image", "video", "audio":
+		return kind
+	}
+	return "unknown"
+}
+
+// apList returns the items of a list, or the one item that isn't in a list.
+func apList(raw json.RawMessage) []json.RawMessage {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list
+	}
+	return []json.RawMessage{raw}
+}
+
+// apID is the ID of a link, an object or the first of a list of them.
+func apID(raw json.RawMessage) string {
+	for _, item := range apList(raw) {
+		var id string
+		if err := json.Unmarshal(item, &id); err == nil {
+			return id
+		}
+		var object apObject
+		if err := json.Unmarshal(item, &object); err == nil {
+			if object.ID != "" {
+				return object.ID
+			}
+			return object.Href
+		}
+	}
+	return ""
+}
+
+// apURL is the address a url or icon field links to, preferring the link of
+// mediaType when there are several.
+func apURL(raw json.RawMessage, mediaType string) string {
+	first := ""
+	for _, item := range apList(raw) {
+		var href string
+		if err := json.Unmarshal(item, &href); err == nil {
+			if first == "" {
+				first = href
+			}
+			continue
+		}
+		var link apObject
+		if err := json.Unmarshal(item, &link); err != nil {
+			continue
+		}
+		href = link.Href
+		if href == "" {
+			href = apURL(link.URL, mediaType)
+		}
+		if mediaType != "" && link.MediaType == mediaType && href != "" {
+			return href
+		}
+		if first == "" {
+			first = href
+		}
+	}
+	return first
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// activityPubServer serves ActivityPub objects by path, with {{server}}
+// standing for its own URL.
+func activityPubServer(objects map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/activity+json") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/activity+json; charset=utf-8")
+		fmt.Fprint(w, strings.ReplaceAll(object, "{{server}}", server.URL))
+	}))
+	return server
+}
+
+var kActivityPubObjects = map[string]string{
+	"/users/alice": `{"id": "{{server}}/users/alice", "type": "Person",
+		"preferredUsername": "alice", "name": "Alice"}`,
+	"/users/bob": `{"id": "{{server}}/users/bob", "type": "Person",
+		"preferredUsername": "bob", "name": "Bob", "url": "{{server}}/@bob",
+		"icon": {"type": "Image", "mediaType": "image/png", "url": "{{server}}/media/bob.png"},
+		"summary": "<p>Digs <script>alert(1)</script>tunnels</p>"}`,
+	"/notes/1": `{"id": "{{server}}/notes/1", "type": "Article", "name": "Gophers",
+		"content": "<p>Gophers dig.</p>", "url": "{{server}}/@alice/1",
+		"published": "2026-01-01T12:00:00Z", "attributedTo": "{{server}}/users/alice"}`,
+	"/notes/2": `{"id": "{{server}}/notes/2", "type": "Note",
+		"content": "<p>They do <script>alert(1)</script>:blob:</p>",
+		"url": [{"type": "Link", "mediaType": "application/json", "href": "{{server}}/api/2"},
+			{"type": "Link", "mediaType": "text/html", "href": "{{server}}/@bob/2"}],
+		"published": "2026-01-01T12:05:00Z", "attributedTo": {"id": "{{server}}/users/bob"},
+		"inReplyTo": "{{server}}/notes/1",
+		"attachment": [{"type": "Document", "mediaType": "image/png", "url": "{{server}}/media/a.png",
+			"name": "a gopher", "blurhash": "LEHV6n", "width": 640, "height": 480}],
+		"tag": [{"type": "Hashtag", "name": "#gophers", "href": "{{server}}/tags/gophers"},
+			{"type": "Emoji", "name": ":blob:", "icon": {"type": "Image", "url": "{{server}}/emoji/blob.png"}}],
+		"replies": {"type": "Collection", "first": {"type": "CollectionPage",
+			"items": ["{{server}}/notes/3"], "next": "{{server}}/notes/2/replies?page=2"}}}`,
+	"/notes/2/replies": `{"type": "CollectionPage", "items": [{"id": "{{server}}/notes/4", "type": "Note",
+		"content": "<p>Inline reply</p>", "published": "2026-01-01T12:20:00Z",
+		"attributedTo": "{{server}}/users/alice", "inReplyTo": "{{server}}/notes/2"}]}`,
+	"/notes/3": `{"id": "{{server}}/notes/3", "type": "Note", "content": "<p>Continued</p>",
+		"published": "2026-01-01T12:10:00Z", "attributedTo": "{{server}}/users/bob",
+		"inReplyTo": "{{server}}/notes/2"}`,
+	"/notes/5": `{"id": "{{server}}/notes/5", "type": "Question", "content": "<p>Best pet?</p>",
+		"summary": "pets &amp; more", "sensitive": true, "contentMap": {"en": "<p>Best pet?</p>"},
+		"published": "2026-01-01T12:00:00Z", "updated": "2026-01-01T13:00:00Z",
+		"attributedTo": "{{server}}/users/alice", "endTime": "2026-01-02T12:00:00Z", "votersCount": 3,
+		"anyOf": [{"type": "Note", "name": "cats", "replies": {"type": "Collection", "totalItems": 3}},
+			{"type": "Note", "name": "dogs", "replies": {"type": "Collection", "totalItems": 1}}]}`,
+	"/activities/2":          `{"id": "{{server}}/activities/2", "type": "Create", "object": "{{server}}/notes/2"}`,
+	"/users/alice/followers": `{"id": "{{server}}/users/alice/followers", "type": "OrderedCollection"}`,
+}
+
+func TestActivityPubFetcher_Fetch(t *testing.T) {
+	server := activityPubServer(kActivityPubObjects)
+	defer server.Close()
+	ctx := context.Background()
+
+	af := &ActivityPubFetcher{client: server.Client(), fallback: fakeFetcher{}, mode: ThreadAncestors}
+	thread, err := af.Fetch(ctx, server.URL+"/activities/2")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(thread) != 2 {
+		t.Fatalf("Expected the post and the article it replies to, got %d statuses", len(thread))
+	}
+	article, post := thread[0], thread[1]
+	if article.ID != server.URL+"/notes/1" || article.URL != server.URL+"/@alice/1" ||
+		!strings.HasPrefix(article.Content, "<p><strong>Gophers</strong></p>") || article.Requested {
+		t.Errorf("Unexpected article %+v", article)
+	}
+	if post.InReplyToID != article.ID || post.URL != server.URL+"/@bob/2" || !post.Requested ||
+		post.CreatedAt.Minute() != 5 || strings.Contains(post.Content, "script") {
+		t.Errorf("Unexpected post %+v", post)
+	}
+	host := strings.TrimPrefix(server.URL, "https://")
+	if post.Account.URL != server.URL+"/@bob" || post.Account.Avatar != server.URL+"/media/bob.png" ||
+		post.Account.Note != "<p>Digs tunnels</p>" {
+		t.Errorf("Account = %+v, want bob's profile without the script", post.Account)
+	}
+	if post.Account.Username != "bob" || post.Account.DisplayName != "Bob" || post.Account.Acct != "bob@"+host {
+		t.Errorf("Unexpected author %+v", post.Account)
+	}
+	if len(post.Tags) != 1 || post.Tags[0].Name != "gophers" {
+		t.Errorf("Unexpected tags %+v", post.Tags)
+	}
+	if len(post.Emojis) != 1 || post.Emojis[0] != (SavedEmoji{Shortcode: "blob", URL: server.URL + "/emoji/blob.png"}) {
+		t.Errorf("Unexpected emojis %+v", post.Emojis)
+	}
+	want := SavedMedia{URL: server.URL + "/media/a.png", RemoteURL: server.URL + "/media/a.png", Type: "image",
+		AltText: "a gopher", Blurhash: "LEHV6n", Width: 640, Height: 480}
+	if len(post.MediaAttachments) != 1 || post.MediaAttachments[0] != want {
+		t.Errorf("Unexpected media %+v", post.MediaAttachments)
+	}
+
+	af.mode = ThreadTree
+	thread, err = af.Fetch(ctx, server.URL+"/notes/2")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	var ids []string
+	for _, status := range thread {
+		ids = append(ids, fmt.Sprintf("%s:%d", strings.TrimPrefix(status.ID, server.URL+"/notes/"), status.Depth))
+	}
+	// bob continues his post, alice's reply from the second page nests below it
+	if got := strings.Join(ids, " "); got != "1:0 2:0 4:1 3:0" {
+		t.Errorf("Expected the replies from both pages below the post, got %s", got)
+	}
+}
+
+func TestActivityPubFetcher_Question(t *testing.T) {
+	server := activityPubServer(kActivityPubObjects)
+	defer server.Close()
+
+	af := &ActivityPubFetcher{client: server.Client(), fallback: fakeFetcher{}}
+	thread, err := af.Fetch(context.Background(), server.URL+"/notes/5")
+	if err != nil || len(thread) != 1 {
+		t.Fatalf("Fetch = %v, %v, want the poll", thread, err)
+	}
+	status := thread[0]
+	if status.SpoilerText != "pets & more" || !status.Sensitive || status.Language != "en" || status.EditedAt.Hour() != 13 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	want := &SavedPoll{
+		Options:     []SavedPollOption{{Title: "cats", VotesCount: 3}, {Title: "dogs", VotesCount: 1}},
+		VotesCount:  4,
+		VotersCount: 3,
+		Multiple:    true,
+		ExpiresAt:   time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC),
+		Expired:     true,
+	}
+	if !reflect.DeepEqual(status.Poll, want) {
+		t.Errorf("Poll = %+v, want %+v", status.Poll, want)
+	}
+	if got := status.Poll.Result(status.Poll.Options[0]); got != "3 votes (100%)" {
+		t.Errorf("Result = %q, want the share of the voters", got)
+	}
+}
+
+func TestActivityPubFetcher_Fallback(t *testing.T) {
+	server := activityPubServer(kActivityPubObjects)
+	defer server.Close()
+
+	searched := &SavedStatus{ID: "109", Content: "<p>found by search</p>"}
+	af := &ActivityPubFetcher{
+		client: server.Client(),
+		fallback: fakeFetcher{
+			"109":                                 searched,
+			server.URL + "/@alice/1":              searched,
+			server.URL + "/users/alice/followers": searched,
+		},
+	}
+	for _, idOrUrl := range []string{"109", server.URL + "/@alice/1", server.URL + "/users/alice/followers"} {
+		thread, err := af.Fetch(context.Background(), idOrUrl)
+		if err != nil || len(thread) != 1 || thread[0] != searched {
+			t.Errorf("Fetch(%s) = %v, %v, want the post found by search", idOrUrl, thread, err)
+		}
+	}
+}
+
+func TestActivityPubFetcher_LocalID(t *testing.T) {
+	server := activityPubServer(kActivityPubObjects)
+	defer server.Close()
+	uri := server.URL + "/notes/2"
+	mastodon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/v2/search" && r.URL.Query().Get("q") == uri:
+			fmt.Fprint(w, `{"statuses": [{"id": "109"}]}`)
+		case r.URL.Path == "/api/v1/statuses/109":
+			fmt.Fprint(w, `{"id": "109", "visibility": "unlisted", "edited_at": "2026-01-02T00:00:00Z"}`)
+		case r.URL.Path == "/api/v1/statuses/109/history":
+			fmt.Fprint(w, `[{"content": "<p>first</p>", "created_at": "2026-01-01T00:00:00Z"},
+				{"content": "<p>now</p>", "created_at": "2026-01-02T00:00:00Z"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mastodon.Close()
+
+	af := &ActivityPubFetcher{
+		client:   server.Client(),
+		mClient:  mdon.NewClient(&mdon.Config{Server: mastodon.URL}),
+		fallback: fakeFetcher{},
+		mode:     ThreadTree,
+	}
+	thread, err := af.Fetch(context.Background(), uri)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	post := requestedStatus(thread)
+	if post.ID != "109" || post.URI != uri {
+		t.Errorf("Expected the post keyed by its status ID on our server, got %q, %q", post.ID, post.URI)
+	}
+	if post.Visibility != "unlisted" || len(post.Edits) != 1 || post.Edits[0].Content != "<p>first</p>" {
+		t.Errorf("Expected the visibility and edits our server has, got %q, %+v", post.Visibility, post.Edits)
+	}
+	for _, status := range thread {
+		if status != post && status.URI != status.ID {
+			t.Errorf("Expected %s to keep its URI as ID", status.URI)
+		}
+		if status.URI == server.URL+"/notes/3" && status.InReplyToID != "109" {
+			t.Errorf("Expected the reply to point at the post's new ID, got %q", status.InReplyToID)
+		}
+	}
+
+	// a post our server can't find keeps its URI
+	thread, err = af.Fetch(context.Background(), server.URL+"/notes/5")
+	if err != nil || len(thread) != 1 || thread[0].ID != server.URL+"/notes/5" {
+		t.Errorf("Fetch = %v, %v, want the poll keyed by its URI", thread, err)
+	}
+}
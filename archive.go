@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// how many posts are asked for per page
+const kArchivePageSize = 40
+
+// ArchiveOptions select the posts save archives in bulk.
+type ArchiveOptions struct {
+	// the posts bookmarked by the logged in user
+	Bookmarks bool
+	// the posts favourited (liked on Bluesky) by the logged in user
+	Favourites bool
+	// the posts of this account
+	Account string
+	// only posts of Account written since then
+	Since time.Time
+	// a file listing one post ID or URL per line
+	List string
+	// list from Bluesky instead of Mastodon
+	Sky bool
+	// remove the bookmark of each post once it is saved
+	Unbookmark bool
+	// wait this long between posts
+	Delay time.Duration
+}
+
+// ArchiveItem is a post a Lister found.
+type ArchiveItem struct {
+	// what a Fetcher takes: a status ID, URL or at:// URI
+	ID        string
+	CreatedAt time.Time
+}
+
+// Lister pages through a collection of posts.
+type Lister interface {
+	// Next returns the next page of posts, or none when all were listed.
+	Next(ctx context.Context) ([]ArchiveItem, error)
+}
+
+// bookmarkRemover is implemented by listers of bookmarks.
+type bookmarkRemover interface {
+	Unbookmark(ctx context.Context, item ArchiveItem) error
+}
+
+type mastodonListKind int
+
+const (
+	mastodonBookmarks mastodonListKind = iota
+	mastodonFavourites
+	mastodonAccount
+)
+
+// MastodonLister pages through bookmarks, favourites or an account's
+// statuses, newest first.
+type MastodonLister struct {
+	mClient   *mdon.Client
+	kind      mastodonListKind
+	accountID mdon.ID
+	since     time.Time
+	maxID     mdon.ID
+	done      bool
+}
+
+func (ml *MastodonLister) Next(ctx context.Context) ([]ArchiveItem, error) {
+	if ml.done {
+		return nil, nil
+	}
+	pg := &mdon.Pagination{MaxID: ml.maxID, Limit: kArchivePageSize}
+	var statuses []*mdon.Status
+	var err error
+	switch ml.kind {
+	case mastodonBookmarks:
+		statuses, err = ml.mClient.GetBookmarks(ctx, pg)
+	case mastodonFavourites:
+		statuses, err = ml.mClient.GetFavourites(ctx, pg)
+	default:
+		statuses, err = ml.mClient.GetAccountStatuses(ctx, ml.accountID, pg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the next page starts where the link header says, without one this
+	// was the last page
+	if len(statuses) == 0 || pg.MaxID == "" || pg.MaxID == ml.maxID {
+		ml.done = true
+	}
+	ml.maxID = pg.MaxID
+
+	var items []ArchiveItem
+	for _, s := range statuses {
+		if ml.kind == mastodonAccount {
+			if s.CreatedAt.Before(ml.since) {
+				ml.done = true
+				break
+			}
+			if s.Reblog != nil {
+				continue
+			}
+		}
+		items = append(items, ArchiveItem{ID: string(s.ID), CreatedAt: s.CreatedAt})
+	}
+	return items, nil
+}
+
+func (ml *MastodonLister) Unbookmark(ctx context.Context, item ArchiveItem) error {
+	_, err := ml.mClient.Unbookmark(ctx, mdon.ID(item.ID))
+	return err
+}
+
+type blueskyListKind int
+
+const (
+	blueskyBookmarks blueskyListKind = iota
+	blueskyLikes
+	blueskyAuthor
+)
+
+// BlueskyLister pages through bookmarks, likes or an actor's posts, newest
+// first.
+type BlueskyLister struct {
+	skyClient *xrpc.Client
+	kind      blueskyListKind
+	actor     string
+	since     time.Time
+	cursor    string
+	done      bool
+}
+
+func (bl *BlueskyLister) Next(ctx context.Context) ([]ArchiveItem, error) {
+	if bl.done {
+		return nil, nil
+	}
+	posts, next, err := bl.page(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if next == "" {
+		bl.done = true
+	} else {
+		bl.cursor = next
+	}
+
+	var items []ArchiveItem
+	for _, p := range posts {
+		createdAt := savedFromBluesky(p).CreatedAt
+		if bl.kind == blueskyAuthor && createdAt.Before(bl.since) {
+			bl.done = true
+			break
+		}
+		items = append(items, ArchiveItem{ID: p.Uri, CreatedAt: createdAt})
+	}
+	return items, nil
+}
+
+// page fetches the posts at the lister's cursor and returns them with the
+// cursor of the next page, empty after the last.
+func (bl *BlueskyLister) page(ctx context.Context) ([]*appbsky.FeedDefs_PostView, string, error) {
+	var posts []*appbsky.FeedDefs_PostView
+	var cursor *string
+	switch bl.kind {
+	case blueskyBookmarks:
+		out, err := appbsky.BookmarkGetBookmarks(ctx, bl.skyClient, bl.cursor, kArchivePageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, b := range out.Bookmarks {
+			if b.Item != nil && b.Item.FeedDefs_PostView != nil {
+				posts = append(posts, b.Item.FeedDefs_PostView)
+			}
+		}
+		cursor = out.Cursor
+	case blueskyLikes:
+		out, err := appbsky.FeedGetActorLikes(ctx, bl.skyClient, bl.actor, bl.cursor, kArchivePageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, fp := range out.Feed {
+			posts = append(posts, fp.Post)
+		}
+		cursor = out.Cursor
+	default:
+		out, err := appbsky.FeedGetAuthorFeed(ctx, bl.skyClient, bl.actor, bl.cursor, "posts_with_replies", false, kArchivePageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, fp := range out.Feed {
+			// reposts are someone else's posts
+			if fp.Reason == nil {
+				posts = append(posts, fp.Post)
+			}
+		}
+		cursor = out.Cursor
+	}
+	return posts, blueskyCursor(cursor, bl.cursor), nil
+}
+
+// blueskyCursor returns the cursor of the next page, empty when there is
+// none.
+func blueskyCursor(next *string, cursor string) string {
+	if next == nil || *next == cursor {
+		return ""
+	}
+	return *next
+}
+
+func (bl *BlueskyLister) Unbookmark(ctx context.Context, item ArchiveItem) error {
+	return appbsky.BookmarkDeleteBookmark(ctx, bl.skyClient, &appbsky.BookmarkDeleteBookmark_Input{Uri: item.ID})
+}
+
+// FileLister lists the IDs and URLs in a file, one per line. Blank lines and
+// lines starting with # are skipped.
+type FileLister struct {
+	ids  []string
+	done bool
+}
+
+func ReadFileLister(path string) (*FileLister, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fl := &FileLister{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fl.ids = append(fl.ids, line)
+	}
+	return fl, scanner.Err()
+}
+
+// HasBluesky reports whether any of the listed posts is on Bluesky.
+func (fl *FileLister) HasBluesky() bool {
+	for _, id := range fl.ids {
+		if isBlueskyURL(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fl *FileLister) Next(ctx context.Context) ([]ArchiveItem, error) {
+	if fl.done {
+		return nil, nil
+	}
+	fl.done = true
+	var items []ArchiveItem
+	for _, id := range fl.ids {
+		items = append(items, ArchiveItem{ID: id})
+	}
+	return items, nil
+}
+
+// platformFetcher fetches Bluesky posts with one fetcher and Mastodon
+// statuses with the other.
+type platformFetcher struct {
+	mastodon Fetcher
+	bluesky  Fetcher
+}
+
+func (pf *platformFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
+	if isBlueskyURL(idOrUrl) {
+		if pf.bluesky == nil {
+			return nil, fmt.Errorf("not logged in to bluesky to save %s", idOrUrl)
+		}
+		return pf.bluesky.Fetch(ctx, idOrUrl)
+	}
+	return pf.mastodon.Fetch(ctx, idOrUrl)
+}
+
+// Archive saves the thread of every post the lister finds. A post that fails
+// to save is reported and skipped; the count of failures is returned as an
+// error at the end. A dry run only lists the posts that would be saved.
+func (saver *Saver) Archive(ctx context.Context, lister Lister, unbookmark bool, delay time.Duration) error {
+	remover, _ := lister.(bookmarkRemover)
+	if unbookmark && remover == nil {
+		return fmt.Errorf("only bookmarks can be removed once saved")
+	}
+
+	count, failed := 0, 0
+	for {
+		items, err := lister.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list posts after %d: %w", count, err)
+		}
+		if len(items) == 0 {
+			break
+		}
+		for _, item := range items {
+			count++
+			from := ""
+			if !item.CreatedAt.IsZero() {
+				from = " from " + item.CreatedAt.Local().Format(time.DateOnly)
+			}
+			if saver.dryrun {
+				log.Printf("[dryrun] [%d] would save %s%s", count, item.ID, from)
+				continue
+			}
+			if count > 1 && delay > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+			log.Printf("[%d] saving %s%s", count, item.ID, from)
+			if err := saver.Save(item.ID); err != nil {
+				log.Printf("failed to save %s: %v", item.ID, err)
+				failed++
+				continue
+			}
+			if unbookmark {
+				if err := remover.Unbookmark(ctx, item); err != nil {
+					log.Printf("failed to remove bookmark of %s: %v", item.ID, err)
+				}
+			}
+		}
+	}
+
+	if saver.dryrun {
+		log.Printf("[dryrun] would save %d posts", count)
+		return nil
+	}
+	log.Printf("saved %d of %d posts", count-failed, count)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d posts failed to save", failed, count)
+	}
+	return nil
+}
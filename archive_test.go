@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+func listAll(t *testing.T, lister Lister) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < 10; i++ {
+		items, err := lister.Next(context.Background())
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if len(items) == 0 {
+			return ids
+		}
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+	}
+	t.Fatal("Lister did not stop")
+	return nil
+}
+
+func TestMastodonLister_Bookmarks(t *testing.T) {
+	var server *httptest.Server
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/bookmarks" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("max_id") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/bookmarks?max_id=2>; rel="next"`, server.URL))
+			json.NewEncoder(w).Encode([]*mdon.Status{{ID: "3"}, {ID: "2"}})
+			return
+		}
+		json.NewEncoder(w).Encode([]*mdon.Status{{ID: "1"}})
+	})
+	server = httptest.NewServer(handler)
+	defer server.Close()
+
+	lister := &MastodonLister{mClient: mdon.NewClient(&mdon.Config{Server: server.URL}), kind: mastodonBookmarks}
+	if got := strings.Join(listAll(t, lister), " "); got != "3 2 1" {
+		t.Errorf("Listed %q, want %q", got, "3 2 1")
+	}
+}
+
+func TestMastodonLister_AccountSince(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 12, 0, 0, 0, time.UTC) }
+	var server *httptest.Server
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/accounts/42/statuses" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/accounts/42/statuses?max_id=1>; rel="next"`, server.URL))
+		json.NewEncoder(w).Encode([]*mdon.Status{
+			{ID: "4", CreatedAt: day(4)},
+			{ID: "3", CreatedAt: day(3), Reblog: &mdon.Status{ID: "99"}},
+			{ID: "2", CreatedAt: day(2)},
+			{ID: "1", CreatedAt: day(1)},
+		})
+	})
+	server = httptest.NewServer(handler)
+	defer server.Close()
+
+	lister := &MastodonLister{
+		mClient:   mdon.NewClient(&mdon.Config{Server: server.URL}),
+		kind:      mastodonAccount,
+		accountID: "42",
+		since:     day(2),
+	}
+	if got := strings.Join(listAll(t, lister), " "); got != "4 2" {
+		t.Errorf("Listed %q, want %q", got, "4 2")
+	}
+}
+
+func TestBlueskyLister_AuthorFeed(t *testing.T) {
+	post := func(id string) map[string]any {
+		return map[string]any{
+			"uri":    "at://did:plc:alice/app.bsky.feed.post/" + id,
+			"cid":    "cid" + id,
+			"author": map[string]any{"did": "did:plc:alice", "handle": "alice.bsky.social"},
+			"record": map[string]any{
+				"$type":     "app.bsky.feed.post",
+				"text":      id,
+				"createdAt": "2026-01-01T12:00:00.000Z",
+			},
+			"indexedAt": "2026-01-01T12:00:00.000Z",
+		}
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/app.bsky.feed.getAuthorFeed" || r.URL.Query().Get("actor") != "alice.bsky.social" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("cursor") == "" {
+			json.NewEncoder(w).Encode(map[string]any{
+				"cursor": "page2",
+				"feed": []any{
+					map[string]any{"post": post("p2")},
+					map[string]any{
+						"post":   post("repost"),
+						"reason": map[string]any{"$type": "app.bsky.feed.defs#reasonRepost", "by": map[string]any{"did": "did:plc:alice", "handle": "alice.bsky.social"}, "indexedAt": "2026-01-01T12:00:00.000Z"},
+					},
+				},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"feed": []any{map[string]any{"post": post("p1")}}})
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	lister := &BlueskyLister{
+		skyClient: &xrpc.Client{Client: new(http.Client), Host: server.URL},
+		kind:      blueskyAuthor,
+		actor:     "alice.bsky.social",
+	}
+	want := "at://did:plc:alice/app.bsky.feed.post/p2 at://did:plc:alice/app.bsky.feed.post/p1"
+	if got := strings.Join(listAll(t, lister), " "); got != want {
+		t.Errorf("Listed %q, want %q", got, want)
+	}
+}
+
+func TestReadFileLister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "posts.txt")
+	content := "# to read later\n109876543210\n\n  https://bsky.app/profile/alice.bsky.social/post/3abc  \n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lister, err := ReadFileLister(path)
+	if err != nil {
+		t.Fatalf("ReadFileLister failed: %v", err)
+	}
+	if !lister.HasBluesky() {
+		t.Error("Expected the list to contain a Bluesky post")
+	}
+	want := "109876543210 https://bsky.app/profile/alice.bsky.social/post/3abc"
+	if got := strings.Join(listAll(t, lister), " "); got != want {
+		t.Errorf("Listed %q, want %q", got, want)
+	}
+}
+
+type fakeFetcher map[string]*SavedStatus
+
+func (ff fakeFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
+	status, ok := ff[idOrUrl]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", idOrUrl)
+	}
+	return []*SavedStatus{status}, nil
+}
+
+type fakeBookmarks struct {
+	FileLister
+	removed []string
+}
+
+func (fb *fakeBookmarks) Unbookmark(ctx context.Context, item ArchiveItem) error {
+	fb.removed = append(fb.removed, item.ID)
+	return nil
+}
+
+func TestSaver_Archive(t *testing.T) {
+	dir := t.TempDir()
+	first := savedStatus("1", "", "alice", 0)
+	first.Content = "<p>First post</p>"
+	second := savedStatus("2", "", "alice", 1)
+	second.Content = "<p>Second post</p>"
+	first.Account.Username, second.Account.Username = "alice", "alice"
+
+	saver := &Saver{
+		fetcher: fakeFetcher{"1": first, "2": second},
+		sink:    &MarkdownSink{outputPath: dir},
+	}
+	lister := &fakeBookmarks{FileLister: FileLister{ids: []string{"1", "missing", "2"}}}
+	err := saver.Archive(context.Background(), lister, true, 0)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Errorf("Expected the missing post to be reported, got %v", err)
+	}
+	if got := strings.Join(lister.removed, " "); got != "1 2" {
+		t.Errorf("Removed bookmarks %q, want %q", got, "1 2")
+	}
+	for _, name := range []string{"alice__First_post.md", "alice__Second_post.md"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected each thread to be saved under its own title: %v", err)
+		}
+	}
+
+	err = saver.Archive(context.Background(), &FileLister{ids: []string{"1"}}, true, 0)
+	if err == nil {
+		t.Error("Expected an error removing bookmarks from a list")
+	}
+
+	// a dry run only lists the posts, saving and removing nothing
+	dryDir := t.TempDir()
+	saver = &Saver{dryrun: true, fetcher: fakeFetcher{"1": first}, sink: &MarkdownSink{outputPath: dryDir}}
+	lister = &fakeBookmarks{FileLister: FileLister{ids: []string{"1", "missing"}}}
+	if err := saver.Archive(context.Background(), lister, true, 0); err != nil {
+		t.Errorf("Expected a dry run to succeed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dryDir); len(entries) != 0 || len(lister.removed) != 0 {
+		t.Errorf("Expected nothing saved or removed, got %d files and %q removed", len(entries), lister.removed)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// the collections of posts a backup keeps, newest first
+var kBackupStatusCollections = []string{"posts", "bookmarks", "favourites"}
+
+// the collections of accounts a backup keeps
+var kBackupAccountCollections = []string{"following", "followers", "mutes", "blocks"}
+
+const (
+	kBackupManifest = "manifest.json"
+	kBackupMediaDir = "media"
+	kBackupIndex    = "index.html"
+	kBackupLists    = "lists.json"
+)
+
+// BackupAccount is an account a backup lists, followed, following, muted,
+// blocked or in a list.
+type BackupAccount struct {
+	ID          string
+	Acct        string
+	DisplayName string
+	URL         string
+}
+
+// BackupList is a list of accounts.
+type BackupList struct {
+	ID      string
+	Title   string
+	Members []BackupAccount
+}
+
+// BackupSource pages through what a backup keeps of an account. Cursors start
+// empty, and an empty cursor is returned with the last page.
+type BackupSource interface {
+	// Account names the account backed up.
+	Account(ctx context.Context) (string, error)
+	// Statuses returns a page of a collection of posts, newest first.
+	Statuses(ctx context.Context, collection string, cursor string) ([]*SavedStatus, string, error)
+	// Accounts returns a page of a collection of accounts.
+	Accounts(ctx context.Context, collection string, cursor string) ([]BackupAccount, string, error)
+	// Lists returns the account's lists with their members.
+	Lists(ctx context.Context) ([]BackupList, error)
+}
+
+// BackupManifest describes a backup, with a checksum of each of its files.
+type BackupManifest struct {
+	Platform string    `json:"platform"`
+	Account  string    `json:"account"`
+	Updated  time.Time `json:"updated"`
+	// the number of items in each collection
+	Counts map[string]int `json:"counts"`
+	// the SHA-256 of each file, by its path in the backup
+	Files map[string]string `json:"files"`
+}
+
+// Backup keeps an account's posts, bookmarks, favourites, follows, followers,
+// mutes, blocks and lists in a directory, as JSON with the media of the posts
+// downloaded and a web page to browse them. Running it again only adds the
+// posts that are new since; the accounts and lists are taken anew.
+type Backup struct {
+	source   BackupSource
+	platform string
+	dir      string
+	manifest *BackupManifest
+}
+
+func (b *Backup) Run(ctx context.Context) error {
+	account, err := b.source.Account(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(b.dir, kBackupMediaDir), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	b.manifest, err = readBackupManifest(b.dir)
+	if err != nil {
+		return err
+	}
+	if b.manifest.Account != "" && (b.manifest.Account != account || b.manifest.Platform != b.platform) {
+		return fmt.Errorf("%s is the backup of %s on %s, not %s", b.dir, b.manifest.Account, b.manifest.Platform, account)
+	}
+	b.manifest.Platform = b.platform
+	b.manifest.Account = account
+
+	statuses := make(map[string][]*SavedStatus)
+	for _, collection := range kBackupStatusCollections {
+		if statuses[collection], err = b.backupStatuses(ctx, collection); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", collection, err)
+		}
+	}
+	accounts := make(map[string][]BackupAccount)
+	for _, collection := range kBackupAccountCollections {
+		if accounts[collection], err = b.backupAccounts(ctx, collection); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", collection, err)
+		}
+	}
+	lists, err := b.source.Lists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to back up lists: %w", err)
+	}
+	if err := b.writeJSON(kBackupLists, lists); err != nil {
+		return err
+	}
+	b.manifest.Counts["lists"] = len(lists)
+	log.Printf("lists: %d", len(lists))
+
+	b.manifest.Updated = time.Now().UTC()
+	page, err := renderBackupHTML(b.manifest, statuses, accounts, lists)
+	if err != nil {
+		return err
+	}
+	if err := b.writeFile(kBackupIndex, page); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(b.dir, kBackupManifest), content, 0644)
+}
+
+// backupStatuses adds the posts of a collection that are new since the last
+// backup, newest first, and downloads their media.
+func (b *Backup) backupStatuses(ctx context.Context, collection string) ([]*SavedStatus, error) {
+	name := collection + ".json"
+	var existing []*SavedStatus
+	if err := readBackupJSON(filepath.Join(b.dir, name), &existing); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, status := range existing {
+		known[status.ID] = true
+	}
+
+	var added []*SavedStatus
+	cursor := ""
+	for done := false; !done; {
+		page, next, err := b.source.Statuses(ctx, collection, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, status := range page {
+			// the rest was kept by the last backup
+			if known[status.ID] {
+				done = true
+				break
+			}
+			known[status.ID] = true
+			b.keepMedia(status)
+			added = append(added, status)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	all := append(added, existing...)
+	if err := b.writeJSON(name, all); err != nil {
+		return nil, err
+	}
+	b.manifest.Counts[collection] = len(all)
+	log.Printf("%s: %d new, %d in all", collection, len(added), len(all))
+	return all, nil
+}
+
+// backupAccounts takes a collection of accounts anew.
+func (b *Backup) backupAccounts(ctx context.Context, collection string) ([]BackupAccount, error) {
+	var all []BackupAccount
+	cursor := ""
+	for {
+		page, next, err := b.source.Accounts(ctx, collection, cursor)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if err := b.writeJSON(collection+".json", all); err != nil {
+		return nil, err
+	}
+	b.manifest.Counts[collection] = len(all)
+	log.Printf("%s: %d", collection, len(all))
+	return all, nil
+}
+
+// keepMedia downloads the media of a post and the post it quotes into the
+// backup and links it there. Media that can't be downloaded is logged and
+// stays linked at its original URL.
+func (b *Backup) keepMedia(status *SavedStatus) {
+	for i := range status.MediaAttachments {
+		ma := &status.MediaAttachments[i]
+		if isStreamingPlaylist(ma.URL) {
+			continue
+		}
+		content, name, err := fetchMedia(ma.URL)
+		if err != nil {
+			log.Printf("failed to back up media %s: %v", ma.URL, err)
+			continue
+		}
+		path := kBackupMediaDir + "/" + name
+		if err := b.writeFile(path, content); err != nil {
+			log.Printf("failed to back up media %s: %v", ma.URL, err)
+			continue
+		}
+		if ma.RemoteURL == "" {
+			ma.RemoteURL = ma.URL
+		}
+		ma.URL = path
+	}
+	if status.Quote != nil {
+		b.keepMedia(status.Quote)
+	}
+}
+
+func (b *Backup) writeJSON(name string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.writeFile(name, content)
+}
+
+// writeFile writes a file of the backup and records its checksum.
+func (b *Backup) writeFile(name string, content []byte) error {
+	if err := os.WriteFile(filepath.Join(b.dir, filepath.FromSlash(name)), content, 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	b.manifest.Files[name] = hex.EncodeToString(sum[:])
+	return nil
+}
+
+func readBackupManifest(dir string) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+	if err := readBackupJSON(filepath.Join(dir, kBackupManifest), manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Counts == nil {
+		manifest.Counts = make(map[string]int)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]string)
+	}
+	return manifest, nil
+}
+
+// readBackupJSON reads a file of the backup, leaving v as it is when the file
+// isn't there yet.
+func readBackupJSON(path string, v any) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// VerifyBackup checks the files of a backup against the checksums in its
+// manifest and returns the paths of those missing or changed.
+func VerifyBackup(dir string) ([]string, error) {
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Account == "" {
+		return nil, fmt.Errorf("%s has no backup", dir)
+	}
+	var bad []string
+	for name, want := range manifest.Files {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			bad = append(bad, name)
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != want {
+			bad = append(bad, name)
+		}
+	}
+	sort.Strings(bad)
+	return bad, nil
+}
+
+var backupTemplate = template.Must(template.Must(threadTemplate.Clone()).New("backup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Backup of {{.Manifest.Account}}</title>
+<style>
+body { max-width: 40em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+article { border-top: 1px solid #ccc; padding: 1em 0; }
+blockquote article { border-top: none; }
+img, video { max-width: 100%; }
+figcaption, time, .acct { color: #666; font-size: 0.9em; }
+aside { border: 1px solid #ccc; border-radius: 4px; padding: 0.5em 1em; }
+.invisible { display: none; }
+.ellipsis::after { content: "…"; }
+</style>
+</head>
+<body>
+<h1>Backup of {{.Manifest.Account}}</h1>
+<p>On {{.Manifest.Platform}}, updated <time datetime="{{.Manifest.Updated.Format "2006-01-02T15:04:05Z07:00"}}">{{.Manifest.Updated.Format "2006-01-02 15:04"}}</time></p>
+<nav>{{range .Statuses}}<a href="#{{.Name}}">{{.Name}}</a> {{end}}{{range .Accounts}}<a href="#{{.Name}}">{{.Name}}</a> {{end}}<a href="#lists">lists</a></nav>
+{{range .Statuses}}<section id="{{.Name}}">
+<h2>{{.Name}} ({{len .Statuses}})</h2>
+{{range .Statuses}}{{template "status" .}}{{end}}</section>
+{{end}}{{range .Accounts}}<section id="{{.Name}}">
+<h2>{{.Name}} ({{len .Accounts}})</h2>
+<ul>
+{{range .Accounts}}<li>{{template "account" .}}</li>
+{{end}}</ul>
+</section>
+{{end}}<section id="lists">
+<h2>lists ({{len .Lists}})</h2>
+{{range .Lists}}<h3>{{.Title}}</h3>
+<ul>
+{{range .Members}}<li>{{template "account" .}}</li>
+{{end}}</ul>
+{{end}}</section>
+</body>
+</html>
+{{define "account"}}<a href="{{.URL}}">{{if .DisplayName}}{{.DisplayName}} {{end}}<span class="acct">@{{.Acct}}</span></a>{{end}}`))
+
+// renderBackupHTML renders the web page that browses a backup.
+func renderBackupHTML(manifest *BackupManifest, statuses map[string][]*SavedStatus, accounts map[string][]BackupAccount, lists []BackupList) ([]byte, error) {
+	type statusSection struct {
+		Name     string
+		Statuses []*htmlStatus
+	}
+	type accountSection struct {
+		Name     string
+		Accounts []BackupAccount
+	}
+	var statusSections []statusSection
+	for _, collection := range kBackupStatusCollections {
+		section := statusSection{Name: collection}
+		for _, status := range statuses[collection] {
+			// media is in the backup already, or stays at its original URL
+			section.Statuses = append(section.Statuses, newHTMLStatus(status, func(ma SavedMedia) (string, error) {
+				return ma.URL, nil
+			}))
+		}
+		statusSections = append(statusSections, section)
+	}
+	var accountSections []accountSection
+	for _, collection := range kBackupAccountCollections {
+		accountSections = append(accountSections, accountSection{Name: collection, Accounts: accounts[collection]})
+	}
+
+	var buf bytes.Buffer
+	err := backupTemplate.Execute(&buf, struct {
+		Manifest *BackupManifest
+		Statuses []statusSection
+		Accounts []accountSection
+		Lists    []BackupList
+	}{manifest, statusSections, accountSections, lists})
+	return buf.Bytes(), err
+}
+
+// MastodonBackupSource backs up the logged in Mastodon account.
+type MastodonBackupSource struct {
+	mClient   *mdon.Client
+	accountID mdon.ID
+}
+
+func (mb *MastodonBackupSource) Account(ctx context.Context) (string, error) {
+	account, err := mb.mClient.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return "", err
+	}
+	mb.accountID = account.ID
+	acct := account.Acct
+	if u, err := url.Parse(mb.mClient.Config.Server); err == nil && !strings.Contains(acct, "@") {
+		acct += "@" + u.Host
+	}
+	return acct, nil
+}
+
+// mastodonCursor returns the cursor of the page after pg, empty when there
+// is none.
+func mastodonCursor(pg *mdon.Pagination, cursor string, count int) string {
+	if count == 0 || pg.MaxID == "" || string(pg.MaxID) == cursor {
+		return ""
+	}
+	return string(pg.MaxID)
+}
+
+func (mb *MastodonBackupSource) Statuses(ctx context.Context, collection string, cursor string) ([]*SavedStatus, string, error) {
+	pg := &mdon.Pagination{MaxID: mdon.ID(cursor), Limit: kArchivePageSize}
+	var page []*mdon.Status
+	var err error
+	switch collection {
+	case "posts":
+		page, err = mb.mClient.GetAccountStatuses(ctx, mb.accountID, pg)
+	case "bookmarks":
+		page, err = mb.mClient.GetBookmarks(ctx, pg)
+	case "favourites":
+		page, err = mb.mClient.GetFavourites(ctx, pg)
+	default:
+		return nil, "", fmt.Errorf("unknown collection %s", collection)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var statuses []*SavedStatus
+	for _, s := range page {
+		// boosts are someone else's posts
+		if collection == "posts" && s.Reblog != nil {
+			continue
+		}
+		statuses = append(statuses, savedFromMastodon(s))
+	}
+	return statuses, mastodonCursor(pg, cursor, len(page)), nil
+}
+
+func (mb *MastodonBackupSource) Accounts(ctx context.Context, collection string, cursor string) ([]BackupAccount, string, error) {
+	pg := &mdon.Pagination{MaxID: mdon.ID(cursor), Limit: 80}
+	var page []*mdon.Account
+	var err error
+	switch collection {
+	case "following":
+		page, err = mb.mClient.GetAccountFollowing(ctx, mb.accountID, pg)
+	case "followers":
+		page, err = mb.mClient.GetAccountFollowers(ctx, mb.accountID, pg)
+	case "mutes":
+		page, err = mb.mClient.GetMutes(ctx, pg)
+	case "blocks":
+		page, err = mb.mClient.GetBlocks(ctx, pg)
+	default:
+		return nil, "", fmt.Errorf("unknown collection %s", collection)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return backupMastodonAccounts(page), mastodonCursor(pg, cursor, len(page)), nil
+}
+
+func (mb *MastodonBackupSource) Lists(ctx context.Context) ([]BackupList, error) {
+	lists, err := mb.mClient.GetLists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []BackupList
+	for _, list := range lists {
+		members, err := mb.mClient.GetListAccounts(ctx, list.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the accounts of list %s: %w", list.Title, err)
+		}
+		result = append(result, BackupList{ID: string(list.ID), Title: list.Title, Members: backupMastodonAccounts(members)})
+	}
+	return result, nil
+}
+
+func backupMastodonAccounts(accounts []*mdon.Account) []BackupAccount {
+	var result []BackupAccount
+	for _, a := range accounts {
+		result = append(result, BackupAccount{ID: string(a.ID), Acct: a.Acct, DisplayName: a.DisplayName, URL: a.URL})
+	}
+	return result
+}
+
+// BlueskyBackupSource backs up the logged in Bluesky account.
+type BlueskyBackupSource struct {
+	skyClient *xrpc.Client
+}
+
+func (bb *BlueskyBackupSource) Account(ctx context.Context) (string, error) {
+	return bb.skyClient.Auth.Handle, nil
+}
+
+func (bb *BlueskyBackupSource) Statuses(ctx context.Context, collection string, cursor string) ([]*SavedStatus, string, error) {
+	bl := &BlueskyLister{skyClient: bb.skyClient, actor: bb.skyClient.Auth.Did, cursor: cursor}
+	switch collection {
+	case "posts":
+		bl.kind = blueskyAuthor
+	case "bookmarks":
+		bl.kind = blueskyBookmarks
+	case "favourites":
+		bl.kind = blueskyLikes
+	default:
+		return nil, "", fmt.Errorf("unknown collection %s", collection)
+	}
+	posts, next, err := bl.page(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var statuses []*SavedStatus
+	for _, p := range posts {
+		statuses = append(statuses, savedFromBluesky(p))
+	}
+	return statuses, next, nil
+}
+
+func (bb *BlueskyBackupSource) Accounts(ctx context.Context, collection string, cursor string) ([]BackupAccount, string, error) {
+	actor := bb.skyClient.Auth.Did
+	var page []*appbsky.ActorDefs_ProfileView
+	var next *string
+	switch collection {
+	case "following":
+		out, err := appbsky.GraphGetFollows(ctx, bb.skyClient, actor, cursor, 100)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next = out.Follows, out.Cursor
+	case "followers":
+		out, err := appbsky.GraphGetFollowers(ctx, bb.skyClient, actor, cursor, 100)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next = out.Followers, out.Cursor
+	case "mutes":
+		out, err := appbsky.GraphGetMutes(ctx, bb.skyClient, cursor, 100)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next = out.Mutes, out.Cursor
+	case "blocks":
+		out, err := appbsky.GraphGetBlocks(ctx, bb.skyClient, cursor, 100)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next = out.Blocks, out.Cursor
+	default:
+		return nil, "", fmt.Errorf("unknown collection %s", collection)
+	}
+	return backupBlueskyAccounts(page), blueskyCursor(next, cursor), nil
+}
+
+func (bb *BlueskyBackupSource) Lists(ctx context.Context) ([]BackupList, error) {
+	var result []BackupList
+	cursor := ""
+	for {
+		out, err := appbsky.GraphGetLists(ctx, bb.skyClient, bb.skyClient.Auth.Did, cursor, 100, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range out.Lists {
+			bl := BackupList{ID: list.Uri, Title: list.Name}
+			itemCursor := ""
+			for {
+				items, err := appbsky.GraphGetList(ctx, bb.skyClient, itemCursor, 100, list.Uri)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get the accounts of list %s: %w", list.Name, err)
+				}
+				for _, item := range items.Items {
+					if item.Subject != nil {
+						bl.Members = append(bl.Members, backupBlueskyAccounts([]*appbsky.ActorDefs_ProfileView{item.Subject})...)
+					}
+				}
+				if itemCursor = blueskyCursor(items.Cursor, itemCursor); itemCursor == "" {
+					break
+				}
+			}
+			result = append(result, bl)
+		}
+		if cursor = blueskyCursor(out.Cursor, cursor); cursor == "" {
+			return result, nil
+		}
+	}
+}
+
+func backupBlueskyAccounts(profiles []*appbsky.ActorDefs_ProfileView) []BackupAccount {
+	var result []BackupAccount
+	for _, p := range profiles {
+		account := BackupAccount{ID: p.Did, Acct: p.Handle, URL: "https://bsky.app/profile/" + p.Handle}
+		if p.DisplayName != nil {
+			account.DisplayName = *p.DisplayName
+		}
+		result = append(result, account)
+	}
+	return result
+}
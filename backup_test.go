@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBackupSource pages through its posts two at a time.
+type fakeBackupSource struct {
+	mu       sync.Mutex
+	statuses map[string][]*SavedStatus
+	accounts map[string][]BackupAccount
+	lists    []BackupList
+	// the cursors each collection was asked for
+	asked map[string][]string
+}
+
+func (fb *fakeBackupSource) Account(ctx context.Context) (string, error) {
+	return "alice@mastodon.example", nil
+}
+
+func (fb *fakeBackupSource) Statuses(ctx context.Context, collection string, cursor string) ([]*SavedStatus, string, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.asked[collection] = append(fb.asked[collection], cursor)
+	start := 0
+	fmt.Sscan(cursor, &start)
+	all := fb.statuses[collection]
+	end := min(start+2, len(all))
+	next := ""
+	if end < len(all) {
+		next = fmt.Sprint(end)
+	}
+	// copies, as the backup links media in the backup
+	var page []*SavedStatus
+	for _, status := range all[start:end] {
+		copied := *status
+		copied.MediaAttachments = append([]SavedMedia(nil), status.MediaAttachments...)
+		page = append(page, &copied)
+	}
+	return page, next, nil
+}
+
+func (fb *fakeBackupSource) Accounts(ctx context.Context, collection string, cursor string) ([]BackupAccount, string, error) {
+	return fb.accounts[collection], "", nil
+}
+
+func (fb *fakeBackupSource) Lists(ctx context.Context) ([]BackupList, error) {
+	return fb.lists, nil
+}
+
+func TestBackup_Run(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+
+	post := func(id string, media ...string) *SavedStatus {
+		status := savedStatus(id, "", "alice", 0)
+		for _, name := range media {
+			status.MediaAttachments = append(status.MediaAttachments, SavedMedia{URL: server.URL + "/" + name, Type: "image"})
+		}
+		return status
+	}
+	bob := BackupAccount{ID: "2", Acct: "bob@other.example", DisplayName: "Bob", URL: "https://other.example/@bob"}
+	source := &fakeBackupSource{
+		statuses: map[string][]*SavedStatus{
+			"posts":     {post("p3"), post("p2", "a.png"), post("p1")},
+			"bookmarks": {post("b1", "b.png")},
+		},
+		accounts: map[string][]BackupAccount{"followers": {bob}},
+		lists:    []BackupList{{ID: "1", Title: "Friends", Members: []BackupAccount{bob}}},
+		asked:    make(map[string][]string),
+	}
+	dir := t.TempDir()
+	backup := &Backup{source: source, platform: "mastodon", dir: dir}
+	if err := backup.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var posts []*SavedStatus
+	if err := readBackupJSON(filepath.Join(dir, "posts.json"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 3 || posts[0].ID != "p3" {
+		t.Fatalf("Expected the 3 posts newest first, got %d", len(posts))
+	}
+	image := posts[1].MediaAttachments[0]
+	if !strings.HasPrefix(image.URL, "media/") || image.RemoteURL != server.URL+"/a.png" {
+		t.Errorf("Expected the image linked in the backup, got %+v", image)
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(image.URL))); err != nil {
+		t.Errorf("Expected the image downloaded: %v", err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Backup of alice@mastodon.example", "<h2>posts (3)</h2>", `src="` + image.URL + `"`,
+		"<h2>followers (1)</h2>", "<h3>Friends</h3>", "@bob@other.example"} {
+		if !strings.Contains(string(index), want) {
+			t.Errorf("Expected %q in the index", want)
+		}
+	}
+
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Counts["posts"] != 3 || manifest.Counts["bookmarks"] != 1 || manifest.Counts["lists"] != 1 {
+		t.Errorf("Unexpected counts %v", manifest.Counts)
+	}
+	for _, name := range []string{"posts.json", "followers.json", "lists.json", "index.html", image.URL} {
+		if manifest.Files[name] == "" {
+			t.Errorf("Expected a checksum of %s in the manifest", name)
+		}
+	}
+	if bad, err := VerifyBackup(dir); err != nil || len(bad) != 0 {
+		t.Errorf("Expected the backup intact, got %v, %v", bad, err)
+	}
+
+	// a new post is added without paging through the ones kept
+	source.statuses["posts"] = append([]*SavedStatus{post("p4")}, source.statuses["posts"]...)
+	source.asked = make(map[string][]string)
+	if err := backup.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := readBackupJSON(filepath.Join(dir, "posts.json"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 4 || posts[0].ID != "p4" || posts[2].MediaAttachments[0].URL != image.URL {
+		t.Errorf("Expected the new post before the kept ones, got %d posts", len(posts))
+	}
+	if got := source.asked["posts"]; len(got) != 1 {
+		t.Errorf("Expected only the first page asked for, got %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "followers.json"), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := VerifyBackup(dir); err != nil || len(bad) != 1 || bad[0] != "followers.json" {
+		t.Errorf("Expected the changed file found, got %v, %v", bad, err)
+	}
+}
+
+func TestBackup_OtherAccount(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, kBackupManifest), []byte(`{"platform": "mastodon", "account": "bob@mastodon.example"}`), 0644)
+	backup := &Backup{source: &fakeBackupSource{asked: make(map[string][]string)}, platform: "mastodon", dir: dir}
+	if err := backup.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "bob@mastodon.example") {
+		t.Errorf("Expected the backup of another account refused, got %v", err)
+	}
+}
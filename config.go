@@ -8,6 +8,10 @@ import (
 type FeedTemplatePair struct {
 	FeedURL  string
 	Template string
+	// attach the item's image to the post
+	Images bool
+	// quote the item's link when it is a post on the network posted to
+	Quote bool
 }
 
 type BlueSkyConfig struct {
@@ -15,16 +19,73 @@ type BlueSkyConfig struct {
 	APIKey string
 }
 
+// MediaStoreConfig selects where the media of notion pages is kept.
+type MediaStoreConfig struct {
+	// gdrive (the default), local, s3 or webdav
+	Kind string
+	// local: the directory media is written to
+	Dir string
+	// local: the URL Dir is served at; s3 and webdav: the public URL of the
+	// bucket or collection, when it isn't served where it is written to
+	BaseURL string
+	// s3: the endpoint, like https://s3.eu-central-1.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// webdav: the collection media is put in
+	URL      string
+	Username string
+	Password string
+}
+
+// MarkdownConfig lays out the notes save writes into a directory. Its
+// templates are filled with markdownFields.
+type MarkdownConfig struct {
+	// file name of a note without extension, like
+	// "{{.Date}}-{{.Author}}-{{.Slug}}"; the title when empty
+	Filename string
+	// folder of a note in the directory, like "{{.Year}}/{{.Month}}"
+	Folder string
+	// folder in the directory media is downloaded to, images when empty
+	Media string
+	// how notes embed media: wikilink (the default) or markdown
+	Images string
+	// extra frontmatter of notes by platform, mastodon or bluesky
+	Frontmatter map[string]map[string]string
+	// folder in the directory with a note per author listing their threads,
+	// like "people"; no notes when empty
+	People string
+}
+
+// TitleConfig is how threads saved without a title are titled.
+type TitleConfig struct {
+	// like "{{.Date}} {{.DisplayName}}: {{.Text}}"; "{{.Author}}: {{.Text}}"
+	// when empty
+	Template string
+	// the most characters of the post's text in the title, 60 when 0
+	Length int
+}
+
 type Config struct {
 	Mas          mastodon.Config
 	Feeds        []FeedTemplatePair
 	SkyFeeds     []FeedTemplatePair
 	NotionToken  string
 	NotionParent string
-	Bridge       string
-	Parent       string
-	Mandala      string
-	BlueSky      BlueSkyConfig
+	// save into this database instead of under NotionParent
+	NotionDatabase string
+	Bridge         string
+	Parent         string
+	Mandala        string
+	BlueSky        BlueSkyConfig
+	// where media of saved posts is kept, Google Drive by default
+	MediaStore MediaStoreConfig
+	// how posts saved as markdown are laid out
+	Markdown MarkdownConfig
+	// how saved threads are titled
+	Title TitleConfig
 }
 
 func InitConfig(path string) error {
@@ -37,16 +98,18 @@ func InitConfig(path string) error {
 		AccessToken:  "some_access_token",
 	})
 	viper.SetDefault("feeds",
-		[]FeedTemplatePair{{"https://someAFeed.com/xml", "someA.tmpl"},
-			{"https://someBFeed.com/xml", "someB.tmpl"}})
+		[]FeedTemplatePair{{"https://someAFeed.com/xml", "someA.tmpl", false, false},
+			{"https://someBFeed.com/xml", "someB.tmpl", false, false}})
 	viper.SetDefault("skyfeeds",
-		[]FeedTemplatePair{{"https://someAFeed.com/xml", "someA.tmpl"},
-			{"https://someBFeed.com/xml", "someB.tmpl"}})
+		[]FeedTemplatePair{{"https://someAFeed.com/xml", "someA.tmpl", false, false},
+			{"https://someBFeed.com/xml", "someB.tmpl", false, false}})
 	viper.SetDefault("notiontoken", "some_notion_token")
 	viper.SetDefault("notionparent", "some_notion_parent_page_id")
+	viper.SetDefault("notiondatabase", "")
 	viper.SetDefault("bridge", "some_bridge")
 	viper.SetDefault("parent", "some_parent_folder_id")
 	viper.SetDefault("mandala", "some_mandala_script")
+	viper.SetDefault("mediastore", MediaStoreConfig{Kind: "gdrive"})
 	viper.SetDefault("bluesky", BlueSkyConfig{
 		Handle: "some_bluesky_handle",
 		APIKey: "some_api_key"})
@@ -8,6 +8,8 @@ import (
 
 type DAO struct {
 	db *sql.DB
+	// whether the search index is FTS5 rather than FTS4
+	searchFTS5 bool
 }
 
 type Toot struct {
@@ -96,3 +98,102 @@ func OpenDB(path string) (*DAO, error) {
 		db: db,
 	}, nil
 }
+
+// SavedItem records where a post was saved to, so saving it again updates
+// that page or file.
+type SavedItem struct {
+	Platform string
+	StatusID string
+	// "notion" or the directory Markdown files are written to
+	Destination string
+	// notion page ID or Markdown file path
+	Target      string
+	ContentHash string
+	SavedAt     time.Time
+}
+
+const createSavedTableSQL string = `CREATE TABLE IF NOT EXISTS saved (
+		   "platform" TEXT NOT NULL,
+		   "statusid" TEXT NOT NULL,
+		   "destination" TEXT NOT NULL,
+		   "target" TEXT NOT NULL,
+		   "contenthash" TEXT NOT NULL,
+		   "savedat" TEXT NOT NULL,
+		   PRIMARY KEY (platform, statusid, destination)
+	    );`
+const upsertSavedSQL string = `INSERT INTO saved (platform, statusid, destination, target, contenthash, savedat)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (platform, statusid, destination) DO UPDATE SET
+		target=excluded.target, contenthash=excluded.contenthash, savedat=excluded.savedat`
+const selectSavedSQL string = "SELECT target, contenthash, savedat FROM saved WHERE platform=? AND statusid=? AND destination=?"
+
+const createNotionUploadsTableSQL string = `CREATE TABLE IF NOT EXISTS notionuploads (
+		   "contenthash" TEXT NOT NULL PRIMARY KEY,
+		   "uploadid" TEXT NOT NULL,
+		   "uploadedat" TEXT NOT NULL
+	    );`
+const upsertNotionUploadSQL string = `INSERT INTO notionuploads (contenthash, uploadid, uploadedat) VALUES (?, ?, ?)
+		ON CONFLICT (contenthash) DO UPDATE SET uploadid=excluded.uploadid, uploadedat=excluded.uploadedat`
+const selectNotionUploadSQL string = "SELECT uploadid FROM notionuploads WHERE contenthash=?"
+
+// OpenSavedIndex opens the index of saved posts, creating it if needed.
+func OpenSavedIndex(path string) (*DAO, error) {
+	dao, err := OpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, create := range []string{createSavedTableSQL, createNotionUploadsTableSQL} {
+		_, err = dao.db.Exec(create)
+		if err != nil {
+			dao.db.Close()
+			return nil, err
+		}
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		dao.db.Close()
+		return nil, err
+	}
+	return dao, nil
+}
+
+func (dao *DAO) RecordSaved(item *SavedItem) error {
+	_, err := dao.db.Exec(upsertSavedSQL, item.Platform, item.StatusID, item.Destination,
+		item.Target, item.ContentHash, item.SavedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func (dao *DAO) FindSaved(platform, statusID, destination string) (*SavedItem, error) {
+	item := SavedItem{Platform: platform, StatusID: statusID, Destination: destination}
+	var ts string
+	err := dao.db.QueryRow(selectSavedSQL, platform, statusID, destination).Scan(&item.Target, &item.ContentHash, &ts)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	item.SavedAt, err = time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// RecordNotionUpload remembers the notion file upload of content with the
+// hash.
+func (dao *DAO) RecordNotionUpload(contentHash, uploadID string) error {
+	_, err := dao.db.Exec(upsertNotionUploadSQL, contentHash, uploadID, time.Now().UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// FindNotionUpload returns the ID of the notion file upload of content with
+// the hash, or "" when it wasn't uploaded.
+func (dao *DAO) FindNotionUpload(contentHash string) (string, error) {
+	var uploadID string
+	err := dao.db.QueryRow(selectNotionUploadSQL, contentHash).Scan(&uploadID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return uploadID, err
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -54,3 +55,43 @@ func TestDAO_FindToot(t *testing.T) {
 		t.Errorf("Expected nil for non-existing record, got %v", toot)
 	}
 }
+
+func TestDAO_RecordSaved(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "saved.sqlite3")
+	dao, err := OpenSavedIndex(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer dao.db.Close()
+
+	item, err := dao.FindSaved("mastodon", "1", "notion")
+	if err != nil || item != nil {
+		t.Fatalf("Expected no saved item, got %v, %v", item, err)
+	}
+
+	savedAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, hash := range []string{"h1", "h2"} {
+		err = dao.RecordSaved(&SavedItem{
+			Platform:    "mastodon",
+			StatusID:    "1",
+			Destination: "notion",
+			Target:      "page1",
+			ContentHash: hash,
+			SavedAt:     savedAt,
+		})
+		if err != nil {
+			t.Fatalf("RecordSaved failed: %v", err)
+		}
+	}
+
+	item, err = dao.FindSaved("mastodon", "1", "notion")
+	if err != nil {
+		t.Fatalf("FindSaved failed: %v", err)
+	}
+	if item == nil || item.Target != "page1" || item.ContentHash != "h2" || !item.SavedAt.Equal(savedAt) {
+		t.Errorf("Expected the second save to replace the first, got %+v", item)
+	}
+	if item, _ := dao.FindSaved("bluesky", "1", "notion"); item != nil {
+		t.Errorf("Expected posts of other platforms to be kept apart, got %+v", item)
+	}
+}
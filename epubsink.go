@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+var epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+var epubPackageTemplate = template.Must(template.New("opf").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">{{xml .ID}}</dc:identifier>
+    <dc:title>{{xml .Title}}</dc:title>
+    <dc:creator>{{xml .Author}}</dc:creator>
+    <dc:date>{{.Date.Format "2006-01-02T15:04:05Z"}}</dc:date>
+    <dc:language>und</dc:language>
+    <meta property="dcterms:modified">{{.Modified.Format "2006-01-02T15:04:05Z"}}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="thread" href="thread.xhtml" media-type="application/xhtml+xml"/>
+{{- range $i, $m := .Media}}
+    <item id="media{{$i}}" href="media/{{xml $m.Name}}" media-type="{{xml $m.Type}}"/>
+{{- end}}
+  </manifest>
+  <spine>
+    <itemref idref="thread"/>
+  </spine>
+</package>
+`))
+
+var epubNavTemplate = template.Must(template.New("nav").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{{xml .}}</title></head>
+<body>
+<nav epub:type="toc"><ol><li><a href="thread.xhtml">{{xml .}}</a></li></ol></nav>
+</body>
+</html>
+`))
+
+func xmlEscape(s string) string {
+	return html.EscapeString(s)
+}
+
+// epubMedia is an attachment packed into the book.
+type epubMedia struct {
+	Name    string
+	Type    string
+	content []byte
+}
+
+// epubFile is a file in the book's zip.
+type epubFile struct {
+	name    string
+	content []byte
+}
+
+// xhtml turns a web page into the XHTML an e-book is made of.
+func xhtml(page []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	for n := doc.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode && n.Data == "html" {
+			n.Attr = append(n.Attr, html.Attribute{Key: "xmlns", Val: "http://www.w3.org/1999/xhtml"})
+		}
+		if err := html.Render(&buf, n); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// EPUBSink saves threads as e-books with their media packed inside.
+type EPUBSink struct {
+	dryrun     bool
+	outputPath string
+}
+
+func (es *EPUBSink) Destination() (string, error) {
+	return fileDestination(SinkEPUB, es.outputPath)
+}
+
+func (es *EPUBSink) Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error) {
+	if title == "" {
+		title = ExtractTitle(thread[0])
+	}
+	if target == "" {
+		target = newFilePath(es.outputPath, title, ".epub")
+	}
+	if es.dryrun {
+		log.Printf("[dryrun] would write %s", target)
+		return target, nil
+	}
+	if err := os.MkdirAll(es.outputPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	var media []epubMedia
+	packed := make(map[string]bool)
+	page, err := renderThreadHTML(thread, title, func(ma SavedMedia) (string, error) {
+		content, name, err := fetchMedia(ma.URL)
+		if err != nil {
+			return "", err
+		}
+		if !packed[name] {
+			packed[name] = true
+			mediaType := mime.TypeByExtension(path.Ext(name))
+			if mediaType == "" {
+				mediaType = "application/octet-stream"
+			}
+			media = append(media, epubMedia{Name: name, Type: mediaType, content: content})
+		}
+		return "media/" + name, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	page, err = xhtml(page)
+	if err != nil {
+		return "", err
+	}
+
+	first := thread[0]
+	id := first.URL
+	if id == "" {
+		id = "urn:mastosync:" + savedPlatform(first) + ":" + first.ID
+	}
+	var opf, nav bytes.Buffer
+	err = epubPackageTemplate.Execute(&opf, struct {
+		ID       string
+		Title    string
+		Author   string
+		Date     time.Time
+		Modified time.Time
+		Media    []epubMedia
+	}{id, title, "@" + first.Account.Acct, first.CreatedAt.UTC(), time.Now().UTC(), media})
+	if err != nil {
+		return "", err
+	}
+	if err := epubNavTemplate.Execute(&nav, title); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	// the mimetype comes first and uncompressed, so readers can sniff it
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte("application/epub+zip")); err != nil {
+		return "", err
+	}
+	files := []epubFile{
+		{"META-INF/container.xml", []byte(epubContainer)},
+		{"OEBPS/content.opf", opf.Bytes()},
+		{"OEBPS/nav.xhtml", nav.Bytes()},
+		{"OEBPS/thread.xhtml", page},
+	}
+	for _, m := range media {
+		files = append(files, epubFile{"OEBPS/media/" + m.Name, m.content})
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(f.content); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return target, os.WriteFile(target, buf.Bytes(), 0644)
+}
+
+func (es *EPUBSink) Exists(ctx context.Context, target string) (bool, error) {
+	return fileExists(target)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jomei/notionapi"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// contentPolicy keeps the markup of a post, and the classes Mastodon uses to
+// shorten links and mark mentions.
+var contentPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").OnElements("a", "span")
+	return p
+}()
+
+// htmlStatus is a status as the thread template shows it.
+type htmlStatus struct {
+	Author  string
+	Acct    string
+	URL     string
+	Date    time.Time
+	Content template.HTML
+	// the content warning the status is folded under
+	SpoilerText string
+	Sensitive   bool
+	Language    string
+	Poll        *SavedPoll
+	Media       []htmlMedia
+	Card        *SavedCard
+	Quote       *htmlStatus
+	Edited      string
+	Edits       []htmlEdit
+	Depth       int
+}
+
+// htmlEdit is an earlier version of an edited status.
+type htmlEdit struct {
+	Date        time.Time
+	SpoilerText string
+	Content     template.HTML
+}
+
+type htmlMedia struct {
+	// image, video, audio, file or link
+	Kind    string
+	Src     string
+	Alt     string
+	Preview string
+}
+
+// mediaSource stores an attachment and returns where the page finds it.
+type mediaSource func(ma SavedMedia) (string, error)
+
+var threadTemplate = template.Must(template.New("thread").Funcs(template.FuncMap{
+	"indent": func(depth int) string { return fmt.Sprintf("%dem", 2*depth) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 40em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+article { border-top: 1px solid #ccc; padding: 1em 0; }
+article.reply { border-left: 3px solid #ccc; padding-left: 1em; }
+blockquote article { border-top: none; }
+img, video { max-width: 100%; }
+figcaption, time, .acct, .caption { color: #666; font-size: 0.9em; }
+table.poll td, table.poll th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+summary { cursor: pointer; font-weight: bold; }
+aside { border: 1px solid #ccc; border-radius: 4px; padding: 0.5em 1em; }
+.invisible { display: none; }
+.ellipsis::after { content: "…"; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Statuses}}{{template "status" .}}{{end}}
+</body>
+</html>
+{{define "status"}}<article{{if .Depth}} class="reply" style="margin-left: {{indent .Depth}}"{{end}}{{with .Language}} lang="{{.}}"{{end}}>
+<header><a href="{{.URL}}"><strong>{{.Author}}</strong> <span class="acct">@{{.Acct}}</span></a> <time datetime="{{.Date.Format "2006-01-02T15:04:05Z07:00"}}">{{.Date.Format "2006-01-02 15:04"}}</time></header>
+{{if .SpoilerText}}<details><summary>CW: {{.SpoilerText}}</summary>
+{{end}}{{.Content}}
+{{with .Poll}}<table class="poll"><tr><th>Option</th><th>Votes</th></tr>
+{{range .Options}}<tr><td>{{.Title}}</td><td>{{$.Poll.Result .}}</td></tr>
+{{end}}</table>
+<p class="caption">{{.Summary}}</p>
+{{end}}{{if and .Sensitive (not .SpoilerText) .Media}}<details><summary>Sensitive media</summary>
+{{end}}{{range .Media}}{{if eq .Kind "image"}}<figure><img src="{{.Src}}" alt="{{.Alt}}">{{if .Alt}}<figcaption>{{.Alt}}</figcaption>{{end}}</figure>
+{{else if eq .Kind "video"}}<figure><video src="{{.Src}}" controls="controls"{{if .Preview}} poster="{{.Preview}}"{{end}}></video>{{if .Alt}}<figcaption>{{.Alt}}</figcaption>{{end}}</figure>
+{{else if eq .Kind "audio"}}<figure><audio src="{{.Src}}" controls="controls"></audio>{{if .Alt}}<figcaption>{{.Alt}}</figcaption>{{end}}</figure>
+{{else if eq .Kind "link"}}<p><a href="{{.Src}}">▶ {{.Alt}}</a></p>
+{{else}}<p><a href="{{.Src}}">{{if .Alt}}{{.Alt}}{{else}}{{.Src}}{{end}}</a></p>
+{{end}}{{end}}{{with .Card}}<aside><a href="{{.URL}}">{{if .Title}}{{.Title}}{{else}}{{.URL}}{{end}}</a>{{if .Description}}<p>{{.Description}}</p>{{end}}</aside>
+{{end}}{{if and .Sensitive (not .SpoilerText) .Media}}</details>
+{{end}}{{with .Quote}}<blockquote>{{template "status" .}}</blockquote>
+{{end}}{{if .Edits}}<details><summary>{{.Edited}}</summary>
+{{range .Edits}}<p class="caption">{{.Date.Format "2006-01-02 15:04"}}{{if .SpoilerText}} · CW: {{.SpoilerText}}{{end}}</p>
+{{.Content}}
+{{end}}</details>
+{{else if .Edited}}<p class="caption">{{.Edited}}</p>
+{{end}}{{if .SpoilerText}}</details>
+{{end}}</article>
+{{end}}`))
+
+// renderThreadHTML renders the thread as a web page. The media of each status
+// is stored with media; it is linked at its original URL when that fails.
+func renderThreadHTML(thread []*SavedStatus, title string, media mediaSource) ([]byte, error) {
+	var statuses []*htmlStatus
+	for _, status := range thread {
+		statuses = append(statuses, newHTMLStatus(status, media))
+	}
+	var buf bytes.Buffer
+	err := threadTemplate.Execute(&buf, struct {
+		Title    string
+		Statuses []*htmlStatus
+	}{title, statuses})
+	return buf.Bytes(), err
+}
+
+func newHTMLStatus(status *SavedStatus, media mediaSource) *htmlStatus {
+	hs := &htmlStatus{
+		Author:  status.Account.DisplayName,
+		Acct:    status.Account.Acct,
+		URL:     status.URL,
+		Date:    status.CreatedAt,
+		Content: template.HTML(contentPolicy.Sanitize(status.Content)),
+		Card:    status.Card,
+		Depth:   status.Depth,
+
+		SpoilerText: status.SpoilerText,
+		Sensitive:   status.Sensitive,
+		Language:    status.Language,
+		Poll:        status.Poll,
+	}
+	if !status.EditedAt.IsZero() {
+		hs.Edited = editedNote(status)
+	}
+	for _, edit := range status.Edits {
+		hs.Edits = append(hs.Edits, htmlEdit{
+			Date:        edit.CreatedAt,
+			SpoilerText: edit.SpoilerText,
+			Content:     template.HTML(contentPolicy.Sanitize(edit.Content)),
+		})
+	}
+	if hs.Author == "" {
+		hs.Author = status.Account.Username
+	}
+	for _, ma := range status.MediaAttachments {
+		hm := htmlMedia{Alt: ma.AltText, Src: ma.URL}
+		if isStreamingPlaylist(ma.URL) {
+			hm.Kind = "link"
+			if hm.Alt == "" {
+				hm.Alt = ma.Type
+			}
+			hs.Media = append(hs.Media, hm)
+			continue
+		}
+		switch notionMediaKind(ma.Type) {
+		case notionapi.BlockTypeImage:
+			hm.Kind = "image"
+		case notionapi.BlockTypeVideo:
+			hm.Kind = "video"
+		case kBlockTypeAudio:
+			hm.Kind = "audio"
+		default:
+			hm.Kind = "file"
+		}
+		src, err := media(ma)
+		if err != nil {
+			log.Printf("failed to store attachment %s: %v", ma.URL, err)
+		} else {
+			hm.Src = src
+		}
+		hs.Media = append(hs.Media, hm)
+	}
+	if status.Quote != nil {
+		hs.Quote = newHTMLStatus(status.Quote, media)
+	}
+	return hs
+}
+
+// HTMLSink saves threads as web pages, with media downloaded into assets/
+// next to them.
+type HTMLSink struct {
+	dryrun     bool
+	outputPath string
+}
+
+func (hs *HTMLSink) Destination() (string, error) {
+	return fileDestination(SinkHTML, hs.outputPath)
+}
+
+func (hs *HTMLSink) Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error) {
+	if title == "" {
+		title = ExtractTitle(thread[0])
+	}
+	if target == "" {
+		target = newFilePath(hs.outputPath, title, ".html")
+	}
+	if hs.dryrun {
+		log.Printf("[dryrun] would write %s", target)
+		return target, nil
+	}
+	assetsDir := filepath.Join(hs.outputPath, "assets")
+	if err := os.MkdirAll(assetsDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create assets directory: %w", err)
+	}
+
+	page, err := renderThreadHTML(thread, title, func(ma SavedMedia) (string, error) {
+		name, err := downloadAndHash(ma.URL, assetsDir, hs.dryrun)
+		return "assets/" + name, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, os.WriteFile(target, page, 0644)
+}
+
+func (hs *HTMLSink) Exists(ctx context.Context, target string) (bool, error) {
+	return fileExists(target)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// pages larger than this aren't archived
+	kLinkMaxBytes = 5 << 20
+	// the time between two requests to the same host
+	kLinkHostDelay = 2 * time.Second
+	// the user agent links are fetched as, and the one looked for in robots.txt
+	kLinkUserAgent = "mastosync"
+	// the longest a page, with its body, takes to fetch
+	kLinkFetchTimeout = 30 * time.Second
+	// the most redirects followed for one page
+	kLinkMaxRedirects = 5
+)
+
+// Article is the readable part of a web page a post links to.
+type Article struct {
+	URL   string
+	Title string
+	// the article's markup, sanitized
+	Content   string
+	FetchedAt time.Time
+}
+
+// LinkArchiver fetches the web pages posts link to and extracts their
+// articles. It keeps to robots.txt, skips pages over maxBytes and waits
+// hostDelay between requests to the same host.
+type LinkArchiver struct {
+	client    *http.Client
+	maxBytes  int64
+	hostDelay time.Duration
+
+	mu sync.Mutex
+	// the robots.txt rules of each host
+	robots map[string]*robotsRules
+	// when each host is next fetched from
+	next map[string]time.Time
+	// articles fetched before, by URL
+	articles map[string]*Article
+}
+
+func NewLinkArchiver() *LinkArchiver {
+	return &LinkArchiver{
+		client:    &http.Client{Timeout: kLinkFetchTimeout},
+		maxBytes:  kLinkMaxBytes,
+		hostDelay: kLinkHostDelay,
+	}
+}
+
+// Fetch returns the article at link.
+func (la *LinkArchiver) Fetch(ctx context.Context, link string) (*Article, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("can't archive %s, it isn't a web page", link)
+	}
+	la.mu.Lock()
+	article, ok := la.articles[link]
+	la.mu.Unlock()
+	if ok {
+		return article, nil
+	}
+
+	resp, err := la.follow(ctx, u, func(u *url.URL) error {
+		rules, err := la.robotsRules(ctx, u)
+		if err != nil {
+			return err
+		}
+		if !rules.allows(u.EscapedPath()) {
+			return fmt.Errorf("robots.txt of %s doesn't allow archiving %s", u.Host, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", link, resp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType != "text/html" && contentType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("can't archive %s, it is %s", link, contentType)
+	}
+	if resp.ContentLength > la.maxBytes {
+		return nil, fmt.Errorf("can't archive %s, it is larger than %d bytes", link, la.maxBytes)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, la.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(page)) > la.maxBytes {
+		return nil, fmt.Errorf("can't archive %s, it is larger than %d bytes", link, la.maxBytes)
+	}
+
+	title, content, err := extractArticle(page, resp.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	if title == "" {
+		title = link
+	}
+	article = &Article{URL: link, Title: title, Content: content, FetchedAt: time.Now()}
+	la.mu.Lock()
+	if la.articles == nil {
+		la.articles = make(map[string]*Article)
+	}
+	la.articles[link] = article
+	la.mu.Unlock()
+	return article, nil
+}
+
+// follow fetches u, following redirects one hop at a time so that every
+// hop passes check and waits for its host's delay.
+func (la *LinkArchiver) follow(ctx context.Context, u *url.URL, check func(u *url.URL) error) (*http.Response, error) {
+	for hops := 0; ; hops++ {
+		if check != nil {
+			if err := check(u); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := la.get(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return resp, nil
+		}
+		next, err := resp.Location()
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to follow the redirect of %s: %w", u, err)
+		}
+		if hops == kLinkMaxRedirects {
+			return nil, fmt.Errorf("%s redirects more than %d times", u, kLinkMaxRedirects)
+		}
+		if next.Scheme != "http" && next.Scheme != "https" {
+			return nil, fmt.Errorf("%s redirects to %s, which isn't a web page", u, next)
+		}
+		u = next
+	}
+}
+
+// get fetches u once the host's delay has passed. Redirects are returned
+// rather than followed.
+func (la *LinkArchiver) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	la.mu.Lock()
+	if la.next == nil {
+		la.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	at := la.next[u.Host]
+	if at.Before(now) {
+		at = now
+	}
+	la.next[u.Host] = at.Add(la.hostDelay)
+	la.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Until(at)):
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", kLinkUserAgent)
+	client := *la.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client.Do(req)
+}
+
+// robotsRules returns the robots.txt rules of u's host, fetching them the
+// first time.
+func (la *LinkArchiver) robotsRules(ctx context.Context, u *url.URL) (*robotsRules, error) {
+	la.mu.Lock()
+	rules, ok := la.robots[u.Host]
+	la.mu.Unlock()
+	if ok {
+		return rules, nil
+	}
+
+	resp, err := la.follow(ctx, &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		rules = parseRobots(io.LimitReader(resp.Body, la.maxBytes), kLinkUserAgent)
+	case resp.StatusCode >= 500:
+		// a host that can't tell what it allows is left alone
+		rules = &robotsRules{disallowAll: true}
+	default:
+		rules = &robotsRules{}
+	}
+	la.mu.Lock()
+	if la.robots == nil {
+		la.robots = make(map[string]*robotsRules)
+	}
+	la.robots[u.Host] = rules
+	la.mu.Unlock()
+	return rules, nil
+}
+
+// robotsRules are the Allow and Disallow lines of robots.txt that apply to
+// us.
+type robotsRules struct {
+	disallowAll bool
+	rules       []robotsRule
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	match   *regexp.Regexp
+}
+
+// parseRobots reads the rules of the group for agent, or of the group for
+// all agents when there is none.
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	var own, all []robotsRule
+	var ownFound bool
+	// the agents of the current group, and whether its rules started
+	var agents []string
+	inRules := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents = nil
+				inRules = false
+			}
+			agents = append(agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inRules = true
+			var rule *robotsRule
+			if value != "" {
+				rule = &robotsRule{allow: key == "allow", pattern: value, match: robotsPattern(value)}
+			}
+			for _, a := range agents {
+				switch {
+				case a == "*":
+					if rule != nil {
+						all = append(all, *rule)
+					}
+				case strings.Contains(strings.ToLower(agent), a):
+					// a group for us counts even when its rules are empty
+					ownFound = true
+					if rule != nil {
+						own = append(own, *rule)
+					}
+				}
+			}
+		}
+	}
+	if ownFound {
+		return &robotsRules{rules: own}
+	}
+	return &robotsRules{rules: all}
+}
+
+// robotsPattern matches a robots.txt path, with * for any characters and a
+// trailing $ for the end of the path.
+func robotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// allows reports whether the path may be fetched. The longest matching rule
+// wins, Allow when an Allow and a Disallow rule are as long.
+func (rr *robotsRules) allows(path string) bool {
+	if rr.disallowAll {
+		return false
+	}
+	if path == "" {
+		path = "/"
+	}
+	allowed, longest := true, -1
+	for _, rule := range rr.rules {
+		if !rule.match.MatchString(path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			allowed, longest = rule.allow, len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+// kPageClutter are the elements left out of articles.
+var kPageClutter = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "header": true,
+	"footer": true, "aside": true, "form": true, "iframe": true, "svg": true,
+	"button": true, "template": true,
+}
+
+// extractArticle finds the readable part of a web page: its article or main
+// element, or else the element holding most of its paragraphs. Links are made
+// absolute against pageURL.
+func extractArticle(page []byte, pageURL *url.URL) (string, string, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return "", "", err
+	}
+
+	var title, ogTitle string
+	var article, main, body *html.Node
+	// the length of the paragraphs below each element
+	scores := make(map[*html.Node]int)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; {
+			next := child.NextSibling
+			if child.Type == html.ElementNode && kPageClutter[child.Data] {
+				n.RemoveChild(child)
+			} else {
+				walk(child)
+			}
+			child = next
+		}
+		if n.Type != html.ElementNode {
+			return
+		}
+		switch n.Data {
+		case "title":
+			if title == "" {
+				title = strings.TrimSpace(htmlText(n))
+			}
+		case "meta":
+			if htmlAttr(n, "property") == "og:title" {
+				ogTitle = strings.TrimSpace(htmlAttr(n, "content"))
+			}
+		case "article":
+			if article == nil {
+				article = n
+			}
+		case "main":
+			if main == nil {
+				main = n
+			}
+		case "body":
+			body = n
+		case "p":
+			if length := len(strings.TrimSpace(htmlText(n))); length >= 25 && n.Parent != nil {
+				scores[n.Parent] += length
+				if n.Parent.Parent != nil {
+					scores[n.Parent.Parent] += length / 2
+				}
+			}
+		case "a":
+			resolveAttr(n, "href", pageURL)
+		case "img":
+			resolveAttr(n, "src", pageURL)
+		}
+	}
+	walk(doc)
+	if ogTitle != "" {
+		title = ogTitle
+	}
+
+	content := article
+	if content == nil {
+		content = main
+	}
+	if content == nil {
+		best := 0
+		for n, score := range scores {
+			if score > best {
+				content, best = n, score
+			}
+		}
+	}
+	if content == nil {
+		content = body
+	}
+	if content == nil {
+		return title, "", nil
+	}
+	var buf bytes.Buffer
+	for child := content.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&buf, child); err != nil {
+			return "", "", err
+		}
+	}
+	return title, contentPolicy.Sanitize(buf.String()), nil
+}
+
+func resolveAttr(n *html.Node, key string, base *url.URL) {
+	for i, attr := range n.Attr {
+		if attr.Key == key {
+			if ref, err := url.Parse(attr.Val); err == nil {
+				n.Attr[i].Val = base.ResolveReference(ref).String()
+			}
+		}
+	}
+}
+
+// statusLinks are the web pages a status links to, leaving out mentions and
+// hashtags.
+func statusLinks(status *SavedStatus) []string {
+	doc, err := html.Parse(strings.NewReader(status.Content))
+	if err != nil {
+		return nil
+	}
+	var links []string
+	seen := make(map[string]bool)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			href := htmlAttr(n, "href")
+			u, err := url.Parse(href)
+			if err == nil && (u.Scheme == "http" || u.Scheme == "https") && !seen[href] && href != status.URL &&
+				!hasClass(n, "mention") && !hasClass(n, "hashtag") && htmlAttr(n, "rel") != "tag" {
+				seen[href] = true
+				links = append(links, href)
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+	return links
+}
+
+// linkHash names the copy of a link.
+func linkHash(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRobotsRules(t *testing.T) {
+	robots := `# comments are ignored
+User-agent: *
+Disallow: /private
+Allow: /private/open
+Disallow: /*.pdf$
+
+User-agent: otherbot
+Disallow: /
+`
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/", want: true},
+		{path: "/blog/post", want: true},
+		{path: "/private/notes", want: false},
+		{path: "/private/open/notes", want: true},
+		{path: "/papers/a.pdf", want: false},
+		{path: "/papers/a.pdf.html", want: true},
+	}
+	rules := parseRobots(strings.NewReader(robots), kLinkUserAgent)
+	for _, tt := range tests {
+		if got := rules.allows(tt.path); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	own := parseRobots(strings.NewReader("User-agent: *\nDisallow: /\n\nUser-agent: Mastosync\nDisallow: /drafts\n"), kLinkUserAgent)
+	if !own.allows("/blog") || own.allows("/drafts/a") {
+		t.Error("Expected the group naming mastosync to apply instead of the one for all agents")
+	}
+
+	// an empty Disallow allows us everything, whatever the group for all says
+	open := parseRobots(strings.NewReader("User-agent: *\nDisallow: /\n\nUser-agent: mastosync\nDisallow:\n"), kLinkUserAgent)
+	if !open.allows("/blog") {
+		t.Error("Expected an empty group naming mastosync to allow everything")
+	}
+}
+
+func TestExtractArticle(t *testing.T) {
+	page := `<html><head><title>Page title</title><script>track()</script></head><body>
+<nav><a href="/">Home</a></nav>
+<div class="post">
+<p>Gophers dig long tunnels under the garden, and they do it quickly.</p>
+<p>A <a href="/more">second paragraph</a> about the same gophers and their tunnels.</p>
+</div>
+<footer>Copyright</footer>
+</body></html>`
+	base, _ := url.Parse("https://blog.example/2026/gophers")
+	title, content, err := extractArticle([]byte(page), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Page title" {
+		t.Errorf("title = %q, want Page title", title)
+	}
+	if !strings.Contains(content, "Gophers dig long tunnels") || !strings.Contains(content, `href="https://blog.example/more"`) {
+		t.Errorf("Expected the paragraphs with absolute links, got %q", content)
+	}
+	for _, clutter := range []string{"Home", "Copyright", "track()"} {
+		if strings.Contains(content, clutter) {
+			t.Errorf("Expected %q left out, got %q", clutter, content)
+		}
+	}
+
+	title, content, err = extractArticle([]byte(`<html><head><meta property="og:title" content="Shared title">
+<title>Site | Shared title</title></head><body><p>Sidebar</p><article><h1>Heading</h1><p>Short.</p></article></body></html>`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Shared title" || !strings.Contains(content, "Heading") || strings.Contains(content, "Sidebar") {
+		t.Errorf("Expected the og:title and the article element, got %q, %q", title, content)
+	}
+}
+
+func TestStatusLinks(t *testing.T) {
+	status := &SavedStatus{
+		URL: "https://mastodon.example/@alice/1",
+		Content: `<p><span class="h-card"><a href="https://mastodon.example/@bob" class="u-url mention">@bob</a></span>
+read <a href="https://blog.example/gophers">this</a> and <a href="https://blog.example/gophers">this again</a>
+<a href="https://mastodon.example/tags/go" class="mention hashtag" rel="tag">#go</a>
+<a href="mailto:alice@example.com">mail</a> <a href="https://mastodon.example/@alice/1">self</a></p>`,
+	}
+	got := statusLinks(status)
+	if len(got) != 1 || got[0] != "https://blog.example/gophers" {
+		t.Errorf("statusLinks() = %v, want only the blog post", got)
+	}
+}
+
+// linkServer serves a site for archiving, recording when each request came.
+type linkServer struct {
+	mu       sync.Mutex
+	requests []time.Time
+}
+
+func (ls *linkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ls.mu.Lock()
+	ls.requests = append(ls.requests, time.Now())
+	ls.mu.Unlock()
+	switch r.URL.Path {
+	case "/robots.txt":
+		w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	case "/big":
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<p>" + strings.Repeat("x", 2048) + "</p>"))
+	case "/moved":
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	case "/paper.pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF"))
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><title>Gophers</title></head><body>
+<article><p>Gophers dig long tunnels under the garden.</p></article></body></html>`))
+	}
+}
+
+func TestLinkArchiver_Fetch(t *testing.T) {
+	ls := &linkServer{}
+	server := httptest.NewServer(ls)
+	defer server.Close()
+	la := &LinkArchiver{client: server.Client(), maxBytes: 1024, hostDelay: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	article, err := la.Fetch(ctx, server.URL+"/gophers")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if article.Title != "Gophers" || !strings.Contains(article.Content, "long tunnels") {
+		t.Errorf("Expected the article, got %+v", article)
+	}
+	if len(ls.requests) != 2 || ls.requests[1].Sub(ls.requests[0]) < la.hostDelay/2 {
+		t.Errorf("Expected robots.txt and the page fetched %v apart, got %v", la.hostDelay, ls.requests)
+	}
+	if _, err := la.Fetch(ctx, server.URL+"/gophers"); err != nil || len(ls.requests) != 2 {
+		t.Errorf("Expected the article fetched once, got %d requests, %v", len(ls.requests), err)
+	}
+
+	for _, path := range []string{"/private/notes", "/big", "/paper.pdf"} {
+		if _, err := la.Fetch(ctx, server.URL+path); err == nil {
+			t.Errorf("Expected %s not archived", path)
+		}
+	}
+	if len(ls.requests) != 4 {
+		t.Errorf("Expected robots.txt to keep /private from being fetched, got %d requests", len(ls.requests))
+	}
+
+	// every hop of a redirect keeps to the robots.txt of its host
+	var closed []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closed = append(closed, r.URL.Path)
+		w.Write([]byte("User-agent: *\nDisallow: /\n"))
+	}))
+	defer other.Close()
+	for _, to := range []string{"/private/notes", other.URL + "/gophers"} {
+		if _, err := la.Fetch(ctx, server.URL+"/moved?to="+url.QueryEscape(to)); err == nil {
+			t.Errorf("Expected the redirect to %s refused by robots.txt", to)
+		}
+	}
+	if len(ls.requests) != 6 || len(closed) != 1 || closed[0] != "/robots.txt" {
+		t.Errorf("Expected only the redirects and the other host's robots.txt fetched, got %d requests and %v", len(ls.requests), closed)
+	}
+}
+
+func TestMarkdownSink_WithLinks(t *testing.T) {
+	server := httptest.NewServer(&linkServer{})
+	defer server.Close()
+
+	dir := t.TempDir()
+	thread := []*SavedStatus{savedStatus("p", "", "alice", 0)}
+	thread[0].Content = `<p>read <a href="` + server.URL + `/gophers">this</a> and <a href="` + server.URL + `/private">that</a></p>`
+	sink := &MarkdownSink{
+		outputPath: dir,
+		links:      &LinkArchiver{client: server.Client(), maxBytes: kLinkMaxBytes},
+	}
+	mdPath, err := sink.Write(context.Background(), thread, "thread", "")
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	name := "thread_" + linkHash(server.URL+"/gophers") + ".md"
+	note, err := os.ReadFile(mdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(note), "[Saved copy: Gophers]("+name+")") {
+		t.Errorf("Expected the note to link the saved copy %s, got:\n%s", name, note)
+	}
+	copied, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Expected the saved copy next to the note: %v", err)
+	}
+	for _, want := range []string{"url: " + server.URL + "/gophers", "# Gophers", "Gophers dig long tunnels"} {
+		if !strings.Contains(string(copied), want) {
+			t.Errorf("Expected %q in the saved copy, got:\n%s", want, copied)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "thread_*.md"))
+	if len(matches) != 1 {
+		t.Errorf("Expected only the allowed link saved, got %v", matches)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/xrpc"
@@ -148,13 +149,77 @@ func main() {
 					Name:  "toots",
 					Usage: "path to a txt file containing the toot chain",
 				},
+				cli.StringFlag{
+					Name:  "at",
+					Usage: "schedule the chain for this time (2006-01-02 15:04 or RFC3339)",
+				},
+				cli.BoolFlag{
+					Name:  "detach",
+					Usage: "with --at, don't wait for the root; post the rest with 'scheduled run'",
+				},
+				cli.StringFlag{
+					Name:  "preview",
+					Usage: "write an html preview of the chain to this file instead of posting",
+				},
+				cli.StringFlag{
+					Name:  "reply-to",
+					Usage: "url of a post on any server to start the chain as a reply to",
+				},
 			},
 			Action: func(c *cli.Context) error {
 				dir, err := configDir(c)
 				if err != nil {
 					return err
 				}
-				return ActionChain(dir, c.String("toots"), c.Bool("dryrun"))
+				return ActionChain(dir, c.String("toots"), c.String("at"), c.Bool("detach"), c.String("preview"), c.String("reply-to"), c.Bool("dryrun"))
+			},
+		},
+		{
+			Name:  "scheduled",
+			Usage: "manage scheduled chains",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list scheduled statuses",
+					Action: func(c *cli.Context) error {
+						dir, err := configDir(c)
+						if err != nil {
+							return err
+						}
+						return ActionScheduledList(dir)
+					},
+				},
+				{
+					Name:  "cancel",
+					Usage: "cancel a scheduled status and the rest of its chain",
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							return fmt.Errorf("missing scheduled status id to cancel")
+						}
+						dir, err := configDir(c)
+						if err != nil {
+							return err
+						}
+						return ActionScheduledCancel(dir, c.Args().First())
+					},
+				},
+				{
+					Name:  "run",
+					Usage: "post the rest of chains whose root has been published",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "wait",
+							Usage: "keep running until all scheduled chains are posted",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						dir, err := configDir(c)
+						if err != nil {
+							return err
+						}
+						return ActionScheduledRun(dir, c.Bool("wait"))
+					},
+				},
 			},
 		},
 		{
@@ -190,7 +255,7 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "external",
-					Usage: "do not use gdrive to store media, rely on external mastodon server",
+					Usage: "do not keep media in the media store, upload it to notion",
 				},
 				cli.StringFlag{
 					Name:  "title",
@@ -200,16 +265,93 @@ func main() {
 					Name:  "dir",
 					Usage: "directory to save as markdown",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "what to save as: notion, or markdown, html, json or epub in --dir",
+				},
+				cli.StringFlag{
+					Name:  "thread",
+					Value: "ancestors",
+					Usage: "how much of the conversation to save: ancestors, author or tree",
+				},
+				cli.BoolFlag{
+					Name:  "bookmarks",
+					Usage: "save every bookmarked post",
+				},
+				cli.BoolFlag{
+					Name:  "favourites",
+					Usage: "save every favourited (liked) post",
+				},
+				cli.StringFlag{
+					Name:  "account",
+					Usage: "save every post of this account",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "with --account, only posts since this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "list",
+					Usage: "save the posts in this file, one id or url per line",
+				},
+				cli.BoolFlag{
+					Name:  "sky",
+					Usage: "list bookmarks, likes or the account from bluesky",
+				},
+				cli.BoolFlag{
+					Name:  "unbookmark",
+					Usage: "remove each bookmark once its post is saved",
+				},
+				cli.BoolFlag{
+					Name:  "strict-media",
+					Usage: "fail the save when media can't be kept in the media store or notion",
+				},
+				cli.BoolFlag{
+					Name:  "with-links",
+					Usage: "also save the web pages posts link to, next to markdown notes or as notion child pages",
+				},
+				cli.StringFlag{
+					Name:  "repair",
+					Usage: "keep the media of this saved notion page (id or url) that still links its original url",
+				},
+				cli.DurationFlag{
+					Name:  "delay",
+					Value: 2 * time.Second,
+					Usage: "wait between posts when saving many",
+				},
 			},
 			Action: func(c *cli.Context) error {
-				if !c.Args().Present() {
-					return fmt.Errorf("missing toot id or url to save")
-				}
 				dir, err := configDir(c)
 				if err != nil {
 					return err
 				}
-				return ActionSave(dir, c.Args().First(), c.String("title"), c.String("dir"), c.Bool("dryrun"), c.Bool("debug"), c.Bool("external"))
+				if page := c.String("repair"); page != "" {
+					summary, err := ActionRepair(dir, page, c.Bool("dryrun"), c.Bool("debug"), c.Bool("external"))
+					fmt.Println(summary)
+					return err
+				}
+				if c.Bool("bookmarks") || c.Bool("favourites") || c.String("account") != "" || c.String("list") != "" {
+					opts := ArchiveOptions{
+						Bookmarks:  c.Bool("bookmarks"),
+						Favourites: c.Bool("favourites"),
+						Account:    c.String("account"),
+						List:       c.String("list"),
+						Sky:        c.Bool("sky"),
+						Unbookmark: c.Bool("unbookmark"),
+						Delay:      c.Duration("delay"),
+					}
+					if since := c.String("since"); since != "" {
+						opts.Since, err = time.ParseInLocation(time.DateOnly, since, time.Local)
+						if err != nil {
+							return fmt.Errorf("invalid --since date %q: %w", since, err)
+						}
+					}
+					return ActionArchive(dir, opts, c.String("dir"), c.String("format"), c.String("thread"), c.Bool("dryrun"), c.Bool("debug"), c.Bool("external"), c.Bool("strict-media"), c.Bool("with-links"))
+				}
+				if !c.Args().Present() {
+					return fmt.Errorf("missing toot id or url to save")
+				}
+				return ActionSave(dir, c.Args().First(), c.String("title"), c.String("dir"), c.String("format"), c.String("thread"), c.Bool("dryrun"), c.Bool("debug"), c.Bool("external"), c.Bool("strict-media"), c.Bool("with-links"))
 			},
 		},
 		{
@@ -224,6 +366,81 @@ func main() {
 				return ActionAuth(dir)
 			},
 		},
+		{
+			Name:  "backup",
+			Usage: "keep the account's posts, media, bookmarks, favourites, lists, follows, followers, mutes and blocks in a local archive",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "sky",
+					Usage: "back up the bluesky account instead of the mastodon one",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "directory of the archive, backup/mastodon or backup/bluesky in the config directory by default",
+				},
+				cli.BoolFlag{
+					Name:  "verify",
+					Usage: "check the archive's files against its manifest instead of backing up",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				dir, err := configDir(c)
+				if err != nil {
+					return err
+				}
+				summary, err := ActionBackup(dir, c.Bool("sky"), c.String("dir"), c.Bool("verify"))
+				if summary != "" {
+					fmt.Println(summary)
+				}
+				return err
+			},
+		},
+		{
+			Name:  "search",
+			Usage: "search the posts synced from feeds and the threads saved",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "platform",
+					Usage: "only posts of mastodon or bluesky",
+				},
+				cli.StringFlag{
+					Name:  "kind",
+					Usage: "only synced feed items or saved posts",
+				},
+				cli.StringFlag{
+					Name:  "author",
+					Usage: "only posts whose author's name or account contains this",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only posts since this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "only posts before this date (YYYY-MM-DD)",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Value: 20,
+					Usage: "how many posts to list at most",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				dir, err := configDir(c)
+				if err != nil {
+					return err
+				}
+				if !c.Args().Present() {
+					return fmt.Errorf("missing what to search for")
+				}
+				results, err := ActionSearch(dir, strings.Join(c.Args(), " "), c.String("platform"), c.String("kind"), c.String("author"), c.String("since"), c.String("until"), c.Int("limit"))
+				if err != nil {
+					return err
+				}
+				fmt.Print(results)
+				return nil
+			},
+		},
 		{
 			Name:    "mandala",
 			Aliases: []string{"m"},
@@ -301,14 +518,35 @@ func ActionInit(dir string) error {
 	return nil
 }
 
+// newBlueskyClient logs in to Bluesky with the configured app password.
+func newBlueskyClient(ctx context.Context, cfg *Config) (*xrpc.Client, error) {
+	skyClient := &xrpc.Client{Client: new(http.Client), Host: "https://bsky.social"}
+	session, err := atproto.ServerCreateSession(ctx, skyClient, &atproto.ServerCreateSession_Input{
+		Identifier: cfg.BlueSky.Handle,
+		Password:   cfg.BlueSky.APIKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	skyClient.Auth = &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	}
+	return skyClient, nil
+}
+
 func ActionSync(dir string, sky bool, dryrun bool) error {
 	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
 	if err != nil {
 		return err
 	}
 	dbPath := filepath.Join(dir, "sync.sqlite3")
+	platform := "mastodon"
 	if sky {
 		dbPath = filepath.Join(dir, "skysync.sqlite3")
+		platform = "bluesky"
 	}
 
 	dao, err := OpenDB(dbPath)
@@ -316,6 +554,18 @@ func ActionSync(dir string, sky bool, dryrun bool) error {
 		return err
 	}
 
+	// a dry run indexes nothing
+	var search *DAO
+	if !dryrun {
+		search, err = openSearchIndexForUpdates(dir)
+		if err != nil {
+			return err
+		}
+		if search != nil {
+			defer search.db.Close()
+		}
+	}
+
 	var poster Poster
 
 	if sky {
@@ -328,20 +578,34 @@ func ActionSync(dir string, sky bool, dryrun bool) error {
 			return err
 		}
 		blueAgent = &agent
+		skyClient, err := newBlueskyClient(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		media := NewMediaPipeline(kBlueskyLimits)
+		defer media.Close()
 		poster = &BlueskyPoster{
-			skyAgent: blueAgent,
+			skyAgent:  blueAgent,
+			skyClient: skyClient,
+			media:     media,
 		}
 	} else {
 		mClient := mdon.NewClient(&cfg.Mas)
 
-		poster = &MastodonPoster{
-			mClient: mClient,
+		mastodonPoster := &MastodonPoster{mClient: mClient}
+		// a dry run posts nothing, so it needn't ask the instance for its limits
+		if !dryrun {
+			mastodonPoster.media = NewMastodonMediaPipeline(mClient)
+			defer mastodonPoster.media.Close()
 		}
+		poster = mastodonPoster
 	}
 	syncer := Syncer{
 		feedParser: gofeed.NewParser(),
 		poster:     poster,
 		dao:        dao,
+		search:     search,
+		platform:   platform,
 		feeds:      cfg.Feeds,
 		tmplDir:    filepath.Join(dir, "templates"),
 		dryrun:     dryrun,
@@ -349,7 +613,7 @@ func ActionSync(dir string, sky bool, dryrun bool) error {
 	return syncer.Sync()
 }
 
-func ActionChain(dir string, tootsPath string, dryrun bool) error {
+func ActionChain(dir string, tootsPath string, at string, detach bool, preview string, replyTo string, dryrun bool) error {
 	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
 	if err != nil {
 		return err
@@ -378,14 +642,95 @@ func ActionChain(dir string, tootsPath string, dryrun bool) error {
 	}
 
 	tooter := Tooter{
-		mClient:   mClient,
-		tootsPath: tootsPath,
-		dryrun:    dryrun,
-		tokenizer: tokenizer,
+		mClient:    mClient,
+		tootsPath:  tootsPath,
+		dryrun:     dryrun,
+		tokenizer:  tokenizer,
+		pendingDir: filepath.Join(dir, "scheduled"),
+		wait:       !detach,
+		replyTo:    replyTo,
+	}
+	if at != "" {
+		scheduledAt, err := ParseScheduleTime(at, time.Now())
+		if err != nil {
+			return err
+		}
+		tooter.scheduledAt = &scheduledAt
+	}
+	if preview != "" {
+		tooter.previewPath = preview
+	} else if !dryrun {
+		tooter.media = NewMastodonMediaPipeline(mClient)
+		defer tooter.media.Close()
 	}
 	return tooter.Toot()
 }
 
+func newScheduler(dir string) (*Scheduler, error) {
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	return &Scheduler{
+		mClient:    mdon.NewClient(&cfg.Mas),
+		pendingDir: filepath.Join(dir, "scheduled"),
+	}, nil
+}
+
+func ActionScheduledList(dir string) error {
+	scheduler, err := newScheduler(dir)
+	if err != nil {
+		return err
+	}
+	scheduled, err := scheduler.List(context.Background())
+	if err != nil {
+		return err
+	}
+	pendings, err := ReadPendingChains(scheduler.pendingDir)
+	if err != nil {
+		return err
+	}
+	restByID := make(map[string]int)
+	for _, pending := range pendings {
+		restByID[pending.ScheduledID] = len(pending.Toots)
+	}
+	for _, ss := range scheduled {
+		// skip the "1/n" counter line
+		lines := strings.SplitN(ss.Params.Text, "\n", 2)
+		summary := []rune(lines[len(lines)-1])
+		if len(summary) > 60 {
+			summary = append(summary[:60], '…')
+		}
+		fmt.Printf("%s\t%s\t+%d\t%s\n", ss.ID, ss.ScheduledAt.Local().Format("2006-01-02 15:04"),
+			restByID[string(ss.ID)], string(summary))
+		delete(restByID, string(ss.ID))
+	}
+	for _, pending := range pendings {
+		if rest, ok := restByID[pending.ScheduledID]; ok {
+			fmt.Printf("%s\tpublished\t+%d\twaiting for 'scheduled run'\n", pending.ScheduledID, rest)
+		}
+	}
+	return nil
+}
+
+func ActionScheduledCancel(dir string, id string) error {
+	scheduler, err := newScheduler(dir)
+	if err != nil {
+		return err
+	}
+	return scheduler.Cancel(context.Background(), id)
+}
+
+func ActionScheduledRun(dir string, wait bool) error {
+	scheduler, err := newScheduler(dir)
+	if err != nil {
+		return err
+	}
+	scheduler.media = NewMastodonMediaPipeline(scheduler.mClient)
+	defer scheduler.media.Close()
+	return scheduler.Run(context.Background(), wait)
+}
+
 func ActionCatchup(dir string, sky bool) error {
 	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
 	if err != nil {
@@ -409,83 +754,415 @@ func ActionCatchup(dir string, sky bool) error {
 	return syncer.Catchup()
 }
 
-func ActionSave(dir string, input string, title string, outputPath string, dryrun bool, debug bool, external bool) error {
+func ActionSave(dir string, input string, title string, outputPath string, format string, thread string, dryrun bool, debug bool, external bool, strictMedia bool, withLinks bool) error {
 	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
 	if err != nil {
 		return err
 	}
 
-	notionClient := notionapi.NewClient(notionapi.Token(cfg.NotionToken), notionapi.WithRetry(2))
+	mode, err := ParseThreadMode(thread)
+	if err != nil {
+		return err
+	}
 
 	var fetcher Fetcher
 
 	if strings.Contains(input, "bsky.app") || strings.HasPrefix(input, "at://") {
-		ctx := context.Background()
-		skyClient := &xrpc.Client{Client: new(http.Client), Host: "https://bsky.social"}
-		session, err := atproto.ServerCreateSession(ctx, skyClient, &atproto.ServerCreateSession_Input{
-			Identifier: cfg.BlueSky.Handle,
-			Password:   cfg.BlueSky.APIKey,
-		})
+		skyClient, err := newBlueskyClient(context.Background(), cfg)
 		if err != nil {
 			return err
 		}
-		skyClient.Auth = &xrpc.AuthInfo{
-			AccessJwt:  session.AccessJwt,
-			RefreshJwt: session.RefreshJwt,
-			Handle:     session.Handle,
-			Did:        session.Did,
-		}
-		fetcher = &BlueskyFetcher{skyClient: skyClient}
+		fetcher = &BlueskyFetcher{skyClient: skyClient, mode: mode}
 	} else {
 		mClient := mdon.NewClient(&cfg.Mas)
-		fetcher = &MastodonFetcher{mClient: mClient}
+		fetcher = &ActivityPubFetcher{mode: mode, mClient: mClient, fallback: &MastodonFetcher{mClient: mClient, mode: mode}}
 	}
 
-	b, err := os.ReadFile(filepath.Join(dir, "gdrive.json"))
+	saver, err := newSaver(dir, cfg, fetcher, title, outputPath, format, dryrun, debug, external, strictMedia, withLinks)
 	if err != nil {
 		return err
 	}
+	defer saver.Close()
+	return saver.SaveToot(input)
+}
 
-	gdriveConfig, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+// ActionArchive saves the threads of bookmarks, favourites, an account's
+// posts or the posts listed in a file.
+func ActionArchive(dir string, opts ArchiveOptions, outputPath string, format string, thread string, dryrun bool, debug bool, external bool, strictMedia bool, withLinks bool) error {
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
 	if err != nil {
 		return err
 	}
 
-	tokenFile, err := os.Open(filepath.Join(dir, "gdrive.token"))
+	mode, err := ParseThreadMode(thread)
+	if err != nil {
+		return err
+	}
+
+	sources := 0
+	for _, set := range []bool{opts.Bookmarks, opts.Favourites, opts.Account != "", opts.List != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("expected exactly one of --bookmarks, --favourites, --account or --list")
+	}
+	if !opts.Since.IsZero() && opts.Account == "" {
+		return fmt.Errorf("--since only applies to --account")
+	}
+	if opts.Unbookmark && !opts.Bookmarks {
+		return fmt.Errorf("--unbookmark only applies to --bookmarks")
+	}
+
+	var fileLister *FileLister
+	sky := opts.Sky
+	if opts.List != "" {
+		fileLister, err = ReadFileLister(opts.List)
+		if err != nil {
+			return err
+		}
+		sky = fileLister.HasBluesky()
+	}
+
+	ctx := context.Background()
+	mClient := mdon.NewClient(&cfg.Mas)
+	fetcher := &platformFetcher{mastodon: &ActivityPubFetcher{mode: mode, mClient: mClient, fallback: &MastodonFetcher{mClient: mClient, mode: mode}}}
+	var skyClient *xrpc.Client
+	if sky {
+		skyClient, err = newBlueskyClient(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		fetcher.bluesky = &BlueskyFetcher{skyClient: skyClient, mode: mode}
+	}
+
+	var lister Lister
+	switch {
+	case fileLister != nil:
+		lister = fileLister
+	case opts.Sky:
+		bl := &BlueskyLister{skyClient: skyClient, actor: skyClient.Auth.Did, since: opts.Since}
+		switch {
+		case opts.Bookmarks:
+			bl.kind = blueskyBookmarks
+		case opts.Favourites:
+			bl.kind = blueskyLikes
+		default:
+			bl.kind = blueskyAuthor
+			bl.actor = strings.TrimPrefix(opts.Account, "@")
+		}
+		lister = bl
+	default:
+		ml := &MastodonLister{mClient: mClient, since: opts.Since}
+		switch {
+		case opts.Bookmarks:
+			ml.kind = mastodonBookmarks
+		case opts.Favourites:
+			ml.kind = mastodonFavourites
+		default:
+			account, err := mClient.AccountLookup(ctx, strings.TrimPrefix(opts.Account, "@"))
+			if err != nil {
+				return fmt.Errorf("failed to look up %s: %w", opts.Account, err)
+			}
+			ml.kind = mastodonAccount
+			ml.accountID = account.ID
+		}
+		lister = ml
+	}
+
+	saver, err := newSaver(dir, cfg, fetcher, "", outputPath, format, dryrun, debug, external, strictMedia, withLinks)
 	if err != nil {
 		return err
 	}
+	defer saver.Close()
+	return saver.Archive(ctx, lister, opts.Unbookmark, opts.Delay)
+}
+
+// ActionRepair keeps the media of a saved notion page that still links its
+// original URL, and returns what became of it. A dry run only lists the media
+// it would keep.
+func ActionRepair(dir string, page string, dryrun bool, debug bool, external bool) (string, error) {
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		return "", err
+	}
+
+	pageID, err := ParseNotionPageID(page)
+	if err != nil {
+		return "", err
+	}
+
+	index, err := OpenSavedIndex(filepath.Join(dir, "saved.sqlite3"))
+	if err != nil {
+		return "", err
+	}
+	defer index.db.Close()
+
+	sink, err := newNotionSink(dir, cfg, index, debug, external, false, dryrun)
+	if err != nil {
+		return "", err
+	}
+	report, err := sink.Repair(context.Background(), pageID, dryrun)
+	summary := report.String()
+	if summary == "" {
+		summary = "no media to repair"
+	}
+	if err != nil {
+		return summary, err
+	}
+	return summary, report.Err()
+}
+
+// ActionSearch lists the synced and saved posts matching text and the
+// filters, with dates as YYYY-MM-DD.
+func ActionSearch(dir string, text string, platform string, kind string, author string, since string, until string, limit int) (string, error) {
+	q := SearchQuery{Text: text, Platform: platform, Kind: kind, Author: author, Limit: limit}
+	switch platform {
+	case "", "mastodon", "bluesky":
+	default:
+		return "", fmt.Errorf("unknown platform %q, expected mastodon or bluesky", platform)
+	}
+	switch kind {
+	case "", SearchSynced, SearchSaved:
+	default:
+		return "", fmt.Errorf("unknown kind %q, expected %s or %s", kind, SearchSynced, SearchSaved)
+	}
+	var err error
+	if since != "" {
+		q.Since, err = time.ParseInLocation(time.DateOnly, since, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("invalid since date %q: %w", since, err)
+		}
+	}
+	if until != "" {
+		q.Until, err = time.ParseInLocation(time.DateOnly, until, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("invalid until date %q: %w", until, err)
+		}
+	}
+	results, err := searchArchive(dir, q)
+	if err != nil {
+		return "", err
+	}
+	return formatSearchResults(results), nil
+}
+
+// ActionBackup backs up the Mastodon or Bluesky account into outputPath, or
+// checks the backup there and returns a summary of the check.
+func ActionBackup(dir string, sky bool, outputPath string, verify bool) (string, error) {
+	platform := "mastodon"
+	if sky {
+		platform = "bluesky"
+	}
+	if outputPath == "" {
+		outputPath = filepath.Join(dir, "backup", platform)
+	}
+	outputPath, err := expandTilde(outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	if verify {
+		bad, err := VerifyBackup(outputPath)
+		if err != nil {
+			return "", err
+		}
+		if len(bad) > 0 {
+			return "", fmt.Errorf("%d files of %s are missing or changed: %s", len(bad), outputPath, strings.Join(bad, ", "))
+		}
+		return outputPath + " is intact", nil
+	}
+
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	var source BackupSource
+	if sky {
+		skyClient, err := newBlueskyClient(ctx, cfg)
+		if err != nil {
+			return "", err
+		}
+		source = &BlueskyBackupSource{skyClient: skyClient}
+	} else {
+		source = &MastodonBackupSource{mClient: mdon.NewClient(&cfg.Mas)}
+	}
+	backup := &Backup{source: source, platform: platform, dir: outputPath}
+	return "", backup.Run(ctx)
+}
+
+// newSaver sets up saving in format, to outputPath or to notion with media
+// in Google Drive. The caller closes the saver.
+func newSaver(dir string, cfg *Config, fetcher Fetcher, title string, outputPath string, format string, dryrun bool, debug bool, external bool, strictMedia bool, withLinks bool) (*Saver, error) {
+	sinkFormat, err := ParseSinkFormat(format, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	if strictMedia && sinkFormat != SinkNotion {
+		return nil, fmt.Errorf("--strict-media only applies to saving to notion")
+	}
+	if withLinks && sinkFormat != SinkNotion && sinkFormat != SinkMarkdown {
+		return nil, fmt.Errorf("--with-links only applies to saving to notion or markdown")
+	}
+
+	titler, err := NewTitler(cfg.Title)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := OpenSavedIndex(filepath.Join(dir, "saved.sqlite3"))
+	if err != nil {
+		return nil, err
+	}
+
+	// a dry run indexes nothing
+	var search *DAO
+	if !dryrun {
+		search, err = openSearchIndexForUpdates(dir)
+		if err != nil {
+			index.db.Close()
+			return nil, err
+		}
+	}
+
+	var sink Sink
+	if sinkFormat == SinkNotion {
+		sink, err = newNotionSink(dir, cfg, index, debug, external, strictMedia, dryrun)
+	} else {
+		sink, err = newFileSink(sinkFormat, outputPath, cfg.Markdown, dryrun)
+	}
+	if err != nil {
+		index.db.Close()
+		if search != nil {
+			search.db.Close()
+		}
+		return nil, err
+	}
+	if withLinks {
+		switch s := sink.(type) {
+		case *NotionSink:
+			s.links = NewLinkArchiver()
+		case *MarkdownSink:
+			s.links = NewLinkArchiver()
+		}
+	}
+
+	return &Saver{
+		dryrun:    dryrun,
+		pageTitle: title,
+		titler:    titler,
+		fetcher:   fetcher,
+		sink:      sink,
+		index:     index,
+		search:    search,
+	}, nil
+}
+
+// newNotionSink logs in to notion and the media store, unless media is
+// uploaded to notion.
+func newNotionSink(dir string, cfg *Config, index *DAO, debug bool, external bool, strictMedia bool, dryrun bool) (*NotionSink, error) {
+	notionClient := notionapi.NewClient(notionapi.Token(cfg.NotionToken), notionapi.WithRetry(2),
+		notionapi.WithVersion(kNotionVersion))
+
+	var mediaStore MediaStore
+	if !external {
+		var err error
+		mediaStore, err = newMediaStore(dir, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &NotionSink{
+		notionClient:     notionClient,
+		notionParentID:   cfg.NotionParent,
+		notionDatabaseID: cfg.NotionDatabase,
+		debug:            debug,
+		mediaStore:       mediaStore,
+		uploads:          index,
+		strictMedia:      strictMedia,
+		dryrun:           dryrun,
+	}, nil
+}
+
+// newMediaStore sets up the configured media store.
+func newMediaStore(dir string, cfg *Config) (MediaStore, error) {
+	msc := cfg.MediaStore
+	switch msc.Kind {
+	case "", "gdrive":
+		return newGDriveStore(dir, cfg)
+	case "local":
+		if msc.Dir == "" || msc.BaseURL == "" {
+			return nil, fmt.Errorf("local media store needs dir and baseurl")
+		}
+		return &LocalStore{dir: msc.Dir, baseURL: msc.BaseURL}, nil
+	case "s3":
+		if msc.Endpoint == "" || msc.Bucket == "" {
+			return nil, fmt.Errorf("s3 media store needs endpoint and bucket")
+		}
+		region := msc.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &S3Store{
+			client:    http.DefaultClient,
+			endpoint:  msc.Endpoint,
+			region:    region,
+			bucket:    msc.Bucket,
+			accessKey: msc.AccessKey,
+			secretKey: msc.SecretKey,
+			baseURL:   msc.BaseURL,
+		}, nil
+	case "webdav":
+		if msc.URL == "" {
+			return nil, fmt.Errorf("webdav media store needs url")
+		}
+		return &WebDAVStore{
+			client:   http.DefaultClient,
+			url:      msc.URL,
+			username: msc.Username,
+			password: msc.Password,
+			baseURL:  msc.BaseURL,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown media store %q, expected gdrive, local, s3 or webdav", msc.Kind)
+}
+
+// newGDriveStore logs in to Google Drive with the token from the auth command.
+func newGDriveStore(dir string, cfg *Config) (*GDriveStore, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "gdrive.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	gdriveConfig, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenFile, err := os.Open(filepath.Join(dir, "gdrive.token"))
+	if err != nil {
+		return nil, err
+	}
 	gdriveToken := &oauth2.Token{}
 	err = json.NewDecoder(tokenFile).Decode(gdriveToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = tokenFile.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	gdriveClient := gdriveConfig.Client(context.Background(), gdriveToken)
 
 	gdriveService, err := drive.NewService(context.Background(),
 		option.WithHTTPClient(gdriveClient))
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	saver := Saver{
-		dryrun:         dryrun,
-		notionClient:   notionClient,
-		notionParentID: cfg.NotionParent,
-		pageTitle:      title,
-		gdriveService:  gdriveService,
-		debug:          debug,
-		usegdrive:      !external,
-		bridge:         cfg.Bridge,
-		parent:         cfg.Parent,
-		outputPath:     outputPath,
-		fetcher:        fetcher,
-	}
-	return saver.SaveToot(input)
+	return &GDriveStore{service: gdriveService, parent: cfg.Parent, bridge: cfg.Bridge}, nil
 }
 
 func ActionAuth(dir string) error {
@@ -572,7 +1249,11 @@ func ActionMandala(dir string, path string, toot string) error {
 		scriptPath:  cfg.Mandala,
 		mandalaPath: path,
 		tootText:    toot,
+		media:       NewMastodonMediaPipeline(mClient),
+		skyMedia:    NewMediaPipeline(kBlueskyLimits),
 	}
+	defer mandala.media.Close()
+	defer mandala.skyMedia.Close()
 	return mandala.Post()
 }
 
@@ -601,9 +1282,13 @@ func RunMCPServer(dir string) error {
 		mcp.WithString("id", mcp.Description("toot id or url to save"), mcp.Required()),
 		mcp.WithString("title", mcp.Description("title of the saved page")),
 		mcp.WithString("dir", mcp.Description("directory to save as markdown")),
+		mcp.WithString("format", mcp.Description("what to save as: notion, or markdown, html, json or epub in dir")),
+		mcp.WithString("thread", mcp.Description("how much of the conversation to save: ancestors, author or tree")),
 		mcp.WithBoolean("dryrun", mcp.Description("dryrun the save")),
 		mcp.WithBoolean("debug", mcp.Description("debug the save")),
-		mcp.WithBoolean("external", mcp.Description("do not use gdrive to store media")),
+		mcp.WithBoolean("external", mcp.Description("do not keep media in the media store, upload it to notion")),
+		mcp.WithBoolean("strict_media", mcp.Description("fail the save when media can't be kept in the media store or notion")),
+		mcp.WithBoolean("with_links", mcp.Description("also save the web pages posts link to, next to markdown notes or as notion child pages")),
 	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		id, err := request.RequireString("id")
 		if err != nil {
@@ -611,17 +1296,137 @@ func RunMCPServer(dir string) error {
 		}
 		title := request.GetString("title", "")
 		saveDir := request.GetString("dir", "")
+		format := request.GetString("format", "")
+		thread := request.GetString("thread", "ancestors")
 		dryrun := request.GetBool("dryrun", false)
 		debug := request.GetBool("debug", false)
 		external := request.GetBool("external", false)
+		strictMedia := request.GetBool("strict_media", false)
+		withLinks := request.GetBool("with_links", false)
 
-		err = ActionSave(dir, id, title, saveDir, dryrun, debug, external)
+		err = ActionSave(dir, id, title, saveDir, format, thread, dryrun, debug, external, strictMedia, withLinks)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
 		return mcp.NewToolResultText("Save completed successfully"), nil
 	})
 
+	s.AddTool(mcp.NewTool("archive",
+		mcp.WithDescription("Save the threads of bookmarked, favourited or listed posts, or of an account's posts"),
+		mcp.WithBoolean("bookmarks", mcp.Description("save every bookmarked post")),
+		mcp.WithBoolean("favourites", mcp.Description("save every favourited (liked) post")),
+		mcp.WithString("account", mcp.Description("save every post of this account")),
+		mcp.WithString("since", mcp.Description("with account, only posts since this date (YYYY-MM-DD)")),
+		mcp.WithString("list", mcp.Description("save the posts in this file, one id or url per line")),
+		mcp.WithBoolean("sky", mcp.Description("list bookmarks, likes or the account from bluesky")),
+		mcp.WithBoolean("unbookmark", mcp.Description("remove each bookmark once its post is saved")),
+		mcp.WithString("dir", mcp.Description("directory to save as markdown")),
+		mcp.WithString("format", mcp.Description("what to save as: notion, or markdown, html, json or epub in dir")),
+		mcp.WithString("thread", mcp.Description("how much of the conversation to save: ancestors, author or tree")),
+		mcp.WithBoolean("dryrun", mcp.Description("dryrun the save")),
+		mcp.WithBoolean("external", mcp.Description("do not keep media in the media store, upload it to notion")),
+		mcp.WithBoolean("strict_media", mcp.Description("fail the save when media can't be kept in the media store or notion")),
+		mcp.WithBoolean("with_links", mcp.Description("also save the web pages posts link to, next to markdown notes or as notion child pages")),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		opts := ArchiveOptions{
+			Bookmarks:  request.GetBool("bookmarks", false),
+			Favourites: request.GetBool("favourites", false),
+			Account:    request.GetString("account", ""),
+			List:       request.GetString("list", ""),
+			Sky:        request.GetBool("sky", false),
+			Unbookmark: request.GetBool("unbookmark", false),
+			Delay:      2 * time.Second,
+		}
+		if since := request.GetString("since", ""); since != "" {
+			t, err := time.ParseInLocation(time.DateOnly, since, time.Local)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			opts.Since = t
+		}
+		saveDir := request.GetString("dir", "")
+		format := request.GetString("format", "")
+		thread := request.GetString("thread", "ancestors")
+		dryrun := request.GetBool("dryrun", false)
+		external := request.GetBool("external", false)
+		strictMedia := request.GetBool("strict_media", false)
+		withLinks := request.GetBool("with_links", false)
+
+		err := ActionArchive(dir, opts, saveDir, format, thread, dryrun, false, external, strictMedia, withLinks)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText("Archive completed successfully"), nil
+	})
+
+	s.AddTool(mcp.NewTool("repair",
+		mcp.WithDescription("Keep the media of a saved Notion page that still links its original URL"),
+		mcp.WithString("page", mcp.Description("id or url of the notion page"), mcp.Required()),
+		mcp.WithBoolean("external", mcp.Description("do not keep media in the media store, upload it to notion")),
+		mcp.WithBoolean("dryrun", mcp.Description("only list the media that would be kept")),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		page, err := request.RequireString("page")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		external := request.GetBool("external", false)
+		dryrun := request.GetBool("dryrun", false)
+
+		summary, err := ActionRepair(dir, page, dryrun, false, external)
+		if err != nil {
+			return mcp.NewToolResultError(summary + "\n" + err.Error()), nil
+		}
+		return mcp.NewToolResultText(summary), nil
+	})
+
+	s.AddTool(mcp.NewTool("backup",
+		mcp.WithDescription("Keep the account's posts, media, bookmarks, favourites, lists, follows, followers, mutes and blocks in a local archive"),
+		mcp.WithBoolean("sky", mcp.Description("back up the bluesky account instead of the mastodon one")),
+		mcp.WithString("dir", mcp.Description("directory of the archive, backup/mastodon or backup/bluesky in the config directory by default")),
+		mcp.WithBoolean("verify", mcp.Description("check the archive's files against its manifest instead of backing up")),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		sky := request.GetBool("sky", false)
+		backupDir := request.GetString("dir", "")
+		verify := request.GetBool("verify", false)
+
+		summary, err := ActionBackup(dir, sky, backupDir, verify)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if summary != "" {
+			return mcp.NewToolResultText(summary), nil
+		}
+		return mcp.NewToolResultText("Backup completed successfully"), nil
+	})
+
+	s.AddTool(mcp.NewTool("search",
+		mcp.WithDescription("Search the posts synced from feeds and the threads saved"),
+		mcp.WithString("query", mcp.Description("words to search for, a word ending in * matches as a prefix"), mcp.Required()),
+		mcp.WithString("platform", mcp.Description("only posts of mastodon or bluesky")),
+		mcp.WithString("kind", mcp.Description("only synced feed items or saved posts")),
+		mcp.WithString("author", mcp.Description("only posts whose author's name or account contains this")),
+		mcp.WithString("since", mcp.Description("only posts since this date (YYYY-MM-DD)")),
+		mcp.WithString("until", mcp.Description("only posts before this date (YYYY-MM-DD)")),
+		mcp.WithNumber("limit", mcp.Description("how many posts to list at most, 20 by default")),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		query, err := request.RequireString("query")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		platform := request.GetString("platform", "")
+		kind := request.GetString("kind", "")
+		author := request.GetString("author", "")
+		since := request.GetString("since", "")
+		until := request.GetString("until", "")
+		limit := request.GetInt("limit", 20)
+
+		results, err := ActionSearch(dir, query, platform, kind, author, since, until, limit)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText(results), nil
+	})
+
 	s.AddTool(mcp.NewTool("catchup",
 		mcp.WithDescription("Catchup DB with RSS feed"),
 		mcp.WithBoolean("sky", mcp.Description("bluesky")),
@@ -651,19 +1456,58 @@ func RunMCPServer(dir string) error {
 	s.AddTool(mcp.NewTool("chain",
 		mcp.WithDescription("Post a chain of toots"),
 		mcp.WithString("toots", mcp.Description("path to a txt file containing the toot chain"), mcp.Required()),
+		mcp.WithString("at", mcp.Description("schedule the chain for this time (2006-01-02 15:04 or RFC3339)")),
+		mcp.WithString("preview", mcp.Description("write an html preview of the chain to this file instead of posting")),
+		mcp.WithString("reply_to", mcp.Description("url of a post on any server to start the chain as a reply to")),
 		mcp.WithBoolean("dryrun", mcp.Description("dryrun the posting")),
 	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		toots, err := request.RequireString("toots")
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		at := request.GetString("at", "")
+		preview := request.GetString("preview", "")
+		replyTo := request.GetString("reply_to", "")
 		dryrun := request.GetBool("dryrun", false)
-		err = ActionChain(dir, toots, dryrun)
+		// a tool call can't block until the root is published, the rest of
+		// the chain is posted by 'scheduled run'
+		err = ActionChain(dir, toots, at, true, preview, replyTo, dryrun)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		if preview != "" {
+			return mcp.NewToolResultText("Preview written to " + preview), nil
+		}
+		if at != "" {
+			return mcp.NewToolResultText("Chain scheduled successfully"), nil
+		}
 		return mcp.NewToolResultText("Chain posted successfully"), nil
 	})
 
+	s.AddTool(mcp.NewTool("scheduled_cancel",
+		mcp.WithDescription("Cancel a scheduled chain"),
+		mcp.WithString("id", mcp.Description("scheduled status id"), mcp.Required()),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		id, err := request.RequireString("id")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		err = ActionScheduledCancel(dir, id)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText("Scheduled chain cancelled successfully"), nil
+	})
+
+	s.AddTool(mcp.NewTool("scheduled_run",
+		mcp.WithDescription("Post the rest of scheduled chains whose root has been published"),
+	), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		err := ActionScheduledRun(dir, false)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText("Scheduled chains advanced successfully"), nil
+	})
+
 	return server.ServeStdio(s)
 }
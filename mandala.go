@@ -18,6 +18,19 @@ type Mandala struct {
 	scriptPath  string
 	mandalaPath string
 	tootText    string
+	// prepare the image for each network's limits; nil uploads it as is
+	media    *MediaPipeline
+	skyMedia *MediaPipeline
+}
+
+const kMandalaAltText = "Colorful Mandala generated with https://mathematica.stackexchange.com/q/136974"
+
+func (mandala *Mandala) imagePath(mp *MediaPipeline) (string, error) {
+	p := filepath.Join(mandala.mandalaPath, "mandala.png")
+	if mp == nil {
+		return p, nil
+	}
+	return mp.Prepare(p, kMandalaAltText)
 }
 
 func (mandala *Mandala) Generate() error {
@@ -33,14 +46,18 @@ func (mandala *Mandala) Generate() error {
 }
 
 func (mandala *Mandala) PostMastodon() error {
-	mandalaFile, err := os.Open(filepath.Join(mandala.mandalaPath, "mandala.png"))
+	p, err := mandala.imagePath(mandala.media)
+	if err != nil {
+		return err
+	}
+	mandalaFile, err := os.Open(p)
 	if err != nil {
 		return err
 	}
 	defer mandalaFile.Close()
 	mandalaMedia := mdon.Media{
 		File:        mandalaFile,
-		Description: "Colorful Mandala generated with https://mathematica.stackexchange.com/q/136974",
+		Description: kMandalaAltText,
 	}
 	attachment, err := mandala.mClient.UploadMediaFromMedia(context.Background(), &mandalaMedia)
 	if err != nil {
@@ -64,11 +81,15 @@ func (mandala *Mandala) PostMastodon() error {
 }
 
 func (mandala *Mandala) PostBlueSky() error {
-	uu, err := url.Parse("file://" + filepath.Join(mandala.mandalaPath, "mandala.png"))
+	p, err := mandala.imagePath(mandala.skyMedia)
+	if err != nil {
+		return err
+	}
+	uu, err := url.Parse("file://" + p)
 	if err != nil {
 		return err
 	}
-	images := []skybot.Image{{Title: "Mandala", Uri: *uu}}
+	images := []skybot.Image{{Title: kMandalaAltText, Uri: *uu}}
 
 	ctx := context.Background()
 	blobs, err := mandala.skyAgent.UploadImages(ctx, images...)
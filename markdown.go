@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"`", "\\`",
+	"[", `\[`,
+	"]", `\]`,
+)
+
+// kWikilinkEscaper removes what would end a wikilink early.
+var kWikilinkEscaper = strings.NewReplacer("|", "", "[", "", "]", "")
+
+var extraNewlines = regexp.MustCompile(`\n{3,}`)
+
+// ConvertHtml2Markdown converts the HTML of a status to Markdown for notes.
+// It covers the subset Mastodon sends: paragraphs, line breaks, links,
+// mentions, hashtags, emphasis, code, quotes and lists. Hashtags become
+// Obsidian tags and the parts of long links Mastodon hides stay hidden.
+func ConvertHtml2Markdown(content string) string {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return stripTagsPolicy.Sanitize(content)
+	}
+	return normalizeMarkdown(markdownChildren(doc))
+}
+
+func normalizeMarkdown(md string) string {
+	lines := strings.Split(md, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	md = strings.Join(lines, "\n")
+	return strings.Trim(extraNewlines.ReplaceAllString(md, "\n\n"), "\n")
+}
+
+func markdownChildren(node *html.Node) string {
+	var sb strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		sb.WriteString(markdownNode(child))
+	}
+	return sb.String()
+}
+
+func markdownNode(node *html.Node) string {
+	switch node.Type {
+	case html.TextNode:
+		return escapeMarkdownText(node.Data)
+	case html.ElementNode:
+	default:
+		return markdownChildren(node)
+	}
+
+	switch node.Data {
+	case "br":
+		return "\n"
+	case "p", "div":
+		return "\n\n" + markdownChildren(node) + "\n\n"
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level := int(node.Data[1] - '0')
+		return "\n\n" + strings.Repeat("#", level) + " " + strings.TrimSpace(markdownChildren(node)) + "\n\n"
+	case "strong", "b":
+		return emphasize(markdownChildren(node), "**")
+	case "em", "i":
+		return emphasize(markdownChildren(node), "*")
+	case "del", "s":
+		return emphasize(markdownChildren(node), "~~")
+	case "code":
+		return codeSpan(htmlText(node))
+	case "pre":
+		code := strings.TrimRight(htmlText(node), "\n")
+		fence := "```"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		return "\n\n" + fence + "\n" + code + "\n" + fence + "\n\n"
+	case "blockquote":
+		inner := normalizeMarkdown(markdownChildren(node))
+		lines := strings.Split(inner, "\n")
+		for i, line := range lines {
+			lines[i] = "> " + line
+		}
+		return "\n\n" + strings.Join(lines, "\n") + "\n\n"
+	case "ul", "ol":
+		return "\n\n" + markdownList(node) + "\n\n"
+	case "span":
+		if hasClass(node, "invisible") {
+			return ""
+		}
+		return markdownChildren(node)
+	case "a":
+		return markdownLink(node)
+	}
+	return markdownChildren(node)
+}
+
+func markdownList(list *html.Node) string {
+	var items []string
+	n := 0
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.Data != "li" {
+			continue
+		}
+		n++
+		marker := "- "
+		if list.Data == "ol" {
+			marker = fmt.Sprintf("%d. ", n)
+		}
+		lines := strings.Split(normalizeMarkdown(markdownChildren(li)), "\n")
+		indent := strings.Repeat(" ", len(marker))
+		for i := range lines {
+			if i == 0 {
+				lines[i] = marker + lines[i]
+			} else if lines[i] != "" {
+				lines[i] = indent + lines[i]
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+func markdownLink(node *html.Node) string {
+	href := htmlAttr(node, "href")
+	text := strings.TrimSpace(markdownChildren(node))
+
+	if hasClass(node, "hashtag") || htmlAttr(node, "rel") == "tag" {
+		tag := obsidianTag(strings.TrimPrefix(visibleText(node), "#"))
+		if tag != "" {
+			return "#" + tag
+		}
+	}
+	if href == "" {
+		return text
+	}
+	if text == "" {
+		text = escapeMarkdownText(href)
+	}
+	if strings.ContainsAny(href, " ()<>") {
+		href = "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(href) + ">"
+	}
+	return "[" + text + "](" + href + ")"
+}
+
+// obsidianTag keeps the characters Obsidian allows in a tag.
+func obsidianTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '/' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// emphasize wraps text in marker, keeping surrounding spaces outside since
+// Markdown ignores emphasis that starts or ends with a space.
+func emphasize(text string, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+func codeSpan(code string) string {
+	fence := "`"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		return fence + " " + code + " " + fence
+	}
+	return fence + code + fence
+}
+
+// escapeMarkdownText escapes Markdown syntax in text, leaving bare URLs alone
+// so they stay clickable.
+func escapeMarkdownText(text string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range tootURL.FindAllStringIndex(text, -1) {
+		sb.WriteString(markdownEscaper.Replace(text[last:loc[0]]))
+		sb.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(markdownEscaper.Replace(text[last:]))
+	return sb.String()
+}
+
+// htmlText is the raw text below node, with line breaks for <br>.
+func htmlText(node *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			sb.WriteString(n.Data)
+		case n.Type == html.ElementNode && n.Data == "br":
+			sb.WriteString("\n")
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return sb.String()
+}
+
+// visibleText is the text below node without Mastodon's invisible spans.
+func visibleText(node *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		if n.Type == html.ElementNode && n.Data == "span" && hasClass(n, "invisible") {
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return sb.String()
+}
+
+func htmlAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(node *html.Node, class string) bool {
+	return strings.Contains(" "+htmlAttr(node, "class")+" ", " "+class+" ")
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestConvertHtml2Markdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "paragraphs and breaks",
+			content: "<p>first<br />line</p><p>second</p>",
+			want:    "first\nline\n\nsecond",
+		},
+		{
+			name:    "link hides invisible parts",
+			content: `<p>see <a href="https://example.com/a/very/long/path" rel="nofollow noopener" target="_blank"><span class="invisible">https://</span><span class="ellipsis">example.com/a/very</span><span class="invisible">/long/path</span></a></p>`,
+			want:    "see [example.com/a/very](https://example.com/a/very/long/path)",
+		},
+		{
+			name:    "hashtag",
+			content: `<p>hello <a href="https://mastodon.social/tags/GoLang" class="mention hashtag" rel="tag">#<span>GoLang</span></a></p>`,
+			want:    "hello #GoLang",
+		},
+		{
+			name:    "mention",
+			content: `<p><span class="h-card" translate="no"><a href="https://mastodon.social/@bob" class="u-url mention">@<span>bob</span></a></span> hi</p>`,
+			want:    "[@bob](https://mastodon.social/@bob) hi",
+		},
+		{
+			name:    "emphasis and code",
+			content: "<p><strong>bold</strong> <em>it </em><del>gone</del> <code>a*b</code></p>",
+			want:    "**bold** *it* ~~gone~~ `a*b`",
+		},
+		{
+			name:    "escapes text but not urls",
+			content: "<p>snake_case [x] https://example.com/a_b</p>",
+			want:    `snake\_case \[x\] https://example.com/a_b`,
+		},
+		{
+			name:    "pre",
+			content: "<pre><code>if a {\n\treturn\n}\n</code></pre>",
+			want:    "```\nif a {\n\treturn\n}\n```",
+		},
+		{
+			name:    "lists",
+			content: "<ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul>",
+			want:    "- one\n- two\n\n  1. a\n  2. b",
+		},
+		{
+			name:    "blockquote",
+			content: "<blockquote><p>quoted</p><p>more</p></blockquote><p>after</p>",
+			want:    "> quoted\n>\n> more\n\nafter",
+		},
+		{
+			name:    "plain text",
+			content: "line one\nline two",
+			want:    "line one\nline two",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertHtml2Markdown(tt.content)
+			if got != tt.want {
+				t.Errorf("ConvertHtml2Markdown() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
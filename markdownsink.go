@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/jomei/notionapi"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+// MarkdownSink saves threads as Markdown notes with frontmatter, with media
+// downloaded into images/ next to them.
+type MarkdownSink struct {
+	dryrun     bool
+	outputPath string
+	// names notes, after their title when nil
+	filename *template.Template
+	// the folder of notes in outputPath, outputPath itself when nil
+	folder *template.Template
+	// the folder in outputPath media is downloaded to, images when empty
+	mediaDir string
+	// embeds media as ![[images/name]] rather than ![alt](path), as notes
+	// did before the syntax could be chosen
+	wikilinks bool
+	// extra frontmatter by platform
+	frontmatter map[string]map[string]*template.Template
+	// saves the web pages posts link to next to notes, nil to leave them
+	links *LinkArchiver
+	// the folder in outputPath with a note per author, none when empty
+	people string
+}
+
+// markdownFields fill the file name, folder and frontmatter templates of a
+// note.
+type markdownFields struct {
+	Title string
+	// the title in lower case with dashes between words
+	Slug string
+	// the username of the thread's author, Acct with the server
+	Author   string
+	Acct     string
+	Platform string
+	ID       string
+	URL      string
+	// when the thread started, as 2006-01-02, 2006, 01 and 02
+	Date  string
+	Year  string
+	Month string
+	Day   string
+}
+
+func newMarkdownFields(status *SavedStatus, title string) markdownFields {
+	date := status.CreatedAt.Local()
+	return markdownFields{
+		Title:    title,
+		Slug:     slugify(title),
+		Author:   status.Account.Username,
+		Acct:     status.Account.Acct,
+		Platform: savedPlatform(status),
+		ID:       status.ID,
+		URL:      status.URL,
+		Date:     date.Format(time.DateOnly),
+		Year:     date.Format("2006"),
+		Month:    date.Format("01"),
+		Day:      date.Format("02"),
+	}
+}
+
+// slugify lower cases s and joins its words, in any script, with dashes.
+func slugify(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range norm.NFC.String(strings.ToLower(s)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			dash = false
+			sb.WriteRune(r)
+		} else {
+			dash = true
+		}
+	}
+	return sb.String()
+}
+
+// mediaFolder is the folder in outputPath media is downloaded to.
+func (ms *MarkdownSink) mediaFolder() string {
+	if ms.mediaDir == "" {
+		return "images"
+	}
+	return ms.mediaDir
+}
+
+// newMarkdownSink sets up a sink laid out as configured.
+func newMarkdownSink(outputPath string, config MarkdownConfig, dryrun bool) (*MarkdownSink, error) {
+	ms := &MarkdownSink{dryrun: dryrun, outputPath: outputPath, mediaDir: config.Media}
+	var err error
+	if config.People != "" {
+		if ms.people = safeFileName(strings.TrimSpace(config.People)); strings.Trim(ms.people, "_") == "" {
+			return nil, fmt.Errorf("invalid markdown people folder %q", config.People)
+		}
+	}
+	if config.Filename != "" {
+		if ms.filename, err = parseMarkdownTemplate("filename", config.Filename); err != nil {
+			return nil, err
+		}
+	}
+	if config.Folder != "" {
+		if ms.folder, err = parseMarkdownTemplate("folder", config.Folder); err != nil {
+			return nil, err
+		}
+	}
+	switch config.Images {
+	case "", "wikilink":
+		ms.wikilinks = true
+	case "markdown":
+	default:
+		return nil, fmt.Errorf("unknown markdown image syntax %q, expected wikilink or markdown", config.Images)
+	}
+	for platform, fields := range config.Frontmatter {
+		for key, value := range fields {
+			t, err := parseMarkdownTemplate(platform+"."+key, value)
+			if err != nil {
+				return nil, err
+			}
+			if ms.frontmatter == nil {
+				ms.frontmatter = make(map[string]map[string]*template.Template)
+			}
+			if ms.frontmatter[platform] == nil {
+				ms.frontmatter[platform] = make(map[string]*template.Template)
+			}
+			ms.frontmatter[platform][key] = t
+		}
+	}
+	return ms, nil
+}
+
+func parseMarkdownTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid markdown %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+func executeMarkdownTemplate(t *template.Template, fields markdownFields) (string, error) {
+	var sb strings.Builder
+	if err := t.Execute(&sb, fields); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// noteDir is the folder a new note goes to.
+func (ms *MarkdownSink) noteDir(fields markdownFields) (string, error) {
+	if ms.folder == nil {
+		return ms.outputPath, nil
+	}
+	folder, err := executeMarkdownTemplate(ms.folder, fields)
+	if err != nil {
+		return "", err
+	}
+	dir := ms.outputPath
+	for _, segment := range strings.Split(filepath.ToSlash(folder), "/") {
+		if segment = safeFileName(strings.TrimSpace(segment)); strings.Trim(segment, "_") != "" {
+			dir = filepath.Join(dir, segment)
+		}
+	}
+	return dir, nil
+}
+
+func (ms *MarkdownSink) Destination() (string, error) {
+	// the bare directory, as indexed before there were other file formats
+	return filepath.Abs(ms.outputPath)
+}
+
+func (ms *MarkdownSink) Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error) {
+	return ms.WriteMarkdown(ctx, thread, title, target)
+}
+
+func (ms *MarkdownSink) Exists(ctx context.Context, target string) (bool, error) {
+	return fileExists(target)
+}
+
+// WriteMarkdown writes the thread to mdPath, or to a new file named after the
+// title when mdPath is empty, and returns the path written. A dry run writes
+// nothing.
+func (ms *MarkdownSink) WriteMarkdown(ctx context.Context, thread []*SavedStatus, title string, mdPath string) (string, error) {
+	if ms.outputPath == "" {
+		return "", fmt.Errorf("output path not set")
+	}
+
+	imagesDir := filepath.Join(ms.outputPath, ms.mediaFolder())
+	if !ms.dryrun {
+		if err := os.MkdirAll(imagesDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create images directory: %w", err)
+		}
+	}
+
+	if len(title) == 0 {
+		title = ExtractTitle(thread[0])
+	}
+	fields := newMarkdownFields(thread[0], title)
+	if mdPath == "" {
+		dir, err := ms.noteDir(fields)
+		if err != nil {
+			return "", err
+		}
+		if !ms.dryrun {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create output directory: %w", err)
+			}
+		}
+		name := title
+		if ms.filename != nil {
+			if name, err = executeMarkdownTemplate(ms.filename, fields); err != nil {
+				return "", err
+			}
+		}
+		mdPath = newFilePath(dir, name, ".md")
+	}
+	// media is linked relative to the note
+	mediaLink, err := filepath.Rel(filepath.Dir(mdPath), imagesDir)
+	if err != nil {
+		return "", err
+	}
+	mediaLink = filepath.ToSlash(mediaLink)
+
+	var buf bytes.Buffer
+
+	// Frontmatter
+	type Frontmatter struct {
+		Title  string    `yaml:"title"`
+		Date   time.Time `yaml:"date"`
+		Author string    `yaml:"author"`
+		URL    string    `yaml:"url"`
+		ID     string    `yaml:"id"`
+		Tags   []string  `yaml:"tags"`
+		// Mastodon's visibility and the language the post is in, if known
+		Visibility string `yaml:"visibility,omitempty"`
+		Language   string `yaml:"language,omitempty"`
+		// wikilinks to the notes of the thread's authors
+		People []string `yaml:"people,omitempty"`
+	}
+
+	tags := []string{savedPlatform(thread[0])}
+
+	for _, tag := range thread[0].Tags {
+		tags = append(tags, tag.Name)
+	}
+
+	fm := Frontmatter{
+		Title:  title,
+		Date:   thread[0].CreatedAt,
+		Author: fmt.Sprintf("%s (@%s)", thread[0].Account.DisplayName, thread[0].Account.Acct),
+		URL:    thread[0].URL,
+		ID:     string(thread[0].ID),
+		Tags:   tags,
+
+		Visibility: thread[0].Visibility,
+		Language:   thread[0].Language,
+	}
+	var people []person
+	// links to people notes by account
+	personLinks := make(map[string]string)
+	if ms.people != "" {
+		people = ms.threadPeople(thread)
+		for _, p := range people {
+			fm.People = append(fm.People, fmt.Sprintf("[[%s]]", strings.TrimSuffix(filepath.Base(p.path), ".md")))
+			if personLinks[p.status.Account.Acct], err = ms.personLink(p, mdPath); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var node yaml.Node
+	if err := node.Encode(fm); err != nil {
+		return "", fmt.Errorf("failed to marshal frontmatter: %w", err)
+	}
+	if err := ms.addFrontmatter(&node, fields); err != nil {
+		return "", err
+	}
+	buf.WriteString("---\n")
+	fmBytes, err := yaml.Marshal(&node)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal frontmatter: %w", err)
+	}
+	buf.Write(fmBytes)
+	buf.WriteString("---\n\n")
+
+	// Content
+	mainAuthor := ""
+	for i, status := range thread {
+		if status.Depth == 0 && i > 0 {
+			buf.WriteString("\n---\n\n")
+		}
+		// replies below the main line are nested as block quotes
+		var statusBuf bytes.Buffer
+		author := fmt.Sprintf("@%s", status.Account.Acct)
+		if link, ok := personLinks[status.Account.Acct]; ok {
+			author = link
+		}
+		// with people notes the main line names its author when it changes
+		switch {
+		case status.Depth > 0:
+			statusBuf.WriteString(fmt.Sprintf("**%s**\n\n", author))
+		case ms.people != "" && status.Account.Acct != mainAuthor:
+			statusBuf.WriteString(fmt.Sprintf("**%s**\n\n", author))
+		}
+		if status.Depth == 0 {
+			mainAuthor = status.Account.Acct
+		}
+
+		statusBuf.WriteString(ms.statusMarkdown(status, imagesDir, mediaLink))
+		if ms.links != nil {
+			statusBuf.WriteString(ms.archiveLinks(ctx, status, mdPath))
+		}
+		buf.WriteString(blockquote(statusBuf.String(), status.Depth))
+	}
+	if len(thread) > 0 {
+		buf.WriteString("\n---\n\n")
+	}
+
+	if ms.dryrun {
+		log.Printf("[dryrun] would write %s", mdPath)
+	} else if err := os.WriteFile(mdPath, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	if len(people) > 0 {
+		ms.writePeople(people, thread, title, mdPath, imagesDir)
+	}
+	return mdPath, nil
+}
+
+// archiveLinks saves the web pages a status links to as Markdown files next
+// to the note at mdPath, and returns links to the copies. Saving again
+// overwrites the copies. Pages that can't be fetched are logged and left out.
+func (ms *MarkdownSink) archiveLinks(ctx context.Context, status *SavedStatus, mdPath string) string {
+	var buf bytes.Buffer
+	base := strings.TrimSuffix(filepath.Base(mdPath), ".md")
+	for _, link := range statusLinks(status) {
+		name := base + "_" + linkHash(link)
+		if ms.dryrun {
+			log.Printf("[dryrun] would archive %s as %s.md", link, name)
+			continue
+		}
+		article, err := ms.links.Fetch(ctx, link)
+		if err != nil {
+			log.Printf("failed to archive %s: %v", link, err)
+			continue
+		}
+		if err := writeArticleMarkdown(filepath.Join(filepath.Dir(mdPath), name+".md"), article); err != nil {
+			log.Printf("failed to archive %s: %v", link, err)
+			continue
+		}
+		if ms.wikilinks {
+			buf.WriteString(fmt.Sprintf("\n[[%s|Saved copy: %s]]\n", name, kWikilinkEscaper.Replace(article.Title)))
+		} else {
+			buf.WriteString(fmt.Sprintf("\n[Saved copy: %s](%s)\n", markdownEscaper.Replace(article.Title), url.PathEscape(name+".md")))
+		}
+	}
+	return buf.String()
+}
+
+// writeArticleMarkdown writes an article as a Markdown file with where it was
+// saved from in its frontmatter.
+func writeArticleMarkdown(path string, article *Article) error {
+	fm, err := yaml.Marshal(struct {
+		Title string    `yaml:"title"`
+		URL   string    `yaml:"url"`
+		Saved time.Time `yaml:"saved"`
+	}{article.Title, article.URL, article.FetchedAt})
+	if err != nil {
+		return fmt.Errorf("failed to marshal frontmatter: %w", err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	buf.Write(fm)
+	buf.WriteString("---\n\n")
+	buf.WriteString(fmt.Sprintf("# %s\n\n", markdownEscaper.Replace(article.Title)))
+	buf.WriteString(ConvertHtml2Markdown(article.Content))
+	buf.WriteString("\n")
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// addFrontmatter adds the frontmatter configured for the thread's platform to
+// the mapping node, replacing fields of the same name.
+func (ms *MarkdownSink) addFrontmatter(node *yaml.Node, fields markdownFields) error {
+	extra := ms.frontmatter[fields.Platform]
+	var keys []string
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := executeMarkdownTemplate(extra[key], fields)
+		if err != nil {
+			return err
+		}
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		replaced := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				node.Content[i+1] = valueNode
+				replaced = true
+			}
+		}
+		if !replaced {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, valueNode)
+		}
+	}
+	return nil
+}
+
+// statusMarkdown renders one status' text, poll, media, link card, quoted
+// post and earlier versions. Media is downloaded into imagesDir and linked at
+// mediaLink. Content warnings and sensitive media fold into callouts.
+func (ms *MarkdownSink) statusMarkdown(status *SavedStatus, imagesDir string, mediaLink string) string {
+	var buf strings.Builder
+	buf.WriteString(ConvertHtml2Markdown(status.Content))
+	buf.WriteString("\n\n")
+	if status.Poll != nil {
+		buf.WriteString(savedPollMarkdown(status.Poll))
+	}
+
+	var media strings.Builder
+	for _, ma := range status.MediaAttachments {
+		if isStreamingPlaylist(ma.URL) {
+			label := ma.AltText
+			if label == "" {
+				label = ma.Type
+			}
+			media.WriteString(fmt.Sprintf("[▶ %s](%s)\n", markdownEscaper.Replace(label), ma.URL))
+			continue
+		}
+		hashedName, err := downloadAndHash(ma.URL, imagesDir, ms.dryrun)
+		if err != nil {
+			log.Printf("failed to download attachment %s: %v", ma.URL, err)
+			continue
+		}
+
+		// Obsidian embeds images, video and audio, and finds wikilinked
+		// media by its path in the vault
+		embed := "!"
+		if notionMediaKind(ma.Type) == notionapi.BlockTypeFile {
+			embed = ""
+		}
+		alt := strings.ReplaceAll(ma.AltText, "\n", " ")
+		if ms.wikilinks {
+			if alt = kWikilinkEscaper.Replace(alt); alt != "" {
+				alt = "|" + alt
+			}
+			media.WriteString(fmt.Sprintf("%s[[%s/%s%s]]\n", embed, ms.mediaFolder(), hashedName, alt))
+		} else {
+			media.WriteString(fmt.Sprintf("%s[%s](%s/%s)\n", embed, markdownEscaper.Replace(alt), mediaLink, hashedName))
+		}
+	}
+
+	if status.Sensitive && status.SpoilerText == "" && media.Len() > 0 {
+		buf.WriteString(blockquote("[!warning]- Sensitive media\n"+media.String(), 1))
+	} else {
+		buf.WriteString(media.String())
+	}
+
+	if status.Card != nil {
+		title := status.Card.Title
+		if title == "" {
+			title = status.Card.URL
+		}
+		card := fmt.Sprintf("[!info] [%s](%s)\n", markdownEscaper.Replace(title), status.Card.URL)
+		if status.Card.Description != "" {
+			card += markdownEscaper.Replace(status.Card.Description) + "\n"
+		}
+		if !strings.HasSuffix(buf.String(), "\n\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(blockquote(card, 1))
+	}
+
+	if status.Quote != nil {
+		quote := fmt.Sprintf("[!quote] [@%s](%s)\n", status.Quote.Account.Acct, status.Quote.URL)
+		quote += ms.statusMarkdown(status.Quote, imagesDir, mediaLink)
+		if !strings.HasSuffix(buf.String(), "\n\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(blockquote(quote, 1))
+	}
+
+	if !status.EditedAt.IsZero() {
+		if !strings.HasSuffix(buf.String(), "\n\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(editsMarkdown(status))
+	}
+	if status.SpoilerText != "" {
+		return blockquote("[!warning]- CW: "+calloutTitle(status.SpoilerText)+"\n"+buf.String(), 1)
+	}
+	return buf.String()
+}
+
+// savedPollMarkdown renders the options of a poll as a table with their votes.
+func savedPollMarkdown(poll *SavedPoll) string {
+	var buf strings.Builder
+	buf.WriteString("| Option | Votes |\n| --- | --- |\n")
+	for _, option := range poll.Options {
+		title := strings.ReplaceAll(markdownEscaper.Replace(option.Title), "|", `\|`)
+		buf.WriteString(fmt.Sprintf("| %s | %s |\n", title, poll.Result(option)))
+	}
+	buf.WriteString("\n*" + poll.Summary() + "*\n\n")
+	return buf.String()
+}
+
+// editsMarkdown notes when a status was edited, with its earlier versions
+// folded into a callout when they are known.
+func editsMarkdown(status *SavedStatus) string {
+	if len(status.Edits) == 0 {
+		return "*" + editedNote(status) + "*\n\n"
+	}
+	var buf strings.Builder
+	buf.WriteString("[!note]- " + editedNote(status) + "\n")
+	for _, edit := range status.Edits {
+		buf.WriteString("**" + edit.CreatedAt.Local().Format(time.DateTime) + "**\n\n")
+		if edit.SpoilerText != "" {
+			buf.WriteString("CW: " + calloutTitle(edit.SpoilerText) + "\n\n")
+		}
+		buf.WriteString(ConvertHtml2Markdown(edit.Content) + "\n\n")
+	}
+	return blockquote(buf.String(), 1)
+}
+
+// calloutTitle escapes text for the one line title of a callout.
+func calloutTitle(text string) string {
+	return markdownEscaper.Replace(strings.Join(strings.Fields(text), " "))
+}
+
+// blockquote nests text depth levels deep in block quotes.
+func blockquote(text string, depth int) string {
+	if depth == 0 {
+		return text
+	}
+	prefix := strings.Repeat("> ", depth)
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(prefix+line, " ")
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
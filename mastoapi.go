@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// MastodonAPIError is returned by mastodonAPI for non-2xx responses so callers
+// can tell e.g. a missing resource apart from a failed request.
+type MastodonAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *MastodonAPIError) Error() string {
+	return fmt.Sprintf("mastodon api: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*MastodonAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// mastodonAPI calls Mastodon endpoints that go-mastodon doesn't wrap, using the
+// client's server, access token and http client.
+func mastodonAPI(ctx context.Context, mClient *mdon.Client, method string, uri string, params url.Values, res any) error {
+	u, err := url.Parse(mClient.Config.Server)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, uri)
+
+	var body io.Reader
+	if params != nil {
+		if method == http.MethodGet {
+			u.RawQuery = params.Encode()
+		} else {
+			body = strings.NewReader(params.Encode())
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+mClient.Config.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if mClient.UserAgent != "" {
+		req.Header.Set("User-Agent", mClient.UserAgent)
+	}
+
+	resp, err := mClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &MastodonAPIError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+const kMediaProcessingTimeout = 10 * time.Minute
+
+// waitForMedia polls an attachment uploaded through the async /api/v2/media
+// flow until the server has finished processing it.
+func waitForMedia(ctx context.Context, mClient *mdon.Client, id mdon.ID, interval time.Duration) (*mdon.Attachment, error) {
+	deadline := time.Now().Add(kMediaProcessingTimeout)
+	for {
+		var attachment mdon.Attachment
+		err := mastodonAPI(ctx, mClient, http.MethodGet, "/api/v1/media/"+string(id), nil, &attachment)
+		if err != nil {
+			return nil, err
+		}
+		// the server answers 206 without a url while it is still processing
+		if attachment.URL != "" {
+			return &attachment, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("media %s still processing after %s", id, kMediaProcessingTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// postStatus posts toot like mClient.PostStatus, quoting the status quotedID
+// when it is set. Quotes need Mastodon 4.5 and go-mastodon doesn't know the
+// parameter yet.
+func postStatus(ctx context.Context, mClient *mdon.Client, toot *mdon.Toot, quotedID mdon.ID) (*mdon.Status, error) {
+	if quotedID == "" {
+		return mClient.PostStatus(ctx, toot)
+	}
+
+	params := url.Values{}
+	params.Set("status", toot.Status)
+	params.Set("quoted_status_id", string(quotedID))
+	if toot.InReplyToID != "" {
+		params.Set("in_reply_to_id", string(toot.InReplyToID))
+	}
+	for _, media := range toot.MediaIDs {
+		params.Add("media_ids[]", string(media))
+	}
+	if toot.Poll != nil && toot.Poll.Options != nil && toot.MediaIDs == nil {
+		for _, opt := range toot.Poll.Options {
+			params.Add("poll[options][]", opt)
+		}
+		params.Set("poll[expires_in]", fmt.Sprint(toot.Poll.ExpiresInSeconds))
+		if toot.Poll.Multiple {
+			params.Set("poll[multiple]", "true")
+		}
+		if toot.Poll.HideTotals {
+			params.Set("poll[hide_totals]", "true")
+		}
+	}
+	if toot.Visibility != "" {
+		params.Set("visibility", toot.Visibility)
+	}
+	if toot.Language != "" {
+		params.Set("language", toot.Language)
+	}
+	if toot.Sensitive {
+		params.Set("sensitive", "true")
+	}
+	if toot.SpoilerText != "" {
+		params.Set("spoiler_text", toot.SpoilerText)
+	}
+	if toot.ScheduledAt != nil {
+		params.Set("scheduled_at", toot.ScheduledAt.Format(time.RFC3339))
+	}
+
+	var status mdon.Status
+	err := mastodonAPI(ctx, mClient, http.MethodPost, "/api/v1/statuses", params, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// Go's builtin mime table lacks most video and audio types and the system
+// one differs between machines, so the types we post are listed here.
+var mediaContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+}
+
+func mediaContentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ct, ok := mediaContentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// mediaKind returns "image", "video", "audio" or "unknown" for path.
+func mediaKind(path string) string {
+	kind, _, _ := strings.Cut(mediaContentType(path), "/")
+	switch kind {
+	case "image", "video", "audio":
+		return kind
+	}
+	return "unknown"
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// MediaLimits are the upload restrictions of the server media is posted to.
+// Zero values mean no limit.
+type MediaLimits struct {
+	SupportedMimeTypes []string
+	ImageSizeLimit     int64
+	ImageMatrixLimit   int64
+	VideoSizeLimit     int64
+}
+
+// kDefaultMastodonLimits are the limits of a stock Mastodon 4 server, used
+// when the instance doesn't report its own.
+var kDefaultMastodonLimits = MediaLimits{
+	SupportedMimeTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+	ImageSizeLimit:     16 * 1024 * 1024,
+	ImageMatrixLimit:   33177600,
+	VideoSizeLimit:     99 * 1024 * 1024,
+}
+
+// kBlueskyLimits follow the app view: blobs up to 1MB and images are
+// shown at most 2000px wide.
+var kBlueskyLimits = MediaLimits{
+	SupportedMimeTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+	ImageSizeLimit:     1000000,
+	ImageMatrixLimit:   2000 * 2000,
+}
+
+func (ml *MediaLimits) supports(contentType string) bool {
+	return slices.Contains(ml.SupportedMimeTypes, contentType)
+}
+
+// FetchMediaLimits reads the media configuration from /api/v2/instance.
+func FetchMediaLimits(ctx context.Context, mClient *mdon.Client) (*MediaLimits, error) {
+	var instance struct {
+		Configuration struct {
+			MediaAttachments struct {
+				SupportedMimeTypes []string `json:"supported_mime_types"`
+				ImageSizeLimit     int64    `json:"image_size_limit"`
+				ImageMatrixLimit   int64    `json:"image_matrix_limit"`
+				VideoSizeLimit     int64    `json:"video_size_limit"`
+			} `json:"media_attachments"`
+		} `json:"configuration"`
+	}
+	err := mastodonAPI(ctx, mClient, http.MethodGet, "/api/v2/instance", nil, &instance)
+	if err != nil {
+		return nil, err
+	}
+	ma := instance.Configuration.MediaAttachments
+	limits := kDefaultMastodonLimits
+	if len(ma.SupportedMimeTypes) > 0 {
+		limits.SupportedMimeTypes = ma.SupportedMimeTypes
+	}
+	if ma.ImageSizeLimit > 0 {
+		limits.ImageSizeLimit = ma.ImageSizeLimit
+	}
+	if ma.ImageMatrixLimit > 0 {
+		limits.ImageMatrixLimit = ma.ImageMatrixLimit
+	}
+	if ma.VideoSizeLimit > 0 {
+		limits.VideoSizeLimit = ma.VideoSizeLimit
+	}
+	return &limits, nil
+}
+
+// MediaPipeline prepares local media for upload: images are oriented, stripped
+// of metadata and downsized or re-encoded until they fit the server's limits.
+type MediaPipeline struct {
+	limits MediaLimits
+	tmpDir string
+	// converter turns formats the standard library can't decode (HEIC, WebP,
+	// AVIF) into dst, auto-oriented and stripped. nil disables conversion.
+	converter func(src, dst string, maxPixels int64) error
+}
+
+func NewMediaPipeline(limits MediaLimits) *MediaPipeline {
+	mp := &MediaPipeline{limits: limits}
+	if tool, err := exec.LookPath("magick"); err == nil {
+		mp.converter = imageMagickConverter(tool)
+	}
+	return mp
+}
+
+// NewMastodonMediaPipeline uses the instance's limits, falling back to the
+// Mastodon defaults when they can't be fetched.
+func NewMastodonMediaPipeline(mClient *mdon.Client) *MediaPipeline {
+	limits, err := FetchMediaLimits(context.Background(), mClient)
+	if err != nil {
+		log.Printf("failed to fetch instance media limits, using defaults: %v", err)
+		limits = &kDefaultMastodonLimits
+	}
+	return NewMediaPipeline(*limits)
+}
+
+func imageMagickConverter(tool string) func(src, dst string, maxPixels int64) error {
+	return func(src, dst string, maxPixels int64) error {
+		args := []string{src, "-auto-orient", "-strip"}
+		if maxPixels > 0 {
+			args = append(args, "-resize", fmt.Sprintf("%d@>", maxPixels))
+		}
+		args = append(args, "-quality", "90", dst)
+		out, err := exec.Command(tool, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to convert %s: %w\n%s", src, err, out)
+		}
+		return nil
+	}
+}
+
+// Close removes the files Prepare created.
+func (mp *MediaPipeline) Close() error {
+	if mp.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(mp.tmpDir)
+}
+
+// Prepare returns the path to upload in place of path. That is path itself
+// when nothing needs to change, otherwise a processed copy that lives until
+// Close.
+func (mp *MediaPipeline) Prepare(path string, altText string) (string, error) {
+	if strings.TrimSpace(altText) == "" {
+		log.Printf("warning: %s has no alt text", path)
+	}
+	return mp.prepare(path)
+}
+
+func (mp *MediaPipeline) prepare(path string) (string, error) {
+	switch mediaKind(path) {
+	case "image":
+	case "video", "audio":
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if mp.limits.VideoSizeLimit > 0 && fi.Size() > mp.limits.VideoSizeLimit {
+			return "", fmt.Errorf("%s is %s, the server accepts at most %s",
+				path, humanSize(fi.Size()), humanSize(mp.limits.VideoSizeLimit))
+		}
+		return path, nil
+	default:
+		return path, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	contentType := mediaContentType(path)
+	switch contentType {
+	case "image/jpeg":
+		return mp.prepareJPEG(path, data)
+	case "image/png":
+		return mp.preparePNG(path, data)
+	case "image/gif":
+		// re-encoding would drop the animation, the server converts gifs itself
+		return path, mp.checkImageSize(path, int64(len(data)))
+	}
+
+	if mp.converter != nil {
+		ext := ".jpg"
+		if mp.limits.supports(contentType) && contentType == "image/webp" {
+			ext = ".webp"
+		}
+		dst, err := mp.tempFile(path, ext)
+		if err != nil {
+			return "", err
+		}
+		err = mp.converter(path, dst, mp.limits.ImageMatrixLimit)
+		if err != nil {
+			return "", err
+		}
+		if ext != ".jpg" {
+			return dst, mp.checkImageSize(path, fileSize(dst))
+		}
+		converted, err := os.ReadFile(dst)
+		if err != nil {
+			return "", err
+		}
+		return mp.prepareJPEG(dst, converted)
+	}
+	if !mp.limits.supports(contentType) {
+		return "", fmt.Errorf("%s is %s which the server doesn't accept; install ImageMagick to convert it", path, contentType)
+	}
+	log.Printf("warning: can't strip metadata from %s without ImageMagick", path)
+	return path, mp.checkImageSize(path, int64(len(data)))
+}
+
+func (mp *MediaPipeline) checkImageSize(path string, size int64) error {
+	if mp.limits.ImageSizeLimit > 0 && size > mp.limits.ImageSizeLimit {
+		return fmt.Errorf("%s is %s, the server accepts at most %s",
+			path, humanSize(size), humanSize(mp.limits.ImageSizeLimit))
+	}
+	return nil
+}
+
+func (mp *MediaPipeline) fits(width, height int, size int64) bool {
+	if mp.limits.ImageMatrixLimit > 0 && int64(width)*int64(height) > mp.limits.ImageMatrixLimit {
+		return false
+	}
+	return mp.limits.ImageSizeLimit <= 0 || size <= mp.limits.ImageSizeLimit
+}
+
+func (mp *MediaPipeline) prepareJPEG(path string, data []byte) (string, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		stripped, err := stripJPEG(data)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if mp.fits(cfg.Width, cfg.Height, int64(len(stripped))) {
+			if len(stripped) == len(data) {
+				return path, nil
+			}
+			return mp.writeTemp(path, ".jpg", stripped)
+		}
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return mp.reencode(path, orient(img, orientation), false)
+}
+
+func (mp *MediaPipeline) preparePNG(path string, data []byte) (string, error) {
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	stripped, err := stripPNG(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if mp.fits(cfg.Width, cfg.Height, int64(len(stripped))) {
+		if len(stripped) == len(data) {
+			return path, nil
+		}
+		return mp.writeTemp(path, ".png", stripped)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return mp.reencode(path, img, true)
+}
+
+// reencode downsizes img to the matrix limit and encodes it, lowering the
+// jpeg quality and then the resolution until it fits the size limit. A png
+// that is still too large is turned into a jpeg.
+func (mp *MediaPipeline) reencode(path string, img image.Image, asPNG bool) (string, error) {
+	img = downscale(img, mp.limits.ImageMatrixLimit)
+	var buf bytes.Buffer
+	for attempt := 0; attempt < 8; attempt++ {
+		b := img.Bounds()
+		if asPNG {
+			buf.Reset()
+			err := png.Encode(&buf, img)
+			if err != nil {
+				return "", err
+			}
+			if mp.fits(b.Dx(), b.Dy(), int64(buf.Len())) {
+				return mp.writeTemp(path, ".png", buf.Bytes())
+			}
+			asPNG = false
+			img = flatten(img)
+		}
+		for _, quality := range []int{90, 80, 70} {
+			buf.Reset()
+			err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+			if err != nil {
+				return "", err
+			}
+			if mp.fits(b.Dx(), b.Dy(), int64(buf.Len())) {
+				return mp.writeTemp(path, ".jpg", buf.Bytes())
+			}
+		}
+		img = resize(img, b.Dx()*3/4, b.Dy()*3/4)
+	}
+	return "", fmt.Errorf("failed to shrink %s below %s", path, humanSize(mp.limits.ImageSizeLimit))
+}
+
+func (mp *MediaPipeline) tempFile(path string, ext string) (string, error) {
+	if mp.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "mastosync-media")
+		if err != nil {
+			return "", err
+		}
+		mp.tmpDir = dir
+	}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	f, err := os.CreateTemp(mp.tmpDir, base+"-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+func (mp *MediaPipeline) writeTemp(path string, ext string, data []byte) (string, error) {
+	dst, err := mp.tempFile(path, ext)
+	if err != nil {
+		return "", err
+	}
+	return dst, os.WriteFile(dst, data, 0644)
+}
+
+// the longest a download of remote media may take
+const kMediaFetchTimeout = 2 * time.Minute
+
+var kMediaFetchClient = &http.Client{Timeout: kMediaFetchTimeout}
+
+// fetchLimit is the most bytes of remote media downloaded: the larger of the
+// instance's image and video limits, as images above their limit can still
+// be shrunk.
+func (mp *MediaPipeline) fetchLimit() int64 {
+	return mediaFetchLimit(mp.limits)
+}
+
+func mediaFetchLimit(limits MediaLimits) int64 {
+	limit := max(limits.ImageSizeLimit, limits.VideoSizeLimit)
+	if limit <= 0 {
+		limit = max(kDefaultMastodonLimits.ImageSizeLimit, kDefaultMastodonLimits.VideoSizeLimit)
+	}
+	return limit
+}
+
+// Fetch downloads a remote image into the pipeline's temp dir so it can be
+// prepared like a local file.
+func (mp *MediaPipeline) Fetch(rawURL string) (string, error) {
+	resp, err := kMediaFetchClient.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+	limit := mp.fetchLimit()
+	if resp.ContentLength > limit {
+		return "", fmt.Errorf("can't download %s, it is larger than %s", rawURL, humanSize(limit))
+	}
+
+	ext := ""
+	if u, err := url.Parse(rawURL); err == nil {
+		ext = strings.ToLower(filepath.Ext(u.Path))
+	}
+	if _, known := mediaContentTypes[ext]; !known {
+		ext = ""
+		ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		for e, t := range mediaContentTypes {
+			if t == ct && (ext == "" || e < ext) {
+				ext = e
+			}
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > limit {
+		return "", fmt.Errorf("can't download %s, it is larger than %s", rawURL, humanSize(limit))
+	}
+	return mp.writeTemp("download", ext, data)
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a jpeg, 1 if it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(bo.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if bo.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(bo.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// stripJPEG drops the EXIF, XMP, IPTC and comment segments of a jpeg without
+// re-encoding it. JFIF and ICC profile segments are kept.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a jpeg")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, errors.New("malformed jpeg")
+		}
+		marker := data[i+1]
+		if marker == 0xDA {
+			return append(out, data[i:]...), nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil, errors.New("malformed jpeg")
+		}
+		segment := data[i : i+2+size]
+		isICC := marker == 0xE2 && bytes.HasPrefix(segment[4:], []byte("ICC_PROFILE\x00"))
+		metadata := marker == 0xFE || (marker >= 0xE1 && marker <= 0xEF && !isICC)
+		if !metadata {
+			out = append(out, segment...)
+		}
+		i += 2 + size
+	}
+}
+
+const kPNGSignature = "\x89PNG\r\n\x1a\n"
+
+// stripPNG drops the text, EXIF and timestamp chunks of a png.
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(kPNGSignature)) {
+		return nil, errors.New("not a png")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, kPNGSignature...)
+	for i := len(kPNGSignature); i+12 <= len(data); {
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, errors.New("malformed png")
+		}
+		chunkType := string(data[i+4 : i+8])
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return out, nil
+		}
+		i = end
+	}
+	return nil, errors.New("malformed png")
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	b := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	return nrgba
+}
+
+// orient rotates and flips img so it displays upright without the EXIF
+// orientation tag.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := toNRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-dx, dy
+			case 3:
+				sx, sy = w-1-dx, h-1-dy
+			case 4:
+				sx, sy = dx, h-1-dy
+			case 5:
+				sx, sy = dy, dx
+			case 6:
+				sx, sy = dy, h-1-dx
+			case 7:
+				sx, sy = w-1-dy, h-1-dx
+			case 8:
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// downscale shrinks img proportionally to at most maxPixels pixels.
+func downscale(img image.Image, maxPixels int64) image.Image {
+	b := img.Bounds()
+	pixels := int64(b.Dx()) * int64(b.Dy())
+	if maxPixels <= 0 || pixels <= maxPixels {
+		return img
+	}
+	scale := math.Sqrt(float64(maxPixels) / float64(pixels))
+	return resize(img, int(float64(b.Dx())*scale), int(float64(b.Dy())*scale))
+}
+
+// resize scales img down to width x height by averaging the source pixels
+// covered by each destination pixel.
+func resize(img image.Image, width, height int) image.Image {
+	src := toNRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	width, height = max(width, 1), max(height, 1)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*h/height, max((y+1)*h/height, y*h/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*w/width, max((x+1)*w/width, x*w/width+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				p := src.Pix[src.PixOffset(x0, sy):]
+				for sx := 0; sx < x1-x0; sx++ {
+					pa := uint64(p[sx*4+3])
+					r += uint64(p[sx*4]) * pa
+					g += uint64(p[sx*4+1]) * pa
+					b += uint64(p[sx*4+2]) * pa
+					a += pa
+					n++
+				}
+			}
+			d := dst.Pix[dst.PixOffset(x, y):]
+			if a > 0 {
+				d[0], d[1], d[2] = uint8(r/a), uint8(g/a), uint8(b/a)
+			}
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// flatten draws img over white so transparent areas don't turn black in a jpeg.
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Over)
+	return rgba
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// exifSegment builds an APP1 segment carrying just an orientation tag.
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJPEG encodes a w x h image whose left half is red and right half blue,
+// with an EXIF orientation segment if orientation is non-zero.
+func testJPEG(t *testing.T, w, h int, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+	return append(append([]byte{0xFF, 0xD8}, exifSegment(orientation)...), data[2:]...)
+}
+
+func TestJPEGOrientationAndStrip(t *testing.T) {
+	data := testJPEG(t, 8, 4, 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Errorf("jpegOrientation() = %d, want 6", got)
+	}
+
+	stripped, err := stripJPEG(data)
+	if err != nil {
+		t.Fatalf("stripJPEG failed: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Error("Expected EXIF segment to be removed")
+	}
+	if got := jpegOrientation(stripped); got != 1 {
+		t.Errorf("Expected no orientation after stripping, got %d", got)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("Stripped jpeg doesn't decode: %v", err)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	data := buf.Bytes()
+	// insert a tEXt chunk after IHDR, the crc isn't checked by stripPNG
+	text := []byte("GPS\x0052.5,13.4")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	ihdrEnd := 8 + 12 + 13
+	withText := append(append(append([]byte{}, data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+
+	stripped, err := stripPNG(withText)
+	if err != nil {
+		t.Fatalf("stripPNG failed: %v", err)
+	}
+	if !bytes.Equal(stripped, data) {
+		t.Error("Expected the tEXt chunk to be removed and nothing else")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, color.NRGBA{R: 255, A: 255})
+
+	tests := []struct {
+		orientation int
+		x, y        int
+	}{
+		{orientation: 2, x: 2, y: 0},
+		{orientation: 3, x: 2, y: 1},
+		{orientation: 4, x: 0, y: 1},
+		{orientation: 5, x: 0, y: 0},
+		{orientation: 6, x: 1, y: 0},
+		{orientation: 7, x: 1, y: 2},
+		{orientation: 8, x: 0, y: 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.orientation), func(t *testing.T) {
+			got := orient(src, tt.orientation)
+			if r, _, _, _ := got.At(tt.x, tt.y).RGBA(); r == 0 {
+				t.Errorf("Expected the red corner at %d,%d", tt.x, tt.y)
+			}
+		})
+	}
+}
+
+func TestMediaPipeline_Prepare(t *testing.T) {
+	dir, err := os.MkdirTemp("", "media")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, data, 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return p
+	}
+
+	mp := NewMediaPipeline(MediaLimits{ImageMatrixLimit: 100 * 100})
+	mp.converter = nil
+	defer mp.Close()
+
+	t.Run("clean jpeg is kept", func(t *testing.T) {
+		p := write("clean.jpg", testJPEG(t, 40, 20, 0))
+		got, err := mp.Prepare(p, "alt")
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		if got != p {
+			t.Errorf("Expected %s to be uploaded as is, got %s", p, got)
+		}
+	})
+
+	t.Run("rotated and resized", func(t *testing.T) {
+		p := write("phone.jpg", testJPEG(t, 400, 200, 6))
+		got, err := mp.Prepare(p, "alt")
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		data, err := os.ReadFile(got)
+		if err != nil {
+			t.Fatalf("Failed to read prepared file: %v", err)
+		}
+		if bytes.Contains(data, []byte("Exif")) {
+			t.Error("Expected EXIF to be stripped")
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Prepared file isn't a jpeg: %v", err)
+		}
+		if cfg.Width*cfg.Height > 100*100 {
+			t.Errorf("Expected at most %d pixels, got %dx%d", 100*100, cfg.Width, cfg.Height)
+		}
+		if cfg.Height <= cfg.Width {
+			t.Errorf("Expected a portrait image after rotation, got %dx%d", cfg.Width, cfg.Height)
+		}
+	})
+
+	t.Run("large png becomes jpeg", func(t *testing.T) {
+		rnd := rand.New(rand.NewPCG(1, 2))
+		img := image.NewNRGBA(image.Rect(0, 0, 90, 90))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(rnd.UintN(256))
+		}
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		p := write("noise.png", buf.Bytes())
+
+		small := NewMediaPipeline(MediaLimits{ImageSizeLimit: int64(buf.Len() / 2)})
+		defer small.Close()
+		got, err := small.Prepare(p, "alt")
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		if filepath.Ext(got) != ".jpg" || fileSize(got) > int64(buf.Len()/2) {
+			t.Errorf("Expected a jpeg under the size limit, got %s (%d bytes)", got, fileSize(got))
+		}
+	})
+
+	t.Run("unsupported format without converter", func(t *testing.T) {
+		p := write("photo.heic", []byte("heic"))
+		_, err := mp.Prepare(p, "alt")
+		if err == nil {
+			t.Error("Expected an error for heic without a converter")
+		}
+	})
+
+	t.Run("video too large", func(t *testing.T) {
+		p := write("clip.mp4", make([]byte, 2048))
+		limited := NewMediaPipeline(MediaLimits{VideoSizeLimit: 1024})
+		_, err := limited.Prepare(p, "alt")
+		if err == nil {
+			t.Error("Expected an error for a video over the limit")
+		}
+	})
+}
+
+func TestFetchMediaLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/instance" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"configuration":{"media_attachments":{
+			"supported_mime_types":["image/jpeg","image/png"],
+			"image_size_limit":1048576,"image_matrix_limit":4000000}}}`)
+	}))
+	defer server.Close()
+
+	limits, err := FetchMediaLimits(t.Context(), mdon.NewClient(&mdon.Config{Server: server.URL}))
+	if err != nil {
+		t.Fatalf("FetchMediaLimits failed: %v", err)
+	}
+	if limits.ImageSizeLimit != 1048576 || limits.ImageMatrixLimit != 4000000 {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+	if limits.VideoSizeLimit != kDefaultMastodonLimits.VideoSizeLimit {
+		t.Errorf("Expected the default video limit, got %d", limits.VideoSizeLimit)
+	}
+	if limits.supports("image/webp") {
+		t.Error("Expected webp to be unsupported")
+	}
+}
+
+func TestMediaPipeline_Fetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone.png" {
+			http.NotFound(w, r)
+			return
+		}
+		// no Content-Length, so the limit is enforced while reading
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		limits  MediaLimits
+		wantErr bool
+	}{
+		{"within the limit", "/a.png", MediaLimits{ImageSizeLimit: 100}, false},
+		{"video limit counts", "/a.png", MediaLimits{ImageSizeLimit: 10, VideoSizeLimit: 200}, false},
+		{"too large", "/a.png", MediaLimits{ImageSizeLimit: 50, VideoSizeLimit: 99}, true},
+		{"not found", "/gone.png", MediaLimits{ImageSizeLimit: 100}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := &MediaPipeline{limits: tt.limits, tmpDir: t.TempDir()}
+			path, err := mp.Fetch(server.URL + tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (filepath.Ext(path) != ".png" || fileSize(path) != 100) {
+				t.Errorf("Fetch() = %s of %d bytes, want the png", path, fileSize(path))
+			}
+		})
+	}
+}
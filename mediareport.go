@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// MediaReport tells what became of the media of a save: kept in the media
+// store or notion, or linked at its original URL because keeping it failed.
+// Links to the original URL break once its server purges the media.
+type MediaReport struct {
+	Kept   int
+	Failed []MediaFailure
+	// media a dry run of a repair would keep
+	Repairable []string
+}
+
+// MediaFailure is media that couldn't be kept.
+type MediaFailure struct {
+	URL string
+	Err error
+}
+
+func (mr *MediaReport) kept() {
+	if mr != nil {
+		mr.Kept++
+	}
+}
+
+func (mr *MediaReport) failed(mediaURL string, err error) {
+	if mr != nil {
+		mr.Failed = append(mr.Failed, MediaFailure{URL: mediaURL, Err: err})
+	}
+}
+
+// Err returns an error naming the media that couldn't be kept, or nil when
+// all of it was.
+func (mr *MediaReport) Err() error {
+	if mr == nil || len(mr.Failed) == 0 {
+		return nil
+	}
+	var urls []string
+	for _, failure := range mr.Failed {
+		urls = append(urls, failure.URL)
+	}
+	return fmt.Errorf("%d of %d media couldn't be kept: %s", len(mr.Failed), mr.Kept+len(mr.Failed), strings.Join(urls, ", "))
+}
+
+// String summarizes the report, one line per failure after the first. It is
+// empty when there was no media.
+func (mr *MediaReport) String() string {
+	if mr == nil {
+		return ""
+	}
+	if len(mr.Repairable) > 0 {
+		return fmt.Sprintf("media: %d to keep\n  %s", len(mr.Repairable), strings.Join(mr.Repairable, "\n  "))
+	}
+	if mr.Kept+len(mr.Failed) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "media: %d kept", mr.Kept)
+	if len(mr.Failed) > 0 {
+		fmt.Fprintf(&sb, ", %d linked at the original URL", len(mr.Failed))
+	}
+	for _, failure := range mr.Failed {
+		fmt.Fprintf(&sb, "\n  %s: %v", failure.URL, failure.Err)
+	}
+	return sb.String()
+}
+
+// mediaReporter is a sink that reports what became of the media of its last
+// write.
+type mediaReporter interface {
+	MediaReport() *MediaReport
+}
+
+// printMediaReport logs what became of the media of the last save, for sinks
+// that keep media.
+func (saver *Saver) printMediaReport() {
+	if reporter, ok := saver.sink.(mediaReporter); ok {
+		if report := reporter.MediaReport().String(); report != "" {
+			log.Println(report)
+		}
+	}
+}
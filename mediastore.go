@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	googdrive "google.golang.org/api/drive/v3"
+)
+
+// MediaStore keeps media at a lasting public URL, so saved pages don't
+// depend on the server the media came from.
+type MediaStore interface {
+	// Store keeps content under name and returns its public URL. Names are
+	// hashes of the content, so content stored before isn't stored again.
+	Store(ctx context.Context, name string, contentType string, content []byte) (string, error)
+	// Keeps reports whether the URL is of media in the store.
+	Keeps(mediaURL string) bool
+}
+
+// storeMedia downloads media and keeps it in store under the hash of its
+// content.
+func storeMedia(ctx context.Context, store MediaStore, mediaURL string) (string, error) {
+	content, name, err := fetchMedia(mediaURL)
+	if err != nil {
+		return "", err
+	}
+	return store.Store(ctx, name, mime.TypeByExtension(path.Ext(name)), content)
+}
+
+// joinURL appends name to a base URL.
+func joinURL(base string, name string) string {
+	return strings.TrimSuffix(base, "/") + "/" + url.PathEscape(name)
+}
+
+// underURL reports whether mediaURL is below base.
+func underURL(base string, mediaURL string) bool {
+	return base != "" && strings.HasPrefix(mediaURL, strings.TrimSuffix(base, "/")+"/")
+}
+
+// GDriveStore keeps media in a Google Drive folder, served through the
+// bridge.
+type GDriveStore struct {
+	service *googdrive.Service
+	// the folder media is kept in
+	parent string
+	bridge string
+}
+
+func (gs *GDriveStore) Store(ctx context.Context, name string, contentType string, content []byte) (string, error) {
+	list, err := gs.service.Files.List().Context(ctx).
+		Q(fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", name, gs.parent)).
+		Fields("files(id)").Do()
+	if err != nil {
+		return "", err
+	}
+	if len(list.Files) > 0 {
+		return fmt.Sprintf("%s/%s/%s", gs.bridge, list.Files[0].Id, name), nil
+	}
+
+	df := googdrive.File{
+		Name:     name,
+		MimeType: contentType,
+		Parents:  []string{gs.parent},
+	}
+	dFile, err := gs.service.Files.Create(&df).Context(ctx).Media(bytes.NewReader(content)).Do()
+	if err != nil {
+		return "", err
+	}
+	perm := googdrive.Permission{
+		Role: "reader",
+		Type: "anyone",
+	}
+	_, err = gs.service.Permissions.Create(dFile.Id, &perm).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", gs.bridge, dFile.Id, name), nil
+}
+
+func (gs *GDriveStore) Keeps(mediaURL string) bool {
+	return underURL(gs.bridge, mediaURL)
+}
+
+// LocalStore keeps media in a directory served at baseURL.
+type LocalStore struct {
+	dir     string
+	baseURL string
+}
+
+func (ls *LocalStore) Store(ctx context.Context, name string, contentType string, content []byte) (string, error) {
+	target := filepath.Join(ls.dir, name)
+	exists, err := fileExists(target)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := os.MkdirAll(ls.dir, 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return "", err
+		}
+	}
+	return joinURL(ls.baseURL, name), nil
+}
+
+func (ls *LocalStore) Keeps(mediaURL string) bool {
+	return underURL(ls.baseURL, mediaURL)
+}
+
+// S3Store keeps media in a bucket of S3 or a compatible object storage,
+// addressed path style.
+type S3Store struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// where the bucket is served publicly, the endpoint when empty
+	baseURL string
+}
+
+func (s3 *S3Store) Store(ctx context.Context, name string, contentType string, content []byte) (string, error) {
+	objectURL := joinURL(joinURL(s3.endpoint, s3.bucket), name)
+	publicURL := objectURL
+	if s3.baseURL != "" {
+		publicURL = joinURL(s3.baseURL, name)
+	}
+
+	head, err := http.NewRequestWithContext(ctx, http.MethodHead, objectURL, nil)
+	if err != nil {
+		return "", err
+	}
+	s3.sign(head, nil, time.Now())
+	resp, err := s3.client.Do(head)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return publicURL, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return "", fmt.Errorf("failed to look up %s in bucket %s: %s", name, s3.bucket, resp.Status)
+	}
+
+	put, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	put.Header.Set("Content-Type", contentType)
+	s3.sign(put, content, time.Now())
+	resp, err = s3.client.Do(put)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to store %s in bucket %s: %s %s", name, s3.bucket, resp.Status, body)
+	}
+	return publicURL, nil
+}
+
+func (s3 *S3Store) Keeps(mediaURL string) bool {
+	if s3.baseURL != "" {
+		return underURL(s3.baseURL, mediaURL)
+	}
+	return underURL(joinURL(s3.endpoint, s3.bucket), mediaURL)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds an AWS signature version 4 to the request, covering all its
+// headers and the payload.
+func (s3 *S3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, strings.ReplaceAll(url.QueryEscape(key)+"="+url.QueryEscape(value), "+", "%20"))
+		}
+	}
+	sort.Strings(params)
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + s3.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s3.secretKey), date)
+	key = hmacSHA256(key, s3.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s3.accessKey, scope, signedHeaders, signature))
+}
+
+// WebDAVStore keeps media in a WebDAV collection.
+type WebDAVStore struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+	// where the collection is served publicly, url when empty
+	baseURL string
+}
+
+func (ws *WebDAVStore) Store(ctx context.Context, name string, contentType string, content []byte) (string, error) {
+	fileURL := joinURL(ws.url, name)
+	publicURL := fileURL
+	if ws.baseURL != "" {
+		publicURL = joinURL(ws.baseURL, name)
+	}
+
+	head, err := http.NewRequestWithContext(ctx, http.MethodHead, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	head.SetBasicAuth(ws.username, ws.password)
+	resp, err := ws.client.Do(head)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return publicURL, nil
+	}
+
+	put, err := http.NewRequestWithContext(ctx, http.MethodPut, fileURL, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	put.SetBasicAuth(ws.username, ws.password)
+	put.Header.Set("Content-Type", contentType)
+	resp, err = ws.client.Do(put)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to store %s in %s: %s", name, ws.url, resp.Status)
+	}
+	return publicURL, nil
+}
+
+func (ws *WebDAVStore) Keeps(mediaURL string) bool {
+	if ws.baseURL != "" {
+		return underURL(ws.baseURL, mediaURL)
+	}
+	return underURL(ws.url, mediaURL)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jomei/notionapi"
+	"golang.org/x/net/html"
+)
+
+// notion rejects rich text objects with more than 2000 characters
+const kNotionMaxTextLength = 2000
+
+var emojiShortcode = regexp.MustCompile(`:[a-zA-Z0-9_]+:`)
+
+// blockConverter turns the HTML of a status into notion blocks. Inline
+// content collects in rich until a block element flushes it.
+type blockConverter struct {
+	blocks      notionapi.Blocks
+	rich        []notionapi.RichText
+	annotations notionapi.Annotations
+	href        string
+	emojis      map[string]string
+	// set while collecting a list item, whose nested lists follow it
+	skipLists bool
+}
+
+// ConvertHtml2Blocks converts the HTML of a status to notion blocks. Custom
+// emoji can't be inline images in notion, so their shortcodes link to the
+// emoji image instead.
+func ConvertHtml2Blocks(content string, emojis []SavedEmoji) notionapi.Blocks {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	bc := &blockConverter{emojis: make(map[string]string)}
+	for _, emoji := range emojis {
+		bc.emojis[":"+emoji.Shortcode+":"] = emoji.URL
+	}
+	bc.walk(doc)
+	bc.paragraph()
+	return bc.blocks
+}
+
+func (bc *blockConverter) walkChildren(node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		bc.walk(child)
+	}
+}
+
+func (bc *blockConverter) walk(node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		bc.text(node.Data)
+		return
+	case html.ElementNode:
+	default:
+		bc.walkChildren(node)
+		return
+	}
+
+	saved := bc.annotations
+	switch node.Data {
+	case "p", "div":
+		bc.paragraph()
+		bc.walkChildren(node)
+		bc.paragraph()
+	case "br":
+		bc.appendText("\n", "")
+	case "strong", "b":
+		bc.annotations.Bold = true
+		bc.walkChildren(node)
+	case "em", "i":
+		bc.annotations.Italic = true
+		bc.walkChildren(node)
+	case "del", "s":
+		bc.annotations.Strikethrough = true
+		bc.walkChildren(node)
+	case "u":
+		bc.annotations.Underline = true
+		bc.walkChildren(node)
+	case "code":
+		bc.annotations.Code = true
+		bc.walkChildren(node)
+	case "pre":
+		bc.paragraph()
+		bc.blocks = append(bc.blocks, notionapi.CodeBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeCode,
+			},
+			Code: notionapi.Code{
+				RichText: splitRichText(strings.TrimRight(htmlText(node), "\n"), nil, ""),
+				Language: "plain text",
+			},
+		})
+	case "blockquote":
+		bc.paragraph()
+		bc.blocks = append(bc.blocks, notionapi.QuoteBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeQuote,
+			},
+			Quote: notionapi.Quote{RichText: bc.inline(node, "\n", false)},
+		})
+	case "ul", "ol":
+		if bc.skipLists {
+			break
+		}
+		bc.paragraph()
+		bc.list(node)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		bc.paragraph()
+		bc.heading(node)
+	case "span":
+		if !hasClass(node, "invisible") {
+			bc.walkChildren(node)
+		}
+	case "a":
+		href := bc.href
+		bc.href = htmlAttr(node, "href")
+		bc.walkChildren(node)
+		bc.href = href
+	case "img":
+		// remote servers sometimes send custom emoji as images
+		alt := htmlAttr(node, "alt")
+		if alt == "" {
+			alt = htmlAttr(node, "title")
+		}
+		if alt != "" {
+			bc.appendText(alt, htmlAttr(node, "src"))
+		}
+	default:
+		bc.walkChildren(node)
+	}
+	bc.annotations = saved
+}
+
+// inline collects the rich text below node, separating the paragraphs in it
+// with sep. Nested blocks are flattened since notion only takes two levels of
+// children per request and replies already use them.
+func (bc *blockConverter) inline(node *html.Node, sep string, skipLists bool) []notionapi.RichText {
+	inner := &blockConverter{emojis: bc.emojis, annotations: bc.annotations, href: bc.href, skipLists: skipLists}
+	inner.walkChildren(node)
+	inner.paragraph()
+	var rich []notionapi.RichText
+	for i, block := range inner.blocks {
+		if i > 0 {
+			rich = appendRichText(rich, notionapi.RichText{
+				Type:      notionapi.ObjectTypeText,
+				Text:      &notionapi.Text{Content: sep},
+				PlainText: sep,
+			})
+		}
+		for _, rt := range blockRichText(block) {
+			rich = appendRichText(rich, rt)
+		}
+	}
+	return rich
+}
+
+func (bc *blockConverter) list(node *html.Node) {
+	for li := node.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.Data != "li" {
+			continue
+		}
+		item := notionapi.ListItem{RichText: bc.inline(li, "\n", true)}
+		if node.Data == "ol" {
+			bc.blocks = append(bc.blocks, notionapi.NumberedListItemBlock{
+				BasicBlock: notionapi.BasicBlock{
+					Object: notionapi.ObjectTypeBlock,
+					Type:   notionapi.BlockTypeNumberedListItem,
+				},
+				NumberedListItem: item,
+			})
+		} else {
+			bc.blocks = append(bc.blocks, notionapi.BulletedListItemBlock{
+				BasicBlock: notionapi.BasicBlock{
+					Object: notionapi.ObjectTypeBlock,
+					Type:   notionapi.BlockTypeBulletedListItem,
+				},
+				BulletedListItem: item,
+			})
+		}
+		// nested lists follow their item at the same level
+		for child := li.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.ElementNode && (child.Data == "ul" || child.Data == "ol") {
+				bc.list(child)
+			}
+		}
+	}
+}
+
+func (bc *blockConverter) heading(node *html.Node) {
+	heading := notionapi.Heading{RichText: bc.inline(node, "\n", false)}
+	switch node.Data {
+	case "h1":
+		bc.blocks = append(bc.blocks, notionapi.Heading1Block{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeHeading1,
+			},
+			Heading1: heading,
+		})
+	case "h2":
+		bc.blocks = append(bc.blocks, notionapi.Heading2Block{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeHeading2,
+			},
+			Heading2: heading,
+		})
+	default:
+		bc.blocks = append(bc.blocks, notionapi.Heading3Block{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeHeading3,
+			},
+			Heading3: heading,
+		})
+	}
+}
+
+// text appends a text node, linking custom emoji shortcodes to their image.
+func (bc *blockConverter) text(content string) {
+	last := 0
+	for _, loc := range emojiShortcode.FindAllStringIndex(content, -1) {
+		url, ok := bc.emojis[content[loc[0]:loc[1]]]
+		if !ok {
+			continue
+		}
+		bc.appendText(content[last:loc[0]], bc.href)
+		bc.appendText(content[loc[0]:loc[1]], url)
+		last = loc[1]
+	}
+	bc.appendText(content[last:], bc.href)
+}
+
+func (bc *blockConverter) appendText(content string, href string) {
+	var annotations *notionapi.Annotations
+	if bc.annotations != (notionapi.Annotations{}) {
+		a := bc.annotations
+		annotations = &a
+	}
+	for _, rt := range splitRichText(content, annotations, href) {
+		bc.rich = appendRichText(bc.rich, rt)
+	}
+}
+
+// paragraph flushes the collected rich text into a paragraph block.
+func (bc *blockConverter) paragraph() {
+	rich := bc.rich
+	bc.rich = nil
+	empty := true
+	for _, rt := range rich {
+		if strings.TrimSpace(rt.PlainText) != "" {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return
+	}
+	bc.blocks = append(bc.blocks, notionapi.ParagraphBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeParagraph,
+		},
+		Paragraph: notionapi.Paragraph{RichText: rich},
+	})
+}
+
+// splitRichText makes rich text objects for content within notion's length
+// limit.
+func splitRichText(content string, annotations *notionapi.Annotations, href string) []notionapi.RichText {
+	var result []notionapi.RichText
+	for content != "" {
+		n := len(content)
+		if utf8.RuneCountInString(content) > kNotionMaxTextLength {
+			n = 0
+			for i := 0; i < kNotionMaxTextLength; i++ {
+				_, size := utf8.DecodeRuneInString(content[n:])
+				n += size
+			}
+		}
+		rt := notionapi.RichText{
+			Type:        notionapi.ObjectTypeText,
+			Text:        &notionapi.Text{Content: content[:n]},
+			PlainText:   content[:n],
+			Annotations: annotations,
+		}
+		if href != "" {
+			rt.Text.Link = &notionapi.Link{Url: href}
+		}
+		result = append(result, rt)
+		content = content[n:]
+	}
+	return result
+}
+
+// appendRichText merges rt into the last rich text object when they look the
+// same, which keeps pages well below notion's limit of 100 objects per block.
+func appendRichText(rich []notionapi.RichText, rt notionapi.RichText) []notionapi.RichText {
+	if len(rich) == 0 {
+		return append(rich, rt)
+	}
+	last := &rich[len(rich)-1]
+	if sameLink(last.Text.Link, rt.Text.Link) && sameAnnotations(last.Annotations, rt.Annotations) &&
+		utf8.RuneCountInString(last.Text.Content)+utf8.RuneCountInString(rt.Text.Content) <= kNotionMaxTextLength {
+		text := *last.Text
+		text.Content += rt.Text.Content
+		last.Text = &text
+		last.PlainText = text.Content
+		return rich
+	}
+	return append(rich, rt)
+}
+
+func sameLink(a, b *notionapi.Link) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Url == b.Url
+}
+
+func sameAnnotations(a, b *notionapi.Annotations) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// blockRichText is the text of one of the blocks blockConverter creates.
+func blockRichText(block notionapi.Block) []notionapi.RichText {
+	switch b := block.(type) {
+	case notionapi.ParagraphBlock:
+		return b.Paragraph.RichText
+	case notionapi.QuoteBlock:
+		return b.Quote.RichText
+	case notionapi.CodeBlock:
+		return b.Code.RichText
+	case notionapi.BulletedListItemBlock:
+		return b.BulletedListItem.RichText
+	case notionapi.NumberedListItemBlock:
+		return b.NumberedListItem.RichText
+	case notionapi.Heading1Block:
+		return b.Heading1.RichText
+	case notionapi.Heading2Block:
+		return b.Heading2.RichText
+	case notionapi.Heading3Block:
+		return b.Heading3.RichText
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jomei/notionapi"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestConvertHtml2Blocks_Golden converts statuses as the Mastodon API returns
+// them and compares the blocks with testdata/notion/*.golden.
+func TestConvertHtml2Blocks_Golden(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "notion", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no test statuses found")
+	}
+	for _, p := range paths {
+		name := strings.TrimSuffix(filepath.Base(p), ".json")
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var status mdon.Status
+			if err := json.Unmarshal(b, &status); err != nil {
+				t.Fatal(err)
+			}
+			saved := savedFromMastodon(&status)
+
+			got, err := json.MarshalIndent(ConvertHtml2Blocks(saved.Content, saved.Emojis), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(p, ".json") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("blocks differ from %s:\n%s", goldenPath, got)
+			}
+		})
+	}
+}
+
+func TestConvertHtml2Blocks_Annotations(t *testing.T) {
+	blocks := ConvertHtml2Blocks("<p>a <strong>b <em>c</em></strong> d</p>", nil)
+	if len(blocks) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(blocks))
+	}
+	rich := blocks[0].(notionapi.ParagraphBlock).Paragraph.RichText
+	want := []struct {
+		text   string
+		bold   bool
+		italic bool
+	}{
+		{"a ", false, false},
+		{"b ", true, false},
+		{"c", true, true},
+		{" d", false, false},
+	}
+	if len(rich) != len(want) {
+		t.Fatalf("got %d rich texts, want %d", len(rich), len(want))
+	}
+	for i, w := range want {
+		rt := rich[i]
+		var bold, italic bool
+		if rt.Annotations != nil {
+			bold, italic = rt.Annotations.Bold, rt.Annotations.Italic
+		}
+		if rt.PlainText != w.text || bold != w.bold || italic != w.italic {
+			t.Errorf("rich text %d = %q bold=%v italic=%v, want %q bold=%v italic=%v",
+				i, rt.PlainText, bold, italic, w.text, w.bold, w.italic)
+		}
+	}
+}
+
+func TestConvertHtml2Blocks_LongText(t *testing.T) {
+	long := strings.Repeat("ä", kNotionMaxTextLength+10)
+	blocks := ConvertHtml2Blocks("<p>"+long+"</p>", nil)
+	rich := blocks[0].(notionapi.ParagraphBlock).Paragraph.RichText
+	if len(rich) != 2 {
+		t.Fatalf("got %d rich texts, want 2", len(rich))
+	}
+	if got := len([]rune(rich[0].PlainText)); got != kNotionMaxTextLength {
+		t.Errorf("first rich text has %d characters, want %d", got, kNotionMaxTextLength)
+	}
+}
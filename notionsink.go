@@ -0,0 +1,849 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jomei/notionapi"
+)
+
+// NotionSink saves threads as notion pages, with media kept in a media store
+// or uploaded to notion.
+type NotionSink struct {
+	notionClient   *notionapi.Client
+	notionParentID string
+	// saves into this database instead of under notionParentID
+	notionDatabaseID string
+	debug            bool
+	// nil to upload media to notion
+	mediaStore MediaStore
+	// downloads media and uploads it to notion, http.DefaultClient when nil
+	httpClient *http.Client
+	// remembers media uploaded to notion, so it isn't uploaded again
+	uploads *DAO
+	// fails saves with media that couldn't be kept
+	strictMedia bool
+	// what became of the media of the last write
+	report *MediaReport
+	// saves the web pages posts link to as child pages, nil to leave them
+	links *LinkArchiver
+	// logs what would be saved instead of saving it
+	dryrun bool
+}
+
+func (ns *NotionSink) Destination() (string, error) {
+	return kNotionDestination, nil
+}
+
+func (ns *NotionSink) Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error) {
+	ns.report = &MediaReport{}
+	if ns.dryrun {
+		log.Printf("[dryrun] would save %q to notion", title)
+		return target, nil
+	}
+	pageID, err := ns.SaveToNotion(ctx, thread, title, target)
+	if err != nil || ns.links == nil {
+		return pageID, err
+	}
+	return pageID, ns.archiveLinks(ctx, thread, pageID)
+}
+
+func (ns *NotionSink) MediaReport() *MediaReport {
+	return ns.report
+}
+
+// Exists reports whether the page is still there and not archived.
+func (ns *NotionSink) Exists(ctx context.Context, target string) (bool, error) {
+	page, err := ns.notionClient.Page.Get(ctx, notionapi.PageID(target))
+	var notionErr *notionapi.Error
+	if errors.As(err, &notionErr) && notionErr.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !page.Archived, nil
+}
+
+func (ns *NotionSink) Blocks(thread []*SavedStatus) notionapi.Blocks {
+	var blocks notionapi.Blocks
+	blocks = append(blocks, notionapi.Heading3Block{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeHeading3,
+		},
+		Heading3: notionapi.Heading{
+			RichText: []notionapi.RichText{
+				{
+					Type: notionapi.ObjectTypeText,
+					Text: &notionapi.Text{
+						Content: thread[0].URL,
+						Link: &notionapi.Link{
+							Url: thread[0].URL,
+						},
+					},
+				},
+			},
+			Color: "blue",
+		},
+	})
+	divider := notionapi.DividerBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeDivider,
+		},
+		Divider: notionapi.Divider{},
+	}
+
+	byID := make(map[string]*SavedStatus)
+	// the innermost reply toggle at each depth
+	var toggles []*notionapi.ToggleBlock
+	for i, status := range thread {
+		byID[status.ID] = status
+		if status.Depth == 0 {
+			if i > 0 {
+				blocks = append(blocks, divider)
+			}
+			blocks = append(blocks, ns.statusBlocks(status, 0)...)
+			toggles = nil
+			continue
+		}
+
+		// replies nest as toggles, deeper replies than notion can nest are
+		// named after the post they answer
+		depth := min(status.Depth, kMaxNotionNesting, len(toggles)+1)
+		title := "@" + status.Account.Acct
+		if parent, ok := byID[status.InReplyToID]; ok && depth < status.Depth {
+			title += " replying to @" + parent.Account.Acct
+		}
+		// the toggle already hides the reply behind its content warning
+		if status.SpoilerText != "" {
+			title += " · CW: " + status.SpoilerText
+		}
+		toggle := &notionapi.ToggleBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeToggle,
+			},
+			Toggle: notionapi.Toggle{
+				RichText: []notionapi.RichText{
+					{
+						Type:        notionapi.ObjectTypeText,
+						Text:        &notionapi.Text{Content: title},
+						Annotations: &notionapi.Annotations{Bold: true},
+					},
+				},
+				Children: ns.statusBlocks(status, depth),
+			},
+		}
+		if depth == 1 {
+			blocks = append(blocks, toggle)
+		} else {
+			outer := toggles[depth-2]
+			outer.Toggle.Children = append(outer.Toggle.Children, toggle)
+		}
+		toggles = append(toggles[:depth-1], toggle)
+	}
+	if len(thread) > 0 {
+		blocks = append(blocks, divider)
+	}
+	return blocks
+}
+
+// the deepest reply toggle created; notion takes two levels of nested
+// children per request, which a toggle inside a toggle uses up
+const kMaxNotionNesting = 2
+
+// statusBlocks renders one status' text, poll, media, link card, quoted post
+// and earlier versions, as the children of a reply toggle at depth or on the
+// page for depth 0. Content warnings and sensitive media fold into toggles
+// where notion can nest them.
+func (ns *NotionSink) statusBlocks(status *SavedStatus, depth int) notionapi.Blocks {
+	if status.SpoilerText != "" && depth == 0 {
+		// the toggle hides the media too
+		hidden := *status
+		hidden.SpoilerText = ""
+		hidden.Sensitive = false
+		return notionapi.Blocks{toggleBlock("CW: "+status.SpoilerText, ns.statusBlocks(&hidden, 1))}
+	}
+	nestable := depth < kMaxNotionNesting
+
+	blocks := ConvertHtml2Blocks(status.Content, status.Emojis)
+	if status.Poll != nil {
+		blocks = append(blocks, pollBlocks(status.Poll, nestable)...)
+	}
+	attachments := ns.attachmentBlocks(status)
+	if status.Sensitive && status.SpoilerText == "" && len(status.MediaAttachments) > 0 && nestable {
+		attachments = notionapi.Blocks{toggleBlock("Sensitive media", attachments)}
+	}
+	blocks = append(blocks, attachments...)
+	if status.Quote != nil {
+		blocks = append(blocks, ns.quoteBlocks(status.Quote)...)
+	}
+	if !status.EditedAt.IsZero() {
+		blocks = append(blocks, editsBlocks(status, nestable)...)
+	}
+	return blocks
+}
+
+// toggleBlock folds children under a bold title.
+func toggleBlock(title string, children notionapi.Blocks) notionapi.ToggleBlock {
+	return notionapi.ToggleBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeToggle,
+		},
+		Toggle: notionapi.Toggle{
+			RichText: []notionapi.RichText{
+				{
+					Type:        notionapi.ObjectTypeText,
+					Text:        &notionapi.Text{Content: title},
+					Annotations: &notionapi.Annotations{Bold: true},
+				},
+			},
+			Children: children,
+		},
+	}
+}
+
+// captionBlock is a paragraph of text in gray italics.
+func captionBlock(text string) notionapi.ParagraphBlock {
+	return notionapi.ParagraphBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeParagraph,
+		},
+		Paragraph: notionapi.Paragraph{
+			RichText: splitRichText(text, &notionapi.Annotations{Italic: true, Color: notionapi.ColorGray}, ""),
+		},
+	}
+}
+
+// pollBlocks renders the options of a poll with their votes, as a table or,
+// where a table's rows would be nested deeper than notion takes, as a list.
+func pollBlocks(poll *SavedPoll, table bool) notionapi.Blocks {
+	var blocks notionapi.Blocks
+	if table {
+		cell := func(text string) []notionapi.RichText { return splitRichText(text, nil, "") }
+		rows := notionapi.Blocks{
+			notionapi.TableRowBlock{
+				BasicBlock: notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: notionapi.BlockTypeTableRowBlock},
+				TableRow:   notionapi.TableRow{Cells: [][]notionapi.RichText{cell("Option"), cell("Votes")}},
+			},
+		}
+		for _, option := range poll.Options {
+			rows = append(rows, notionapi.TableRowBlock{
+				BasicBlock: notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: notionapi.BlockTypeTableRowBlock},
+				TableRow:   notionapi.TableRow{Cells: [][]notionapi.RichText{cell(option.Title), cell(poll.Result(option))}},
+			})
+		}
+		blocks = append(blocks, notionapi.TableBlock{
+			BasicBlock: notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: notionapi.BlockTypeTableBlock},
+			Table:      notionapi.Table{TableWidth: 2, HasColumnHeader: true, Children: rows},
+		})
+	} else {
+		for _, option := range poll.Options {
+			blocks = append(blocks, notionapi.BulletedListItemBlock{
+				BasicBlock: notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: notionapi.BlockTypeBulletedListItem},
+				BulletedListItem: notionapi.ListItem{
+					RichText: splitRichText(option.Title+" — "+poll.Result(option), nil, ""),
+				},
+			})
+		}
+	}
+	return append(blocks, captionBlock(poll.Summary()))
+}
+
+// editsBlocks notes when a status was edited, with its earlier versions
+// folded into a toggle when they are known and notion can nest them.
+func editsBlocks(status *SavedStatus, nestable bool) notionapi.Blocks {
+	note := captionBlock(editedNote(status))
+	if len(status.Edits) == 0 || !nestable {
+		return notionapi.Blocks{note}
+	}
+	var versions notionapi.Blocks
+	for _, edit := range status.Edits {
+		versions = append(versions, captionBlock(edit.CreatedAt.Local().Format(time.DateTime)))
+		if edit.SpoilerText != "" {
+			versions = append(versions, captionBlock("CW: "+edit.SpoilerText))
+		}
+		versions = append(versions, ConvertHtml2Blocks(edit.Content, status.Emojis)...)
+	}
+	return notionapi.Blocks{toggleBlock(editedNote(status), versions)}
+}
+
+// attachmentBlocks renders the media and link card of a status.
+func (ns *NotionSink) attachmentBlocks(status *SavedStatus) notionapi.Blocks {
+	var blocks notionapi.Blocks
+	for _, ma := range status.MediaAttachments {
+		if isStreamingPlaylist(ma.RemoteURL) {
+			blocks = append(blocks, mediaLinkBlock(ma))
+			continue
+		}
+		blocks = append(blocks, ns.mediaBlock(ma))
+	}
+	if status.Card != nil {
+		bookmark := notionapi.BookmarkBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeBookmark,
+			},
+			Bookmark: notionapi.Bookmark{URL: status.Card.URL},
+		}
+		if status.Card.Title != "" {
+			bookmark.Bookmark.Caption = splitRichText(status.Card.Title, nil, "")
+		}
+		blocks = append(blocks, bookmark)
+	}
+	return blocks
+}
+
+// quoteBlocks renders a quoted post as a quote block followed by its media.
+// The quote's text is flattened into the quote block, since a quote inside a
+// reply toggle can't have children of its own.
+func (ns *NotionSink) quoteBlocks(quote *SavedStatus) notionapi.Blocks {
+	rich := []notionapi.RichText{
+		{
+			Type:        notionapi.ObjectTypeText,
+			Text:        &notionapi.Text{Content: "@" + quote.Account.Acct, Link: &notionapi.Link{Url: quote.URL}},
+			PlainText:   "@" + quote.Account.Acct,
+			Annotations: &notionapi.Annotations{Bold: true},
+		},
+	}
+	for _, block := range ConvertHtml2Blocks(quote.Content, quote.Emojis) {
+		rich = appendRichText(rich, notionapi.RichText{
+			Type:      notionapi.ObjectTypeText,
+			Text:      &notionapi.Text{Content: "\n"},
+			PlainText: "\n",
+		})
+		for _, rt := range blockRichText(block) {
+			rich = appendRichText(rich, rt)
+		}
+	}
+	blocks := notionapi.Blocks{
+		notionapi.QuoteBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeQuote,
+			},
+			Quote: notionapi.Quote{RichText: rich},
+		},
+	}
+	return append(blocks, ns.attachmentBlocks(quote)...)
+}
+
+// mediaLinkBlock links to media notion can't show, with its preview image
+// when there is one.
+func mediaLinkBlock(ma SavedMedia) notionapi.Block {
+	label := ma.AltText
+	if label == "" {
+		label = ma.Type
+	}
+	caption := splitRichText("▶ "+label, nil, ma.RemoteURL)
+	if ma.PreviewURL == "" {
+		return notionapi.ParagraphBlock{
+			BasicBlock: notionapi.BasicBlock{
+				Object: notionapi.ObjectTypeBlock,
+				Type:   notionapi.BlockTypeParagraph,
+			},
+			Paragraph: notionapi.Paragraph{RichText: caption},
+		}
+	}
+	return notionapi.ImageBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeImage,
+		},
+		Image: notionapi.Image{
+			Caption:  caption,
+			Type:     notionapi.FileTypeExternal,
+			External: &notionapi.FileObject{URL: ma.PreviewURL},
+		},
+	}
+}
+
+// mediaBlock stores an attachment in the media store or notion and shows it in
+// the block for its kind.
+func (ns *NotionSink) mediaBlock(ma SavedMedia) notionapi.Block {
+	var caption []notionapi.RichText
+	if ma.AltText != "" {
+		caption = splitRichText(ma.AltText, nil, "")
+	}
+	// attachments from the own instance have no remote URL
+	remoteURL := ma.RemoteURL
+	if remoteURL == "" {
+		remoteURL = ma.URL
+	}
+	storedURL, fileID, err := ns.keepMedia(context.Background(), remoteURL)
+	if err != nil {
+		log.Printf("failed to keep media, linking %s instead: %v", remoteURL, err)
+		ns.report.failed(remoteURL, err)
+		return externalMediaBlock(ma.Type, caption, remoteURL)
+	}
+	ns.report.kept()
+	if ns.debug {
+		log.Println("kept", remoteURL)
+	}
+	return keptMediaBlock(ma.Type, caption, storedURL, fileID)
+}
+
+// keepMedia keeps the media at remoteURL in the media store, returning its URL
+// there, or uploads it to notion, returning the ID of the upload.
+func (ns *NotionSink) keepMedia(ctx context.Context, remoteURL string) (string, string, error) {
+	if ns.mediaStore != nil {
+		storedURL, err := storeMedia(ctx, ns.mediaStore, remoteURL)
+		return storedURL, "", err
+	}
+	fileID, err := ns.UploadToNotion(ctx, remoteURL)
+	return "", fileID, err
+}
+
+// keptMediaBlock shows media uploaded to notion as fileID, or kept in the
+// media store at storedURL.
+func keptMediaBlock(mediaType string, caption []notionapi.RichText, storedURL string, fileID string) notionapi.Block {
+	if fileID != "" {
+		return internalMediaBlock(mediaType, InternalMedia{
+			Caption:    caption,
+			Type:       "file_upload",
+			FileUpload: &InternalFileUpload{ID: fileID},
+		})
+	}
+	return externalMediaBlock(mediaType, caption, storedURL)
+}
+
+// notionapi has the audio block but no constant for its type
+const kBlockTypeAudio notionapi.BlockType = "audio"
+
+func internalMediaBlock(mediaType string, media InternalMedia) notionapi.Block {
+	kind := notionMediaKind(mediaType)
+	basic := notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: kind}
+	switch kind {
+	case notionapi.BlockTypeImage:
+		return InternalImageBlock{BasicBlock: basic, Image: media}
+	case notionapi.BlockTypeVideo:
+		return InternalVideoBlock{BasicBlock: basic, Video: media}
+	case kBlockTypeAudio:
+		return InternalAudioBlock{BasicBlock: basic, Audio: media}
+	}
+	return InternalFileBlock{BasicBlock: basic, File: media}
+}
+
+func externalMediaBlock(mediaType string, caption []notionapi.RichText, url string) notionapi.Block {
+	kind := notionMediaKind(mediaType)
+	basic := notionapi.BasicBlock{Object: notionapi.ObjectTypeBlock, Type: kind}
+	external := &notionapi.FileObject{URL: url}
+	switch kind {
+	case notionapi.BlockTypeImage:
+		return notionapi.ImageBlock{BasicBlock: basic, Image: notionapi.Image{
+			Caption: caption, Type: notionapi.FileTypeExternal, External: external}}
+	case notionapi.BlockTypeVideo:
+		return notionapi.VideoBlock{BasicBlock: basic, Video: notionapi.Video{
+			Caption: caption, Type: notionapi.FileTypeExternal, External: external}}
+	case kBlockTypeAudio:
+		return notionapi.AudioBlock{BasicBlock: basic, Audio: notionapi.Audio{
+			Caption: caption, Type: notionapi.FileTypeExternal, External: external}}
+	}
+	return notionapi.FileBlock{BasicBlock: basic, File: notionapi.BlockFile{
+		Caption: caption, Type: notionapi.FileTypeExternal, External: external}}
+}
+
+// notion takes at most 100 children per request
+const kNotionMaxChildren = 100
+
+// kDatabaseProperties are the properties of saved posts in a notion database.
+// Missing ones are added to the database on first use.
+var kDatabaseProperties = notionapi.PropertyConfigs{
+	"Author":   notionapi.RichTextPropertyConfig{Type: notionapi.PropertyConfigTypeRichText},
+	"URL":      notionapi.URLPropertyConfig{Type: notionapi.PropertyConfigTypeURL},
+	"Platform": notionapi.SelectPropertyConfig{Type: notionapi.PropertyConfigTypeSelect, Select: notionapi.Select{Options: []notionapi.Option{}}},
+	"Date":     notionapi.DatePropertyConfig{Type: notionapi.PropertyConfigTypeDate},
+	"Tags":     notionapi.MultiSelectPropertyConfig{Type: notionapi.PropertyConfigTypeMultiSelect, MultiSelect: notionapi.Select{Options: []notionapi.Option{}}},
+	"Saved At": notionapi.DatePropertyConfig{Type: notionapi.PropertyConfigTypeDate},
+}
+
+// SaveToNotion creates one page for the thread titled title, under the parent
+// page or in the database when one is configured, or replaces the content of
+// pageID. The old content of pageID is only deleted once the new one is
+// written, so a failed update leaves the page as it was, with what was
+// appended of the new content after it.
+// Blocks beyond the first request are appended in batches. It returns the
+// page's ID.
+func (ns *NotionSink) SaveToNotion(ctx context.Context, thread []*SavedStatus, title string, pageID string) (string, error) {
+	blocks := ns.Blocks(thread)
+	if ns.strictMedia {
+		if err := ns.report.Err(); err != nil {
+			return "", err
+		}
+	}
+	pageTitle := []notionapi.RichText{
+		{
+			Type: notionapi.ObjectTypeText,
+			Text: &notionapi.Text{Content: title},
+		},
+	}
+
+	var parent notionapi.Parent
+	var properties notionapi.Properties
+	if ns.notionDatabaseID != "" {
+		titleProperty, err := ns.prepareDatabase(ctx)
+		if err != nil {
+			return "", err
+		}
+		parent = notionapi.Parent{
+			Type:       notionapi.ParentTypeDatabaseID,
+			DatabaseID: notionapi.DatabaseID(ns.notionDatabaseID),
+		}
+		properties = databasePageProperties(thread, titleProperty, pageTitle, time.Now())
+	} else {
+		parent = notionapi.Parent{
+			Type:   notionapi.ParentTypePageID,
+			PageID: notionapi.PageID(ns.notionParentID),
+		}
+		properties = notionapi.Properties{
+			"title": notionapi.TitleProperty{Title: pageTitle},
+		}
+	}
+
+	first := 0
+	var oldBlocks []notionapi.BlockID
+	if pageID != "" {
+		var err error
+		if oldBlocks, err = ns.childBlockIDs(ctx, pageID); err != nil {
+			return "", err
+		}
+		_, err = ns.notionClient.Page.Update(ctx, notionapi.PageID(pageID), &notionapi.PageUpdateRequest{Properties: properties})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		pageCreateRequest := notionapi.PageCreateRequest{
+			Parent:     parent,
+			Properties: properties,
+			Children:   blocks[:min(len(blocks), kNotionMaxChildren)],
+		}
+		if ns.debug {
+			var buf bytes.Buffer
+			jenc := json.NewEncoder(&buf)
+			jenc.SetIndent("", "    ")
+			jenc.SetEscapeHTML(false)
+			err := jenc.Encode(pageCreateRequest)
+			if err != nil {
+				return "", err
+			}
+			fmt.Printf("page request: %s\n", buf.String())
+		}
+		page, err := ns.notionClient.Page.Create(ctx, &pageCreateRequest)
+		if err != nil {
+			return "", err
+		}
+		pageID = string(page.ID)
+		first = kNotionMaxChildren
+	}
+
+	if err := ns.appendBlocks(ctx, pageID, blocks[min(first, len(blocks)):]); err != nil {
+		return "", err
+	}
+	if err := ns.deleteBlocks(ctx, oldBlocks); err != nil {
+		return "", fmt.Errorf("failed to clear the old content of page %s: %w", pageID, err)
+	}
+	return pageID, nil
+}
+
+// appendBlocks adds blocks to the end of a page, as many at a time as notion
+// takes.
+func (ns *NotionSink) appendBlocks(ctx context.Context, pageID string, blocks notionapi.Blocks) error {
+	for i := 0; i < len(blocks); i += kNotionMaxChildren {
+		_, err := ns.notionClient.Block.AppendChildren(ctx, notionapi.BlockID(pageID),
+			&notionapi.AppendBlockChildrenRequest{Children: blocks[i:min(len(blocks), i+kNotionMaxChildren)]})
+		if err != nil {
+			return fmt.Errorf("failed to append blocks %d to %d: %w", i, min(len(blocks), i+kNotionMaxChildren), err)
+		}
+	}
+	return nil
+}
+
+// archiveLinks saves the web pages the thread links to as child pages of the
+// thread's page, and lists them under "Saved links" at its end. Pages that
+// can't be fetched are logged and left out.
+func (ns *NotionSink) archiveLinks(ctx context.Context, thread []*SavedStatus, pageID string) error {
+	var items notionapi.Blocks
+	seen := make(map[string]bool)
+	for _, status := range thread {
+		for _, link := range statusLinks(status) {
+			if seen[link] {
+				continue
+			}
+			seen[link] = true
+			article, err := ns.links.Fetch(ctx, link)
+			if err != nil {
+				log.Printf("failed to archive %s: %v", link, err)
+				continue
+			}
+			copyURL, err := ns.saveArticle(ctx, article, pageID)
+			if err != nil {
+				return fmt.Errorf("failed to save %s to notion: %w", link, err)
+			}
+			rich := splitRichText(article.Title, nil, copyURL)
+			rich = append(rich, splitRichText(" — ", nil, "")...)
+			rich = append(rich, splitRichText(link, nil, link)...)
+			items = append(items, notionapi.BulletedListItemBlock{
+				BasicBlock: notionapi.BasicBlock{
+					Object: notionapi.ObjectTypeBlock,
+					Type:   notionapi.BlockTypeBulletedListItem,
+				},
+				BulletedListItem: notionapi.ListItem{RichText: rich},
+			})
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	heading := notionapi.Heading3Block{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeHeading3,
+		},
+		Heading3: notionapi.Heading{RichText: splitRichText("Saved links", nil, "")},
+	}
+	return ns.appendBlocks(ctx, pageID, append(notionapi.Blocks{heading}, items...))
+}
+
+// saveArticle saves an article as a child page of the thread's page and
+// returns the child page's URL.
+func (ns *NotionSink) saveArticle(ctx context.Context, article *Article, pageID string) (string, error) {
+	source := splitRichText("Saved from ", nil, "")
+	source = append(source, splitRichText(article.URL, nil, article.URL)...)
+	source = append(source, splitRichText(" on "+article.FetchedAt.Format(time.DateOnly), nil, "")...)
+	blocks := notionapi.Blocks{notionapi.ParagraphBlock{
+		BasicBlock: notionapi.BasicBlock{
+			Object: notionapi.ObjectTypeBlock,
+			Type:   notionapi.BlockTypeParagraph,
+		},
+		Paragraph: notionapi.Paragraph{RichText: source},
+	}}
+	blocks = append(blocks, ConvertHtml2Blocks(article.Content, nil)...)
+
+	page, err := ns.notionClient.Page.Create(ctx, &notionapi.PageCreateRequest{
+		Parent: notionapi.Parent{
+			Type:   notionapi.ParentTypePageID,
+			PageID: notionapi.PageID(pageID),
+		},
+		Properties: notionapi.Properties{
+			"title": notionapi.TitleProperty{Title: splitRichText(article.Title, nil, "")},
+		},
+		Children: blocks[:min(len(blocks), kNotionMaxChildren)],
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := ns.appendBlocks(ctx, string(page.ID), blocks[min(len(blocks), kNotionMaxChildren):]); err != nil {
+		return "", err
+	}
+	return page.URL, nil
+}
+
+// prepareDatabase adds missing properties to the database and returns the
+// name of its title property.
+func (ns *NotionSink) prepareDatabase(ctx context.Context) (string, error) {
+	id := notionapi.DatabaseID(ns.notionDatabaseID)
+	db, err := ns.notionClient.Database.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	titleProperty := ""
+	for name, config := range db.Properties {
+		if config.GetType() == notionapi.PropertyConfigTypeTitle {
+			titleProperty = name
+		}
+	}
+	if titleProperty == "" {
+		return "", fmt.Errorf("notion database %s has no title property", ns.notionDatabaseID)
+	}
+
+	missing := notionapi.PropertyConfigs{}
+	for name, config := range kDatabaseProperties {
+		existing, ok := db.Properties[name]
+		if !ok {
+			missing[name] = config
+			continue
+		}
+		if existing.GetType() != config.GetType() {
+			return "", fmt.Errorf("property %q of notion database %s is %s, want %s",
+				name, ns.notionDatabaseID, existing.GetType(), config.GetType())
+		}
+	}
+	if len(missing) > 0 {
+		_, err = ns.notionClient.Database.Update(ctx, id, &notionapi.DatabaseUpdateRequest{Properties: missing})
+		if err != nil {
+			return "", fmt.Errorf("failed to add properties to notion database: %w", err)
+		}
+	}
+	return titleProperty, nil
+}
+
+// databasePageProperties describes the first status of a thread.
+func databasePageProperties(thread []*SavedStatus, titleProperty string, title []notionapi.RichText, savedAt time.Time) notionapi.Properties {
+	first := thread[0]
+	created := notionapi.Date(first.CreatedAt)
+	saved := notionapi.Date(savedAt)
+
+	tags := []notionapi.Option{}
+	seen := make(map[string]bool)
+	for _, tag := range first.Tags {
+		// notion doesn't allow commas in options
+		name := strings.ReplaceAll(tag.Name, ",", "")
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		tags = append(tags, notionapi.Option{Name: name})
+	}
+
+	author := "@" + first.Account.Acct
+	if first.Account.DisplayName != "" {
+		author = fmt.Sprintf("%s (@%s)", first.Account.DisplayName, first.Account.Acct)
+	}
+	return notionapi.Properties{
+		titleProperty: notionapi.TitleProperty{Title: title},
+		"Author": notionapi.RichTextProperty{
+			RichText: []notionapi.RichText{
+				{Type: notionapi.ObjectTypeText, Text: &notionapi.Text{Content: author}},
+			},
+		},
+		"URL":      notionapi.URLProperty{URL: first.URL},
+		"Platform": notionapi.SelectProperty{Select: notionapi.Option{Name: savedPlatform(first)}},
+		"Date":     notionapi.DateProperty{Date: &notionapi.DateObject{Start: &created}},
+		"Tags":     notionapi.MultiSelectProperty{MultiSelect: tags},
+		"Saved At": notionapi.DateProperty{Date: &notionapi.DateObject{Start: &saved}},
+	}
+}
+
+// childBlockIDs lists the blocks of a page.
+func (ns *NotionSink) childBlockIDs(ctx context.Context, pageID string) ([]notionapi.BlockID, error) {
+	var ids []notionapi.BlockID
+	pagination := &notionapi.Pagination{PageSize: kNotionMaxChildren}
+	for {
+		children, err := ns.notionClient.Block.GetChildren(ctx, notionapi.BlockID(pageID), pagination)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children.Results {
+			ids = append(ids, child.GetID())
+		}
+		if !children.HasMore {
+			break
+		}
+		pagination.StartCursor = notionapi.Cursor(children.NextCursor)
+	}
+	return ids, nil
+}
+
+// deleteBlocks deletes the blocks, replaced by content appended after them.
+func (ns *NotionSink) deleteBlocks(ctx context.Context, ids []notionapi.BlockID) error {
+	for _, id := range ids {
+		if _, err := ns.notionClient.Block.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair keeps the media of a saved page that is still shown from its original
+// URL, replacing each block showing it. Audio blocks are left, notionapi
+// doesn't read them. A dry run only reports the media it would keep.
+func (ns *NotionSink) Repair(ctx context.Context, pageID string, dryrun bool) (*MediaReport, error) {
+	report := &MediaReport{}
+	return report, ns.repairChildren(ctx, notionapi.BlockID(pageID), report, dryrun)
+}
+
+func (ns *NotionSink) repairChildren(ctx context.Context, parentID notionapi.BlockID, report *MediaReport, dryrun bool) error {
+	var children notionapi.Blocks
+	pagination := &notionapi.Pagination{PageSize: kNotionMaxChildren}
+	for {
+		resp, err := ns.notionClient.Block.GetChildren(ctx, parentID, pagination)
+		if err != nil {
+			return err
+		}
+		children = append(children, resp.Results...)
+		if !resp.HasMore {
+			break
+		}
+		pagination.StartCursor = notionapi.Cursor(resp.NextCursor)
+	}
+
+	for _, child := range children {
+		if child.GetHasChildren() {
+			if err := ns.repairChildren(ctx, child.GetID(), report, dryrun); err != nil {
+				return err
+			}
+		}
+		mediaType, caption, remoteURL := externalMedia(child)
+		if remoteURL == "" || (ns.mediaStore != nil && ns.mediaStore.Keeps(remoteURL)) {
+			continue
+		}
+		if dryrun {
+			report.Repairable = append(report.Repairable, remoteURL)
+			continue
+		}
+		storedURL, fileID, err := ns.keepMedia(ctx, remoteURL)
+		if err != nil {
+			report.failed(remoteURL, err)
+			continue
+		}
+		_, err = ns.notionClient.Block.AppendChildren(ctx, parentID, &notionapi.AppendBlockChildrenRequest{
+			After:    child.GetID(),
+			Children: notionapi.Blocks{keptMediaBlock(mediaType, caption, storedURL, fileID)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to replace media %s: %w", remoteURL, err)
+		}
+		if _, err := ns.notionClient.Block.Delete(ctx, child.GetID()); err != nil {
+			return fmt.Errorf("failed to replace media %s: %w", remoteURL, err)
+		}
+		report.kept()
+	}
+	return nil
+}
+
+// externalMedia returns the media type, caption and URL of a block showing
+// media from a URL, and no URL for other blocks.
+func externalMedia(block notionapi.Block) (string, []notionapi.RichText, string) {
+	switch b := block.(type) {
+	case *notionapi.ImageBlock:
+		if b.Image.External != nil {
+			return "image", b.Image.Caption, b.Image.External.URL
+		}
+	case *notionapi.VideoBlock:
+		if b.Video.External != nil {
+			return "video", b.Video.Caption, b.Video.External.URL
+		}
+	case *notionapi.FileBlock:
+		if b.File.External != nil {
+			return "unknown", b.File.Caption, b.File.External.URL
+		}
+	}
+	return "", nil, ""
+}
+
+var notionPageIDPattern = regexp.MustCompile(`([0-9a-f]{8})-?([0-9a-f]{4})-?([0-9a-f]{4})-?([0-9a-f]{4})-?([0-9a-f]{12})$`)
+
+// ParseNotionPageID returns the ID of a notion page given by its ID or URL.
+func ParseNotionPageID(page string) (string, error) {
+	if i := strings.IndexAny(page, "?#"); i >= 0 {
+		page = page[:i]
+	}
+	m := notionPageIDPattern.FindStringSubmatch(strings.ToLower(page))
+	if m == nil {
+		return "", fmt.Errorf("no notion page id in %q", page)
+	}
+	return strings.Join(m[1:], "-"), nil
+}
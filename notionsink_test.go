@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jomei/notionapi"
+)
+
+func TestParseNotionPageID(t *testing.T) {
+	tests := []struct {
+		page    string
+		want    string
+		wantErr bool
+	}{
+		{page: "0123456789abcdef0123456789abcdef", want: "01234567-89ab-cdef-0123-456789abcdef"},
+		{page: "01234567-89ab-cdef-0123-456789abcdef", want: "01234567-89ab-cdef-0123-456789abcdef"},
+		{page: "https://www.notion.so/alice/Saved-post-0123456789ABCDEF0123456789abcdef?pvs=4", want: "01234567-89ab-cdef-0123-456789abcdef"},
+		{page: "https://www.notion.so/alice/Saved-post", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseNotionPageID(tt.page)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseNotionPageID(%q) = %q, %v, want %q, error %v", tt.page, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMediaReport(t *testing.T) {
+	report := &MediaReport{}
+	if report.String() != "" || report.Err() != nil {
+		t.Errorf("Expected an empty report without media, got %q, %v", report.String(), report.Err())
+	}
+	report.kept()
+	report.failed("https://m.example/a.png", errors.New("404 Not Found"))
+	want := "media: 1 kept, 1 linked at the original URL\n  https://m.example/a.png: 404 Not Found"
+	if got := report.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if err := report.Err(); err == nil || !strings.Contains(err.Error(), "1 of 2 media") {
+		t.Errorf("Err() = %v, want the failed media named", err)
+	}
+}
+
+func TestNotionSink_StrictMedia(t *testing.T) {
+	var created bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/pages") {
+			created = true
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	thread := []*SavedStatus{savedStatus("p", "", "alice", 0)}
+	thread[0].MediaAttachments = []SavedMedia{{URL: server.URL + "/gone.png", Type: "image"}}
+	sink := &NotionSink{
+		notionClient: notionapi.NewClient("token",
+			notionapi.WithHTTPClient(&http.Client{Transport: hostTransport{server}})),
+		mediaStore:  &LocalStore{dir: t.TempDir(), baseURL: "https://media.example"},
+		strictMedia: true,
+	}
+	_, err := sink.Write(context.Background(), thread, "thread", "")
+	if err == nil || !strings.Contains(err.Error(), "gone.png") {
+		t.Errorf("Expected the save to fail naming the missing media, got %v", err)
+	}
+	if created {
+		t.Error("Expected no page created when media can't be kept")
+	}
+	if report := sink.MediaReport(); len(report.Failed) != 1 {
+		t.Errorf("Expected the failure in the report, got %+v", report)
+	}
+}
+
+func TestNotionSink_Repair(t *testing.T) {
+	var mu sync.Mutex
+	var appended []string
+	var deleted []string
+	var serverURL string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/media/"):
+			if r.URL.Path == "/media/gone.png" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png " + r.URL.Path))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/blocks/page1/children":
+			fmt.Fprintf(w, `{"object": "list", "has_more": false, "results": [
+				{"object": "block", "id": "img1", "type": "image", "image": {"type": "external",
+					"external": {"url": "%s/media/a.png"},
+					"caption": [{"type": "text", "text": {"content": "a gopher"}, "plain_text": "a gopher"}]}},
+				{"object": "block", "id": "img2", "type": "image", "image": {"type": "external",
+					"external": {"url": "https://media.example/kept.png"}}},
+				{"object": "block", "id": "toggle1", "type": "toggle", "has_children": true,
+					"toggle": {"rich_text": []}}
+			]}`, serverURL)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/blocks/toggle1/children":
+			fmt.Fprintf(w, `{"object": "list", "has_more": false, "results": [
+				{"object": "block", "id": "vid1", "type": "video", "video": {"type": "external",
+					"external": {"url": "%s/media/gone.png"}}}
+			]}`, serverURL)
+		case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/children"):
+			var body struct {
+				After    string           `json:"after"`
+				Children []map[string]any `json:"children"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			image, _ := json.Marshal(body.Children[0]["image"])
+			appended = append(appended, body.After+" "+string(image))
+			w.Write([]byte(`{"object": "list", "results": []}`))
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1/blocks/"))
+			w.Write([]byte(`{"object": "block", "id": "x", "type": "paragraph", "paragraph": {"rich_text": []}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	serverURL = server.URL
+
+	client := &http.Client{Transport: hostTransport{server}}
+	sink := &NotionSink{
+		notionClient: notionapi.NewClient("token", notionapi.WithHTTPClient(client)),
+		mediaStore:   &LocalStore{dir: t.TempDir(), baseURL: "https://media.example"},
+	}
+	report, err := sink.Repair(context.Background(), "page1", true)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	want := []string{server.URL + "/media/a.png", server.URL + "/media/gone.png"}
+	if !slices.Equal(report.Repairable, want) || len(appended)+len(deleted) != 0 {
+		t.Errorf("Expected a dry run to list %q and change nothing, got %+v, %v, %v", want, report, appended, deleted)
+	}
+	if got := report.String(); !strings.HasPrefix(got, "media: 2 to keep\n  ") {
+		t.Errorf("String() = %q, want the media to keep listed", got)
+	}
+
+	report, err = sink.Repair(context.Background(), "page1", false)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report.Kept != 1 || len(report.Failed) != 1 || report.Failed[0].URL != server.URL+"/media/gone.png" {
+		t.Errorf("Expected one image kept and the gone video reported, got %+v", report)
+	}
+	if len(appended) != 1 || !strings.HasPrefix(appended[0], "img1 ") ||
+		!strings.Contains(appended[0], `"url":"https://media.example/`) || !strings.Contains(appended[0], "a gopher") {
+		t.Errorf("Expected the image replaced after itself with the kept one and its caption, got %v", appended)
+	}
+	if len(deleted) != 1 || deleted[0] != "img1" {
+		t.Errorf("Expected only the repaired block deleted, got %v", deleted)
+	}
+}
+
+func TestNotionSink_UpdateDeletesOldContentLast(t *testing.T) {
+	for _, failAppend := range []bool{false, true} {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/v1/blocks/page1/children":
+				fmt.Fprint(w, `{"object": "list", "has_more": false, "results": [
+					{"object": "block", "id": "old1", "type": "paragraph", "paragraph": {"rich_text": []}},
+					{"object": "block", "id": "old2", "type": "paragraph", "paragraph": {"rich_text": []}}
+				]}`)
+				return
+			case r.Method == http.MethodPatch && r.URL.Path == "/v1/pages/page1":
+				fmt.Fprint(w, `{"object": "page", "id": "page1"}`)
+			case r.Method == http.MethodPatch && r.URL.Path == "/v1/blocks/page1/children":
+				if failAppend {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, `{"object": "error", "status": 500, "code": "internal_server_error", "message": "boom"}`)
+					return
+				}
+				fmt.Fprint(w, `{"object": "list", "results": []}`)
+			case r.Method == http.MethodDelete:
+				fmt.Fprint(w, `{"object": "block", "id": "x", "type": "paragraph", "paragraph": {"rich_text": []}}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requests = append(requests, r.Method+" "+r.URL.Path)
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: hostTransport{server}}
+		sink := &NotionSink{notionClient: notionapi.NewClient("token", notionapi.WithHTTPClient(client)), notionParentID: "parent"}
+		_, err := sink.SaveToNotion(context.Background(), []*SavedStatus{savedStatus("p1", "", "alice", 0)}, "Thread", "page1")
+		want := []string{"PATCH /v1/pages/page1", "PATCH /v1/blocks/page1/children", "DELETE /v1/blocks/old1", "DELETE /v1/blocks/old2"}
+		if failAppend {
+			if err == nil {
+				t.Error("Expected the failed append reported")
+			}
+			want = want[:1]
+		} else if err != nil {
+			t.Fatalf("SaveToNotion failed: %v", err)
+		}
+		if strings.Join(requests, ", ") != strings.Join(want, ", ") {
+			t.Errorf("failAppend %v: requests %q, want %q", failAppend, requests, want)
+		}
+	}
+}
+
+func TestNotionSink_DryRunSavesNothing(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: hostTransport{server}}
+	sink := &NotionSink{notionClient: notionapi.NewClient("token", notionapi.WithHTTPClient(client)), notionParentID: "parent", dryrun: true}
+	if _, err := sink.Write(context.Background(), []*SavedStatus{savedStatus("p1", "", "alice", 0)}, "Thread", ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(requests) > 0 {
+		t.Errorf("Expected a dry run to send nothing to notion, got %v", requests)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	kNotionAPI = "https://api.notion.com/v1"
+	// the API version of uploads and the notion client
+	kNotionVersion = "2022-06-28"
+	// files up to this size are sent in one request, larger ones in parts
+	kNotionSinglePartLimit = 20 << 20
+	// notion takes parts of 5 to 20 MB, only the last may be smaller
+	kNotionPartSize = 10 << 20
+)
+
+// kNotionUploadTypes are the content types notion takes uploads of, with the
+// extension it expects their file names to have.
+var kNotionUploadTypes = map[string]string{
+	"image/gif":                ".gif",
+	"image/heic":               ".heic",
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/svg+xml":            ".svg",
+	"image/tiff":               ".tiff",
+	"image/webp":               ".webp",
+	"image/vnd.microsoft.icon": ".ico",
+	"video/mp4":                ".mp4",
+	"video/webm":               ".webm",
+	"video/quicktime":          ".mov",
+	"video/mpeg":               ".mpeg",
+	"video/x-msvideo":          ".avi",
+	"video/x-flv":              ".flv",
+	"video/x-ms-wmv":           ".wmv",
+	"audio/aac":                ".aac",
+	"audio/midi":               ".midi",
+	"audio/mpeg":               ".mp3",
+	"audio/mp4":                ".m4a",
+	"audio/ogg":                ".ogg",
+	"audio/wav":                ".wav",
+	"audio/x-ms-wma":           ".wma",
+	"application/pdf":          ".pdf",
+	"text/plain":               ".txt",
+	"application/json":         ".json",
+}
+
+// notionUploadType is the content type notion files media under, from the type
+// its server sends or else the extension of its URL, and the extension that
+// goes with it.
+func notionUploadType(header string, mediaURL string) (string, string, error) {
+	contentType, _, _ := mime.ParseMediaType(header)
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(mediaURL))))
+	}
+	switch contentType {
+	case "image/jpg", "image/pjpeg", "image/jfif":
+		contentType = "image/jpeg"
+	case "audio/x-wav", "audio/wave":
+		contentType = "audio/wav"
+	case "audio/mp3":
+		contentType = "audio/mpeg"
+	}
+	ext, ok := kNotionUploadTypes[contentType]
+	if !ok {
+		return "", "", fmt.Errorf("notion doesn't take uploads of %s (type %q)", mediaURL, contentType)
+	}
+	return contentType, ext, nil
+}
+
+// notionFileUpload is notion's record of an upload.
+type notionFileUpload struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func (ns *NotionSink) client() *http.Client {
+	if ns.httpClient != nil {
+		return ns.httpClient
+	}
+	return http.DefaultClient
+}
+
+// notionRequest sends a request to notion's upload API and decodes its answer
+// into result.
+func (ns *NotionSink) notionRequest(req *http.Request, result any) error {
+	req.Header.Set("Authorization", "Bearer "+ns.notionClient.Token.String())
+	req.Header.Set("Notion-Version", kNotionVersion)
+	resp, err := ns.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (ns *NotionSink) notionJSON(ctx context.Context, method string, endpoint string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, kNotionAPI+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return ns.notionRequest(req, result)
+}
+
+// sendPart streams one part of the file to the upload. part is 0 for files
+// sent in one request.
+func (ns *NotionSink) sendPart(ctx context.Context, uploadID string, filename string, contentType string, content io.Reader, part int) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			if part > 0 {
+				if err := mw.WriteField("part_number", strconv.Itoa(part)); err != nil {
+					return err
+				}
+			}
+			header := make(map[string][]string)
+			header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename)}
+			header["Content-Type"] = []string{contentType}
+			w, err := mw.CreatePart(header)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, content); err != nil {
+				return err
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kNotionAPI+"/file_uploads/"+uploadID+"/send", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var upload notionFileUpload
+	err = ns.notionRequest(req, &upload)
+	// lets the writer finish when notion answered early
+	pr.Close()
+	return err
+}
+
+// UploadToNotion uploads the media at mediaURL to notion and returns the ID of
+// the file upload. Files larger than notion takes in one request are sent in
+// parts. Media uploaded before, by the hash of its content, isn't uploaded
+// again.
+func (ns *NotionSink) UploadToNotion(ctx context.Context, mediaURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ns.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", mediaURL, resp.Status)
+	}
+	contentType, ext, err := notionUploadType(resp.Header.Get("Content-Type"), mediaURL)
+	if err != nil {
+		return "", err
+	}
+
+	// the download is spooled to disk to hash it without holding it in memory
+	spool, err := os.CreateTemp("", "mastosync-upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", mediaURL, err)
+	}
+	contentHash := hex.EncodeToString(hash.Sum(nil))
+
+	if ns.uploads != nil {
+		uploadID, err := ns.uploads.FindNotionUpload(contentHash)
+		if err != nil {
+			return "", err
+		}
+		if uploadID != "" {
+			// uploads nothing was attached to expire, those are uploaded again
+			var upload notionFileUpload
+			err := ns.notionJSON(ctx, http.MethodGet, "/file_uploads/"+uploadID, nil, &upload)
+			if err == nil && upload.Status == "uploaded" {
+				return uploadID, nil
+			}
+		}
+	}
+
+	filename := contentHash + ext
+	parts := 1
+	create := map[string]any{
+		"filename":     filename,
+		"content_type": contentType,
+	}
+	if size > kNotionSinglePartLimit {
+		parts = int((size + kNotionPartSize - 1) / kNotionPartSize)
+		create["mode"] = "multi_part"
+		create["number_of_parts"] = parts
+	}
+	var upload notionFileUpload
+	if err := ns.notionJSON(ctx, http.MethodPost, "/file_uploads", create, &upload); err != nil {
+		return "", fmt.Errorf("failed to create file upload: %w", err)
+	}
+
+	if parts == 1 {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if err := ns.sendPart(ctx, upload.ID, filename, contentType, spool, 0); err != nil {
+			return "", fmt.Errorf("failed to upload %s: %w", filename, err)
+		}
+	} else {
+		for part := 1; part <= parts; part++ {
+			offset := int64(part-1) * kNotionPartSize
+			section := io.NewSectionReader(spool, offset, min(kNotionPartSize, size-offset))
+			if err := ns.sendPart(ctx, upload.ID, filename, contentType, section, part); err != nil {
+				return "", fmt.Errorf("failed to upload part %d of %d of %s: %w", part, parts, filename, err)
+			}
+		}
+		if err := ns.notionJSON(ctx, http.MethodPost, "/file_uploads/"+upload.ID+"/complete", nil, &upload); err != nil {
+			return "", fmt.Errorf("failed to complete upload of %s: %w", filename, err)
+		}
+	}
+
+	if ns.uploads != nil {
+		if err := ns.uploads.RecordNotionUpload(contentHash, upload.ID); err != nil {
+			return "", err
+		}
+	}
+	return upload.ID, nil
+}
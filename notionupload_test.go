@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jomei/notionapi"
+)
+
+func TestNotionUploadType(t *testing.T) {
+	tests := []struct {
+		header   string
+		mediaURL string
+		want     string
+		wantExt  string
+		wantErr  bool
+	}{
+		{header: "image/png", mediaURL: "https://m.example/a", want: "image/png", wantExt: ".png"},
+		{header: "image/jpeg; charset=binary", mediaURL: "https://m.example/a.jfif", want: "image/jpeg", wantExt: ".jpg"},
+		{header: "application/octet-stream", mediaURL: "https://m.example/a.MP4", want: "video/mp4", wantExt: ".mp4"},
+		{header: "", mediaURL: "https://m.example/a.mp3", want: "audio/mpeg", wantExt: ".mp3"},
+		{header: "text/html", mediaURL: "https://m.example/a.png", wantErr: true},
+		{header: "", mediaURL: "https://m.example/a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, ext, err := notionUploadType(tt.header, tt.mediaURL)
+		if (err != nil) != tt.wantErr || got != tt.want || ext != tt.wantExt {
+			t.Errorf("notionUploadType(%q, %q) = %q, %q, %v, want %q, %q, error %v",
+				tt.header, tt.mediaURL, got, ext, err, tt.want, tt.wantExt, tt.wantErr)
+		}
+	}
+}
+
+// uploadServer stands in for notion's file uploads and the servers media is
+// downloaded from.
+type uploadServer struct {
+	mu      sync.Mutex
+	media   map[string][]byte
+	creates []map[string]any
+	// the parts received of each upload, by part number
+	parts     map[string]map[string][]byte
+	completed map[string]bool
+	versions  map[string]bool
+}
+
+func (us *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/media/") {
+		content, ok := us.media[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if ext := path.Ext(r.URL.Path); ext != "" {
+			w.Header().Set("Content-Type", mime.TypeByExtension(ext))
+		}
+		w.Write(content)
+		return
+	}
+
+	us.versions[r.Header.Get("Notion-Version")] = true
+	w.Header().Set("Content-Type", "application/json")
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/file_uploads/"), "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/file_uploads":
+		var create map[string]any
+		json.NewDecoder(r.Body).Decode(&create)
+		us.creates = append(us.creates, create)
+		id := fmt.Sprintf("upload%d", len(us.creates))
+		us.parts[id] = make(map[string][]byte)
+		fmt.Fprintf(w, `{"id": %q, "status": "pending"}`, id)
+	case r.Method == http.MethodPost && action == "send":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		us.parts[id][r.FormValue("part_number")] = content
+		fmt.Fprintf(w, `{"id": %q, "status": "pending"}`, id)
+	case r.Method == http.MethodPost && action == "complete":
+		us.completed[id] = true
+		fmt.Fprintf(w, `{"id": %q, "status": "uploaded"}`, id)
+	case r.Method == http.MethodGet && action == "":
+		fmt.Fprintf(w, `{"id": %q, "status": "uploaded"}`, id)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestNotionSink_UploadToNotion(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), (kNotionSinglePartLimit+kNotionPartSize+1)/16)
+	us := &uploadServer{
+		media: map[string][]byte{
+			"/media/a.png":    []byte("png"),
+			"/media/copy.png": []byte("png"),
+			"/media/big.mp4":  big,
+			"/media/page":     []byte("<html>"),
+		},
+		parts:     make(map[string]map[string][]byte),
+		completed: make(map[string]bool),
+		versions:  make(map[string]bool),
+	}
+	server := httptest.NewServer(us)
+	defer server.Close()
+
+	index, err := OpenSavedIndex(filepath.Join(t.TempDir(), "saved.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.db.Close()
+	ns := &NotionSink{
+		notionClient: notionapi.NewClient("token"),
+		httpClient:   &http.Client{Transport: hostTransport{server}},
+		uploads:      index,
+	}
+	ctx := context.Background()
+
+	id, err := ns.UploadToNotion(ctx, "https://mastodon.example/media/a.png")
+	if err != nil {
+		t.Fatalf("UploadToNotion failed: %v", err)
+	}
+	if got := string(us.parts[id][""]); got != "png" {
+		t.Errorf("Expected the image sent in one request, got %q", got)
+	}
+	if _, ok := us.creates[0]["mode"]; ok {
+		t.Errorf("Expected a single part upload, got %v", us.creates[0])
+	}
+
+	again, err := ns.UploadToNotion(ctx, "https://mastodon.example/media/copy.png")
+	if err != nil {
+		t.Fatalf("UploadToNotion failed: %v", err)
+	}
+	if again != id || len(us.creates) != 1 {
+		t.Errorf("Expected the same image to reuse upload %s, got %s after %d uploads", id, again, len(us.creates))
+	}
+
+	id, err = ns.UploadToNotion(ctx, "https://mastodon.example/media/big.mp4")
+	if err != nil {
+		t.Fatalf("UploadToNotion failed: %v", err)
+	}
+	create := us.creates[len(us.creates)-1]
+	if create["mode"] != "multi_part" || create["number_of_parts"] != float64(3) || create["content_type"] != "video/mp4" {
+		t.Errorf("Expected a multi part upload of 3 parts, got %v", create)
+	}
+	var sent []byte
+	for _, part := range []string{"1", "2", "3"} {
+		sent = append(sent, us.parts[id][part]...)
+	}
+	if !bytes.Equal(sent, big) || !us.completed[id] {
+		t.Errorf("Expected the video sent in 3 parts and completed, got %d bytes, completed %v", len(sent), us.completed[id])
+	}
+
+	if _, err := ns.UploadToNotion(ctx, "https://mastodon.example/media/gone.png"); err == nil {
+		t.Error("Expected an error when the media is gone")
+	}
+	if _, err := ns.UploadToNotion(ctx, "https://mastodon.example/media/page"); err == nil {
+		t.Error("Expected an error for a type notion doesn't take")
+	}
+	if len(us.versions) != 1 || !us.versions[kNotionVersion] {
+		t.Errorf("Expected every request made with version %s, got %v", kNotionVersion, us.versions)
+	}
+}
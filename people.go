@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// personFrontmatter is the frontmatter of a person's note, with the threads
+// saved from them that the note lists.
+type personFrontmatter struct {
+	Name     string `yaml:"name"`
+	Acct     string `yaml:"acct"`
+	Platform string `yaml:"platform"`
+	URL      string `yaml:"url,omitempty"`
+	// the avatar's file name in the media folder
+	Avatar  string         `yaml:"avatar,omitempty"`
+	Threads []personThread `yaml:"threads"`
+}
+
+// personThread is a thread listed in a person's note.
+type personThread struct {
+	Title string    `yaml:"title"`
+	Date  time.Time `yaml:"date"`
+	// the thread's note relative to the people folder
+	Path string `yaml:"path"`
+}
+
+// person is the author of a post in a thread with their note.
+type person struct {
+	status *SavedStatus
+	// the account with its server, also for local Mastodon accounts
+	acct string
+	path string
+}
+
+// threadPeople are the authors of the thread's posts, quoted posts left out,
+// in the order they first posted.
+func (ms *MarkdownSink) threadPeople(thread []*SavedStatus) []person {
+	seen := make(map[string]bool)
+	var people []person
+	for _, status := range thread {
+		acct := status.Account.Acct
+		if u, err := url.Parse(status.Account.URL); err == nil && u.Host != "" && !strings.Contains(acct, "@") && savedPlatform(status) == "mastodon" {
+			acct += "@" + u.Host
+		}
+		if seen[acct] {
+			continue
+		}
+		seen[acct] = true
+		people = append(people, person{
+			status: status,
+			acct:   acct,
+			path:   filepath.Join(ms.outputPath, ms.people, safeFileName(acct)+".md"),
+		})
+	}
+	return people
+}
+
+// personLink links the note at from to the person's note.
+func (ms *MarkdownSink) personLink(p person, from string) (string, error) {
+	if ms.wikilinks {
+		return fmt.Sprintf("[[%s|@%s]]", strings.TrimSuffix(filepath.Base(p.path), ".md"), kWikilinkEscaper.Replace(p.status.Account.Acct)), nil
+	}
+	rel, err := filepath.Rel(filepath.Dir(from), p.path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("[@%s](%s)", markdownEscaper.Replace(p.status.Account.Acct), markdownPath(rel)), nil
+}
+
+// markdownPath escapes a relative path for a Markdown link.
+func markdownPath(rel string) string {
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// writePeople lists the thread at mdPath in the notes of its authors,
+// creating the notes of people not seen before and refreshing their profile
+// and avatar. Notes that can't be written are logged. A dry run writes none.
+func (ms *MarkdownSink) writePeople(people []person, thread []*SavedStatus, title string, mdPath string, imagesDir string) {
+	if !ms.dryrun {
+		if err := os.MkdirAll(filepath.Join(ms.outputPath, ms.people), 0755); err != nil {
+			log.Printf("failed to create people directory: %v", err)
+			return
+		}
+	}
+	for _, p := range people {
+		if err := ms.writePerson(p, thread[0], title, mdPath, imagesDir); err != nil {
+			log.Printf("failed to write the note of %s: %v", p.acct, err)
+		}
+	}
+}
+
+func (ms *MarkdownSink) writePerson(p person, first *SavedStatus, title string, mdPath string, imagesDir string) error {
+	fm, err := readPersonFrontmatter(p.path)
+	if err != nil {
+		return err
+	}
+	account := p.status.Account
+	fm.Name = account.DisplayName
+	if fm.Name == "" {
+		fm.Name = account.Acct
+	}
+	fm.Acct = p.acct
+	fm.Platform = savedPlatform(p.status)
+	fm.URL = account.URL
+	// the avatar downloaded before stays when the new one fails
+	if account.Avatar != "" && !ms.dryrun {
+		if hashedName, err := downloadAndHash(account.Avatar, imagesDir, false); err != nil {
+			log.Printf("failed to download avatar %s: %v", account.Avatar, err)
+		} else {
+			fm.Avatar = hashedName
+		}
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(p.path), mdPath)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	listed := false
+	for i := range fm.Threads {
+		if fm.Threads[i].Path == rel {
+			fm.Threads[i].Title = title
+			fm.Threads[i].Date = first.CreatedAt
+			listed = true
+		}
+	}
+	if !listed {
+		fm.Threads = append(fm.Threads, personThread{Title: title, Date: first.CreatedAt, Path: rel})
+	}
+	sort.SliceStable(fm.Threads, func(i, j int) bool {
+		return fm.Threads[i].Date.Before(fm.Threads[j].Date)
+	})
+
+	mediaLink, err := filepath.Rel(filepath.Dir(p.path), imagesDir)
+	if err != nil {
+		return err
+	}
+	note, err := ms.personMarkdown(fm, account.Note, filepath.ToSlash(mediaLink))
+	if err != nil {
+		return err
+	}
+	if ms.dryrun {
+		log.Printf("[dryrun] would write %s", p.path)
+		return nil
+	}
+	return os.WriteFile(p.path, note, 0644)
+}
+
+// readPersonFrontmatter reads the frontmatter of the person's note at path,
+// empty when there is no note yet.
+func readPersonFrontmatter(path string) (personFrontmatter, error) {
+	var fm personFrontmatter
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fm, nil
+	} else if err != nil {
+		return fm, err
+	}
+	text, ok := strings.CutPrefix(string(data), "---\n")
+	if !ok {
+		return fm, fmt.Errorf("%s has no frontmatter", path)
+	}
+	text, _, ok = strings.Cut(text, "\n---\n")
+	if !ok {
+		return fm, fmt.Errorf("%s has no end to its frontmatter", path)
+	}
+	if err := yaml.Unmarshal([]byte(text), &fm); err != nil {
+		return fm, fmt.Errorf("failed to parse the frontmatter of %s: %w", path, err)
+	}
+	return fm, nil
+}
+
+// personMarkdown renders a person's note: avatar, name, profile, bio and the
+// threads saved from them, oldest first.
+func (ms *MarkdownSink) personMarkdown(fm personFrontmatter, bio string, mediaLink string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmBytes, err := yaml.Marshal(fm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal frontmatter: %w", err)
+	}
+	buf.WriteString("---\n")
+	buf.Write(fmBytes)
+	buf.WriteString("---\n\n")
+
+	if fm.Avatar != "" {
+		if ms.wikilinks {
+			buf.WriteString(fmt.Sprintf("![[%s/%s|avatar]]\n\n", ms.mediaFolder(), fm.Avatar))
+		} else {
+			buf.WriteString(fmt.Sprintf("![avatar](%s/%s)\n\n", mediaLink, fm.Avatar))
+		}
+	}
+	buf.WriteString(fmt.Sprintf("# %s\n\n", markdownEscaper.Replace(fm.Name)))
+	if fm.URL != "" {
+		buf.WriteString(fmt.Sprintf("[@%s](%s) on %s\n\n", markdownEscaper.Replace(fm.Acct), fm.URL, fm.Platform))
+	} else {
+		buf.WriteString(fmt.Sprintf("@%s on %s\n\n", markdownEscaper.Replace(fm.Acct), fm.Platform))
+	}
+	if bio = strings.TrimSpace(ConvertHtml2Markdown(bio)); bio != "" {
+		buf.WriteString(bio)
+		buf.WriteString("\n\n")
+	}
+
+	buf.WriteString("## Threads\n\n")
+	for _, thread := range fm.Threads {
+		date := thread.Date.Local().Format(time.DateOnly)
+		if ms.wikilinks {
+			name := strings.TrimSuffix(filepath.Base(thread.Path), ".md")
+			buf.WriteString(fmt.Sprintf("- %s [[%s|%s]]\n", date, name, kWikilinkEscaper.Replace(thread.Title)))
+		} else {
+			buf.WriteString(fmt.Sprintf("- %s [%s](%s)\n", date, markdownEscaper.Replace(thread.Title), markdownPath(thread.Path)))
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownSink_People(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+	_, avatar, err := fetchMedia(server.URL + "/alice.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		config     MarkdownConfig
+		wantThread []string
+		wantPerson []string
+	}{
+		{
+			name:   "markdown",
+			config: MarkdownConfig{Folder: "notes", Images: "markdown", People: "people"},
+			wantThread: []string{
+				"**[@alice](../people/alice_example_social.md)**",
+				"> **[@bob@other.example](../people/bob_other_example.md)**",
+				"- '[[alice_example_social]]'",
+			},
+			wantPerson: []string{
+				"![avatar](../images/" + avatar + ")",
+				"# Alice",
+				"[@alice@example.social](https://example.social/@alice) on mastodon",
+				"Bakes **bread**",
+				"- 2026-01-01 [First loaf](../notes/First_loaf.md)",
+				"- 2026-01-01 [Second loaf](../notes/Second_loaf.md)",
+			},
+		},
+		{
+			name:   "wikilinks",
+			config: MarkdownConfig{People: "people"},
+			wantThread: []string{
+				"**[[alice_example_social|@alice]]**",
+			},
+			wantPerson: []string{
+				"![[images/" + avatar + "|avatar]]",
+				"- 2026-01-01 [[First_loaf|First loaf]]",
+				"- 2026-01-01 [[Second_loaf|Second loaf]]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sink, err := newMarkdownSink(dir, tt.config, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			thread := func(id string) []*SavedStatus {
+				post := savedStatus(id, "", "alice", 0)
+				post.Account.DisplayName = "Alice"
+				post.Account.URL = "https://example.social/@alice"
+				post.Account.Avatar = server.URL + "/alice.png"
+				post.Account.Note = "<p>Bakes <b>bread</b></p>"
+				next := savedStatus(id+"2", id, "alice", 1)
+				next.Account = post.Account
+				reply := savedStatus(id+"r", id, "bob@other.example", 2)
+				reply.Account.URL = "https://other.example/@bob"
+				reply.Depth = 1
+				return []*SavedStatus{post, next, reply}
+			}
+
+			first, err := sink.Write(context.Background(), thread("p1"), "First loaf", "")
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			// saving again updates the listing rather than adding to it
+			for _, title := range []string{"Old title", "First loaf"} {
+				if _, err := sink.Write(context.Background(), thread("p1"), title, first); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			if _, err := sink.Write(context.Background(), thread("p2"), "Second loaf", ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			b, err := os.ReadFile(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantThread {
+				if !strings.Contains(string(b), want+"\n") {
+					t.Errorf("Expected thread to contain %q, got:\n%s", want, b)
+				}
+			}
+			if n := strings.Count(string(b), "alice_example_social"); n != 2 {
+				t.Errorf("Expected alice linked in the frontmatter and once in the main line, got %d in:\n%s", n, b)
+			}
+
+			b, err = os.ReadFile(filepath.Join(dir, "people", "alice_example_social.md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantPerson {
+				if !strings.Contains(string(b), want+"\n") {
+					t.Errorf("Expected person note to contain %q, got:\n%s", want, b)
+				}
+			}
+			if strings.Contains(string(b), "Old title") || strings.Count(string(b), "First loaf") != 2 {
+				t.Errorf("Expected the first thread listed once under its title, got:\n%s", b)
+			}
+
+			b, err = os.ReadFile(filepath.Join(dir, "people", "bob_other_example.md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(b), "avatar") || !strings.Contains(string(b), "Second loaf") {
+				t.Errorf("Expected bob's note without an avatar listing both threads, got:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestMarkdownSink_PeopleDryRun(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newMarkdownSink(dir, MarkdownConfig{People: "people"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := savedStatus("p1", "", "alice", 0)
+	post.Account.URL = "https://example.social/@alice"
+	if _, err := sink.Write(context.Background(), []*SavedStatus{post}, "First loaf", ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("Expected a dry run to write nothing, got %v", entries)
+	}
+}
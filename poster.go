@@ -4,11 +4,17 @@ import (
 	"bytes"
 	"context"
 	"html"
+	"log"
 	"net/url"
+	"os"
+	"strings"
 	"text/template"
 
-	skybot "github.com/danrusei/gobot-bsky"
+	"github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	skybot "github.com/danrusei/gobot-bsky"
 	mdon "github.com/mattn/go-mastodon"
 	"github.com/mmcdole/gofeed"
 )
@@ -16,15 +22,65 @@ import (
 const kMastodonMaxTootLen = 500
 const kBlueskyMaxTootLen = 300
 
+// PostOptions are the per-feed settings of how items are posted.
+type PostOptions struct {
+	// attach the item's image
+	Images bool
+	// quote the item's link when it is a post on the network we post to
+	Quote bool
+}
+
 type Poster interface {
-	Post(item *gofeed.Item, tmpl *template.Template) (string, error)
+	Post(item *gofeed.Item, tmpl *template.Template, opts PostOptions) (string, error)
+}
+
+// feedItemImage finds the picture of a feed item: its image element, an image
+// enclosure or a Media RSS image.
+func feedItemImage(item *gofeed.Item) (string, string) {
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL, item.Image.Title
+	}
+	for _, enc := range item.Enclosures {
+		if strings.HasPrefix(enc.Type, "image/") {
+			return enc.URL, ""
+		}
+	}
+	for _, ext := range item.Extensions["media"]["content"] {
+		if ext.Attrs["medium"] == "image" || strings.HasPrefix(ext.Attrs["type"], "image/") {
+			alt := ""
+			if desc := ext.Children["description"]; len(desc) > 0 {
+				alt = desc[0].Value
+			}
+			return ext.Attrs["url"], alt
+		}
+	}
+	return "", ""
+}
+
+// prepareFeedImage downloads and prepares the item's image, returning an
+// empty path when it has none or it can't be used.
+func prepareFeedImage(mp *MediaPipeline, item *gofeed.Item) (string, string) {
+	imageURL, alt := feedItemImage(item)
+	if imageURL == "" || mp == nil {
+		return "", ""
+	}
+	p, err := mp.Fetch(imageURL)
+	if err == nil {
+		p, err = mp.Prepare(p, alt)
+	}
+	if err != nil {
+		log.Printf("posting %s without its image: %v", item.Link, err)
+		return "", ""
+	}
+	return p, alt
 }
 
 type MastodonPoster struct {
 	mClient *mdon.Client
+	media   *MediaPipeline
 }
 
-func (mpr *MastodonPoster) Post(item *gofeed.Item, tmpl *template.Template) (string, error) {
+func (mpr *MastodonPoster) Post(item *gofeed.Item, tmpl *template.Template, opts PostOptions) (string, error) {
 	buf := new(bytes.Buffer)
 	err := tmpl.Execute(buf, item)
 	if err != nil {
@@ -38,7 +94,33 @@ func (mpr *MastodonPoster) Post(item *gofeed.Item, tmpl *template.Template) (str
 		Status: html.UnescapeString(tootStr),
 	}
 
-	status, err := mpr.mClient.PostStatus(context.Background(), &toot)
+	ctx := context.Background()
+	if opts.Images {
+		if p, alt := prepareFeedImage(mpr.media, item); p != "" {
+			f, err := os.Open(p)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			attachment, err := mpr.mClient.UploadMediaFromMedia(ctx, &mdon.Media{File: f, Description: alt})
+			if err != nil {
+				return "", err
+			}
+			toot.MediaIDs = []mdon.ID{attachment.ID}
+		}
+	}
+
+	var quotedID mdon.ID
+	if opts.Quote && item.Link != "" && !isBlueskyURL(item.Link) {
+		quoted, err := resolveMastodonStatus(ctx, mpr.mClient, item.Link)
+		if err != nil {
+			log.Printf("posting %s without quoting it: %v", item.Link, err)
+		} else {
+			quotedID = quoted.ID
+		}
+	}
+
+	status, err := postStatus(ctx, mpr.mClient, &toot, quotedID)
 	if err != nil {
 		return "", err
 	}
@@ -48,9 +130,12 @@ func (mpr *MastodonPoster) Post(item *gofeed.Item, tmpl *template.Template) (str
 
 type BlueskyPoster struct {
 	skyAgent *skybot.BskyAgent
+	// the agent's client is private, quotes are resolved with this one
+	skyClient *xrpc.Client
+	media     *MediaPipeline
 }
 
-func (bpr *BlueskyPoster) Post(item *gofeed.Item, tmpl *template.Template) (string, error) {
+func (bpr *BlueskyPoster) Post(item *gofeed.Item, tmpl *template.Template, opts PostOptions) (string, error) {
 	u, err := url.Parse(item.Link)
 	if err != nil {
 		return "", err
@@ -64,14 +149,45 @@ func (bpr *BlueskyPoster) Post(item *gofeed.Item, tmpl *template.Template) (stri
 	if len(tootStr) > kBlueskyMaxTootLen {
 		tootStr = tootStr[:kBlueskyMaxTootLen]
 	}
+	ctx := context.Background()
+	var quoted *atproto.RepoStrongRef
+	if opts.Quote && bpr.skyClient != nil && isBlueskyURL(item.Link) {
+		quoted, err = resolveBlueskyPost(ctx, bpr.skyClient, item.Link)
+		if err != nil {
+			log.Printf("posting %s without quoting it: %v", item.Link, err)
+		}
+	}
+
+	var thumb *lexutil.LexBlob
+	if opts.Images && quoted == nil {
+		if p, _ := prepareFeedImage(bpr.media, item); p != "" {
+			thumb, err = bpr.skyAgent.UploadImage(ctx, skybot.Image{Uri: url.URL{Scheme: "file", Path: p}})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var thumbBlob lexutil.LexBlob
+	if thumb != nil {
+		thumbBlob = *thumb
+	}
 	post, err := skybot.NewPostBuilder(html.UnescapeString(tootStr)).
-		WithExternalLink(html.UnescapeString(item.Title), *u, html.UnescapeString(item.Title), lexutil.LexBlob{}).
+		WithExternalLink(html.UnescapeString(item.Title), *u, html.UnescapeString(item.Title), thumbBlob).
 		Build()
 	if err != nil {
 		return "", err
 	}
+	// the builder always references a thumb, an empty one can't be marshalled
+	if thumb == nil && post.Embed != nil && post.Embed.EmbedExternal != nil {
+		post.Embed.EmbedExternal.External.Thumb = nil
+	}
+	if quoted != nil {
+		post.Embed = &appbsky.FeedPost_Embed{
+			EmbedRecord: &appbsky.EmbedRecord{Record: quoted},
+		}
+	}
 
-	ctx := context.Background()
 	cid, _, err := bpr.skyAgent.PostToFeed(ctx, post)
 	if err != nil {
 		return "", err
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"image"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"text/template"
 
+	"github.com/bluesky-social/indigo/xrpc"
 	skybot "github.com/danrusei/gobot-bsky"
 	mdon "github.com/mattn/go-mastodon"
 	"github.com/mmcdole/gofeed"
@@ -48,7 +51,7 @@ func TestMastodonPoster_Post(t *testing.T) {
 		Title: "Hello Mastodon",
 	}
 
-	id, err := poster.Post(item, tmpl)
+	id, err := poster.Post(item, tmpl, PostOptions{})
 	if err != nil {
 		t.Fatalf("Post failed: %v", err)
 	}
@@ -84,7 +87,7 @@ func TestMastodonPoster_Post_Truncation(t *testing.T) {
 	tmpl, _ := template.New("test").Parse("{{.Title}}")
 	item := &gofeed.Item{Title: longTitle.String()}
 
-	_, err := poster.Post(item, tmpl)
+	_, err := poster.Post(item, tmpl, PostOptions{})
 	if err != nil {
 		t.Fatalf("Post failed: %v", err)
 	}
@@ -139,7 +142,7 @@ func TestBlueskyPoster_Post(t *testing.T) {
 		Link:  "https://example.com/1",
 	}
 
-	cid, err := poster.Post(item, tmpl)
+	cid, err := poster.Post(item, tmpl, PostOptions{})
 	if err != nil {
 		t.Fatalf("Post failed: %v", err)
 	}
@@ -148,3 +151,119 @@ func TestBlueskyPoster_Post(t *testing.T) {
 		t.Error("Expected non-empty CID")
 	}
 }
+
+func TestMastodonPoster_Post_WithImage(t *testing.T) {
+	var uploaded bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cover.png":
+			w.Header().Set("Content-Type", "image/png")
+			png.Encode(w, image.NewGray(image.Rect(0, 0, 4, 4)))
+		case "/api/v2/media":
+			r.ParseMultipartForm(1 << 20)
+			if r.FormValue("description") != "the cover" {
+				t.Errorf("Expected alt text to be sent, got %q", r.FormValue("description"))
+			}
+			uploaded = true
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mdon.Attachment{ID: "media-1", URL: "https://example.com/m.png"})
+		case "/api/v1/statuses":
+			r.ParseForm()
+			if r.Form.Get("media_ids[]") != "media-1" {
+				t.Errorf("Expected the image to be attached, got %q", r.Form["media_ids[]"])
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mdon.Status{ID: "test-status-id"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	media := NewMediaPipeline(kDefaultMastodonLimits)
+	defer media.Close()
+	poster := &MastodonPoster{
+		mClient: mdon.NewClient(&mdon.Config{Server: server.URL}),
+		media:   media,
+	}
+
+	tmpl, _ := template.New("test").Parse("{{.Title}}")
+	item := &gofeed.Item{
+		Title: "Hello Mastodon",
+		Image: &gofeed.Image{URL: server.URL + "/cover.png", Title: "the cover"},
+	}
+
+	_, err := poster.Post(item, tmpl, PostOptions{Images: true})
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	if !uploaded {
+		t.Error("Expected the item image to be uploaded")
+	}
+}
+
+func TestBlueskyPoster_Post_Quote(t *testing.T) {
+	var record map[string]any
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "com.atproto.server.createSession"):
+			json.NewEncoder(w).Encode(map[string]any{
+				"accessJwt": "jwt", "refreshJwt": "jwt", "handle": "handle", "did": "did:plc:me",
+			})
+		case strings.Contains(r.URL.Path, "com.atproto.identity.resolveHandle"):
+			json.NewEncoder(w).Encode(map[string]any{"did": "did:plc:alice"})
+		case strings.Contains(r.URL.Path, "app.bsky.feed.getPosts"):
+			uri := r.URL.Query().Get("uris")
+			if uri != "at://did:plc:alice/app.bsky.feed.post/abc" {
+				t.Errorf("Unexpected post uri %q", uri)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"posts": []map[string]any{{
+				"uri": uri, "cid": "quoted-cid", "indexedAt": "2026-01-01T00:00:00Z",
+				"author": map[string]any{"did": "did:plc:alice", "handle": "alice.test"},
+				"record": map[string]any{"$type": "app.bsky.feed.post", "text": "hi", "createdAt": "2026-01-01T00:00:00Z"},
+			}}})
+		case strings.Contains(r.URL.Path, "com.atproto.repo.createRecord"):
+			var input map[string]any
+			json.NewDecoder(r.Body).Decode(&input)
+			record, _ = input["record"].(map[string]any)
+			json.NewEncoder(w).Encode(map[string]any{"cid": "new-cid", "uri": "at://did:plc:me/app.bsky.feed.post/new"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+	agent := skybot.NewAgent(ctx, server.URL, "handle", "apikey")
+	err := agent.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	poster := &BlueskyPoster{
+		skyAgent:  &agent,
+		skyClient: &xrpc.Client{Client: new(http.Client), Host: server.URL},
+	}
+
+	tmpl, _ := template.New("test").Parse("{{.Title}}")
+	item := &gofeed.Item{
+		Title: "Worth reading",
+		Link:  "https://bsky.app/profile/alice.test/post/abc",
+	}
+
+	_, err = poster.Post(item, tmpl, PostOptions{Quote: true})
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	embed, _ := record["embed"].(map[string]any)
+	if embed["$type"] != "app.bsky.embed.record" {
+		t.Fatalf("Expected a record embed, got %v", record["embed"])
+	}
+	quoted, _ := embed["record"].(map[string]any)
+	if quoted["cid"] != "quoted-cid" || quoted["uri"] != "at://did:plc:alice/app.bsky.feed.post/abc" {
+		t.Errorf("Unexpected quoted record %v", quoted)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Mastodon counts every link as 23 characters and a mention only by its
+// username, whatever their real length.
+const kMastodonURLLen = 23
+
+var tootURL = regexp.MustCompile(`https?://[^\s<>"]+`)
+var tootMention = regexp.MustCompile(`(@[a-zA-Z0-9_]+)@[a-zA-Z0-9.\-]+[a-zA-Z0-9]`)
+
+// tootLength returns the length of text as Mastodon counts it against the
+// character limit.
+func tootLength(text string) int {
+	n := 0
+	text = tootURL.ReplaceAllStringFunc(text, func(string) string {
+		n += kMastodonURLLen
+		return ""
+	})
+	text = tootMention.ReplaceAllString(text, "$1")
+	return n + utf8.RuneCountInString(text)
+}
+
+type previewMedia struct {
+	Path    string
+	Src     template.URL
+	Kind    string
+	AltText string
+}
+
+type previewCard struct {
+	Text     string
+	Length   int
+	Limit    int
+	Links    []string
+	Media    []previewMedia
+	Poll     []string
+	Quote    string
+	Warnings []string
+}
+
+type previewPage struct {
+	Title     string
+	ReplyTo   string
+	Generated string
+	Cards     []previewCard
+	Warnings  int
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f2f3f5; margin: 2em auto; max-width: 40em; }
+.card { background: #fff; border-radius: 8px; padding: 1em; margin-bottom: 1em; box-shadow: 0 1px 3px rgba(0,0,0,.15); }
+.card.warn { border-left: 4px solid #d33; }
+.text { white-space: pre-wrap; word-wrap: break-word; }
+.count { color: #666; font-size: .85em; text-align: right; }
+.count.over { color: #d33; font-weight: bold; }
+.media img, .media video { max-width: 100%; max-height: 20em; border-radius: 4px; }
+.alt { color: #666; font-size: .85em; }
+.warning { color: #d33; font-size: .9em; }
+ul { padding-left: 1.2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{len .Cards}} posts, {{.Warnings}} warnings, generated {{.Generated}}</p>
+{{if .ReplyTo}}<p>In reply to <a href="{{.ReplyTo}}">{{.ReplyTo}}</a></p>{{end}}
+{{range .Cards}}
+<div class="card{{if .Warnings}} warn{{end}}">
+<div class="text">{{.Text}}</div>
+{{range .Media}}
+<div class="media">
+{{if eq .Kind "image"}}<img src="{{.Src}}" alt="{{.AltText}}">
+{{else if eq .Kind "video"}}<video src="{{.Src}}" controls></video>
+{{else if eq .Kind "audio"}}<audio src="{{.Src}}" controls></audio>
+{{else}}<code>{{.Path}}</code>{{end}}
+<div class="alt">{{.Path}}{{if .AltText}}: {{.AltText}}{{end}}</div>
+</div>
+{{end}}
+{{if .Quote}}<blockquote>Quoting <a href="{{.Quote}}">{{.Quote}}</a></blockquote>{{end}}
+{{if .Poll}}<ul class="poll">{{range .Poll}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Links}}<ul class="links">{{range .Links}}<li><a href="{{.}}">{{.}}</a></li>{{end}}</ul>{{end}}
+{{range .Warnings}}<div class="warning">⚠ {{.}}</div>{{end}}
+<div class="count{{if gt .Length .Limit}} over{{end}}">{{.Length}} / {{.Limit}}</div>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+func (ttr *Tooter) previewCard(ct *ChainToot) previewCard {
+	card := previewCard{
+		Text:   ct.Text,
+		Length: tootLength(ct.Text),
+		Limit:  kMastodonMaxTootLen,
+		Links:  tootURL.FindAllString(ct.Text, -1),
+		Quote:  ct.Quote,
+	}
+	if card.Length > card.Limit {
+		card.Warnings = append(card.Warnings,
+			fmt.Sprintf("%d characters over the limit", card.Length-card.Limit))
+	}
+	for _, tm := range ct.Media {
+		p := ttr.ResolvePath(tm.path)
+		pm := previewMedia{
+			Path:    tm.path,
+			Src:     template.URL((&url.URL{Scheme: "file", Path: p}).String()),
+			Kind:    mediaKind(p),
+			AltText: tm.altText,
+		}
+		if strings.TrimSpace(tm.altText) == "" {
+			card.Warnings = append(card.Warnings, fmt.Sprintf("%s has no alt text", tm.path))
+		}
+		if _, err := os.Stat(p); err != nil {
+			card.Warnings = append(card.Warnings, fmt.Sprintf("%s can't be read: %v", tm.path, err))
+		}
+		card.Media = append(card.Media, pm)
+	}
+	if ct.Poll != nil {
+		card.Poll = ct.Poll.Options
+	}
+	return card
+}
+
+// WritePreview renders the chain as an HTML page with one card per post.
+func (ttr *Tooter) WritePreview(chain []*ChainToot, path string) error {
+	page := previewPage{
+		Title:     "Preview of " + ttr.tootsPath,
+		ReplyTo:   ttr.replyTo,
+		Generated: time.Now().Format(time.RFC1123),
+	}
+	for _, ct := range chain {
+		card := ttr.previewCard(ct)
+		page.Warnings += len(card.Warnings)
+		page.Cards = append(page.Cards, card)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = previewTemplate.Execute(f, page)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTootLength(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{name: "plain", text: "hello", want: 5},
+		{name: "unicode", text: "héllo wörld", want: 11},
+		{name: "url", text: "see https://example.com/a/very/long/path/that/goes/on", want: 4 + kMastodonURLLen},
+		{name: "mention", text: "hi @alice@example.social", want: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tootLength(tt.text); got != tt.want {
+				t.Errorf("tootLength(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTooter_WritePreview(t *testing.T) {
+	dir, err := os.MkdirTemp("", "preview")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.WriteFile(filepath.Join(dir, "cat.png"), []byte("png"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+
+	ttr := &Tooter{tootsPath: filepath.Join(dir, "toots.md")}
+	chain := []*ChainToot{
+		{
+			Text:  "1/2\nA cat <3 https://example.com/cats",
+			Media: []*TootMedia{{path: "cat.png"}},
+		},
+		{Text: "2/2\n" + strings.Repeat("x", 600)},
+	}
+
+	previewPath := filepath.Join(dir, "preview.html")
+	err = ttr.WritePreview(chain, previewPath)
+	if err != nil {
+		t.Fatalf("WritePreview failed: %v", err)
+	}
+	b, err := os.ReadFile(previewPath)
+	if err != nil {
+		t.Fatalf("Failed to read preview: %v", err)
+	}
+	out := string(b)
+
+	for _, want := range []string{
+		"A cat &lt;3",
+		`<a href="https://example.com/cats">`,
+		`<img src="file://` + filepath.Join(dir, "cat.png"),
+		"cat.png has no alt text",
+		"104 characters over the limit",
+		"604 / 500",
+		"2 warnings",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected preview to contain %q", want)
+		}
+	}
+}
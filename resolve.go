@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// resolveMastodonStatus finds the local copy of a status given its URL on
+// any server, asking our server to fetch it if it hasn't seen it yet.
+func resolveMastodonStatus(ctx context.Context, mClient *mdon.Client, statusURL string) (*mdon.Status, error) {
+	srs, err := mClient.Search(ctx, statusURL, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(srs.Statuses) == 0 {
+		return nil, fmt.Errorf("toot not found")
+	}
+	return srs.Statuses[0], nil
+}
+
+// isBlueskyURL reports whether s points to a Bluesky post rather than a
+// Mastodon status.
+func isBlueskyURL(s string) bool {
+	return strings.HasPrefix(s, "at://") || strings.Contains(s, "bsky.app/")
+}
+
+// blueskyPostURI turns a https://bsky.app/profile/<handle>/post/<id> URL into
+// an at:// URI, resolving the handle to a DID. Anything else is assumed to
+// be an at:// URI already.
+func blueskyPostURI(ctx context.Context, skyClient *xrpc.Client, postURL string) (string, error) {
+	if !strings.HasPrefix(postURL, "https://") {
+		return postURL, nil
+	}
+	u, err := url.Parse(postURL)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(u.Path, "/")
+	if len(parts) < 5 || parts[1] != "profile" || parts[3] != "post" {
+		return "", fmt.Errorf("invalid bluesky url")
+	}
+	did := parts[2]
+	if !strings.HasPrefix(did, "did:") {
+		resolve, err := atproto.IdentityResolveHandle(ctx, skyClient, did)
+		if err != nil {
+			return "", err
+		}
+		did = resolve.Did
+	}
+	return fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, parts[4]), nil
+}
+
+// resolveBlueskyPost returns the strong reference (uri and cid) a quote or
+// reply needs to point at a post.
+func resolveBlueskyPost(ctx context.Context, skyClient *xrpc.Client, postURL string) (*atproto.RepoStrongRef, error) {
+	uri, err := blueskyPostURI(ctx, skyClient, postURL)
+	if err != nil {
+		return nil, err
+	}
+	out, err := appbsky.FeedGetPosts(ctx, skyClient, []string{uri})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Posts) == 0 {
+		return nil, fmt.Errorf("post not found")
+	}
+	return &atproto.RepoStrongRef{Uri: out.Posts[0].Uri, Cid: out.Posts[0].Cid}, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+var paragraphBreak = regexp.MustCompile(`\n{2,}`)
+
+// blueskyHTML renders the text of a Bluesky post with its facets as HTML in
+// the form Mastodon uses, so saved posts of both go through the same
+// converters. Facets index the UTF-8 bytes of the text.
+func blueskyHTML(text string, facets []*appbsky.RichtextFacet) string {
+	sorted := make([]*appbsky.RichtextFacet, 0, len(facets))
+	for _, facet := range facets {
+		if facet.Index != nil && len(facet.Features) > 0 {
+			sorted = append(sorted, facet)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index.ByteStart < sorted[j].Index.ByteStart
+	})
+
+	var sb strings.Builder
+	sb.WriteString("<p>")
+	last := 0
+	for _, facet := range sorted {
+		start, end := int(facet.Index.ByteStart), int(facet.Index.ByteEnd)
+		// skip facets that overlap the previous one or point outside the text
+		if start < last || end <= start || end > len(text) {
+			continue
+		}
+		sb.WriteString(plainHTML(text[last:start]))
+		sb.WriteString(facetHTML(text[start:end], facet.Features[0]))
+		last = end
+	}
+	sb.WriteString(plainHTML(text[last:]))
+	sb.WriteString("</p>")
+	return sb.String()
+}
+
+func plainHTML(text string) string {
+	text = html.EscapeString(text)
+	text = paragraphBreak.ReplaceAllString(text, "</p><p>")
+	return strings.ReplaceAll(text, "\n", "<br />")
+}
+
+func facetHTML(text string, feature *appbsky.RichtextFacet_Features_Elem) string {
+	escaped := html.EscapeString(text)
+	switch {
+	case feature.RichtextFacet_Link != nil:
+		return `<a href="` + html.EscapeString(feature.RichtextFacet_Link.Uri) + `">` + escaped + `</a>`
+	case feature.RichtextFacet_Mention != nil:
+		href := "https://bsky.app/profile/" + feature.RichtextFacet_Mention.Did
+		return `<span class="h-card"><a href="` + html.EscapeString(href) + `" class="u-url mention">` + escaped + `</a></span>`
+	case feature.RichtextFacet_Tag != nil:
+		href := "https://bsky.app/hashtag/" + url.PathEscape(feature.RichtextFacet_Tag.Tag)
+		return `<a href="` + html.EscapeString(href) + `" class="mention hashtag" rel="tag">` + escaped + `</a>`
+	}
+	return escaped
+}
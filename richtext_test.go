@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+func facet(start, end int64, feature *appbsky.RichtextFacet_Features_Elem) *appbsky.RichtextFacet {
+	return &appbsky.RichtextFacet{
+		Index:    &appbsky.RichtextFacet_ByteSlice{ByteStart: start, ByteEnd: end},
+		Features: []*appbsky.RichtextFacet_Features_Elem{feature},
+	}
+}
+
+func TestBlueskyHTML(t *testing.T) {
+	link := &appbsky.RichtextFacet_Features_Elem{RichtextFacet_Link: &appbsky.RichtextFacet_Link{Uri: "https://example.com/?a=1&b=2"}}
+	tests := []struct {
+		name   string
+		text   string
+		facets []*appbsky.RichtextFacet
+		want   string
+	}{
+		{
+			name: "plain text",
+			text: "a < b\nc\n\nd",
+			want: "<p>a &lt; b<br />c</p><p>d</p>",
+		},
+		{
+			name:   "link after multibyte text",
+			text:   "ünïcode example.com",
+			facets: []*appbsky.RichtextFacet{facet(10, 21, link)},
+			want:   `<p>ünïcode <a href="https://example.com/?a=1&amp;b=2">example.com</a></p>`,
+		},
+		{
+			name:   "facets out of order and out of range",
+			text:   "one two",
+			facets: []*appbsky.RichtextFacet{facet(4, 7, link), facet(0, 3, link), facet(5, 99, link)},
+			want:   `<p><a href="https://example.com/?a=1&amp;b=2">one</a> <a href="https://example.com/?a=1&amp;b=2">two</a></p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blueskyHTML(tt.text, tt.facets); got != tt.want {
+				t.Errorf("blueskyHTML() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
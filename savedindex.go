@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// the destination of posts saved to notion in the index
+const kNotionDestination = "notion"
+
+// requestedStatus is the post save was asked for.
+func requestedStatus(thread []*SavedStatus) *SavedStatus {
+	for _, status := range thread {
+		if status.Requested {
+			return status
+		}
+	}
+	return thread[len(thread)-1]
+}
+
+// hashedStatus is what of a status decides whether its saved thread changed:
+// its place in the thread, text, media, card, poll and quoted post. Fields
+// are listed here rather than taken from SavedStatus, so a field added later
+// or a new avatar or bio of the author doesn't resave every thread.
+type hashedStatus struct {
+	ID          string
+	URL         string
+	InReplyToID string
+	Depth       int
+	Author      string
+	Content     string
+	SpoilerText string
+	Sensitive   bool
+	EditedAt    time.Time
+	Tags        []string
+	Media       []hashedMedia
+	Card        *SavedCard
+	Poll        []SavedPollOption
+	Quote       *hashedStatus
+}
+
+type hashedMedia struct {
+	URL     string
+	Type    string
+	AltText string
+}
+
+func newHashedStatus(status *SavedStatus) *hashedStatus {
+	hs := &hashedStatus{
+		ID:          status.ID,
+		URL:         status.URL,
+		InReplyToID: status.InReplyToID,
+		Depth:       status.Depth,
+		Author:      status.Account.DisplayName + " @" + status.Account.Acct,
+		Content:     status.Content,
+		SpoilerText: status.SpoilerText,
+		Sensitive:   status.Sensitive,
+		EditedAt:    status.EditedAt,
+		Card:        status.Card,
+	}
+	for _, tag := range status.Tags {
+		hs.Tags = append(hs.Tags, tag.Name)
+	}
+	for _, ma := range status.MediaAttachments {
+		hs.Media = append(hs.Media, hashedMedia{URL: ma.URL, Type: ma.Type, AltText: ma.AltText})
+	}
+	if status.Poll != nil {
+		hs.Poll = status.Poll.Options
+	}
+	if status.Quote != nil {
+		hs.Quote = newHashedStatus(status.Quote)
+	}
+	return hs
+}
+
+// threadHash summarizes what gets saved of a thread, so an unchanged thread
+// isn't saved again.
+func threadHash(thread []*SavedStatus, title string) (string, error) {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	if err := enc.Encode(title); err != nil {
+		return "", err
+	}
+	for _, status := range thread {
+		if err := enc.Encode(newHashedStatus(status)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveIndexed saves the thread where the requested post was saved before, or
+// skips it when nothing changed since.
+func (saver *Saver) saveIndexed(ctx context.Context, thread []*SavedStatus) error {
+	post := requestedStatus(thread)
+	platform := savedPlatform(post)
+	destination, err := saver.sink.Destination()
+	if err != nil {
+		return err
+	}
+
+	hash, err := threadHash(thread, saver.pageTitle)
+	if err != nil {
+		return err
+	}
+	existing, err := saver.index.FindSaved(platform, post.ID, destination)
+	if err != nil {
+		return err
+	}
+
+	target := ""
+	if existing != nil {
+		exists, err := saver.sink.Exists(ctx, existing.Target)
+		if err != nil {
+			return err
+		}
+		if exists && existing.ContentHash == hash {
+			log.Printf("unchanged since %s, skipped %s", existing.SavedAt.Local().Format(time.DateTime), existing.Target)
+			return nil
+		}
+		if exists {
+			target = existing.Target
+		}
+	}
+
+	// a dry run neither creates nor replaces anything
+	if saver.dryrun {
+		if target != "" {
+			log.Printf("[dryrun] would update %s", target)
+		} else {
+			log.Printf("[dryrun] would create a save of %s", post.URL)
+		}
+		return nil
+	}
+
+	saved, err := saver.sink.Write(ctx, thread, saver.pageTitle, target)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		log.Printf("updated %s", saved)
+	} else {
+		log.Printf("created %s", saved)
+	}
+	saver.printMediaReport()
+
+	saver.indexForSearch(thread, saved)
+	return saver.index.RecordSaved(&SavedItem{
+		Platform:    platform,
+		StatusID:    post.ID,
+		Destination: destination,
+		Target:      saved,
+		ContentHash: hash,
+		SavedAt:     time.Now(),
+	})
+}
@@ -5,7 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -14,22 +14,16 @@ import (
 	"log"
 	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
-	"text/scanner"
 	"time"
 
 	"github.com/jomei/notionapi"
 	mdon "github.com/mattn/go-mastodon"
 	"github.com/microcosm-cc/bluemonday"
-	"golang.org/x/net/html"
-	googdrive "google.golang.org/api/drive/v3"
-	"gopkg.in/yaml.v3"
 
-	"github.com/bluesky-social/indigo/api/atproto"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/xrpc"
 )
@@ -40,127 +34,152 @@ type SavedMedia struct {
 	ID        string
 	URL       string
 	RemoteURL string
+	// image, video, gifv or audio
+	Type       string
+	AltText    string
+	PreviewURL string
+	Blurhash   string
+	// in pixels; Bluesky only gives the aspect ratio
+	Width  int64
+	Height int64
 }
 
-type SavedStatus struct {
-	ID        string
-	Content   string
+// SavedCard is the preview of a link in a status.
+type SavedCard struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+}
+
+// SavedEmoji is a custom emoji used in a status, shown as :Shortcode:.
+type SavedEmoji struct {
+	Shortcode string
 	URL       string
-	CreatedAt time.Time
-	Account   struct {
-		Username    string
-		DisplayName string
-		Acct        string
+}
+
+// SavedPoll is a poll with its results when the status was saved.
+type SavedPoll struct {
+	Options []SavedPollOption
+	// votes over all options, more than the voters when several can be chosen
+	VotesCount  int64
+	VotersCount int64
+	Multiple    bool
+	ExpiresAt   time.Time
+	Expired     bool
+}
+
+type SavedPollOption struct {
+	Title      string
+	VotesCount int64
+}
+
+// Share is the percentage of the votes an option got, of the voters when
+// several options can be chosen.
+func (poll *SavedPoll) Share(option SavedPollOption) int64 {
+	total := poll.VotesCount
+	if poll.Multiple && poll.VotersCount > 0 {
+		total = poll.VotersCount
 	}
-	Tags []struct {
-		Name string
+	if total == 0 {
+		return 0
 	}
-	MediaAttachments []SavedMedia
+	return (option.VotesCount*200 + total) / (2 * total)
 }
 
-func ExtractTitle(status *SavedStatus) string {
-	strippedContent := stripTagsPolicy.Sanitize(status.Content)
-	var s scanner.Scanner
-	s.Init(strings.NewReader(strippedContent))
-	var words []string
-	tok := s.Scan()
-	for tok != scanner.EOF {
-		words = append(words, s.TokenText())
-		tok = s.Scan()
-	}
-	numWords := min(len(words), 5)
-	return status.Account.Username + ": " + strings.Join(words[:numWords], " ")
+// Result is how many votes an option got, as "12 votes (40%)".
+func (poll *SavedPoll) Result(option SavedPollOption) string {
+	return fmt.Sprintf("%s (%d%%)", countOf(option.VotesCount, "vote"), poll.Share(option))
 }
 
-func ConvertHtml2Blocks(content string) notionapi.Blocks {
-	var blocks notionapi.Blocks
+// Summary counts the votes and tells when the poll closed or closes.
+func (poll *SavedPoll) Summary() string {
+	summary := countOf(poll.VotesCount, "vote")
+	if poll.Multiple && poll.VotersCount == 1 {
+		summary = "1 person"
+	} else if poll.Multiple && poll.VotersCount > 0 {
+		summary = fmt.Sprintf("%d people", poll.VotersCount)
+	}
+	switch {
+	case poll.Expired && !poll.ExpiresAt.IsZero():
+		summary += ", closed " + poll.ExpiresAt.Local().Format(time.DateTime)
+	case poll.Expired:
+		summary += ", closed"
+	case !poll.ExpiresAt.IsZero():
+		summary += ", open until " + poll.ExpiresAt.Local().Format(time.DateTime)
+	}
+	return summary
+}
 
-	// we start with a first paragraph even when there are no <p> so text
-	// nodes have a destination
-	currentParagraph := notionapi.ParagraphBlock{
-		BasicBlock: notionapi.BasicBlock{
-			Object: notionapi.ObjectTypeBlock,
-			Type:   notionapi.BlockTypeParagraph,
-		},
-		Paragraph: notionapi.Paragraph{},
+// countOf is n with the noun in the singular or plural.
+func countOf(n int64, noun string) string {
+	if n == 1 {
+		return "1 " + noun
 	}
-	currentHref := ""
+	return fmt.Sprintf("%d %ss", n, noun)
+}
 
-	doc, err := html.Parse(strings.NewReader(content))
-	if err != nil {
-		return nil
-	}
-	var walker func(*html.Node)
-	walker = func(node *html.Node) {
-		if node.Type == html.ElementNode && node.Data == "p" {
-			// if the current paragraph has no content, we don't open a new
-			// paragraph
-			if len(currentParagraph.Paragraph.RichText) > 0 {
-				blocks = append(blocks, currentParagraph)
-				currentParagraph = notionapi.ParagraphBlock{
-					BasicBlock: notionapi.BasicBlock{
-						Object: notionapi.ObjectTypeBlock,
-						Type:   notionapi.BlockTypeParagraph,
-					},
-					Paragraph: notionapi.Paragraph{},
-				}
-			}
-			for child := node.FirstChild; child != nil; child = child.NextSibling {
-				walker(child)
-			}
-		} else if node.Type == html.TextNode {
-			rt := notionapi.RichText{
-				Type: notionapi.ObjectTypeText,
-				Text: &notionapi.Text{
-					Content: node.Data,
-				},
-				PlainText: node.Data,
-			}
-			if currentHref != "" {
-				rt.Text.Link = &notionapi.Link{
-					Url: currentHref,
-				}
-			}
-			currentParagraph.Paragraph.RichText = append(currentParagraph.Paragraph.RichText, rt)
-			for child := node.FirstChild; child != nil; child = child.NextSibling {
-				walker(child)
-			}
-		} else if node.Type == html.ElementNode && node.Data == "a" {
-			for _, attr := range node.Attr {
-				if attr.Key == "href" {
-					currentHref = attr.Val
-				}
-			}
-			for child := node.FirstChild; child != nil; child = child.NextSibling {
-				walker(child)
-			}
-			currentHref = ""
-		} else if node.Type == html.ElementNode && node.Data == "span" {
-			klass := ""
-			for _, attr := range node.Attr {
-				if attr.Key == "class" {
-					klass = attr.Val
-				}
-			}
-			if klass != "invisible" {
-				for child := node.FirstChild; child != nil; child = child.NextSibling {
-					walker(child)
-				}
-			}
-		} else {
-			for child := node.FirstChild; child != nil; child = child.NextSibling {
-				walker(child)
-			}
-		}
-	}
-	walker(doc)
+// SavedEdit is an earlier version of an edited status.
+type SavedEdit struct {
+	Content     string
+	SpoilerText string
+	CreatedAt   time.Time
+}
 
-	// append the last paragraph if it has content
-	if len(currentParagraph.Paragraph.RichText) > 0 {
-		blocks = append(blocks, currentParagraph)
+// editedNote tells when a status was last edited and how often, when its
+// earlier versions are known.
+func editedNote(status *SavedStatus) string {
+	note := "Edited " + status.EditedAt.Local().Format(time.DateTime)
+	if len(status.Edits) > 0 {
+		note += ", " + countOf(int64(len(status.Edits)), "earlier version")
 	}
+	return note
+}
 
-	return blocks
+type SavedStatus struct {
+	// the status ID on our Mastodon server or the Bluesky CID; the
+	// ActivityPub URI when our server doesn't know the status
+	ID string
+	// the ActivityPub ID of a Mastodon status
+	URI       string
+	Content   string
+	URL       string
+	CreatedAt time.Time
+	// the content warning the content is hidden behind, if any
+	SpoilerText string
+	// whether the media is hidden until clicked
+	Sensitive bool
+	// public, unlisted, private or direct; Mastodon only
+	Visibility string
+	// ISO 639 code of the content's language
+	Language string
+	Poll     *SavedPoll
+	// when the status was last edited, zero if never
+	EditedAt time.Time
+	// the earlier versions of an edited status, oldest first
+	Edits   []SavedEdit
+	Account struct {
+		Username    string
+		DisplayName string
+		Acct        string
+		// the profile page, the avatar image and the bio as HTML
+		URL    string
+		Avatar string
+		Note   string
+	}
+	Tags []struct {
+		Name string
+	}
+	MediaAttachments []SavedMedia
+	Emojis           []SavedEmoji
+	Card             *SavedCard
+	// the post this one quotes, Bluesky only for now
+	Quote       *SavedStatus
+	InReplyToID string
+	// nesting below the main line of the thread, 0 for the main line
+	Depth int
+	// the post asked for, as opposed to the ones around it
+	Requested bool
 }
 
 type InternalFileObject struct {
@@ -169,15 +188,37 @@ type InternalFileObject struct {
 	URL    string `json:"url,omitempty"`
 }
 
-type InternalImage struct {
-	Type     string              `json:"type"`
-	File     *InternalFileObject `json:"file,omitempty"`
-	External *InternalFileObject `json:"external,omitempty"`
+// InternalFileUpload attaches a file uploaded to notion.
+type InternalFileUpload struct {
+	ID string `json:"id"`
+}
+
+type InternalMedia struct {
+	Caption    []notionapi.RichText `json:"caption,omitempty"`
+	Type       string               `json:"type"`
+	File       *InternalFileObject  `json:"file,omitempty"`
+	External   *InternalFileObject  `json:"external,omitempty"`
+	FileUpload *InternalFileUpload  `json:"file_upload,omitempty"`
 }
 
 type InternalImageBlock struct {
 	notionapi.BasicBlock
-	Image InternalImage `json:"image"`
+	Image InternalMedia `json:"image"`
+}
+
+type InternalVideoBlock struct {
+	notionapi.BasicBlock
+	Video InternalMedia `json:"video"`
+}
+
+type InternalAudioBlock struct {
+	notionapi.BasicBlock
+	Audio InternalMedia `json:"audio"`
+}
+
+type InternalFileBlock struct {
+	notionapi.BasicBlock
+	File InternalMedia `json:"file"`
 }
 
 type Fetcher interface {
@@ -186,19 +227,81 @@ type Fetcher interface {
 
 type MastodonFetcher struct {
 	mClient *mdon.Client
+	mode    ThreadMode
+}
+
+func savedFromMastodon(s *mdon.Status) *SavedStatus {
+	ss := &SavedStatus{
+		ID:          string(s.ID),
+		URI:         s.URI,
+		Content:     s.Content,
+		URL:         s.URL,
+		CreatedAt:   s.CreatedAt,
+		SpoilerText: s.SpoilerText,
+		Sensitive:   s.Sensitive,
+		Visibility:  s.Visibility,
+		Language:    s.Language,
+		EditedAt:    s.EditedAt,
+	}
+	if s.Poll != nil {
+		ss.Poll = &SavedPoll{
+			VotesCount:  s.Poll.VotesCount,
+			VotersCount: s.Poll.VotersCount,
+			Multiple:    s.Poll.Multiple,
+			ExpiresAt:   s.Poll.ExpiresAt,
+			Expired:     s.Poll.Expired,
+		}
+		for _, option := range s.Poll.Options {
+			ss.Poll.Options = append(ss.Poll.Options, SavedPollOption{Title: option.Title, VotesCount: option.VotesCount})
+		}
+	}
+	if id, ok := s.InReplyToID.(string); ok {
+		ss.InReplyToID = id
+	}
+	ss.Account.Username = s.Account.Username
+	ss.Account.DisplayName = s.Account.DisplayName
+	ss.Account.Acct = s.Account.Acct
+	ss.Account.URL = s.Account.URL
+	ss.Account.Avatar = s.Account.Avatar
+	ss.Account.Note = s.Account.Note
+	for _, t := range s.Tags {
+		ss.Tags = append(ss.Tags, struct{ Name string }{Name: t.Name})
+	}
+	for _, ma := range s.MediaAttachments {
+		ss.MediaAttachments = append(ss.MediaAttachments, SavedMedia{
+			ID:         string(ma.ID),
+			URL:        ma.URL,
+			RemoteURL:  ma.RemoteURL,
+			Type:       ma.Type,
+			AltText:    ma.Description,
+			PreviewURL: ma.PreviewURL,
+			Blurhash:   ma.BlurHash,
+			Width:      ma.Meta.Original.Width,
+			Height:     ma.Meta.Original.Height,
+		})
+	}
+	for _, emoji := range s.Emojis {
+		ss.Emojis = append(ss.Emojis, SavedEmoji{Shortcode: emoji.ShortCode, URL: emoji.URL})
+	}
+	if s.Card != nil && s.Card.URL != "" {
+		ss.Card = &SavedCard{
+			URL:         s.Card.URL,
+			Title:       s.Card.Title,
+			Description: s.Card.Description,
+			Image:       s.Card.Image,
+		}
+	}
+	return ss
 }
 
 func (mf *MastodonFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
 	id := idOrUrl
 	if strings.HasPrefix(idOrUrl, "https://") {
-		srs, err := mf.mClient.Search(ctx, idOrUrl, true)
+		status, err := resolveMastodonStatus(ctx, mf.mClient, idOrUrl)
 		if err != nil {
 			return nil, err
 		}
-		if len(srs.Statuses) == 0 {
-			return nil, fmt.Errorf("toot not found")
-		}
-		id = string(srs.Statuses[0].ID)
+		id = string(status.ID)
 	}
 
 	var thread []*mdon.Status
@@ -222,452 +325,339 @@ func (mf *MastodonFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedS
 
 	var result []*SavedStatus
 	for _, s := range thread {
-		ss := &SavedStatus{
-			ID:        string(s.ID),
-			Content:   s.Content,
-			URL:       s.URL,
-			CreatedAt: s.CreatedAt,
-		}
-		ss.Account.Username = s.Account.Username
-		ss.Account.DisplayName = s.Account.DisplayName
-		ss.Account.Acct = s.Account.Acct
-		for _, t := range s.Tags {
-			ss.Tags = append(ss.Tags, struct{ Name string }{Name: t.Name})
-		}
-		for _, ma := range s.MediaAttachments {
-			ss.MediaAttachments = append(ss.MediaAttachments, SavedMedia{
-				ID:        string(ma.ID),
-				URL:       ma.URL,
-				RemoteURL: ma.RemoteURL,
-			})
-		}
-		result = append(result, ss)
+		result = append(result, mf.saved(ctx, s))
 	}
-	return result, nil
-}
-
-type BlueskyFetcher struct {
-	skyClient *xrpc.Client
-}
-
-func (bf *BlueskyFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
-	uri := idOrUrl
-	if strings.HasPrefix(idOrUrl, "https://") {
-		// Example: https://bsky.app/profile/danrusei.bsky.social/post/3j7z7z7z7z7z7
-		u, err := url.Parse(idOrUrl)
-		if err != nil {
-			return nil, err
-		}
-		parts := strings.Split(u.Path, "/")
-		if len(parts) < 5 {
-			return nil, fmt.Errorf("invalid bluesky url")
-		}
-		handle := parts[2]
-		postID := parts[4]
-
-		resolve, err := atproto.IdentityResolveHandle(ctx, bf.skyClient, handle)
-		if err != nil {
-			return nil, err
-		}
-		uri = fmt.Sprintf("at://%s/app.bsky.feed.post/%s", resolve.Did, postID)
+	result[len(result)-1].Requested = true
+	if mf.mode == ThreadAncestors || mf.mode == "" {
+		return result, nil
 	}
 
-	threadOutput, err := appbsky.FeedGetPostThread(ctx, bf.skyClient, 0, 10, uri)
+	// the ancestors come from walking up, the context adds what is below
+	statusContext, err := mf.mClient.GetStatusContext(ctx, thread[len(thread)-1].ID)
 	if err != nil {
 		return nil, err
 	}
-
-	var thread []*appbsky.FeedDefs_ThreadViewPost
-	curr := threadOutput.Thread.FeedDefs_ThreadViewPost
-	for curr != nil {
-		thread = append(thread, curr)
-		if curr.Parent != nil && curr.Parent.FeedDefs_ThreadViewPost != nil {
-			curr = curr.Parent.FeedDefs_ThreadViewPost
-		} else {
-			curr = nil
-		}
+	var descendants []*SavedStatus
+	for _, s := range statusContext.Descendants {
+		descendants = append(descendants, mf.saved(ctx, s))
 	}
+	return buildThread(result[:len(result)-1], result[len(result)-1], descendants, mf.mode), nil
+}
 
-	// Reverse thread to original order
-	for i, j := 0, len(thread)-1; i < j; i, j = i+1, j-1 {
-		thread[i], thread[j] = thread[j], thread[i]
-	}
+// saved maps a status, with the earlier versions of it when it was edited.
+// Failing to fetch those is logged, the status is saved without them.
+func (mf *MastodonFetcher) saved(ctx context.Context, s *mdon.Status) *SavedStatus {
+	ss := savedFromMastodon(s)
+	ss.Edits = mastodonEdits(ctx, mf.mClient, s)
+	return ss
+}
 
-	var result []*SavedStatus
-	for _, p := range thread {
-		post := p.Post
-		ss := &SavedStatus{
-			ID:      post.Cid,
-			Content: post.Record.Val.(*appbsky.FeedPost).Text,
-			URL:     fmt.Sprintf("https://bsky.app/profile/%s/post/%s", post.Author.Handle, filepath.Base(post.Uri)),
-		}
-		if t, err := time.Parse(time.RFC3339, post.Record.Val.(*appbsky.FeedPost).CreatedAt); err == nil {
-			ss.CreatedAt = t
-		}
-		ss.Account.Username = post.Author.Handle
-		if post.Author.DisplayName != nil {
-			ss.Account.DisplayName = *post.Author.DisplayName
-		}
-		ss.Account.Acct = post.Author.Handle
-
-		if post.Embed != nil && post.Embed.EmbedImages_View != nil {
-			for i, img := range post.Embed.EmbedImages_View.Images {
-				ss.MediaAttachments = append(ss.MediaAttachments, SavedMedia{
-					ID:        fmt.Sprintf("%s-%d", post.Cid, i),
-					URL:       img.Fullsize,
-					RemoteURL: img.Fullsize,
-				})
-			}
-		}
-		result = append(result, ss)
+// mastodonEdits fetches the earlier versions of an edited status, oldest
+// first. Failures are logged.
+func mastodonEdits(ctx context.Context, mClient *mdon.Client, s *mdon.Status) []SavedEdit {
+	if s.EditedAt.IsZero() {
+		return nil
+	}
+	history, err := mClient.GetStatusHistory(ctx, s.ID)
+	if err != nil {
+		log.Printf("failed to fetch the edits of %s: %v", s.ID, err)
+		return nil
 	}
+	// the last version is the status as it is now
+	var edits []SavedEdit
+	for _, version := range history[:max(len(history)-1, 0)] {
+		edits = append(edits, SavedEdit{
+			Content:     version.Content,
+			SpoilerText: version.SpoilerText,
+			CreatedAt:   version.CreatedAt,
+		})
+	}
+	return edits
+}
 
-	return result, nil
+type BlueskyFetcher struct {
+	skyClient *xrpc.Client
+	mode      ThreadMode
 }
 
-type Saver struct {
-	dryrun         bool
-	notionClient   *notionapi.Client
-	notionToken    string
-	notionParentID string
-	pageTitle      string
-	debug          bool
-	gdriveService  *googdrive.Service
-	usegdrive      bool
-	bridge         string
-	parent         string
-	outputPath     string
-	fetcher        Fetcher
-}
-
-func (saver *Saver) UploadToNotion(imageURL string, filename string) (string, error) {
-	resp, err := http.Get(imageURL)
-	if err != nil {
-		return "", err
+// how many levels of replies to ask for when saving more than the ancestors
+const kBlueskyReplyDepth = 1000
+
+// the most profiles getProfiles returns at once
+const kBlueskyProfileBatch = 25
+
+func savedFromBluesky(post *appbsky.FeedDefs_PostView) *SavedStatus {
+	record, _ := post.Record.Val.(*appbsky.FeedPost)
+	ss := savedFromBlueskyRecord(post.Uri, post.Cid, post.Author, record)
+	if post.Embed != nil {
+		ss.addBlueskyEmbed(post.Embed.EmbedImages_View, post.Embed.EmbedVideo_View,
+			post.Embed.EmbedExternal_View, post.Embed.EmbedRecord_View)
+		if rwm := post.Embed.EmbedRecordWithMedia_View; rwm != nil && rwm.Media != nil {
+			ss.addBlueskyEmbed(rwm.Media.EmbedImages_View, rwm.Media.EmbedVideo_View,
+				rwm.Media.EmbedExternal_View, rwm.Record)
+		}
 	}
-	defer resp.Body.Close()
+	return ss
+}
 
-	// 1. Create file upload object
-	uploadReqBody := map[string]string{
-		"name":         filename,
-		"content_type": mime.TypeByExtension(path.Ext(filename)),
+func savedFromBlueskyRecord(uri string, cid string, author *appbsky.ActorDefs_ProfileViewBasic, record *appbsky.FeedPost) *SavedStatus {
+	ss := &SavedStatus{
+		ID:  cid,
+		URL: fmt.Sprintf("https://bsky.app/profile/%s/post/%s", author.Handle, filepath.Base(uri)),
 	}
-	reqJSON, _ := json.Marshal(uploadReqBody)
-	req, err := http.NewRequest("POST", "https://api.notion.com/v1/file_uploads", bytes.NewBuffer(reqJSON))
-	if err != nil {
-		return "", err
+	ss.Account.Username = author.Handle
+	if author.DisplayName != nil {
+		ss.Account.DisplayName = *author.DisplayName
 	}
-	req.Header.Set("Authorization", "Bearer "+saver.notionToken)
-	req.Header.Set("Notion-Version", "2022-06-28") // Or whatever version is required for this endpoint
-	req.Header.Set("Content-Type", "application/json")
-
-	notionResp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+	ss.Account.Acct = author.Handle
+	ss.Account.URL = "https://bsky.app/profile/" + author.Handle
+	if author.Avatar != nil {
+		ss.Account.Avatar = *author.Avatar
 	}
-	defer notionResp.Body.Close()
-
-	if notionResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(notionResp.Body)
-		return "", fmt.Errorf("failed to create file upload: %s", string(body))
+	if record == nil {
+		return ss
 	}
 
-	var uploadData struct {
-		ID        string `json:"id"`
-		UploadURL string `json:"upload_url"`
+	ss.Content = blueskyHTML(record.Text, record.Facets)
+	if t, err := time.Parse(time.RFC3339, record.CreatedAt); err == nil {
+		ss.CreatedAt = t
 	}
-	if err := json.NewDecoder(notionResp.Body).Decode(&uploadData); err != nil {
-		return "", err
+	if record.Reply != nil && record.Reply.Parent != nil {
+		ss.InReplyToID = record.Reply.Parent.Cid
 	}
-
-	// 2. Upload file content
-	// Re-fetch body or use a buffer if the file is small.
-	// For now, let's read the whole thing into a buffer to be safe for Re-requesting if needed,
-	// but we already have resp.Body. Since we closed it, we need to Re-fetch or use a buffer.
-	// Actually, let's read it into a buffer first.
-	content, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if len(record.Langs) > 0 {
+		ss.Language = record.Langs[0]
 	}
-
-	uploadReq, err := http.NewRequest("PUT", uploadData.UploadURL, bytes.NewBuffer(content))
-	if err != nil {
-		return "", err
+	// self-labels like nudity or graphic-media blur the media, as Mastodon's
+	// sensitive flag does
+	if record.Labels != nil && record.Labels.LabelDefs_SelfLabels != nil {
+		ss.Sensitive = len(record.Labels.LabelDefs_SelfLabels.Values) > 0
 	}
-	// Notion's documentation says to use the upload_url directly.
-	// Usually for S3/GCS signed URLs, we don't need many headers.
-	uploadReq.Header.Set("Content-Type", uploadReqBody["content_type"])
-
-	uploadResp, err := http.DefaultClient.Do(uploadReq)
-	if err != nil {
-		return "", err
+	tags := record.Tags
+	for _, facet := range record.Facets {
+		for _, feature := range facet.Features {
+			if feature.RichtextFacet_Tag != nil {
+				tags = append(tags, feature.RichtextFacet_Tag.Tag)
+			}
+		}
 	}
-	defer uploadResp.Body.Close()
-
-	if uploadResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(uploadResp.Body)
-		return "", fmt.Errorf("failed to upload file content: %s", string(body))
+	for _, tag := range tags {
+		ss.Tags = append(ss.Tags, struct{ Name string }{Name: tag})
 	}
-
-	return uploadData.ID, nil
+	return ss
 }
 
-func (saver *Saver) StoreImage(imageURL string, filename string) (*googdrive.File, error) {
-	resp, err := http.Get(imageURL)
-	if err != nil {
-		return nil, err
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println("failed to close response body", err)
+// addBlueskyEmbed maps the parts of a post's embed; quotes with media have
+// both the media and the record.
+func (ss *SavedStatus) addBlueskyEmbed(images *appbsky.EmbedImages_View, video *appbsky.EmbedVideo_View,
+	external *appbsky.EmbedExternal_View, record *appbsky.EmbedRecord_View) {
+	if images != nil {
+		for _, img := range images.Images {
+			sm := SavedMedia{
+				ID:         fmt.Sprintf("%s-%d", ss.ID, len(ss.MediaAttachments)),
+				URL:        img.Fullsize,
+				RemoteURL:  img.Fullsize,
+				Type:       "image",
+				AltText:    img.Alt,
+				PreviewURL: img.Thumb,
+			}
+			if img.AspectRatio != nil {
+				sm.Width, sm.Height = img.AspectRatio.Width, img.AspectRatio.Height
+			}
+			ss.MediaAttachments = append(ss.MediaAttachments, sm)
 		}
-	}(resp.Body)
-	perm := googdrive.Permission{
-		Role: "reader",
-		Type: "anyone",
-	}
-	df := googdrive.File{
-		Name:     filename,
-		MimeType: mime.TypeByExtension(path.Ext(filename)),
-		Parents:  []string{saver.parent},
-	}
-	dFile, err := saver.gdriveService.Files.Create(&df).Media(resp.Body).Do()
-	if err != nil {
-		return nil, err
 	}
-	_, err = saver.gdriveService.Permissions.Create(dFile.Id, &perm).Do()
-	if err != nil {
-		return nil, err
+	if video != nil {
+		sm := SavedMedia{
+			ID:        video.Cid,
+			URL:       video.Playlist,
+			RemoteURL: video.Playlist,
+			Type:      "video",
+		}
+		if video.Alt != nil {
+			sm.AltText = *video.Alt
+		}
+		if video.Thumbnail != nil {
+			sm.PreviewURL = *video.Thumbnail
+		}
+		if video.AspectRatio != nil {
+			sm.Width, sm.Height = video.AspectRatio.Width, video.AspectRatio.Height
+		}
+		ss.MediaAttachments = append(ss.MediaAttachments, sm)
 	}
-	dFile, err = saver.gdriveService.Files.Get(dFile.Id).Fields("webContentLink").Do()
-	if err != nil {
-		return nil, err
+	if external != nil && external.External != nil {
+		ss.Card = &SavedCard{
+			URL:         external.External.Uri,
+			Title:       external.External.Title,
+			Description: external.External.Description,
+		}
+		if external.External.Thumb != nil {
+			ss.Card.Image = *external.External.Thumb
+		}
 	}
-	return dFile, nil
-}
-
-func (saver *Saver) Blocks(thread []*SavedStatus) notionapi.Blocks {
-	var blocks notionapi.Blocks
-	blocks = append(blocks, notionapi.Heading3Block{
-		BasicBlock: notionapi.BasicBlock{
-			Object: notionapi.ObjectTypeBlock,
-			Type:   notionapi.BlockTypeHeading3,
-		},
-		Heading3: notionapi.Heading{
-			RichText: []notionapi.RichText{
-				{
-					Type: notionapi.ObjectTypeText,
-					Text: &notionapi.Text{
-						Content: thread[0].URL,
-						Link: &notionapi.Link{
-							Url: thread[0].URL,
-						},
-					},
-				},
-			},
-			Color: "blue",
-		},
-	})
-	for _, status := range thread {
-		blocks = append(blocks, ConvertHtml2Blocks(status.Content)...)
-		for _, ma := range status.MediaAttachments {
-			remoteURL := ma.RemoteURL
-			var fileID string
-			if saver.usegdrive {
-				filename := path.Base(remoteURL)
-				dFile, err := saver.StoreImage(remoteURL, filename)
-				if err == nil {
-					if len(dFile.WebContentLink) > 0 {
-						wcl, err := url.Parse(dFile.WebContentLink)
-						if err != nil {
-							log.Println("web content url is invalid: ", err)
-						} else {
-							gdriveId := wcl.Query().Get("id")
-							remoteURL = fmt.Sprintf("%s/%s/%s", saver.bridge, gdriveId, filename)
-						}
-					} else if saver.debug {
-						log.Println("Google Drive file doesn't have WebContentLink")
-					}
-				} else if saver.debug {
-					log.Println("failed to store image ", remoteURL, " to Google Drive: ", err)
-				}
-				if saver.debug {
-					log.Println("remote URL", remoteURL)
-				}
-			} else {
-				filename := path.Base(remoteURL)
-				id, err := saver.UploadToNotion(remoteURL, filename)
-				if err == nil {
-					fileID = id
-				} else if saver.debug {
-					log.Println("failed to upload image to Notion: ", err)
+	if record != nil && record.Record != nil {
+		if vr := record.Record.EmbedRecord_ViewRecord; vr != nil {
+			post, _ := vr.Value.Val.(*appbsky.FeedPost)
+			quote := savedFromBlueskyRecord(vr.Uri, vr.Cid, vr.Author, post)
+			for _, embed := range vr.Embeds {
+				quote.addBlueskyEmbed(embed.EmbedImages_View, embed.EmbedVideo_View, embed.EmbedExternal_View, nil)
+				if rwm := embed.EmbedRecordWithMedia_View; rwm != nil && rwm.Media != nil {
+					quote.addBlueskyEmbed(rwm.Media.EmbedImages_View, rwm.Media.EmbedVideo_View, rwm.Media.EmbedExternal_View, nil)
 				}
 			}
-
-			if fileID != "" {
-				blocks = append(blocks, InternalImageBlock{
-					BasicBlock: notionapi.BasicBlock{
-						Object: notionapi.ObjectTypeBlock,
-						Type:   notionapi.BlockTypeImage,
-					},
-					Image: InternalImage{
-						Type: "file",
-						File: &InternalFileObject{
-							Type:   "file",
-							FileID: fileID,
-						},
-					},
-				})
-			} else {
-				blocks = append(blocks, notionapi.ImageBlock{
-					BasicBlock: notionapi.BasicBlock{
-						Object: notionapi.ObjectTypeBlock,
-						Type:   notionapi.BlockTypeImage,
-					},
-					Image: notionapi.Image{
-						Type: notionapi.FileTypeExternal,
-						External: &notionapi.FileObject{
-							URL: remoteURL,
-						},
-					},
-				})
-			}
+			ss.Quote = quote
 		}
-		blocks = append(blocks, notionapi.DividerBlock{
-			BasicBlock: notionapi.BasicBlock{
-				Object: notionapi.ObjectTypeBlock,
-				Type:   notionapi.BlockTypeDivider,
-			},
-			Divider: notionapi.Divider{},
-		})
 	}
-	return blocks
 }
 
-func (saver *Saver) SaveToDirectory(thread []*SavedStatus) error {
-	if saver.outputPath == "" {
-		return fmt.Errorf("output path not set")
+// blueskyReplies flattens the replies below tvp.
+func blueskyReplies(tvp *appbsky.FeedDefs_ThreadViewPost) []*SavedStatus {
+	var result []*SavedStatus
+	for _, reply := range tvp.Replies {
+		if reply.FeedDefs_ThreadViewPost == nil {
+			continue
+		}
+		ss := savedFromBluesky(reply.FeedDefs_ThreadViewPost.Post)
+		ss.InReplyToID = tvp.Post.Cid
+		result = append(result, ss)
+		result = append(result, blueskyReplies(reply.FeedDefs_ThreadViewPost)...)
 	}
+	return result
+}
 
-	if err := os.MkdirAll(saver.outputPath, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+func (bf *BlueskyFetcher) Fetch(ctx context.Context, idOrUrl string) ([]*SavedStatus, error) {
+	// Example: https://bsky.app/profile/danrusei.bsky.social/post/3j7z7z7z7z7z7
+	uri, err := blueskyPostURI(ctx, bf.skyClient, idOrUrl)
+	if err != nil {
+		return nil, err
 	}
 
-	imagesDir := filepath.Join(saver.outputPath, "images")
-	if err := os.MkdirAll(imagesDir, 0755); err != nil {
-		return fmt.Errorf("failed to create images directory: %w", err)
+	depth := int64(0)
+	if bf.mode != ThreadAncestors && bf.mode != "" {
+		depth = kBlueskyReplyDepth
 	}
-
-	if len(saver.pageTitle) == 0 {
-		saver.pageTitle = ExtractTitle(thread[0])
+	threadOutput, err := appbsky.FeedGetPostThread(ctx, bf.skyClient, depth, 10, uri)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sanitize filename
-	filename := strings.Map(func(r rune) rune {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
-			return r
+	var thread []*appbsky.FeedDefs_ThreadViewPost
+	curr := threadOutput.Thread.FeedDefs_ThreadViewPost
+	for curr != nil {
+		thread = append(thread, curr)
+		if curr.Parent != nil && curr.Parent.FeedDefs_ThreadViewPost != nil {
+			curr = curr.Parent.FeedDefs_ThreadViewPost
+		} else {
+			curr = nil
 		}
-		return '_'
-	}, saver.pageTitle) + ".md"
-
-	mdPath := filepath.Join(saver.outputPath, filename)
-
-	var buf bytes.Buffer
-
-	// Frontmatter
-	type Frontmatter struct {
-		Title  string    `yaml:"title"`
-		Date   time.Time `yaml:"date"`
-		Author string    `yaml:"author"`
-		URL    string    `yaml:"url"`
-		ID     string    `yaml:"id"`
-		Tags   []string  `yaml:"tags"`
 	}
 
-	tags := []string{}
-	if strings.Contains(thread[0].URL, "bsky.app") {
-		tags = append(tags, "bluesky")
-	} else {
-		tags = append(tags, "mastodon")
+	// Reverse thread to original order
+	for i, j := 0, len(thread)-1; i < j; i, j = i+1, j-1 {
+		thread[i], thread[j] = thread[j], thread[i]
 	}
 
-	for _, tag := range thread[0].Tags {
-		tags = append(tags, tag.Name)
+	var result []*SavedStatus
+	for _, p := range thread {
+		result = append(result, savedFromBluesky(p.Post))
 	}
-
-	fm := Frontmatter{
-		Title:  saver.pageTitle,
-		Date:   thread[0].CreatedAt,
-		Author: fmt.Sprintf("%s (@%s)", thread[0].Account.DisplayName, thread[0].Account.Acct),
-		URL:    thread[0].URL,
-		ID:     string(thread[0].ID),
-		Tags:   tags,
+	if len(result) > 0 {
+		result[len(result)-1].Requested = true
 	}
+	if depth > 0 && len(result) > 0 {
+		descendants := blueskyReplies(threadOutput.Thread.FeedDefs_ThreadViewPost)
+		result = buildThread(result[:len(result)-1], result[len(result)-1], descendants, bf.mode)
+	}
+	bf.addBios(ctx, result)
+	return result, nil
+}
 
-	buf.WriteString("---\n")
-	fmBytes, err := yaml.Marshal(fm)
-	if err != nil {
-		return fmt.Errorf("failed to marshal frontmatter: %w", err)
-	}
-	buf.Write(fmBytes)
-	buf.WriteString("---\n\n")
-
-	// Content
-	for _, status := range thread {
-		// Simple HTML to Markdown conversion for content
-		content := status.Content
-		// Strip some tags or convert them
-		// This is a simplified version, ideally use a proper html-to-markdown lib
-		content = strings.ReplaceAll(content, "<p>", "")
-		content = strings.ReplaceAll(content, "</p>", "\n\n")
-		content = strings.ReplaceAll(content, "<br />", "\n")
-		content = strings.ReplaceAll(content, "<br/>", "\n")
-
-		// Remove other tags for a cleaner look
-		content = stripTagsPolicy.Sanitize(content)
-
-		buf.WriteString(content)
-		buf.WriteString("\n")
-
-		for _, ma := range status.MediaAttachments {
-			hashedName, err := saver.downloadAndHash(ma.URL, imagesDir)
-			if err != nil {
-				log.Printf("failed to download attachment %s: %v", ma.URL, err)
+// addBios fills in the bios of the thread's authors, which posts leave out.
+// Profiles that can't be fetched are logged and their bios left empty.
+func (bf *BlueskyFetcher) addBios(ctx context.Context, thread []*SavedStatus) {
+	byHandle := make(map[string][]*SavedStatus)
+	var handles []string
+	for _, ss := range thread {
+		if _, ok := byHandle[ss.Account.Acct]; !ok {
+			handles = append(handles, ss.Account.Acct)
+		}
+		byHandle[ss.Account.Acct] = append(byHandle[ss.Account.Acct], ss)
+	}
+	for start := 0; start < len(handles); start += kBlueskyProfileBatch {
+		batch := handles[start:min(start+kBlueskyProfileBatch, len(handles))]
+		out, err := appbsky.ActorGetProfiles(ctx, bf.skyClient, batch)
+		if err != nil {
+			log.Printf("failed to fetch the profiles of %s: %v", strings.Join(batch, ", "), err)
+			return
+		}
+		for _, profile := range out.Profiles {
+			if profile.Description == nil || *profile.Description == "" {
 				continue
 			}
-
-			// Obsidian link to images subfolder
-			buf.WriteString(fmt.Sprintf("![[images/%s]]\n", hashedName))
+			for _, ss := range byHandle[profile.Handle] {
+				ss.Account.Note = blueskyHTML(*profile.Description, nil)
+			}
 		}
-		buf.WriteString("\n---\n\n")
 	}
+}
 
-	return os.WriteFile(mdPath, buf.Bytes(), 0644)
+type Saver struct {
+	dryrun    bool
+	pageTitle string
+	// titles threads saved without a title, the default title when nil
+	titler  *Titler
+	fetcher Fetcher
+	// where threads are saved to
+	sink Sink
+	// where posts were saved before, nil to always save anew
+	index *DAO
+	// the full text index saved posts are added to, nil to not index them
+	search *DAO
 }
 
-func (saver *Saver) downloadAndHash(url string, destDir string) (string, error) {
-	if saver.dryrun {
-		log.Printf("[dryrun] would download and hash %s to %s", url, destDir)
-		return "dryrun_hash.png", nil
-	}
-	resp, err := http.Get(url)
+// isStreamingPlaylist reports whether url is an HLS playlist, which can
+// neither be copied nor played by notion or a Markdown viewer.
+func isStreamingPlaylist(url string) bool {
+	return strings.HasSuffix(strings.ToLower(path.Ext(url)), ".m3u8")
+}
+
+// notionMediaKind is the notion block type for a media type.
+func notionMediaKind(mediaType string) notionapi.BlockType {
+	switch mediaType {
+	case "", "image":
+		return notionapi.BlockTypeImage
+	case "video", "gifv":
+		return notionapi.BlockTypeVideo
+	case "audio":
+		return kBlockTypeAudio
+	}
+	return notionapi.BlockTypeFile
+}
+
+// fetchMedia downloads media and names it after the hash of its content,
+// converting JFIF images to JPEG.
+func fetchMedia(url string) ([]byte, string, error) {
+	resp, err := kMediaFetchClient.Get(url)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download file: %s", resp.Status)
+		return nil, "", fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+	limit := mediaFetchLimit(kDefaultMastodonLimits)
+	if resp.ContentLength > limit {
+		return nil, "", fmt.Errorf("can't download %s, it is larger than %s", url, humanSize(limit))
 	}
 
-	content, err := io.ReadAll(resp.Body)
+	content, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+	if int64(len(content)) > limit {
+		return nil, "", fmt.Errorf("can't download %s, it is larger than %s", url, humanSize(limit))
 	}
-
-	hash := sha256.Sum256(content)
-	hashStr := hex.EncodeToString(hash[:])
 
 	ext := strings.ToLower(filepath.Ext(url))
 	if ext == "" {
@@ -686,9 +676,6 @@ func (saver *Saver) downloadAndHash(url string, destDir string) (string, error)
 			if err := jpeg.Encode(&buf, img, nil); err == nil {
 				content = buf.Bytes()
 				ext = ".jpg"
-				// Re-calculate hash for the new content
-				hash = sha256.Sum256(content)
-				hashStr = hex.EncodeToString(hash[:])
 			} else {
 				log.Printf("failed to encode jfif as jpg: %v", err)
 			}
@@ -697,86 +684,73 @@ func (saver *Saver) downloadAndHash(url string, destDir string) (string, error)
 		}
 	}
 
-	filename := hashStr + ext
-	destPath := filepath.Join(destDir, filename)
-
-	err = os.WriteFile(destPath, content, 0644)
-	return filename, err
+	hash := sha256.Sum256(content)
+	return content, hex.EncodeToString(hash[:]) + ext, nil
 }
 
-func (saver *Saver) Save(idOrUrl string) error {
-	if saver.notionToken == "" && saver.notionClient != nil {
-		saver.notionToken = string(saver.notionClient.Token)
+func downloadAndHash(url string, destDir string, dryrun bool) (string, error) {
+	if dryrun {
+		log.Printf("[dryrun] would download and hash %s to %s", url, destDir)
+		return "dryrun_hash.png", nil
 	}
+	content, filename, err := fetchMedia(url)
+	if err != nil {
+		return "", err
+	}
+	return filename, os.WriteFile(filepath.Join(destDir, filename), content, 0644)
+}
 
+func (saver *Saver) Save(idOrUrl string) error {
 	thread, err := saver.fetcher.Fetch(context.Background(), idOrUrl)
 	if err != nil {
 		return err
 	}
 
 	if len(thread) == 0 {
-		fmt.Println("nothing found to save")
+		log.Println("nothing found to save")
 		return nil
 	}
 
 	if len(saver.pageTitle) == 0 {
-		saver.pageTitle = ExtractTitle(thread[0])
+		// every thread of an archive run gets its own title
+		titler := saver.titler
+		if titler == nil {
+			titler = defaultTitler
+		}
+		saver.pageTitle = titler.Title(thread[0])
+		defer func() { saver.pageTitle = "" }()
 	}
 
-	if saver.outputPath != "" {
-		return saver.SaveToDirectory(thread)
+	if saver.index != nil {
+		return saver.saveIndexed(context.Background(), thread)
 	}
+	saved, err := saver.sink.Write(context.Background(), thread, saver.pageTitle, "")
+	if err != nil {
+		return err
+	}
+	saver.printMediaReport()
+	saver.indexForSearch(thread, saved)
+	return nil
+}
 
-	blocks := saver.Blocks(thread)
-
-	for i := 0; i <= len(blocks)/100; i++ {
-		titleStr := saver.pageTitle
-		if i > 0 {
-			titleStr = fmt.Sprintf("%s %d", saver.pageTitle, i)
-		}
-		title := notionapi.Text{
-			Content: titleStr,
-		}
-		pageBlocks := blocks[i*100 : min(len(blocks), (i+1)*100)]
-
-		if len(pageBlocks) == 0 {
-			break
-		}
-		pageCreateRequest := notionapi.PageCreateRequest{
-			Parent: notionapi.Parent{
-				Type:   notionapi.ParentTypePageID,
-				PageID: notionapi.PageID(saver.notionParentID),
-			},
-			Properties: notionapi.Properties{
-				"title": notionapi.TitleProperty{
-					Title: []notionapi.RichText{
-						{
-							Type: notionapi.ObjectTypeText,
-							Text: &title,
-						},
-					},
-				},
-			},
-			Children: pageBlocks,
-		}
-		if saver.debug {
-			var buf bytes.Buffer
-			jenc := json.NewEncoder(&buf)
-			jenc.SetIndent("", "    ")
-			jenc.SetEscapeHTML(false)
-			err := jenc.Encode(pageCreateRequest)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("page request: %s\n", buf.String())
-		}
-		_, err := saver.notionClient.Page.Create(context.Background(), &pageCreateRequest)
-		if err != nil {
-			return err
-		}
+// savedPlatform names the network a status comes from.
+func savedPlatform(status *SavedStatus) string {
+	if strings.Contains(status.URL, "bsky.app") {
+		return "bluesky"
 	}
+	return "mastodon"
+}
 
-	return nil
+// Close closes the saver's indexes.
+func (saver *Saver) Close() error {
+	var err error
+	if saver.index != nil {
+		err = saver.index.db.Close()
+	}
+	if saver.search != nil {
+		err = errors.Join(err, saver.search.db.Close())
+	}
+	return err
 }
 
 func (saver *Saver) SaveToot(toot string) error {
@@ -1,52 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/jomei/notionapi"
+	mdon "github.com/mattn/go-mastodon"
 )
 
-func TestExtractTitle(t *testing.T) {
-	tests := []struct {
-		name     string
-		content  string
-		username string
-		expected string
-	}{
-		{
-			name:     "simple text",
-			content:  "<p>Hello world this is a test</p>",
-			username: "alice",
-			expected: "alice: Hello world this is a",
-		},
-		{
-			name:     "short text",
-			content:  "<p>Short</p>",
-			username: "bob",
-			expected: "bob: Short",
-		},
-		{
-			name:     "with links",
-			content:  "<p>Visit <a href=\"https://example.com\">Example</a> today!</p>",
-			username: "charlie",
-			expected: "charlie: Visit Example today !",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			status := &SavedStatus{
-				Content: tt.content,
-			}
-			status.Account.Username = tt.username
-			result := ExtractTitle(status)
-			if result != tt.expected {
-				t.Errorf("ExtractTitle() = %q, want %q", result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestConvertHtml2Blocks(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -77,7 +54,7 @@ func TestConvertHtml2Blocks(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			blocks := ConvertHtml2Blocks(tt.content)
+			blocks := ConvertHtml2Blocks(tt.content, nil)
 			if len(blocks) != tt.expected {
 				t.Errorf("ConvertHtml2Blocks() returned %d blocks, want %d", len(blocks), tt.expected)
 			}
@@ -89,3 +66,442 @@ func TestConvertHtml2Blocks(t *testing.T) {
 		})
 	}
 }
+
+func TestBlueskyFetcher_Fetch_RichTextAndEmbeds(t *testing.T) {
+	thread, err := os.ReadFile(filepath.Join("testdata", "bluesky", "thread.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/app.bsky.feed.getPostThread":
+			w.Write(thread)
+		case "/xrpc/app.bsky.actor.getProfiles":
+			if got := r.URL.Query()["actors"]; !slices.Equal(got, []string{"alice.bsky.social"}) {
+				t.Errorf("getProfiles of %q, want alice's alone", got)
+			}
+			fmt.Fprint(w, `{"profiles": [{"did": "did:plc:alice", "handle": "alice.bsky.social", "description": "Gophers & more\nat go.dev"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	fetcher := &BlueskyFetcher{
+		skyClient: &xrpc.Client{Client: new(http.Client), Host: server.URL},
+		mode:      ThreadAuthor,
+	}
+	statuses, err := fetcher.Fetch(context.Background(), "at://did:plc:alice/app.bsky.feed.post/3kpost")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("Fetch() returned %d statuses, want 2", len(statuses))
+	}
+
+	post := statuses[0]
+	for _, want := range []string{
+		`<span class="h-card"><a href="https://bsky.app/profile/did:plc:bob" class="u-url mention">@bob.bsky.social</a></span>`,
+		`<a href="https://go.dev/blog/">go.dev/blog</a>`,
+		`<a href="https://bsky.app/hashtag/golang" class="mention hashtag" rel="tag">#golang</a>`,
+		"</p><p>second paragraph</p>",
+	} {
+		if !strings.Contains(post.Content, want) {
+			t.Errorf("Content = %q, want it to contain %q", post.Content, want)
+		}
+	}
+	account := post.Account
+	if account.URL != "https://bsky.app/profile/alice.bsky.social" || !strings.HasSuffix(account.Avatar, "avatar@jpeg") ||
+		account.Note != "<p>Gophers &amp; more<br />at go.dev</p>" {
+		t.Errorf("Account = %+v, want alice's profile and bio", account)
+	}
+	if statuses[1].Account.Note != account.Note {
+		t.Errorf("Expected the bio on all of alice's posts, got %q", statuses[1].Account.Note)
+	}
+	if len(post.Tags) != 1 || post.Tags[0].Name != "golang" {
+		t.Errorf("Tags = %+v, want golang", post.Tags)
+	}
+	if len(post.MediaAttachments) != 1 || post.MediaAttachments[0].AltText != "a gopher" {
+		t.Errorf("MediaAttachments = %+v, want the image with its alt text", post.MediaAttachments)
+	}
+	if post.Quote == nil || post.Quote.Account.Acct != "carol.bsky.social" || post.Quote.Content != "<p>the quoted post</p>" {
+		t.Fatalf("Quote = %+v, want carol's post", post.Quote)
+	}
+	if post.Quote.Card == nil || post.Quote.Card.Title != "An article" {
+		t.Errorf("Quote.Card = %+v, want the article", post.Quote.Card)
+	}
+
+	video := statuses[1].MediaAttachments
+	if len(video) != 1 || video[0].Type != "video" || video[0].AltText != "a running gopher" ||
+		!strings.HasSuffix(video[0].PreviewURL, "thumbnail.jpg") {
+		t.Errorf("MediaAttachments = %+v, want the video", video)
+	}
+}
+
+func TestSaver_QuoteAndCard(t *testing.T) {
+	status := &SavedStatus{
+		ID:      "p",
+		Content: "<p>look</p>",
+		MediaAttachments: []SavedMedia{
+			{URL: "https://video.example/v.m3u8", RemoteURL: "https://video.example/v.m3u8", Type: "video", AltText: "a clip"},
+		},
+		Quote: &SavedStatus{
+			ID:      "q",
+			Content: "<p>quoted</p>",
+			URL:     "https://bsky.app/profile/carol.bsky.social/post/3kquoted",
+			Card:    &SavedCard{URL: "https://example.com/article", Title: "An article", Description: "About things"},
+		},
+	}
+	status.Quote.Account.Acct = "carol.bsky.social"
+
+	md := (&MarkdownSink{}).statusMarkdown(status, t.TempDir(), "images")
+	want := "look\n\n" +
+		"[▶ a clip](https://video.example/v.m3u8)\n" +
+		"\n" +
+		"> [!quote] [@carol.bsky.social](https://bsky.app/profile/carol.bsky.social/post/3kquoted)\n" +
+		"> quoted\n" +
+		">\n" +
+		"> > [!info] [An article](https://example.com/article)\n" +
+		"> > About things\n\n"
+	if md != want {
+		t.Errorf("statusMarkdown() = %q, want %q", md, want)
+	}
+
+	blocks := (&NotionSink{}).statusBlocks(status, 0)
+	var types []string
+	for _, b := range blocks {
+		types = append(types, string(b.GetType()))
+	}
+	if got := strings.Join(types, " "); got != "paragraph paragraph quote bookmark" {
+		t.Errorf("statusBlocks() types = %q, want %q", got, "paragraph paragraph quote bookmark")
+	}
+	quote := blocks[2].(notionapi.QuoteBlock).Quote.RichText
+	if quote[0].PlainText != "@carol.bsky.social" || quote[len(quote)-1].PlainText != "\nquoted" {
+		t.Errorf("quote rich text = %+v", quote)
+	}
+}
+
+func TestSavedFromMastodon_Media(t *testing.T) {
+	var status mdon.Status
+	err := json.Unmarshal([]byte(`{
+		"id": "1",
+		"media_attachments": [{
+			"id": "10",
+			"type": "gifv",
+			"url": "https://files.example/media/10.mp4",
+			"preview_url": "https://files.example/media/10.png",
+			"remote_url": null,
+			"description": "a dancing gopher",
+			"blurhash": "UBL_:rOpGG-oBUNG,qRj2so|=eE1w^n4S5NH",
+			"meta": {"original": {"width": 640, "height": 480}}
+		}]
+	}`), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := savedFromMastodon(&status).MediaAttachments
+	want := []SavedMedia{{
+		ID:         "10",
+		URL:        "https://files.example/media/10.mp4",
+		Type:       "gifv",
+		AltText:    "a dancing gopher",
+		PreviewURL: "https://files.example/media/10.png",
+		Blurhash:   "UBL_:rOpGG-oBUNG,qRj2so|=eE1w^n4S5NH",
+		Width:      640,
+		Height:     480,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MediaAttachments = %+v, want %+v", got, want)
+	}
+}
+
+func TestSaver_StatusMarkdown_Media(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	status := &SavedStatus{
+		Content: "<p>media</p>",
+		MediaAttachments: []SavedMedia{
+			{URL: server.URL + "/a.png", Type: "image", AltText: "a [gopher]"},
+			{URL: server.URL + "/b.mp4", Type: "video"},
+			{URL: server.URL + "/c.bin", Type: "unknown", AltText: "data"},
+		},
+	}
+	dir := t.TempDir()
+	md := (&MarkdownSink{}).statusMarkdown(status, dir, "images")
+
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	want := "media\n\n" +
+		"![a \\[gopher\\]](images/" + hash("/a.png") + ".png)\n" +
+		"![](images/" + hash("/b.mp4") + ".mp4)\n" +
+		"[data](images/" + hash("/c.bin") + ".bin)\n"
+	if md != want {
+		t.Errorf("statusMarkdown() = %q, want %q", md, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hash("/b.mp4")+".mp4")); err != nil {
+		t.Errorf("video was not downloaded: %v", err)
+	}
+}
+
+func TestExternalMediaBlock(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		want      notionapi.BlockType
+	}{
+		{"", notionapi.BlockTypeImage},
+		{"image", notionapi.BlockTypeImage},
+		{"video", notionapi.BlockTypeVideo},
+		{"gifv", notionapi.BlockTypeVideo},
+		{"audio", kBlockTypeAudio},
+		{"unknown", notionapi.BlockTypeFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			block := externalMediaBlock(tt.mediaType, nil, "https://files.example/m")
+			if block.GetType() != tt.want {
+				t.Errorf("externalMediaBlock(%q) type = %v, want %v", tt.mediaType, block.GetType(), tt.want)
+			}
+			b, err := json.Marshal(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), `"`+string(tt.want)+`":{`) {
+				t.Errorf("externalMediaBlock(%q) = %s, want a %s object", tt.mediaType, b, tt.want)
+			}
+		})
+	}
+}
+
+// hostTransport sends every request to the test server.
+type hostTransport struct {
+	server *httptest.Server
+}
+
+func (ht hostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, _ := url.Parse(ht.server.URL)
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSaver_SaveToNotion_Database(t *testing.T) {
+	var updated map[string]any
+	var created struct {
+		Parent     map[string]string `json:"parent"`
+		Properties map[string]any    `json:"properties"`
+		Children   []any             `json:"children"`
+	}
+	var appended []int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/databases/db1":
+			w.Write([]byte(`{"object": "database", "id": "db1", "properties": {
+				"Name": {"id": "title", "type": "title", "title": {}},
+				"URL": {"id": "u", "type": "url", "url": {}}
+			}}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/v1/databases/db1":
+			var body struct {
+				Properties map[string]any `json:"properties"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			updated = body.Properties
+			w.Write([]byte(`{"object": "database", "id": "db1"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/pages":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.Write([]byte(`{"object": "page", "id": "page1"}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/v1/blocks/page1/children":
+			var body struct {
+				Children []any `json:"children"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			appended = append(appended, len(body.Children))
+			w.Write([]byte(`{"object": "list", "results": []}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var thread []*SavedStatus
+	for i := range 130 {
+		ss := savedStatus(fmt.Sprint(i), "", "alice", i)
+		thread = append(thread, ss)
+	}
+	thread[0].URL = "https://bsky.app/profile/alice/post/0"
+	thread[0].Tags = []struct{ Name string }{{"go"}, {"Go"}, {"a,b"}}
+
+	sink := &NotionSink{
+		notionClient: notionapi.NewClient("token",
+			notionapi.WithHTTPClient(&http.Client{Transport: hostTransport{server}})),
+		notionDatabaseID: "db1",
+	}
+	if _, err := sink.SaveToNotion(context.Background(), thread, "thread", ""); err != nil {
+		t.Fatalf("SaveToNotion failed: %v", err)
+	}
+
+	var added []string
+	for name := range updated {
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	if got := strings.Join(added, ","); got != "Author,Date,Platform,Saved At,Tags" {
+		t.Errorf("added properties %q, want the missing ones", got)
+	}
+
+	if created.Parent["database_id"] != "db1" {
+		t.Errorf("page parent = %v, want database db1", created.Parent)
+	}
+	props, _ := json.Marshal(created.Properties)
+	for _, want := range []string{
+		`"Name":{"title":[{"text":{"content":"thread"}`,
+		`"Platform":{"select":{"name":"bluesky"}}`,
+		`"Tags":{"multi_select":[{"name":"go"},{"name":"ab"}]}`,
+		`"URL":{"url":"https://bsky.app/profile/alice/post/0"}`,
+		`"Author":{"rich_text":[{"text":{"content":"@alice"}`,
+	} {
+		if !strings.Contains(string(props), want) {
+			t.Errorf("page properties %s, want them to contain %s", props, want)
+		}
+	}
+
+	// heading, 130 statuses with dividers between them and a final divider
+	if len(created.Children) != 100 || !reflect.DeepEqual(appended, []int{100, 61}) {
+		t.Errorf("created page with %d blocks and appended %v, want 100 and [100 61]", len(created.Children), appended)
+	}
+}
+
+func TestMastodonFetcher_PollAndEdits(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/statuses/p":
+			fmt.Fprint(w, `{"id": "p", "content": "<p>Best pet?</p>", "spoiler_text": "pets",
+				"sensitive": true, "visibility": "unlisted", "language": "en",
+				"created_at": "2026-01-01T12:00:00Z", "edited_at": "2026-01-01T13:00:00Z",
+				"poll": {"id": "1", "expires_at": "2026-01-02T12:00:00Z", "expired": true, "multiple": false,
+					"votes_count": 3, "options": [{"title": "cats", "votes_count": 2}, {"title": "dogs", "votes_count": 1}]}}`)
+		case "/api/v1/statuses/p/history":
+			fmt.Fprint(w, `[{"content": "<p>Best pets?</p>", "created_at": "2026-01-01T12:00:00Z"},
+				{"content": "<p>Best pet?</p>", "spoiler_text": "pets", "created_at": "2026-01-01T13:00:00Z"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	fetcher := &MastodonFetcher{mClient: mdon.NewClient(&mdon.Config{Server: server.URL})}
+	thread, err := fetcher.Fetch(context.Background(), "p")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	status := thread[0]
+	if status.SpoilerText != "pets" || !status.Sensitive || status.Visibility != "unlisted" || status.Language != "en" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if status.Poll == nil || len(status.Poll.Options) != 2 || status.Poll.Options[0] != (SavedPollOption{Title: "cats", VotesCount: 2}) ||
+		!status.Poll.Expired || status.Poll.VotesCount != 3 {
+		t.Errorf("Unexpected poll %+v", status.Poll)
+	}
+	if status.EditedAt.Hour() != 13 || len(status.Edits) != 1 || status.Edits[0].Content != "<p>Best pets?</p>" {
+		t.Errorf("Expected the version before the edit, got %+v", status.Edits)
+	}
+}
+
+func TestSaver_ContentWarningPollAndEdits(t *testing.T) {
+	expires := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	edited := time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC)
+	status := &SavedStatus{
+		ID:          "p",
+		Content:     "<p>Best pet?</p>",
+		SpoilerText: "pets",
+		Poll: &SavedPoll{
+			Options:    []SavedPollOption{{Title: "cats | kittens", VotesCount: 2}, {Title: "dogs", VotesCount: 1}},
+			VotesCount: 3,
+			ExpiresAt:  expires,
+			Expired:    true,
+		},
+		EditedAt: edited,
+		Edits:    []SavedEdit{{Content: "<p>Best pets?</p>", CreatedAt: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}},
+	}
+	local := func(t time.Time) string { return t.Local().Format(time.DateTime) }
+
+	md := (&MarkdownSink{}).statusMarkdown(status, t.TempDir(), "images")
+	want := "> [!warning]- CW: pets\n" +
+		"> Best pet?\n" +
+		">\n" +
+		"> | Option | Votes |\n" +
+		"> | --- | --- |\n" +
+		"> | cats \\| kittens | 2 votes (67%) |\n" +
+		"> | dogs | 1 vote (33%) |\n" +
+		">\n" +
+		"> *3 votes, closed " + local(expires) + "*\n" +
+		">\n" +
+		"> > [!note]- Edited " + local(edited) + ", 1 earlier version\n" +
+		"> > **" + local(status.Edits[0].CreatedAt) + "**\n" +
+		"> >\n" +
+		"> > Best pets?\n\n"
+	if md != want {
+		t.Errorf("statusMarkdown() = %q, want %q", md, want)
+	}
+
+	blocks := (&NotionSink{}).statusBlocks(status, 0)
+	cw, ok := blocks[0].(notionapi.ToggleBlock)
+	if len(blocks) != 1 || !ok || cw.Toggle.RichText[0].Text.Content != "CW: pets" {
+		t.Fatalf("Expected the post folded under its content warning, got %+v", blocks)
+	}
+	var types []string
+	for _, b := range cw.Toggle.Children {
+		types = append(types, string(b.GetType()))
+	}
+	if got := strings.Join(types, " "); got != "paragraph table paragraph toggle" {
+		t.Errorf("statusBlocks() types = %q, want the text, poll, its summary and the edits", got)
+	}
+	if table := cw.Toggle.Children[1].(notionapi.TableBlock); len(table.Table.Children) != 3 {
+		t.Errorf("Expected a header and a row per option, got %d rows", len(table.Table.Children))
+	}
+
+	// replies two toggles deep can't nest a table's rows or the edits
+	status.SpoilerText = ""
+	types = nil
+	for _, b := range (&NotionSink{}).statusBlocks(status, kMaxNotionNesting) {
+		types = append(types, string(b.GetType()))
+	}
+	if got := strings.Join(types, " "); got != "paragraph bulleted_list_item bulleted_list_item paragraph paragraph" {
+		t.Errorf("statusBlocks() types = %q, want the poll as a list and the edits noted", got)
+	}
+
+	status.SpoilerText = "pets"
+	page, err := renderThreadHTML([]*SavedStatus{status}, "poll", func(ma SavedMedia) (string, error) { return ma.URL, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<summary>CW: pets</summary>", "<td>cats | kittens</td><td>2 votes (67%)</td>",
+		"<summary>Edited " + local(edited) + ", 1 earlier version</summary>", "<p>Best pets?</p>"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("Expected %q in the page", want)
+		}
+	}
+}
+
+func TestFetchMedia_TooLarge(t *testing.T) {
+	limit := mediaFetchLimit(kDefaultMastodonLimits)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.FormatInt(limit+1, 10))
+	}))
+	defer server.Close()
+
+	if _, _, err := fetchMedia(server.URL + "/huge.png"); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("Expected fetchMedia to refuse media over the limit, got %v", err)
+	}
+}
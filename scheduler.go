@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+// Mastodon rejects scheduled_at values less than five minutes in the future.
+const kMinScheduleLead = 5 * time.Minute
+
+const kSchedulerPollInterval = 30 * time.Second
+
+// how long after its time a scheduled root may take to show up among the
+// account's statuses before the chain is given up on
+const kScheduledRootGrace = 10 * time.Minute
+
+// errScheduledRootMissing is returned for a chain whose scheduled root is
+// gone without having been published, deleted or edited outside mastosync.
+var errScheduledRootMissing = errors.New("scheduled root was neither found scheduled nor published")
+
+// ScheduledStatus is a status waiting in Mastodon's scheduled statuses queue.
+type ScheduledStatus struct {
+	ID               mdon.ID              `json:"id"`
+	ScheduledAt      time.Time            `json:"scheduled_at"`
+	Params           mdon.ScheduledParams `json:"params"`
+	MediaAttachments []mdon.Attachment    `json:"media_attachments"`
+}
+
+type PendingMedia struct {
+	Path      string
+	AltText   string
+	Focus     string
+	Thumbnail string
+}
+
+type PendingToot struct {
+	Text  string
+	Media []PendingMedia
+	Poll  *mdon.TootPoll
+	Quote string `json:",omitempty"`
+}
+
+// PendingChain is a chain whose root was handed to Mastodon's scheduler.
+// Scheduled statuses can't reply to each other, so the rest of the chain is
+// kept locally and posted once the root has been published.
+type PendingChain struct {
+	ScheduledID string
+	ScheduledAt time.Time
+	RootText    string
+	Toots       []PendingToot
+	// the last status of the chain posted so far; Toots only holds the ones
+	// still to be posted after it
+	PostedID string `json:",omitempty"`
+}
+
+var scheduleLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+}
+
+// ParseScheduleTime parses a --at value. Times without a zone are local.
+func ParseScheduleTime(s string, now time.Time) (time.Time, error) {
+	var t time.Time
+	var err error
+	for _, layout := range scheduleLayouts {
+		t, err = time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid schedule time %q, use e.g. 2006-01-02 15:04 or RFC3339", s)
+	}
+	if t.Before(now.Add(kMinScheduleLead)) {
+		return time.Time{}, fmt.Errorf("schedule time %s must be at least %s in the future", t.Format(time.RFC3339), kMinScheduleLead)
+	}
+	return t, nil
+}
+
+// Schedule hands the chain's root to Mastodon's scheduler and records the rest
+// of the chain in pendingDir.
+func (ttr *Tooter) Schedule(chain []*ChainToot) (*PendingChain, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("nothing to schedule")
+	}
+	if ttr.scheduledAt == nil {
+		return nil, fmt.Errorf("schedule time not set")
+	}
+
+	toot, err := ttr.buildToot(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	toot.ScheduledAt = ttr.scheduledAt
+	toot.InReplyToID = ttr.inReplyTo
+
+	// for scheduled toots mastodon answers with a ScheduledStatus, so only
+	// the ID is meaningful here
+	scheduled, err := ttr.post(toot, chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &PendingChain{
+		ScheduledID: string(scheduled.ID),
+		ScheduledAt: *ttr.scheduledAt,
+		RootText:    chain[0].Text,
+	}
+	for _, ct := range chain[1:] {
+		pt := PendingToot{Text: ct.Text, Poll: ct.Poll, Quote: ct.Quote}
+		for _, tm := range ct.Media {
+			// scheduled run may start in another directory
+			path, err := filepath.Abs(ttr.ResolvePath(tm.path))
+			if err != nil {
+				return nil, err
+			}
+			pm := PendingMedia{
+				Path:    path,
+				AltText: tm.altText,
+				Focus:   tm.focus,
+			}
+			if tm.thumbnail != "" {
+				if pm.Thumbnail, err = filepath.Abs(ttr.ResolvePath(tm.thumbnail)); err != nil {
+					return nil, err
+				}
+			}
+			pt.Media = append(pt.Media, pm)
+		}
+		pending.Toots = append(pending.Toots, pt)
+	}
+
+	err = WritePendingChain(ttr.pendingDir, pending)
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func pendingChainPath(pendingDir string, scheduledID string) string {
+	return filepath.Join(pendingDir, scheduledID+".json")
+}
+
+func WritePendingChain(pendingDir string, pending *PendingChain) error {
+	if err := os.MkdirAll(pendingDir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pendingChainPath(pendingDir, pending.ScheduledID), b, 0600)
+}
+
+func ReadPendingChains(pendingDir string) ([]*PendingChain, error) {
+	paths, err := filepath.Glob(filepath.Join(pendingDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var result []*PendingChain
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		pending := &PendingChain{}
+		if err := json.Unmarshal(b, pending); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		result = append(result, pending)
+	}
+	return result, nil
+}
+
+// normalizeText reduces status text or HTML content to its visible characters
+// so a published status can be matched with the text it was scheduled with.
+func normalizeText(s string) string {
+	s = html.UnescapeString(stripTagsPolicy.Sanitize(s))
+	// remote mentions are rendered without their domain
+	s = tootMention.ReplaceAllString(s, "$1")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+type Scheduler struct {
+	mClient    *mdon.Client
+	pendingDir string
+	pollEvery  time.Duration
+	media      *MediaPipeline
+}
+
+func (sch *Scheduler) List(ctx context.Context) ([]*ScheduledStatus, error) {
+	var scheduled []*ScheduledStatus
+	err := mastodonAPI(ctx, sch.mClient, http.MethodGet, "/api/v1/scheduled_statuses", nil, &scheduled)
+	if err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// Cancel removes the scheduled status and forgets the rest of its chain.
+func (sch *Scheduler) Cancel(ctx context.Context, id string) error {
+	err := mastodonAPI(ctx, sch.mClient, http.MethodDelete, "/api/v1/scheduled_statuses/"+id, nil, nil)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	notFound := err != nil
+	err = os.Remove(pendingChainPath(sch.pendingDir, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if notFound && os.IsNotExist(err) {
+		return fmt.Errorf("no scheduled status %s", id)
+	}
+	return nil
+}
+
+// findPublishedRoot looks through the account's recent statuses for the one
+// the scheduler published for pending.
+func (sch *Scheduler) findPublishedRoot(ctx context.Context, pending *PendingChain) (*mdon.Status, error) {
+	account, err := sch.mClient.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := sch.mClient.GetAccountStatuses(ctx, account.ID, &mdon.Pagination{Limit: 40})
+	if err != nil {
+		return nil, err
+	}
+	rootText := normalizeText(pending.RootText)
+	for _, status := range statuses {
+		if status.CreatedAt.Before(pending.ScheduledAt.Add(-time.Minute)) {
+			continue
+		}
+		if normalizeText(status.Content) == rootText {
+			return status, nil
+		}
+	}
+	return nil, nil
+}
+
+// Advance posts the rest of a pending chain if its root has been published.
+// It reports whether the chain is done, and fails with errScheduledRootMissing
+// when the root is gone without being published. Progress is written back after every
+// toot, so a chain that fails partway resumes after the last toot posted.
+func (sch *Scheduler) Advance(ctx context.Context, pending *PendingChain) (bool, error) {
+	replyTo := mdon.ID(pending.PostedID)
+	if replyTo == "" {
+		if time.Now().Before(pending.ScheduledAt) {
+			return false, nil
+		}
+		err := mastodonAPI(ctx, sch.mClient, http.MethodGet, "/api/v1/scheduled_statuses/"+pending.ScheduledID, nil, nil)
+		if err == nil {
+			return false, nil
+		}
+		if !isNotFound(err) {
+			return false, err
+		}
+
+		root, err := sch.findPublishedRoot(ctx, pending)
+		if err != nil {
+			return false, err
+		}
+		if root == nil {
+			if time.Since(pending.ScheduledAt) < kScheduledRootGrace {
+				return false, nil
+			}
+			return false, fmt.Errorf("%w; remove %s to give up on the chain", errScheduledRootMissing,
+				pendingChainPath(sch.pendingDir, pending.ScheduledID))
+		}
+		replyTo = root.ID
+	}
+
+	ttr := &Tooter{mClient: sch.mClient, media: sch.media}
+	for len(pending.Toots) > 0 {
+		pt := pending.Toots[0]
+		ct := &ChainToot{Text: pt.Text, Poll: pt.Poll, Quote: pt.Quote}
+		for _, pm := range pt.Media {
+			ct.Media = append(ct.Media, &TootMedia{
+				path:      pm.Path,
+				altText:   pm.AltText,
+				focus:     pm.Focus,
+				thumbnail: pm.Thumbnail,
+			})
+		}
+		status, err := ttr.PostChain([]*ChainToot{ct}, replyTo)
+		if err != nil {
+			return false, err
+		}
+		replyTo = status.ID
+		pending.PostedID = string(status.ID)
+		pending.Toots = pending.Toots[1:]
+		if err := WritePendingChain(sch.pendingDir, pending); err != nil {
+			return false, fmt.Errorf("posted %s but failed to record it: %w", status.ID, err)
+		}
+	}
+
+	err := os.Remove(pendingChainPath(sch.pendingDir, pending.ScheduledID))
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+func (sch *Scheduler) pollInterval() time.Duration {
+	if sch.pollEvery == 0 {
+		return kSchedulerPollInterval
+	}
+	return sch.pollEvery
+}
+
+// Wait blocks until the root of pending has been published and the rest of
+// the chain posted.
+func (sch *Scheduler) Wait(ctx context.Context, pending *PendingChain) error {
+	for {
+		done, err := sch.Advance(ctx, pending)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		delay := sch.pollInterval()
+		if untilRoot := time.Until(pending.ScheduledAt); untilRoot > delay {
+			delay = untilRoot
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Run advances all pending chains once, or, with wait set, until every
+// pending chain has been posted.
+func (sch *Scheduler) Run(ctx context.Context, wait bool) error {
+	for {
+		pendings, err := ReadPendingChains(sch.pendingDir)
+		if err != nil {
+			return err
+		}
+		var outstanding int
+		for _, pending := range pendings {
+			done, err := sch.Advance(ctx, pending)
+			if err != nil {
+				log.Printf("failed to advance scheduled chain %s: %v", pending.ScheduledID, err)
+			}
+			switch {
+			case done:
+				log.Printf("posted the rest of scheduled chain %s", pending.ScheduledID)
+			case errors.Is(err, errScheduledRootMissing):
+				// waiting won't bring it back
+			default:
+				outstanding++
+			}
+		}
+		if !wait || outstanding == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sch.pollInterval()):
+		}
+	}
+}
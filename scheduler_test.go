@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "local time",
+			input: "2026-03-01 18:30",
+			want:  time.Date(2026, 3, 1, 18, 30, 0, 0, time.Local),
+		},
+		{
+			name:  "rfc3339",
+			input: "2026-03-02T08:00:00Z",
+			want:  time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "too soon",
+			input:   "2026-03-01 12:02",
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			input:   "tomorrow",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScheduleTime(tt.input, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseScheduleTime failed: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseScheduleTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type mockScheduleServer struct {
+	published bool
+	rootText  string
+	posted    []postedToot
+	// fails posting the reply of this text
+	failText string
+}
+
+type postedToot struct {
+	status    string
+	inReplyTo string
+}
+
+func (m *mockScheduleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/statuses":
+		r.ParseForm()
+		if r.Form.Get("scheduled_at") != "" {
+			m.rootText = r.Form.Get("status")
+			json.NewEncoder(w).Encode(map[string]any{
+				"id":           "sched-1",
+				"scheduled_at": r.Form.Get("scheduled_at"),
+				"params":       map[string]any{"text": m.rootText},
+			})
+			return
+		}
+		if m.failText != "" && r.Form.Get("status") == m.failText {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error":"boom"}`)
+			return
+		}
+		m.posted = append(m.posted, postedToot{
+			status:    r.Form.Get("status"),
+			inReplyTo: r.Form.Get("in_reply_to_id"),
+		})
+		json.NewEncoder(w).Encode(mdon.Status{ID: mdon.ID(fmt.Sprintf("posted-%d", len(m.posted)))})
+	case r.URL.Path == "/api/v1/scheduled_statuses/sched-1":
+		if m.published {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"Record not found"}`)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": "sched-1"})
+	case r.URL.Path == "/api/v1/accounts/verify_credentials":
+		json.NewEncoder(w).Encode(mdon.Account{ID: "me"})
+	case r.URL.Path == "/api/v1/accounts/me/statuses":
+		json.NewEncoder(w).Encode([]*mdon.Status{
+			{ID: "older", Content: "<p>something else</p>", CreatedAt: time.Now().Add(-time.Hour)},
+			{ID: "root", Content: "<p>1/2<br />" + m.rootText[4:] + "</p>", CreatedAt: time.Now()},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestScheduler_ScheduleAndAdvance(t *testing.T) {
+	mock := &mockScheduleServer{}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	pendingDir, err := os.MkdirTemp("", "scheduled")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(pendingDir)
+
+	client := mdon.NewClient(&mdon.Config{Server: server.URL})
+	scheduledAt := time.Now().Add(-time.Minute)
+	ttr := &Tooter{
+		mClient:     client,
+		pendingDir:  pendingDir,
+		scheduledAt: &scheduledAt,
+	}
+	chain := []*ChainToot{
+		{Text: "1/2\nThe root of the chain."},
+		{Text: "2/2\nThe reply."},
+	}
+
+	pending, err := ttr.Schedule(chain)
+	if err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	if pending.ScheduledID != "sched-1" {
+		t.Errorf("Expected scheduled id sched-1, got %q", pending.ScheduledID)
+	}
+	if len(mock.posted) != 0 {
+		t.Fatalf("Expected nothing posted yet, got %v", mock.posted)
+	}
+
+	pendings, err := ReadPendingChains(pendingDir)
+	if err != nil {
+		t.Fatalf("ReadPendingChains failed: %v", err)
+	}
+	if len(pendings) != 1 || len(pendings[0].Toots) != 1 {
+		t.Fatalf("Expected one pending chain with one toot, got %+v", pendings)
+	}
+
+	scheduler := &Scheduler{mClient: client, pendingDir: pendingDir}
+
+	done, err := scheduler.Advance(context.Background(), pendings[0])
+	if err != nil {
+		t.Fatalf("Advance failed: %v", err)
+	}
+	if done {
+		t.Fatal("Expected chain to wait while the root is still scheduled")
+	}
+
+	mock.published = true
+	done, err = scheduler.Advance(context.Background(), pendings[0])
+	if err != nil {
+		t.Fatalf("Advance failed: %v", err)
+	}
+	if !done {
+		t.Fatal("Expected chain to be done after the root was published")
+	}
+	if len(mock.posted) != 1 || mock.posted[0].inReplyTo != "root" {
+		t.Errorf("Expected the reply to be posted to the root, got %+v", mock.posted)
+	}
+
+	pendings, err = ReadPendingChains(pendingDir)
+	if err != nil {
+		t.Fatalf("ReadPendingChains failed: %v", err)
+	}
+	if len(pendings) != 0 {
+		t.Errorf("Expected pending chain to be removed, got %d", len(pendings))
+	}
+}
+
+func TestScheduler_ScheduleKeepsAbsoluteMediaPaths(t *testing.T) {
+	server := httptest.NewServer(&mockScheduleServer{})
+	defer server.Close()
+
+	scheduledAt := time.Now().Add(time.Hour)
+	ttr := &Tooter{
+		mClient:     mdon.NewClient(&mdon.Config{Server: server.URL}),
+		pendingDir:  t.TempDir(),
+		scheduledAt: &scheduledAt,
+		tootsPath:   "chains/toots.txt",
+	}
+	chain := []*ChainToot{
+		{Text: "1/2\nThe root."},
+		{Text: "2/2\nWith media.", Media: []*TootMedia{{path: "a.png", thumbnail: "a_thumb.png"}}},
+	}
+	pending, err := ttr.Schedule(chain)
+	if err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PendingMedia{Path: filepath.Join(wd, "chains", "a.png"), Thumbnail: filepath.Join(wd, "chains", "a_thumb.png")}
+	if got := pending.Toots[0].Media[0]; got != want {
+		t.Errorf("Expected media paths independent of the working directory, got %+v, want %+v", got, want)
+	}
+}
+
+func TestScheduler_AdvanceResumes(t *testing.T) {
+	mock := &mockScheduleServer{published: true, failText: "3/4"}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	pendingDir := t.TempDir()
+
+	client := mdon.NewClient(&mdon.Config{Server: server.URL})
+	scheduledAt := time.Now().Add(-time.Minute)
+	mock.rootText = "1/2\nThe root."
+	pending := &PendingChain{
+		ScheduledID: "sched-1",
+		ScheduledAt: scheduledAt,
+		RootText:    mock.rootText,
+		Toots:       []PendingToot{{Text: "2/4"}, {Text: "3/4"}, {Text: "4/4"}},
+	}
+	if err := WritePendingChain(pendingDir, pending); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := &Scheduler{mClient: client, pendingDir: pendingDir}
+	if _, err := scheduler.Advance(context.Background(), pending); err == nil {
+		t.Fatal("Expected Advance to fail")
+	}
+	pendings, err := ReadPendingChains(pendingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pendings) != 1 || pendings[0].PostedID != "posted-1" || len(pendings[0].Toots) != 2 {
+		t.Fatalf("Expected the posted toot dropped from the pending chain, got %+v", pendings)
+	}
+
+	mock.failText = ""
+	done, err := scheduler.Advance(context.Background(), pendings[0])
+	if err != nil || !done {
+		t.Fatalf("Advance = %v, %v, want done", done, err)
+	}
+	want := []postedToot{{"2/4", "root"}, {"3/4", "posted-1"}, {"4/4", "posted-2"}}
+	if !reflect.DeepEqual(mock.posted, want) {
+		t.Errorf("Expected each toot posted once in order, got %+v", mock.posted)
+	}
+}
+
+func TestScheduler_AdvanceRootMissing(t *testing.T) {
+	mock := &mockScheduleServer{published: true, rootText: "1/2\nSomething else."}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	pendingDir := t.TempDir()
+
+	scheduler := &Scheduler{mClient: mdon.NewClient(&mdon.Config{Server: server.URL}), pendingDir: pendingDir}
+	pending := &PendingChain{
+		ScheduledID: "sched-1",
+		ScheduledAt: time.Now().Add(-time.Minute),
+		RootText:    "1/2\nThe deleted root.",
+		Toots:       []PendingToot{{Text: "2/2"}},
+	}
+	// the root may still be on its way
+	if done, err := scheduler.Advance(context.Background(), pending); done || err != nil {
+		t.Errorf("Advance = %v, %v, want to wait for the root", done, err)
+	}
+
+	pending.ScheduledAt = time.Now().Add(-kScheduledRootGrace - time.Minute)
+	_, err := scheduler.Advance(context.Background(), pending)
+	if !errors.Is(err, errScheduledRootMissing) || !strings.Contains(err.Error(), pendingChainPath(pendingDir, "sched-1")) {
+		t.Errorf("Expected the missing root reported with the pending file, got %v", err)
+	}
+	if len(mock.posted) != 0 {
+		t.Errorf("Expected nothing posted, got %+v", mock.posted)
+	}
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	mock := &mockScheduleServer{}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	pendingDir, err := os.MkdirTemp("", "scheduled")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(pendingDir)
+
+	err = WritePendingChain(pendingDir, &PendingChain{ScheduledID: "sched-1"})
+	if err != nil {
+		t.Fatalf("WritePendingChain failed: %v", err)
+	}
+
+	scheduler := &Scheduler{
+		mClient:    mdon.NewClient(&mdon.Config{Server: server.URL}),
+		pendingDir: pendingDir,
+	}
+	err = scheduler.Cancel(context.Background(), "sched-1")
+	if err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if _, err := os.Stat(pendingChainPath(pendingDir, "sched-1")); !os.IsNotExist(err) {
+		t.Errorf("Expected pending chain file to be removed")
+	}
+
+	mock.published = true
+	err = scheduler.Cancel(context.Background(), "sched-1")
+	if err == nil {
+		t.Error("Expected error cancelling an unknown scheduled status")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// The search index is an FTS5 table. go-sqlite3 only has FTS5 when built with
+// the sqlite_fts5 tag; without it a new index falls back to FTS4 with a warning.
+const createSearchFTS5SQL string = `CREATE VIRTUAL TABLE IF NOT EXISTS searchindex USING fts5(
+		   kind UNINDEXED, platform UNINDEXED, key UNINDEXED, date UNINDEXED,
+		   author, title, content, tags, link, refs
+	    );`
+const createSearchFTS4SQL string = `CREATE VIRTUAL TABLE IF NOT EXISTS searchindex USING fts4(
+		   kind, platform, key, date, author, title, content, tags, link, refs,
+		   notindexed=kind, notindexed=platform, notindexed=key, notindexed=date
+	    );`
+const deleteSearchSQL string = "DELETE FROM searchindex WHERE kind=? AND key=?"
+const insertSearchSQL string = `INSERT INTO searchindex (kind, platform, key, date, author, title, content, tags, link, refs)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// the column of searchindex snippets are taken from
+const kSearchContentColumn = 6
+
+const (
+	SearchSynced = "synced"
+	SearchSaved  = "saved"
+)
+
+// SearchDoc is a synced feed item or a saved post in the search index.
+type SearchDoc struct {
+	// SearchSynced or SearchSaved
+	Kind     string
+	Platform string
+	// the feed item's GUID or the post's ID, unique within Kind
+	Key     string
+	Date    time.Time
+	Author  string
+	Title   string
+	Content string
+	Tags    []string
+	Link    string
+	// post IDs, media URLs and where the post was saved to
+	Refs []string
+}
+
+// SearchQuery is what to search for, with filters left empty matching all.
+type SearchQuery struct {
+	Text     string
+	Platform string
+	Kind     string
+	// matches part of the author's name or account
+	Author string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// SearchResult is a document that matched, with the matching part of its
+// content.
+type SearchResult struct {
+	SearchDoc
+	Snippet string
+}
+
+// errSearchNeedsFTS5 is returned for an index created by a build with FTS5
+// when this build has no FTS5.
+var errSearchNeedsFTS5 = errors.New("needs a build with the sqlite_fts5 tag")
+
+// OpenSearchIndex opens the full text index of synced and saved posts,
+// creating it if needed. An index keeps the module it was created with, so a
+// build with FTS5 goes on using an FTS4 index created without it.
+func OpenSearchIndex(path string) (*DAO, error) {
+	dao, err := OpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+	var hasFTS5 bool
+	if err := dao.db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&hasFTS5); err != nil {
+		dao.db.Close()
+		return nil, err
+	}
+	var create string
+	err = dao.db.QueryRow("SELECT sql FROM sqlite_master WHERE name='searchindex'").Scan(&create)
+	switch {
+	case err == nil:
+		dao.searchFTS5 = strings.Contains(strings.ToLower(create), "fts5")
+		if dao.searchFTS5 && !hasFTS5 {
+			dao.db.Close()
+			return nil, fmt.Errorf("search index %s %w", path, errSearchNeedsFTS5)
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		createSQL := createSearchFTS5SQL
+		if !hasFTS5 {
+			log.Printf("warning: built without the sqlite_fts5 tag, the new search index %s uses FTS4 and lists matches newest first rather than best first", path)
+			createSQL = createSearchFTS4SQL
+		}
+		if _, err := dao.db.Exec(createSQL); err != nil {
+			dao.db.Close()
+			return nil, err
+		}
+		dao.searchFTS5 = hasFTS5
+	default:
+		dao.db.Close()
+		return nil, err
+	}
+	return dao, nil
+}
+
+// openSearchIndexForUpdates opens the search index sync and save add to. They
+// go on without it, returning nil, when this build can't use the index.
+func openSearchIndexForUpdates(dir string) (*DAO, error) {
+	index, err := OpenSearchIndex(filepath.Join(dir, "search.sqlite3"))
+	if errors.Is(err, errSearchNeedsFTS5) {
+		log.Printf("not indexing for search: %v", err)
+		return nil, nil
+	}
+	return index, err
+}
+
+// IndexForSearch adds a document to the search index, replacing the one of
+// the same kind and key.
+func (dao *DAO) IndexForSearch(doc SearchDoc) error {
+	tx, err := dao.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteSearchSQL, doc.Kind, doc.Key); err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertSearchSQL, doc.Kind, doc.Platform, doc.Key, doc.Date.UTC().Format(time.RFC3339),
+		doc.Author, doc.Title, doc.Content, strings.Join(doc.Tags, " "), doc.Link, strings.Join(doc.Refs, " "))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Search returns the documents matching the query, best matches first with
+// FTS5 and newest first with FTS4.
+func (dao *DAO) Search(q SearchQuery) ([]SearchResult, error) {
+	match := searchMatch(q.Text, dao.searchFTS5)
+	if match == "" {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+	snippet := fmt.Sprintf("snippet(searchindex, '[', ']', '…', %d, 16)", kSearchContentColumn)
+	order := "date DESC"
+	if dao.searchFTS5 {
+		snippet = fmt.Sprintf("snippet(searchindex, %d, '[', ']', '…', 16)", kSearchContentColumn)
+		order = "rank"
+	}
+
+	query := "SELECT kind, platform, key, date, author, title, tags, link, refs, " + snippet +
+		" FROM searchindex WHERE searchindex MATCH ?"
+	args := []any{match}
+	if q.Platform != "" {
+		query += " AND platform = ?"
+		args = append(args, q.Platform)
+	}
+	if q.Kind != "" {
+		query += " AND kind = ?"
+		args = append(args, q.Kind)
+	}
+	if q.Author != "" {
+		query += " AND author LIKE ?"
+		args = append(args, "%"+q.Author+"%")
+	}
+	if !q.Since.IsZero() {
+		query += " AND date >= ?"
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query += " AND date < ?"
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	query += " ORDER BY " + order + " LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := dao.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		var date, tags, refs string
+		if err := rows.Scan(&r.Kind, &r.Platform, &r.Key, &date, &r.Author, &r.Title, &tags, &r.Link, &refs, &r.Snippet); err != nil {
+			return nil, err
+		}
+		if r.Date, err = time.Parse(time.RFC3339, date); err != nil {
+			return nil, err
+		}
+		r.Tags = strings.Fields(tags)
+		r.Refs = strings.Fields(refs)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// searchMatch turns what was typed into a full text query: each word is
+// looked up as it is, and a word ending in * as a prefix. Words are quoted so
+// punctuation like @ or - doesn't trip up the query syntax, and FTS4 has no
+// way to escape quotes within them.
+func searchMatch(text string, fts5 bool) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.ReplaceAll(strings.TrimRight(word, "*"), `"`, "")
+		if word == "" {
+			continue
+		}
+		switch {
+		case prefix && fts5:
+			terms = append(terms, `"`+word+`"*`)
+		case prefix:
+			terms = append(terms, `"`+word+`*"`)
+		default:
+			terms = append(terms, `"`+word+`"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// savedSearchDocs are the documents of the posts of a saved thread.
+func savedSearchDocs(thread []*SavedStatus, title string, target string) []SearchDoc {
+	var docs []SearchDoc
+	for _, status := range thread {
+		platform := savedPlatform(status)
+		doc := SearchDoc{
+			Kind:     SearchSaved,
+			Platform: platform,
+			Key:      platform + ":" + status.ID,
+			Date:     status.CreatedAt,
+			Author:   fmt.Sprintf("%s (@%s)", status.Account.DisplayName, status.Account.Acct),
+			Title:    title,
+			Content:  ConvertHtml2Markdown(status.Content),
+			Link:     status.URL,
+			Refs:     []string{status.ID},
+		}
+		if status.SpoilerText != "" {
+			doc.Content = status.SpoilerText + "\n" + doc.Content
+		}
+		if status.Poll != nil {
+			for _, option := range status.Poll.Options {
+				doc.Content += "\n" + option.Title
+			}
+		}
+		for _, tag := range status.Tags {
+			doc.Tags = append(doc.Tags, tag.Name)
+		}
+		for _, ma := range status.MediaAttachments {
+			doc.Refs = append(doc.Refs, ma.URL)
+			if ma.AltText != "" {
+				doc.Content += "\n" + ma.AltText
+			}
+		}
+		if target != "" {
+			doc.Refs = append(doc.Refs, target)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// syncedSearchDoc is the document of a feed item posted as postID.
+func syncedSearchDoc(item *gofeed.Item, platform string, postID string, postedAt time.Time) SearchDoc {
+	doc := SearchDoc{
+		Kind:     SearchSynced,
+		Platform: platform,
+		Key:      platform + ":" + item.GUID,
+		Date:     postedAt,
+		Title:    item.Title,
+		Content:  ConvertHtml2Markdown(item.Description),
+		Tags:     item.Categories,
+		Link:     item.Link,
+		Refs:     []string{postID, item.GUID},
+	}
+	if item.PublishedParsed != nil {
+		doc.Date = *item.PublishedParsed
+	}
+	var authors []string
+	for _, author := range item.Authors {
+		if author != nil && author.Name != "" {
+			authors = append(authors, author.Name)
+		}
+	}
+	doc.Author = strings.Join(authors, ", ")
+	return doc
+}
+
+// indexForSearch adds the saved thread to the search index, logging failures
+// rather than failing the save.
+func (saver *Saver) indexForSearch(thread []*SavedStatus, target string) {
+	if saver.search == nil || saver.dryrun {
+		return
+	}
+	for _, doc := range savedSearchDocs(thread, saver.pageTitle, target) {
+		if err := saver.search.IndexForSearch(doc); err != nil {
+			log.Printf("failed to index %s for search: %v", doc.Key, err)
+			return
+		}
+	}
+}
+
+// formatSearchResults lists the results, one paragraph each.
+func formatSearchResults(results []SearchResult) string {
+	if len(results) == 0 {
+		return "nothing found"
+	}
+	var sb strings.Builder
+	for i, r := range results {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%s  %s  %s  %s\n", r.Date.Local().Format(time.DateOnly), r.Platform, r.Kind, r.Title)
+		if r.Author != "" {
+			fmt.Fprintf(&sb, "  %s\n", r.Author)
+		}
+		if r.Link != "" {
+			fmt.Fprintf(&sb, "  %s\n", r.Link)
+		}
+		fmt.Fprintf(&sb, "  %s\n", strings.Join(strings.Fields(r.Snippet), " "))
+	}
+	return sb.String()
+}
+
+// searchArchive searches the index in the config directory.
+func searchArchive(dir string, q SearchQuery) ([]SearchResult, error) {
+	index, err := OpenSearchIndex(filepath.Join(dir, "search.sqlite3"))
+	if err != nil {
+		return nil, err
+	}
+	defer index.db.Close()
+	return index.Search(q)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestSearch(t *testing.T) {
+	index, err := OpenSearchIndex(filepath.Join(t.TempDir(), "search.sqlite3"))
+	if err != nil {
+		t.Fatalf("OpenSearchIndex failed: %v", err)
+	}
+	defer index.db.Close()
+
+	published := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{
+		Title:           "Sourdough notes",
+		Description:     "<p>Baking <b>bread</b> with rye</p>",
+		Link:            "https://blog.example/sourdough",
+		GUID:            "guid-1",
+		PublishedParsed: &published,
+		Authors:         []*gofeed.Person{{Name: "Uwe"}},
+	}
+	if err := index.IndexForSearch(syncedSearchDoc(item, "mastodon", "111", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	post := savedStatus("p1", "", "carol@bsky.example", 0)
+	post.URL = "https://bsky.app/profile/carol/post/p1"
+	post.Content = "<p>Rye bread from the oven</p>"
+	post.Account.DisplayName = "Carol"
+	post.Tags = append(post.Tags, struct{ Name string }{"baking"})
+	post.MediaAttachments = []SavedMedia{{URL: "https://cdn.example/loaf.jpg", AltText: "a crusty loaf"}}
+	reply := savedStatus("p2", "p1", "dave@bsky.example", 1)
+	reply.URL = "https://bsky.app/profile/dave/post/p2"
+	reply.Content = "<p>Looks great</p>"
+	for _, doc := range savedSearchDocs([]*SavedStatus{post, reply}, "Carol's loaf", "notes/loaf.md") {
+		if err := index.IndexForSearch(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want []string
+	}{
+		{"both kinds", SearchQuery{Text: "rye"}, []string{"mastodon:guid-1", "bluesky:p1"}},
+		{"all words", SearchQuery{Text: "rye oven"}, []string{"bluesky:p1"}},
+		{"prefix", SearchQuery{Text: "bak*"}, []string{"mastodon:guid-1", "bluesky:p1"}},
+		{"alt text", SearchQuery{Text: "crusty"}, []string{"bluesky:p1"}},
+		{"thread title", SearchQuery{Text: "great loaf"}, []string{"bluesky:p2"}},
+		{"platform", SearchQuery{Text: "rye", Platform: "bluesky"}, []string{"bluesky:p1"}},
+		{"kind", SearchQuery{Text: "rye", Kind: SearchSynced}, []string{"mastodon:guid-1"}},
+		{"author", SearchQuery{Text: "rye", Author: "carol"}, []string{"bluesky:p1"}},
+		{"since", SearchQuery{Text: "rye", Since: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)}, []string{"mastodon:guid-1"}},
+		{"until", SearchQuery{Text: "rye", Until: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)}, []string{"bluesky:p1"}},
+		{"punctuation", SearchQuery{Text: `"carol@bsky.example`}, []string{"bluesky:p1"}},
+		{"nothing", SearchQuery{Text: "pizza"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := index.Search(tt.q)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			// FTS5 and FTS4 order matches differently
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Key)
+			}
+			slices.Sort(got)
+			slices.Sort(tt.want)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	results, err := index.Search(SearchQuery{Text: "oven"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected the saved post found, got %v, %v", results, err)
+	}
+	r := results[0]
+	if r.Author != "Carol (@carol@bsky.example)" || r.Title != "Carol's loaf" || !r.Date.Equal(post.CreatedAt) {
+		t.Errorf("Unexpected result %+v", r.SearchDoc)
+	}
+	if strings.Join(r.Refs, " ") != "p1 https://cdn.example/loaf.jpg notes/loaf.md" || strings.Join(r.Tags, " ") != "baking" {
+		t.Errorf("Unexpected refs %q or tags %q", r.Refs, r.Tags)
+	}
+	if !strings.Contains(r.Snippet, "[oven]") {
+		t.Errorf("Expected the match marked in %q", r.Snippet)
+	}
+
+	// saving again replaces the post
+	post.Content = "<p>Spelt bread</p>"
+	for _, doc := range savedSearchDocs([]*SavedStatus{post}, "Spelt bread", "notes/loaf.md") {
+		if err := index.IndexForSearch(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if results, err := index.Search(SearchQuery{Text: "oven"}); err != nil || len(results) != 0 {
+		t.Errorf("Expected the old content gone, got %v, %v", results, err)
+	}
+	if results, err := index.Search(SearchQuery{Text: "spelt"}); err != nil || len(results) != 1 {
+		t.Errorf("Expected the new content found, got %v, %v", results, err)
+	}
+
+	if _, err := index.Search(SearchQuery{Text: " * "}); err == nil {
+		t.Errorf("Expected an empty query refused")
+	}
+}
+
+func TestOpenSearchIndex_KeepsFTS4(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.sqlite3")
+	dao, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.db.Exec(createSearchFTS4SQL); err != nil {
+		t.Fatal(err)
+	}
+	dao.db.Close()
+
+	// an index created without FTS5 stays usable whatever the build
+	index, err := OpenSearchIndex(path)
+	if err != nil {
+		t.Fatalf("OpenSearchIndex failed: %v", err)
+	}
+	defer index.db.Close()
+	if index.searchFTS5 {
+		t.Error("Expected the FTS4 index kept")
+	}
+	item := &gofeed.Item{Title: "Rye", Description: "<p>Rye bread</p>", GUID: "guid-1"}
+	if err := index.IndexForSearch(syncedSearchDoc(item, "mastodon", "1", time.Now())); err != nil {
+		t.Fatalf("IndexForSearch failed: %v", err)
+	}
+	if results, err := index.Search(SearchQuery{Text: "rye"}); err != nil || len(results) != 1 {
+		t.Errorf("Expected the item found, got %v, %v", results, err)
+	}
+}
+
+func TestSyncer_SyncFeed_Search(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintln(w, `<?xml version="1.0" encoding="utf-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Test Feed</title>
+    <item><title>Item 1</title><link>http://example.com/1</link><guid>guid-1</guid></item>
+    <item><title>Item 2</title><link>http://example.com/2</link><guid>guid-2</guid></item>
+  </channel>
+</rss>`)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := CreateDB(filepath.Join(dir, "sync.sqlite3")); err != nil {
+		t.Fatal(err)
+	}
+	dao, err := OpenDB(filepath.Join(dir, "sync.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dao.db.Close()
+	search, err := OpenSearchIndex(filepath.Join(dir, "search.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer search.db.Close()
+	if err := os.WriteFile(filepath.Join(dir, "template.tmpl"), []byte("{{.Title}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := &Syncer{
+		feedParser: gofeed.NewParser(),
+		poster:     &MockPoster{},
+		dao:        dao,
+		search:     search,
+		platform:   "bluesky",
+		tmplDir:    dir,
+	}
+	if err := syncer.SyncFeed(server.URL, "template.tmpl", PostOptions{}, make(map[string]*gofeed.Item)); err != nil {
+		t.Fatalf("SyncFeed failed: %v", err)
+	}
+
+	results, err := search.Search(SearchQuery{Text: "item", Platform: "bluesky", Kind: SearchSynced})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected both posted items indexed, got %d", len(results))
+	}
+	for _, r := range results {
+		if len(r.Refs) != 2 || !strings.HasPrefix(r.Refs[0], "mock-id-") || r.Link == "" {
+			t.Errorf("Expected the post ID and link indexed, got %+v", r.SearchDoc)
+		}
+	}
+}
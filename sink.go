@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Sink is a destination threads are archived to.
+type Sink interface {
+	// Destination names the sink in the index of saved posts.
+	Destination() (string, error)
+	// Write saves the thread titled title, replacing target when it isn't
+	// empty, and returns the page or file saved to.
+	Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error)
+	// Exists reports whether a page or file saved to before is still there.
+	Exists(ctx context.Context, target string) (bool, error)
+}
+
+// SinkFormat selects the sink threads are saved to.
+type SinkFormat string
+
+const (
+	SinkNotion   SinkFormat = "notion"
+	SinkMarkdown SinkFormat = "markdown"
+	// a web page with its media next to it
+	SinkHTML SinkFormat = "html"
+	// the saved statuses as they are
+	SinkJSON SinkFormat = "json"
+	// an e-book with the media inside
+	SinkEPUB SinkFormat = "epub"
+)
+
+// ParseSinkFormat checks the format threads are saved in. It defaults to
+// Markdown when saving to a directory and to notion otherwise.
+func ParseSinkFormat(s string, outputPath string) (SinkFormat, error) {
+	format := SinkFormat(s)
+	switch format {
+	case "":
+		if outputPath != "" {
+			return SinkMarkdown, nil
+		}
+		return SinkNotion, nil
+	case SinkNotion:
+		if outputPath != "" {
+			return "", fmt.Errorf("a directory doesn't apply to notion")
+		}
+		return format, nil
+	case SinkMarkdown, SinkHTML, SinkJSON, SinkEPUB:
+		if outputPath == "" {
+			return "", fmt.Errorf("format %s needs a directory to save to", format)
+		}
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected notion, markdown, html, json or epub", s)
+}
+
+// newFileSink returns the sink saving files of format into outputPath.
+func newFileSink(format SinkFormat, outputPath string, markdown MarkdownConfig, dryrun bool) (Sink, error) {
+	switch format {
+	case SinkMarkdown:
+		return newMarkdownSink(outputPath, markdown, dryrun)
+	case SinkHTML:
+		return &HTMLSink{dryrun: dryrun, outputPath: outputPath}, nil
+	case SinkJSON:
+		return &JSONSink{dryrun: dryrun, outputPath: outputPath}, nil
+	case SinkEPUB:
+		return &EPUBSink{dryrun: dryrun, outputPath: outputPath}, nil
+	}
+	return nil, fmt.Errorf("%s doesn't save to files", format)
+}
+
+// safeFileName keeps the letters, digits, dashes and underscores of name, in
+// any script, and replaces everything else with underscores.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, norm.NFC.String(name))
+}
+
+// newFilePath names a new file in dir after the title, numbering it when a
+// file of that name exists already.
+func newFilePath(dir string, title string, ext string) string {
+	base := safeFileName(title)
+
+	filePath := filepath.Join(dir, base+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			return filePath
+		}
+		filePath = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
+	}
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// fileDestination names a directory files of format are saved to, so each
+// format in the same directory is indexed apart.
+func fileDestination(format SinkFormat, dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return string(format) + ":" + abs, nil
+}
+
+// JSONSink saves threads as the JSON of their statuses.
+type JSONSink struct {
+	dryrun     bool
+	outputPath string
+}
+
+func (js *JSONSink) Destination() (string, error) {
+	return fileDestination(SinkJSON, js.outputPath)
+}
+
+func (js *JSONSink) Write(ctx context.Context, thread []*SavedStatus, title string, target string) (string, error) {
+	if title == "" {
+		title = ExtractTitle(thread[0])
+	}
+	if target == "" {
+		target = newFilePath(js.outputPath, title, ".json")
+	}
+	b, err := json.MarshalIndent(thread, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if js.dryrun {
+		log.Printf("[dryrun] would write %s", target)
+		return target, nil
+	}
+	if err := os.MkdirAll(js.outputPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return target, os.WriteFile(target, append(b, '\n'), 0644)
+}
+
+func (js *JSONSink) Exists(ctx context.Context, target string) (bool, error) {
+	return fileExists(target)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSinkFormat(t *testing.T) {
+	tests := []struct {
+		format     string
+		outputPath string
+		want       SinkFormat
+		wantErr    bool
+	}{
+		{format: "", want: SinkNotion},
+		{format: "", outputPath: "notes", want: SinkMarkdown},
+		{format: "epub", outputPath: "books", want: SinkEPUB},
+		{format: "html", wantErr: true},
+		{format: "notion", outputPath: "notes", wantErr: true},
+		{format: "pdf", outputPath: "notes", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSinkFormat(tt.format, tt.outputPath)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSinkFormat(%q, %q) = %q, %v, want %q, error %v", tt.format, tt.outputPath, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// sinkThread is a post with an image and a reply, its media served by server.
+func sinkThread(server *httptest.Server) []*SavedStatus {
+	post := savedStatus("p", "", "alice", 0)
+	post.Content = `<p>Look <b>here</b> &amp; there<script>alert(1)</script><br></p>`
+	post.URL = "https://mastodon.example/@alice/p"
+	post.MediaAttachments = []SavedMedia{{URL: server.URL + "/a.png", Type: "image", AltText: "a <gopher>"}}
+	reply := savedStatus("r", "p", "bob", 1)
+	reply.Depth = 1
+	return []*SavedStatus{post, reply}
+}
+
+func mediaServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("png " + r.URL.Path))
+	}))
+}
+
+func TestHTMLSink_Write(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+
+	dir := t.TempDir()
+	sink := &HTMLSink{outputPath: dir}
+	target, err := sink.Write(context.Background(), sinkThread(server), "A <thread>", "")
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	page := string(b)
+	_, name, err := fetchMedia(server.URL + "/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<title>A &lt;thread&gt;</title>",
+		"Look <b>here</b> &amp; there",
+		`<img src="assets/` + name + `" alt="a &lt;gopher&gt;">`,
+		`<article class="reply" style="margin-left: 2em">`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected page to contain %q, got:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Errorf("Expected scripts to be removed, got:\n%s", page)
+	}
+	if exists, err := sink.Exists(context.Background(), dir+"/assets/"+name); !exists || err != nil {
+		t.Errorf("Expected the image in assets, got %v, %v", exists, err)
+	}
+}
+
+func TestJSONSink_Write(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+
+	thread := sinkThread(server)
+	sink := &JSONSink{outputPath: t.TempDir()}
+	target, err := sink.Write(context.Background(), thread, "thread", "")
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read dump: %v", err)
+	}
+	var got []*SavedStatus
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Failed to decode dump: %v", err)
+	}
+	if len(got) != 2 || got[0].Content != thread[0].Content || got[1].Depth != 1 {
+		t.Errorf("Expected the thread back, got %+v", got)
+	}
+
+	// a dry run writes nothing, not even over the file saved before
+	dry, err := newFileSink(SinkJSON, sink.outputPath, MarkdownConfig{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread[0].Content = "<p>changed</p>"
+	if _, err := dry.Write(context.Background(), thread, "thread", target); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if after, _ := os.ReadFile(target); string(after) != string(b) {
+		t.Errorf("Expected a dry run to leave %s alone", target)
+	}
+}
+
+func TestEPUBSink_Write(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+
+	sink := &EPUBSink{outputPath: t.TempDir()}
+	target, err := sink.Write(context.Background(), sinkThread(server), "A <thread>", "")
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	zr, err := zip.OpenReader(target)
+	if err != nil {
+		t.Fatalf("Failed to open book: %v", err)
+	}
+	defer zr.Close()
+
+	if first := zr.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("Expected an uncompressed mimetype first, got %s", first.Name)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+
+	for _, name := range []string{"OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/thread.xhtml"} {
+		dec := xml.NewDecoder(bytes.NewReader([]byte(files[name])))
+		dec.Strict = true
+		for {
+			_, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s isn't well formed: %v\n%s", name, err, files[name])
+			}
+		}
+	}
+	_, imageName, _ := fetchMedia(server.URL + "/a.png")
+	if _, ok := files["OEBPS/media/"+imageName]; !ok {
+		t.Errorf("Expected the image packed in the book, got %v", zr.File)
+	}
+	if !strings.Contains(files["OEBPS/content.opf"], `href="media/`+imageName+`" media-type="image/png"`) {
+		t.Errorf("Expected the image in the manifest, got:\n%s", files["OEBPS/content.opf"])
+	}
+	if !strings.Contains(files["OEBPS/thread.xhtml"], `<img src="media/`+imageName+`"`) {
+		t.Errorf("Expected the page to show the packed image, got:\n%s", files["OEBPS/thread.xhtml"])
+	}
+}
+
+func TestFileSinks_DryRunWritesNothing(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+
+	for _, format := range []SinkFormat{SinkHTML, SinkEPUB} {
+		dir := filepath.Join(t.TempDir(), "out")
+		sink, err := newFileSink(format, dir, MarkdownConfig{}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Write(context.Background(), sinkThread(server), "thread", ""); err != nil {
+			t.Fatalf("%s: Write failed: %v", format, err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected a dry run to leave %s alone, got %v", format, dir, err)
+		}
+	}
+}
+
+func TestFileSinks_DestinationsDiffer(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, format := range []SinkFormat{SinkMarkdown, SinkHTML, SinkJSON, SinkEPUB} {
+		sink, err := newFileSink(format, "notes", MarkdownConfig{}, false)
+		if err != nil {
+			t.Fatalf("newFileSink(%s) failed: %v", format, err)
+		}
+		destination, err := sink.Destination()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[destination] {
+			t.Errorf("Destination %q of %s is used by another format", destination, format)
+		}
+		seen[destination] = true
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "alice: First post!", want: "alice-first-post"},
+		{s: "Größe über Maß", want: "größe-über-maß"},
+		{s: "東京の 夜", want: "東京の-夜"},
+		{s: "  --  ", want: ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.s); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+	if got := safeFileName("alice: Größe"); got != "alice__Größe" {
+		t.Errorf("safeFileName() = %q, want letters of any script kept", got)
+	}
+}
+
+func TestMarkdownSink_Layout(t *testing.T) {
+	server := mediaServer()
+	defer server.Close()
+	_, image, err := fetchMedia(server.URL + "/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		config    MarkdownConfig
+		wantPath  string
+		wantLines []string
+	}{
+		{
+			name:     "default",
+			wantPath: "Größe_über_Maß.md",
+			wantLines: []string{
+				"title: Größe über Maß",
+				"![[images/" + image + "|a <gopher>]]",
+			},
+		},
+		{
+			name: "dated wikilinks",
+			config: MarkdownConfig{
+				Filename: "{{.Date}}-{{.Author}}-{{.Slug}}",
+				Folder:   "{{.Year}}/{{.Month}}",
+				Media:    "attachments",
+				Images:   "wikilink",
+				Frontmatter: map[string]map[string]string{
+					"mastodon": {"source": "{{.Platform}}", "title": "{{.Slug}}"},
+					"bluesky":  {"bsky": "yes"},
+				},
+			},
+			wantPath: "2026/01/2026-01-01-alice-größe-über-maß.md",
+			wantLines: []string{
+				"title: größe-über-maß",
+				"source: mastodon",
+				"![[attachments/" + image + "|a <gopher>]]",
+			},
+		},
+		{
+			name:     "dated markdown",
+			config:   MarkdownConfig{Folder: "{{.Year}}/../{{.Month}}", Images: "markdown"},
+			wantPath: "2026/01/Größe_über_Maß.md",
+			wantLines: []string{
+				"![a <gopher>](../../images/" + image + ")",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sink, err := newMarkdownSink(dir, tt.config, false)
+			if err != nil {
+				t.Fatalf("newMarkdownSink failed: %v", err)
+			}
+			thread := sinkThread(server)
+			thread[0].Account.Username = "alice"
+			target, err := sink.Write(context.Background(), thread, "Größe über Maß", "")
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if rel, _ := filepath.Rel(dir, target); filepath.ToSlash(rel) != tt.wantPath {
+				t.Errorf("Wrote %s, want %s", rel, tt.wantPath)
+			}
+			b, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantLines {
+				if !strings.Contains(string(b), want+"\n") {
+					t.Errorf("Expected note to contain %q, got:\n%s", want, b)
+				}
+			}
+			if strings.Contains(string(b), "bsky") {
+				t.Errorf("Expected frontmatter of other platforms left out, got:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestNewMarkdownSink_Invalid(t *testing.T) {
+	for _, config := range []MarkdownConfig{
+		{Filename: "{{.Date"},
+		{Images: "html"},
+		{Frontmatter: map[string]map[string]string{"mastodon": {"x": "{{end}}"}}},
+		{People: "/"},
+	} {
+		if _, err := newMarkdownSink("notes", config, false); err == nil {
+			t.Errorf("newMarkdownSink(%+v) succeeded, want an error", config)
+		}
+	}
+}
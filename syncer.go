@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"path/filepath"
 	"text/template"
 	"time"
@@ -13,15 +14,19 @@ type Syncer struct {
 	feedParser *gofeed.Parser
 	poster     Poster
 	dao        *DAO
-	feeds      []FeedTemplatePair
-	tmplDir    string
-	dryrun     bool
+	// the full text index posted items are added to, nil to not index them
+	search   *DAO
+	platform string
+	feeds    []FeedTemplatePair
+	tmplDir  string
+	dryrun   bool
 }
 
 func (syncer *Syncer) Sync() error {
 	alreadyProcessed := make(map[string]*gofeed.Item)
 	for _, feedTmplPair := range syncer.feeds {
-		err := syncer.SyncFeed(feedTmplPair.FeedURL, feedTmplPair.Template, alreadyProcessed)
+		opts := PostOptions{Images: feedTmplPair.Images, Quote: feedTmplPair.Quote}
+		err := syncer.SyncFeed(feedTmplPair.FeedURL, feedTmplPair.Template, opts, alreadyProcessed)
 		if err != nil {
 			return err
 		}
@@ -29,7 +34,7 @@ func (syncer *Syncer) Sync() error {
 	return nil
 }
 
-func (syncer *Syncer) SyncFeed(feedURL string, templatePath string,
+func (syncer *Syncer) SyncFeed(feedURL string, templatePath string, opts PostOptions,
 	alreadyProcessed map[string]*gofeed.Item) error {
 	feed, err := syncer.feedParser.ParseURL(feedURL)
 	if err != nil {
@@ -64,16 +69,24 @@ func (syncer *Syncer) SyncFeed(feedURL string, templatePath string,
 			alreadyProcessed[item.GUID] = item
 			continue
 		}
-		postID, err := syncer.poster.Post(item, tmpl)
+		postID, err := syncer.poster.Post(item, tmpl, opts)
 		if err != nil {
 			return err
 		}
 
-		err = syncer.dao.RecordSync(item.GUID, postID, time.Now())
+		now := time.Now()
+		err = syncer.dao.RecordSync(item.GUID, postID, now)
 		if err != nil {
 			return err
 		}
 		alreadyProcessed[item.GUID] = item
+
+		if syncer.search != nil {
+			err = syncer.search.IndexForSearch(syncedSearchDoc(item, syncer.platform, postID, now))
+			if err != nil {
+				log.Printf("failed to index %s for search: %v", item.GUID, err)
+			}
+		}
 	}
 	return nil
 }
@@ -17,7 +17,7 @@ type MockPoster struct {
 	postedItems []*gofeed.Item
 }
 
-func (m *MockPoster) Post(item *gofeed.Item, tmpl *template.Template) (string, error) {
+func (m *MockPoster) Post(item *gofeed.Item, tmpl *template.Template, opts PostOptions) (string, error) {
 	m.postedItems = append(m.postedItems, item)
 	return fmt.Sprintf("mock-id-%d", len(m.postedItems)), nil
 }
@@ -82,7 +82,7 @@ func TestSyncer_SyncFeed(t *testing.T) {
 	alreadyProcessed := make(map[string]*gofeed.Item)
 
 	// Test SyncFeed
-	err = syncer.SyncFeed(server.URL, tmplPath, alreadyProcessed)
+	err = syncer.SyncFeed(server.URL, tmplPath, PostOptions{}, alreadyProcessed)
 	if err != nil {
 		t.Fatalf("SyncFeed failed: %v", err)
 	}
@@ -93,7 +93,7 @@ func TestSyncer_SyncFeed(t *testing.T) {
 
 	// Run again, should not post anything
 	mockPoster.postedItems = nil
-	err = syncer.SyncFeed(server.URL, tmplPath, alreadyProcessed)
+	err = syncer.SyncFeed(server.URL, tmplPath, PostOptions{}, alreadyProcessed)
 	if err != nil {
 		t.Fatalf("Second SyncFeed failed: %v", err)
 	}
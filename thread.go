@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ThreadMode selects how much of the conversation around a post is saved.
+type ThreadMode string
+
+const (
+	// the post and the chain of posts it replies to
+	ThreadAncestors ThreadMode = "ancestors"
+	// the ancestors plus the author's own continuations below the post
+	ThreadAuthor ThreadMode = "author"
+	// the ancestors plus every reply below the post
+	ThreadTree ThreadMode = "tree"
+)
+
+func ParseThreadMode(s string) (ThreadMode, error) {
+	switch ThreadMode(s) {
+	case "", ThreadAncestors:
+		return ThreadAncestors, nil
+	case ThreadAuthor, ThreadTree:
+		return ThreadMode(s), nil
+	}
+	return "", fmt.Errorf("unknown thread mode %q, expected ancestors, author or tree", s)
+}
+
+// buildThread orders a conversation for saving. The main line - the
+// ancestors, the post and the author's continuations below it - has depth 0.
+// In tree mode the other replies follow the post they answer, one level
+// deeper than it.
+func buildThread(ancestors []*SavedStatus, post *SavedStatus, descendants []*SavedStatus, mode ThreadMode) []*SavedStatus {
+	thread := append(ancestors, post)
+	if mode == ThreadAncestors {
+		return thread
+	}
+
+	children := make(map[string][]*SavedStatus)
+	for _, d := range descendants {
+		children[d.InReplyToID] = append(children[d.InReplyToID], d)
+	}
+	for _, replies := range children {
+		sort.SliceStable(replies, func(i, j int) bool {
+			return replies[i].CreatedAt.Before(replies[j].CreatedAt)
+		})
+	}
+
+	var addReplies func(parent *SavedStatus, skip *SavedStatus, depth int)
+	addReplies = func(parent *SavedStatus, skip *SavedStatus, depth int) {
+		for _, reply := range children[parent.ID] {
+			if reply == skip {
+				continue
+			}
+			reply.Depth = depth
+			thread = append(thread, reply)
+			addReplies(reply, nil, depth+1)
+		}
+	}
+
+	for current := post; current != nil; {
+		var next *SavedStatus
+		for _, reply := range children[current.ID] {
+			if reply.Account.Acct == post.Account.Acct {
+				next = reply
+				break
+			}
+		}
+		if mode == ThreadTree {
+			addReplies(current, next, 1)
+		}
+		if next != nil {
+			next.Depth = 0
+			thread = append(thread, next)
+		}
+		current = next
+	}
+	return thread
+}
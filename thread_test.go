@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jomei/notionapi"
+	mdon "github.com/mattn/go-mastodon"
+)
+
+func savedStatus(id, inReplyTo, acct string, minute int) *SavedStatus {
+	ss := &SavedStatus{
+		ID:          id,
+		InReplyToID: inReplyTo,
+		Content:     "<p>" + id + "</p>",
+		CreatedAt:   time.Date(2026, 1, 1, 12, minute, 0, 0, time.UTC),
+	}
+	ss.Account.Acct = acct
+	return ss
+}
+
+// conversation builds
+//
+//	a (bob)
+//	└ p (alice, the saved post)
+//	  ├ r1 (carol)
+//	  │ └ r2 (alice)
+//	  └ c1 (alice, continuation)
+//	    └ c2 (alice, continuation)
+func conversation() ([]*SavedStatus, *SavedStatus, []*SavedStatus) {
+	ancestors := []*SavedStatus{savedStatus("a", "", "bob", 0)}
+	post := savedStatus("p", "a", "alice", 1)
+	descendants := []*SavedStatus{
+		savedStatus("r1", "p", "carol", 2),
+		savedStatus("c1", "p", "alice", 3),
+		savedStatus("r2", "r1", "alice", 4),
+		savedStatus("c2", "c1", "alice", 5),
+	}
+	return ancestors, post, descendants
+}
+
+func threadShape(thread []*SavedStatus) string {
+	var parts []string
+	for _, ss := range thread {
+		parts = append(parts, ss.ID+strings.Repeat(">", ss.Depth))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBuildThread(t *testing.T) {
+	tests := []struct {
+		mode ThreadMode
+		want string
+	}{
+		{mode: ThreadAncestors, want: "a p"},
+		{mode: ThreadAuthor, want: "a p c1 c2"},
+		{mode: ThreadTree, want: "a p r1> r2>> c1 c2"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			ancestors, post, descendants := conversation()
+			got := threadShape(buildThread(ancestors, post, descendants, tt.mode))
+			if got != tt.want {
+				t.Errorf("buildThread() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseThreadMode(t *testing.T) {
+	if mode, err := ParseThreadMode(""); err != nil || mode != ThreadAncestors {
+		t.Errorf("Expected ancestors by default, got %q, %v", mode, err)
+	}
+	if _, err := ParseThreadMode("everything"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestMastodonFetcher_Fetch_Tree(t *testing.T) {
+	statuses := map[string]*mdon.Status{
+		"a": {ID: "a", Content: "<p>a</p>", Account: mdon.Account{Acct: "bob"}},
+		"p": {ID: "p", Content: "<p>p</p>", InReplyToID: "a", Account: mdon.Account{Acct: "alice"}},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/")
+		if strings.HasSuffix(id, "/context") {
+			json.NewEncoder(w).Encode(mdon.Context{
+				Ancestors: []*mdon.Status{statuses["a"]},
+				Descendants: []*mdon.Status{
+					{ID: "r1", InReplyToID: "p", Account: mdon.Account{Acct: "carol"}, CreatedAt: time.Unix(1, 0)},
+					{ID: "c1", InReplyToID: "p", Account: mdon.Account{Acct: "alice"}, CreatedAt: time.Unix(2, 0)},
+				},
+			})
+			return
+		}
+		if s, ok := statuses[id]; ok {
+			json.NewEncoder(w).Encode(s)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	fetcher := &MastodonFetcher{
+		mClient: mdon.NewClient(&mdon.Config{Server: server.URL}),
+		mode:    ThreadTree,
+	}
+	thread, err := fetcher.Fetch(context.Background(), "p")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if got := threadShape(thread); got != "a p r1> c1" {
+		t.Errorf("Fetch() = %q, want %q", got, "a p r1> c1")
+	}
+}
+
+func TestNotionSink_Blocks_NestsReplies(t *testing.T) {
+	ancestors, post, descendants := conversation()
+	thread := buildThread(ancestors, post, descendants, ThreadTree)
+
+	blocks := (&NotionSink{}).Blocks(thread)
+
+	var toggles []*notionapi.ToggleBlock
+	for _, b := range blocks {
+		if toggle, ok := b.(*notionapi.ToggleBlock); ok {
+			toggles = append(toggles, toggle)
+		}
+	}
+	if len(toggles) != 1 {
+		t.Fatalf("Expected one top level reply toggle, got %d", len(toggles))
+	}
+	r1 := toggles[0]
+	if r1.Toggle.RichText[0].Text.Content != "@carol" {
+		t.Errorf("Unexpected toggle title %q", r1.Toggle.RichText[0].Text.Content)
+	}
+	var nested *notionapi.ToggleBlock
+	for _, b := range r1.Toggle.Children {
+		if toggle, ok := b.(*notionapi.ToggleBlock); ok {
+			nested = toggle
+		}
+	}
+	if nested == nil || nested.Toggle.RichText[0].Text.Content != "@alice" {
+		t.Errorf("Expected alice's answer nested in carol's reply, got %+v", r1.Toggle.Children)
+	}
+}
+
+func TestMarkdownSink_NestsReplies(t *testing.T) {
+	dir, err := os.MkdirTemp("", "saved")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ancestors, post, descendants := conversation()
+	sink := &MarkdownSink{outputPath: dir}
+	_, err = sink.WriteMarkdown(context.Background(), buildThread(ancestors, post, descendants, ThreadTree), "thread", "")
+	if err != nil {
+		t.Fatalf("WriteMarkdown failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "thread.md"))
+	if err != nil {
+		t.Fatalf("Failed to read markdown: %v", err)
+	}
+	md := string(b)
+	for _, want := range []string{
+		"p\n\n> **@carol**\n>\n> r1\n",
+		"> > **@alice**\n> >\n> > r2\n",
+		"\n---\n\nc1\n",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Expected markdown to contain %q, got:\n%s", want, md)
+		}
+	}
+}
+
+func TestSaver_Save_UpdatesOrSkipsSavedPosts(t *testing.T) {
+	dir := t.TempDir()
+	index, err := OpenSavedIndex(filepath.Join(dir, "saved.sqlite3"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer index.db.Close()
+
+	out := filepath.Join(dir, "notes")
+	ancestors, post, descendants := conversation()
+	post.Requested = true
+	thread := buildThread(ancestors, post, descendants, ThreadAncestors)
+	saver := &Saver{sink: &MarkdownSink{outputPath: out}, pageTitle: "thread", index: index}
+
+	save := func() {
+		t.Helper()
+		if err := saver.saveIndexed(context.Background(), thread); err != nil {
+			t.Fatalf("saveIndexed failed: %v", err)
+		}
+	}
+	mdPath := filepath.Join(out, "thread.md")
+
+	save()
+	item, err := index.FindSaved("mastodon", "p", out)
+	if err != nil || item == nil || item.Target != mdPath {
+		t.Fatalf("Expected the save to be recorded, got %+v, %v", item, err)
+	}
+
+	// saving the unchanged thread again leaves the note alone
+	if err := os.WriteFile(mdPath, []byte("edited"), 0644); err != nil {
+		t.Fatalf("Failed to edit note: %v", err)
+	}
+	save()
+	if b, _ := os.ReadFile(mdPath); string(b) != "edited" {
+		t.Errorf("Expected an unchanged thread to be skipped, got:\n%s", b)
+	}
+
+	// so is one whose author changed their profile
+	post.Account.Note = "<p>new bio</p>"
+	post.Account.Avatar = "https://mastodon.example/avatars/new.png"
+	save()
+	if b, _ := os.ReadFile(mdPath); string(b) != "edited" {
+		t.Errorf("Expected a new bio or avatar to leave the note alone, got:\n%s", b)
+	}
+
+	// a dry run doesn't replace the note of a changed thread
+	post.Content = "<p>p edited</p>"
+	saver.dryrun = true
+	save()
+	saver.dryrun = false
+	if b, _ := os.ReadFile(mdPath); string(b) != "edited" {
+		t.Errorf("Expected a dry run to leave the note alone, got:\n%s", b)
+	}
+
+	// a changed thread is written over the same note
+	save()
+	b, err := os.ReadFile(mdPath)
+	if err != nil {
+		t.Fatalf("Failed to read note: %v", err)
+	}
+	if !strings.Contains(string(b), "p edited") {
+		t.Errorf("Expected the note to be updated, got:\n%s", b)
+	}
+	if _, err := os.Stat(filepath.Join(out, "thread_2.md")); !os.IsNotExist(err) {
+		t.Errorf("Expected no second note, got %v", err)
+	}
+
+	// a deleted note is created anew
+	os.Remove(mdPath)
+	save()
+	if _, err := os.Stat(mdPath); err != nil {
+		t.Errorf("Expected the deleted note to be recreated: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	kDefaultTitleTemplate = "{{.Author}}: {{.Text}}"
+	// the most characters of a post's text in its title
+	kDefaultTitleLength = 60
+)
+
+// Titler titles threads saved without a title after their first post.
+type Titler struct {
+	template *template.Template
+	length   int
+}
+
+// titleFields fill the title template.
+type titleFields struct {
+	// the username of the post's author, Acct with the server
+	Author      string
+	DisplayName string
+	Acct        string
+	Platform    string
+	// the first sentence of the post, or what stands for it when it has no
+	// text
+	Text string
+	// when the post was written, as 2006-01-02
+	Date string
+}
+
+var defaultTitler = &Titler{
+	template: template.Must(template.New("title").Parse(kDefaultTitleTemplate)),
+	length:   kDefaultTitleLength,
+}
+
+// NewTitler titles threads as configured.
+func NewTitler(config TitleConfig) (*Titler, error) {
+	titler := &Titler{template: defaultTitler.template, length: config.Length}
+	if config.Template != "" {
+		t, err := template.New("title").Option("missingkey=error").Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid title template: %w", err)
+		}
+		titler.template = t
+	}
+	if titler.length <= 0 {
+		titler.length = kDefaultTitleLength
+	}
+	return titler, nil
+}
+
+// ExtractTitle titles a thread after its first post, as "username: first
+// sentence".
+func ExtractTitle(status *SavedStatus) string {
+	return defaultTitler.Title(status)
+}
+
+// Title titles a thread after its first post. A template that fails is
+// logged and the default title used.
+func (titler *Titler) Title(status *SavedStatus) string {
+	fields := titleFields{
+		Author:      status.Account.Username,
+		DisplayName: status.Account.DisplayName,
+		Acct:        status.Account.Acct,
+		Platform:    savedPlatform(status),
+		Text:        titleText(status, titler.length),
+		Date:        status.CreatedAt.Local().Format(time.DateOnly),
+	}
+	var buf bytes.Buffer
+	if err := titler.template.Execute(&buf, fields); err != nil {
+		log.Printf("failed to title %s: %v", status.URL, err)
+		if titler == defaultTitler {
+			return fields.Author + ": " + fields.Text
+		}
+		return defaultTitler.Title(status)
+	}
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+var (
+	kBareURL     = regexp.MustCompile(`\bhttps?://\S+`)
+	kBareMention = regexp.MustCompile(`(^|\s)[@#][\p{L}\p{N}_.@-]+`)
+	// a sentence ends at its punctuation followed by a space
+	kSentenceEnd = regexp.MustCompile(`[.!?…。](["'”’)\]]*)\s`)
+)
+
+// titleText is the first sentence of a post's text without links, mentions
+// and hashtags, cut to length characters at a word. Posts without text are
+// named after their content warning, media, link card or poll instead.
+func titleText(status *SavedStatus, length int) string {
+	text := status.SpoilerText
+	if text == "" {
+		text = postText(status.Content)
+	}
+	if text == "" {
+		text = untitledText(status)
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if loc := kSentenceEnd.FindStringSubmatchIndex(text + " "); loc != nil {
+		text = text[:loc[3]]
+	}
+	return truncateWords(text, length)
+}
+
+// postText is the text of a post's HTML, leaving out links shown as their
+// URL, mentions and hashtags.
+func postText(content string) string {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			sb.WriteString(n.Data)
+			return
+		case n.Type == html.ElementNode && n.Data == "a":
+			if hasClass(n, "mention") || hasClass(n, "hashtag") || htmlAttr(n, "rel") == "tag" || isURLText(n) {
+				sb.WriteString(" ")
+				return
+			}
+		case n.Type == html.ElementNode && (n.Data == "br" || n.Data == "p"):
+			sb.WriteString(" ")
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+	text := kBareURL.ReplaceAllString(sb.String(), " ")
+	text = kBareMention.ReplaceAllString(text, "$1")
+	return strings.TrimSpace(text)
+}
+
+// isURLText reports whether a link shows its URL, shortened or not, rather
+// than words.
+func isURLText(a *html.Node) bool {
+	text := strings.TrimSpace(htmlText(a))
+	text = strings.TrimRight(strings.TrimSuffix(text, "..."), "…")
+	if text == "" || strings.ContainsAny(text, " \t\n") {
+		return false
+	}
+	trim := func(s string) string {
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+		return strings.TrimPrefix(s, "www.")
+	}
+	return strings.HasPrefix(trim(htmlAttr(a, "href")), trim(text))
+}
+
+// untitledText stands for the text of a post that has none.
+func untitledText(status *SavedStatus) string {
+	for _, ma := range status.MediaAttachments {
+		if ma.AltText != "" {
+			return ma.AltText
+		}
+	}
+	if status.Card != nil && status.Card.Title != "" {
+		return status.Card.Title
+	}
+	if status.Poll != nil && len(status.Poll.Options) > 0 {
+		return "Poll"
+	}
+	if n := len(status.MediaAttachments); n > 0 {
+		kind := status.MediaAttachments[0].Type
+		switch kind {
+		case "", "image":
+			kind = "image"
+		case "gifv":
+			kind = "GIF"
+		}
+		for _, ma := range status.MediaAttachments[1:] {
+			if ma.Type != status.MediaAttachments[0].Type {
+				kind = "attachment"
+			}
+		}
+		return countOf(int64(n), kind)
+	}
+	return "post of " + status.CreatedAt.Local().Format(time.DateOnly)
+}
+
+// truncateWords cuts text to at most length characters, at the end of a word
+// where there is one, and marks the cut with an ellipsis.
+func truncateWords(text string, length int) string {
+	if utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	runes := []rune(text)
+	cut := string(runes[:length])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,;:-–—") + "…"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractTitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		username string
+		expected string
+	}{
+		{
+			name:     "simple text",
+			content:  "<p>Hello world this is a test</p>",
+			username: "alice",
+			expected: "alice: Hello world this is a test",
+		},
+		{
+			name:     "short text",
+			content:  "<p>Short</p>",
+			username: "bob",
+			expected: "bob: Short",
+		},
+		{
+			name:     "with links",
+			content:  "<p>Visit <a href=\"https://example.com\">Example</a> today!</p>",
+			username: "charlie",
+			expected: "charlie: Visit Example today!",
+		},
+		{
+			name: "url mention and hashtag",
+			content: `<p><span class="h-card"><a href="https://example.social/@bob" class="u-url mention">@<span>bob</span></a></span> Check out ` +
+				`<a href="https://example.com/a/long/path" rel="nofollow"><span class="invisible">https://</span><span class="ellipsis">example.com/a/lo</span>` +
+				`<span class="invisible">ng/path</span></a> &amp; tell me <a href="https://example.social/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a></p>`,
+			username: "dave",
+			expected: "dave: Check out & tell me",
+		},
+		{
+			name:     "bluesky link",
+			content:  `<p>Read <a href="https://example.com/article/123">example.com/article...</a> now</p>`,
+			username: "erin",
+			expected: "erin: Read now",
+		},
+		{
+			name:     "bare url and mention",
+			content:  "<p>@bob@example.social see https://example.com/x for details</p>",
+			username: "frank",
+			expected: "frank: see for details",
+		},
+		{
+			name:     "first sentence",
+			content:  "<p>Gophers dig tunnels. They live underground!</p><p>More later.</p>",
+			username: "gina",
+			expected: "gina: Gophers dig tunnels.",
+		},
+		{
+			name:     "long sentence",
+			content:  "<p>Gophers dig long tunnels under the garden and the meadow behind the old barn all summer long</p>",
+			username: "hal",
+			expected: "hal: Gophers dig long tunnels under the garden and the meadow…",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &SavedStatus{
+				Content: tt.content,
+			}
+			status.Account.Username = tt.username
+			result := ExtractTitle(status)
+			if result != tt.expected {
+				t.Errorf("ExtractTitle() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExtractTitle_NoText(t *testing.T) {
+	created := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		status   SavedStatus
+		expected string
+	}{
+		{"content warning", SavedStatus{Content: "<p>Spoilers</p>", SpoilerText: "film ending"}, "film ending"},
+		{"alt text", SavedStatus{MediaAttachments: []SavedMedia{{Type: "image"}, {Type: "image", AltText: "A gopher. Sleeping."}}}, "A gopher."},
+		{"images", SavedStatus{MediaAttachments: []SavedMedia{{Type: "image"}, {Type: "image"}}}, "2 images"},
+		{"mixed media", SavedStatus{MediaAttachments: []SavedMedia{{Type: "image"}, {Type: "video"}}}, "2 attachments"},
+		{"card", SavedStatus{Content: `<p><a href="https://example.com/x">https://example.com/x</a></p>`, Card: &SavedCard{Title: "An article"}}, "An article"},
+		{"nothing", SavedStatus{CreatedAt: created}, "post of " + created.Local().Format(time.DateOnly)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.status.Account.Username = "alice"
+			if got := ExtractTitle(&tt.status); got != "alice: "+tt.expected {
+				t.Errorf("ExtractTitle() = %q, want %q", got, "alice: "+tt.expected)
+			}
+		})
+	}
+}
+
+func TestTitler_Template(t *testing.T) {
+	titler, err := NewTitler(TitleConfig{Template: "{{.Date}} {{.DisplayName}} ({{.Platform}}): {{.Text}}", Length: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &SavedStatus{
+		Content:   "<p>Gophers dig long tunnels</p>",
+		URL:       "https://bsky.app/profile/alice/post/1",
+		CreatedAt: time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local),
+	}
+	status.Account.DisplayName = "Alice"
+	if got := titler.Title(status); got != "2026-01-01 Alice (bluesky): Gophers dig…" {
+		t.Errorf("Title() = %q", got)
+	}
+
+	if _, err := NewTitler(TitleConfig{Template: "{{.Text"}); err == nil || !strings.Contains(err.Error(), "title template") {
+		t.Errorf("Expected the invalid template refused, got %v", err)
+	}
+	// a template that fails gives the default title
+	titler, err = NewTitler(TitleConfig{Template: "{{.Missing}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.Account.Username = "alice"
+	if got := titler.Title(status); got != "alice: Gophers dig long tunnels" {
+		t.Errorf("Title() = %q, want the default title", got)
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	mdon "github.com/mattn/go-mastodon"
@@ -15,17 +18,35 @@ import (
 )
 
 type Tooter struct {
-	mClient   *mdon.Client
-	dryrun    bool
-	tootsPath string
-	tokenizer sentences.SentenceTokenizer
+	mClient     *mdon.Client
+	dryrun      bool
+	tootsPath   string
+	tokenizer   sentences.SentenceTokenizer
+	scheduledAt *time.Time
+	pendingDir  string
+	wait        bool
+	// how often to check on media the server is still processing
+	mediaPollEvery time.Duration
+	// prepares media for upload; nil uploads files as they are
+	media *MediaPipeline
+	// write an html preview here instead of posting
+	previewPath string
+	// url of a status on any server the chain replies to
+	replyTo string
+	// resolved from replyTo by Toot
+	inReplyTo    mdon.ID
+	replyMention string
 }
 
-type TootImage struct {
-	pos     int
-	altText string
-	path    string
-	mediaID mdon.ID
+// TootMedia is an image, video or audio attachment written as ![alt](path)
+// in the toots file. Focus and thumbnail come from the optional markdown
+// title, e.g. ![alt](clip.mp4 "focus=0.2,-0.4 thumbnail=cover.jpg").
+type TootMedia struct {
+	altText   string
+	path      string
+	focus     string
+	thumbnail string
+	mediaID   mdon.ID
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyz")
@@ -42,6 +63,92 @@ var tootSeparator = regexp.MustCompile("(?m)^===$")
 var mediaMarkdown = regexp.MustCompile(`!\[(?P<AltText>[^\]]*)\]\((?P<Path>.*?)\s*(?P<Title>"(?:.*[^"])")?\s*\)`)
 var linkMarkdown = regexp.MustCompile(`\[(?P<Text>[^\]]*)\]\((?P<Link>.*?)\)`)
 var linkPlaceholder = regexp.MustCompile(`xx(?P<Key>[a-z]+)xx`)
+var mediaPlaceholder = regexp.MustCompile(`xx(?P<Kind>[A-Z])(?P<Index>[0-9]+)xx`)
+
+// a poll is a ?[poll ...] line followed by one "- option" line per option,
+// e.g. ?[poll expires=2d multiple hide]
+var pollMarkdown = regexp.MustCompile(`(?m)^\?\[poll(?P<Opts>[^\]]*)\][ \t]*\n(?P<Options>(?:[ \t]*[-*][ \t]+.*\S.*(?:\n|$))+)`)
+var pollOption = regexp.MustCompile(`(?m)^[ \t]*[-*][ \t]+(.*\S)[ \t]*$`)
+
+// a quote is a ?[quote](url) line, the url can point to a status on any server
+var quoteMarkdown = regexp.MustCompile(`(?m)^\?\[quote\]\((?P<URL>[^)\s]+)\)[ \t]*(?:\n|$)`)
+
+const kDefaultPollExpiry = 24 * time.Hour
+const kMinPollExpiry = 5 * time.Minute
+const kMaxPollExpiry = 30 * 24 * time.Hour
+
+// parsePollDuration accepts Go durations plus a "d" suffix for days.
+func parsePollDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid poll expiry %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid poll expiry %q", s)
+	}
+	return d, nil
+}
+
+func parsePoll(opts string, options string) (*mdon.TootPoll, error) {
+	poll := &mdon.TootPoll{
+		ExpiresInSeconds: int64(kDefaultPollExpiry.Seconds()),
+	}
+	for _, opt := range strings.Fields(opts) {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "expires":
+			d, err := parsePollDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if d < kMinPollExpiry || d > kMaxPollExpiry {
+				return nil, fmt.Errorf("poll expiry %s must be between %s and %s", d, kMinPollExpiry, kMaxPollExpiry)
+			}
+			poll.ExpiresInSeconds = int64(d.Seconds())
+		case "multiple":
+			poll.Multiple = true
+		case "hide":
+			poll.HideTotals = true
+		default:
+			return nil, fmt.Errorf("unknown poll option %q", opt)
+		}
+	}
+	for _, sm := range pollOption.FindAllStringSubmatch(options, -1) {
+		poll.Options = append(poll.Options, sm[1])
+	}
+	if len(poll.Options) < 2 {
+		return nil, fmt.Errorf("a poll needs at least two options")
+	}
+	return poll, nil
+}
+
+// parseMediaTitle reads the focus and thumbnail settings from a media
+// markdown title.
+func parseMediaTitle(title string) (string, string, error) {
+	var focus, thumbnail string
+	for _, opt := range strings.Fields(strings.Trim(title, `"`)) {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "focus":
+			x, y, ok := strings.Cut(value, ",")
+			_, errX := strconv.ParseFloat(x, 64)
+			_, errY := strconv.ParseFloat(y, 64)
+			if !ok || errX != nil || errY != nil {
+				return "", "", fmt.Errorf("invalid focus %q, expected x,y between -1 and 1", value)
+			}
+			focus = value
+		case "thumbnail":
+			thumbnail = value
+		default:
+			return "", "", fmt.Errorf("unknown media option %q", opt)
+		}
+	}
+	return focus, thumbnail, nil
+}
 
 func (ttr *Tooter) ResolvePath(path string) string {
 	if filepath.IsAbs(path) {
@@ -52,55 +159,126 @@ func (ttr *Tooter) ResolvePath(path string) string {
 	return filepath.Join(tootsDir, path)
 }
 
-func (ttr *Tooter) UploadImage(path string, altText string) (mdon.ID, error) {
-	imgFile, err := os.Open(ttr.ResolvePath(path))
+// UploadMedia uploads an attachment. Videos and large files are processed
+// asynchronously by the server, so it waits until the attachment is ready.
+func (ttr *Tooter) UploadMedia(tm *TootMedia) (mdon.ID, error) {
+	mediaPath := ttr.ResolvePath(tm.path)
+	thumbPath := ""
+	if tm.thumbnail != "" {
+		thumbPath = ttr.ResolvePath(tm.thumbnail)
+	}
+	if ttr.media != nil {
+		var err error
+		mediaPath, err = ttr.media.Prepare(mediaPath, tm.altText)
+		if err != nil {
+			return "", err
+		}
+		if thumbPath != "" {
+			thumbPath, err = ttr.media.prepare(thumbPath)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	mediaFile, err := os.Open(mediaPath)
 	if err != nil {
 		return "", err
 	}
-	defer imgFile.Close()
+	defer mediaFile.Close()
 
-	imgMedia := mdon.Media{
-		File:        imgFile,
-		Description: altText,
+	media := mdon.Media{
+		File:        mediaFile,
+		Description: tm.altText,
+		Focus:       tm.focus,
+	}
+	if thumbPath != "" {
+		thumbFile, err := os.Open(thumbPath)
+		if err != nil {
+			return "", err
+		}
+		defer thumbFile.Close()
+		media.Thumbnail = thumbFile
 	}
-	attachment, err := ttr.mClient.UploadMediaFromMedia(context.Background(), &imgMedia)
+
+	ctx := context.Background()
+	attachment, err := ttr.mClient.UploadMediaFromMedia(ctx, &media)
 	if err != nil {
 		return "", err
 	}
+	if attachment.URL == "" {
+		pollEvery := ttr.mediaPollEvery
+		if pollEvery == 0 {
+			pollEvery = 2 * time.Second
+		}
+		attachment, err = waitForMedia(ctx, ttr.mClient, attachment.ID, pollEvery)
+		if err != nil {
+			return "", err
+		}
+	}
 	return attachment.ID, nil
 }
 
-func (ttr *Tooter) Toot() error {
+// ChainToot is one status of a chain after the toots file has been split.
+type ChainToot struct {
+	Text  string
+	Media []*TootMedia
+	Poll  *mdon.TootPoll
+	// url of the status this one quotes
+	Quote string
+}
+
+// Split reads the toots file and breaks it into numbered, toot-sized
+// statuses, assigning each image to the status its markdown appeared in.
+func (ttr *Tooter) Split() ([]*ChainToot, error) {
 	tootBytes, err := os.ReadFile(ttr.tootsPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tootText := string(tootBytes)
+	if ttr.replyMention != "" {
+		tootText = ttr.replyMention + " " + tootText
+	}
 
-	var tootImages []*TootImage
-	var totalImageMarkdownSize int
-
-	mediaIndices := mediaMarkdown.FindAllStringSubmatchIndex(tootText, -1)
-	for _, mi := range mediaIndices {
-		tootImages = append(tootImages, &TootImage{
-			pos:     mi[0] - totalImageMarkdownSize,
-			altText: tootText[mi[2]:mi[3]],
-			path:    tootText[mi[4]:mi[5]],
+	// media and polls are replaced by placeholders so they stay with the
+	// sentence they were written next to however the text gets split
+	var parseErr error
+	var tootMedia []*TootMedia
+	tootTextWithoutMedia := mediaMarkdown.ReplaceAllStringFunc(tootText, func(matched string) string {
+		sm := mediaMarkdown.FindStringSubmatch(matched)
+		focus, thumbnail, err := parseMediaTitle(sm[3])
+		if err != nil && parseErr == nil {
+			parseErr = fmt.Errorf("%s: %w", sm[2], err)
+		}
+		tootMedia = append(tootMedia, &TootMedia{
+			altText:   sm[1],
+			path:      sm[2],
+			focus:     focus,
+			thumbnail: thumbnail,
 		})
-		totalImageMarkdownSize += mi[1] - mi[0]
-	}
+		return fmt.Sprintf("xxM%dxx", len(tootMedia)-1)
+	})
 
-	if !ttr.dryrun {
-		for _, tootImage := range tootImages {
-			imgID, err := ttr.UploadImage(tootImage.path, tootImage.altText)
-			if err != nil {
-				return err
-			}
-			tootImage.mediaID = imgID
+	var tootPolls []*mdon.TootPoll
+	tootTextWithoutMedia = pollMarkdown.ReplaceAllStringFunc(tootTextWithoutMedia, func(matched string) string {
+		sm := pollMarkdown.FindStringSubmatch(matched)
+		poll, err := parsePoll(sm[1], sm[2])
+		if err != nil && parseErr == nil {
+			parseErr = err
 		}
+		tootPolls = append(tootPolls, poll)
+		return fmt.Sprintf("xxP%dxx\n", len(tootPolls)-1)
+	})
+	if parseErr != nil {
+		return nil, parseErr
 	}
 
-	tootTextWithoutMedia := mediaMarkdown.ReplaceAllString(tootText, "")
+	var tootQuotes []string
+	tootTextWithoutMedia = quoteMarkdown.ReplaceAllStringFunc(tootTextWithoutMedia, func(matched string) string {
+		sm := quoteMarkdown.FindStringSubmatch(matched)
+		tootQuotes = append(tootQuotes, sm[1])
+		return fmt.Sprintf("xxQ%dxx\n", len(tootQuotes)-1)
+	})
 
 	keyToLink := make(map[string]string)
 
@@ -142,12 +320,35 @@ func (ttr *Tooter) Toot() error {
 		tootStrs = append(tootStrs, sb.String())
 	}
 
-	var previousStatus *mdon.Status
+	var chain []*ChainToot
 
-	var overallIndex int
 	for tootIdx, tootStr := range tootStrs {
-		tootEndIndex := overallIndex + len(tootStr)
-		overallIndex += len(tootStr)
+		ct := &ChainToot{}
+		var polls, quotes int
+		tootStr = mediaPlaceholder.ReplaceAllStringFunc(tootStr, func(matched string) string {
+			sm := mediaPlaceholder.FindStringSubmatch(matched)
+			idx, _ := strconv.Atoi(sm[2])
+			switch sm[1] {
+			case "M":
+				ct.Media = append(ct.Media, tootMedia[idx])
+			case "P":
+				ct.Poll = tootPolls[idx]
+				polls++
+			case "Q":
+				ct.Quote = tootQuotes[idx]
+				quotes++
+			}
+			return ""
+		})
+		if polls > 1 {
+			return nil, fmt.Errorf("toot %d has more than one poll", tootIdx+1)
+		}
+		if quotes > 1 {
+			return nil, fmt.Errorf("toot %d quotes more than one post", tootIdx+1)
+		}
+		if ct.Poll != nil && len(ct.Media) > 0 {
+			return nil, fmt.Errorf("toot %d has both a poll and media, mastodon allows only one", tootIdx+1)
+		}
 
 		tootStr = strings.TrimSpace(tootStr)
 
@@ -155,42 +356,168 @@ func (ttr *Tooter) Toot() error {
 			return keyToLink[matched]
 		})
 
-		tootStr = fmt.Sprintf("%d/%d\n%s", tootIdx+1, len(tootStrs), tootStr)
-		var mids []mdon.ID
-		var imagePaths []string
-		lastAssignedIndex := -1
-		for i, tootImage := range tootImages {
-			if tootImage.pos < tootEndIndex {
-				mids = append(mids, tootImage.mediaID)
-				imagePaths = append(imagePaths, tootImage.path)
-				lastAssignedIndex = i
-			} else {
-				break
-			}
-		}
-		tootImages = tootImages[lastAssignedIndex+1:]
+		ct.Text = fmt.Sprintf("%d/%d\n%s", tootIdx+1, len(tootStrs), tootStr)
+		chain = append(chain, ct)
+	}
 
-		if ttr.dryrun {
-			fmt.Println("toot text: ", tootStr)
-			fmt.Println("toot imgs: ", imagePaths)
-			continue
-		}
-		toot := mdon.Toot{
-			Status:   tootStr,
-			MediaIDs: mids,
+	return chain, nil
+}
+
+// PostChain posts the chain as a thread, uploading each status's media right
+// before it is posted. The first status replies to inReplyTo when it is set.
+func (ttr *Tooter) PostChain(chain []*ChainToot, inReplyTo mdon.ID) (*mdon.Status, error) {
+	var previousStatus *mdon.Status
+
+	for _, ct := range chain {
+		toot, err := ttr.buildToot(ct)
+		if err != nil {
+			return nil, err
 		}
 
 		if previousStatus != nil {
 			toot.InReplyToID = previousStatus.ID
+		} else {
+			toot.InReplyToID = inReplyTo
 		}
 
-		status, err := ttr.mClient.PostStatus(context.Background(), &toot)
+		status, err := ttr.post(toot, ct)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		previousStatus = status
 	}
 
+	return previousStatus, nil
+}
+
+func (ttr *Tooter) buildToot(ct *ChainToot) (*mdon.Toot, error) {
+	var mids []mdon.ID
+	for _, tm := range ct.Media {
+		if tm.mediaID == "" {
+			mediaID, err := ttr.UploadMedia(tm)
+			if err != nil {
+				return nil, err
+			}
+			tm.mediaID = mediaID
+		}
+		mids = append(mids, tm.mediaID)
+	}
+	return &mdon.Toot{
+		Status:   ct.Text,
+		MediaIDs: mids,
+		Poll:     ct.Poll,
+	}, nil
+}
+
+// post sends toot, resolving the status ct quotes on our server first.
+func (ttr *Tooter) post(toot *mdon.Toot, ct *ChainToot) (*mdon.Status, error) {
+	ctx := context.Background()
+	var quotedID mdon.ID
+	if ct.Quote != "" {
+		quoted, err := resolveMastodonStatus(ctx, ttr.mClient, ct.Quote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve quoted post %s: %w", ct.Quote, err)
+		}
+		quotedID = quoted.ID
+	}
+	return postStatus(ctx, ttr.mClient, toot, quotedID)
+}
+
+// resolveReplyTo looks up the status the chain replies to and, unless it is
+// our own, mentions its author so they get notified.
+func (ttr *Tooter) resolveReplyTo() error {
+	ctx := context.Background()
+	status, err := resolveMastodonStatus(ctx, ttr.mClient, ttr.replyTo)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", ttr.replyTo, err)
+	}
+	ttr.inReplyTo = status.ID
+
+	me, err := ttr.mClient.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Account.ID != me.ID {
+		ttr.replyMention = "@" + status.Account.Acct
+	}
 	return nil
 }
+
+func (ttr *Tooter) printDryrun(ct *ChainToot) {
+	fmt.Println("toot text: ", ct.Text)
+	for _, tm := range ct.Media {
+		size := "missing"
+		if fi, err := os.Stat(ttr.ResolvePath(tm.path)); err == nil {
+			size = humanSize(fi.Size())
+		}
+		fmt.Printf("toot media: %s (%s, %s)\n", tm.path, mediaContentType(tm.path), size)
+	}
+	if ct.Poll != nil {
+		fmt.Printf("toot poll: %q expires in %s", ct.Poll.Options,
+			time.Duration(ct.Poll.ExpiresInSeconds)*time.Second)
+		if ct.Poll.Multiple {
+			fmt.Print(", multiple choice")
+		}
+		fmt.Println()
+	}
+	if ct.Quote != "" {
+		fmt.Println("toot quote: ", ct.Quote)
+	}
+}
+
+func (ttr *Tooter) Toot() error {
+	if ttr.replyTo != "" {
+		err := ttr.resolveReplyTo()
+		if err != nil {
+			return err
+		}
+	}
+
+	chain, err := ttr.Split()
+	if err != nil {
+		return err
+	}
+
+	if ttr.previewPath != "" {
+		err = ttr.WritePreview(chain, ttr.previewPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote preview to %s", ttr.previewPath)
+		return nil
+	}
+
+	if ttr.dryrun {
+		if ttr.scheduledAt != nil {
+			fmt.Println("would schedule chain at: ", ttr.scheduledAt.Format(time.RFC3339))
+		}
+		if ttr.replyTo != "" {
+			fmt.Println("would reply to: ", ttr.replyTo)
+		}
+		for _, ct := range chain {
+			ttr.printDryrun(ct)
+		}
+		return nil
+	}
+
+	if ttr.scheduledAt != nil {
+		pending, err := ttr.Schedule(chain)
+		if err != nil {
+			return err
+		}
+		log.Printf("scheduled chain %s at %s", pending.ScheduledID, pending.ScheduledAt.Format(time.RFC3339))
+		if !ttr.wait {
+			return nil
+		}
+		scheduler := Scheduler{
+			mClient:    ttr.mClient,
+			pendingDir: ttr.pendingDir,
+			media:      ttr.media,
+		}
+		return scheduler.Wait(context.Background(), pending)
+	}
+
+	_, err = ttr.PostChain(chain, ttr.inReplyTo)
+	return err
+}
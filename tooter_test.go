@@ -1,9 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	mdon "github.com/mattn/go-mastodon"
+	"github.com/neurosnap/sentences"
+	td "github.com/neurosnap/sentences/data"
 )
 
 func TestRandSeq(t *testing.T) {
@@ -56,3 +65,289 @@ func TestTooter_ResolvePath(t *testing.T) {
 		})
 	}
 }
+
+func newTestTokenizer(t *testing.T) sentences.SentenceTokenizer {
+	b, err := td.Asset("data/english.json")
+	if err != nil {
+		t.Fatalf("Failed to load training data: %v", err)
+	}
+	training, err := sentences.LoadTraining(b)
+	if err != nil {
+		t.Fatalf("Failed to load training: %v", err)
+	}
+	return sentences.NewSentenceTokenizer(training)
+}
+
+func TestTooter_Split(t *testing.T) {
+	tempTootsDir, err := os.MkdirTemp("", "toots")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempTootsDir)
+
+	tootsPath := filepath.Join(tempTootsDir, "toots.md")
+	content := "First toot with [a link](https://example.com/a).\n![a cat](cat.png)\n===\nSecond toot.\n![a dog](dog.png)\n"
+	err = os.WriteFile(tootsPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write toots: %v", err)
+	}
+
+	ttr := &Tooter{
+		tootsPath: tootsPath,
+		tokenizer: newTestTokenizer(t),
+	}
+	chain, err := ttr.Split()
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("Expected 2 toots, got %d", len(chain))
+	}
+	if !strings.HasPrefix(chain[0].Text, "1/2\n") || !strings.Contains(chain[0].Text, "https://example.com/a") {
+		t.Errorf("Unexpected first toot %q", chain[0].Text)
+	}
+	if !strings.HasPrefix(chain[1].Text, "2/2\nSecond toot.") {
+		t.Errorf("Unexpected second toot %q", chain[1].Text)
+	}
+	if len(chain[0].Media) != 1 || chain[0].Media[0].path != "cat.png" || chain[0].Media[0].altText != "a cat" {
+		t.Errorf("Unexpected media for first toot: %+v", chain[0].Media)
+	}
+	if len(chain[1].Media) != 1 || chain[1].Media[0].path != "dog.png" {
+		t.Errorf("Unexpected media for second toot: %+v", chain[1].Media)
+	}
+}
+
+func TestTooter_Split_PollAndMedia(t *testing.T) {
+	tempTootsDir, err := os.MkdirTemp("", "toots")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempTootsDir)
+
+	tootsPath := filepath.Join(tempTootsDir, "toots.md")
+	content := `Which one do you prefer?
+?[poll expires=2d multiple]
+- Cats
+- Dogs
+===
+Here is a clip.
+![a running dog](dog.mp4 "focus=0.5,-0.25 thumbnail=dog.jpg")
+`
+	err = os.WriteFile(tootsPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write toots: %v", err)
+	}
+
+	ttr := &Tooter{
+		tootsPath: tootsPath,
+		tokenizer: newTestTokenizer(t),
+	}
+	chain, err := ttr.Split()
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("Expected 2 toots, got %d", len(chain))
+	}
+	poll := chain[0].Poll
+	if poll == nil {
+		t.Fatal("Expected a poll in the first toot")
+	}
+	if len(poll.Options) != 2 || poll.Options[0] != "Cats" || poll.Options[1] != "Dogs" {
+		t.Errorf("Unexpected poll options %q", poll.Options)
+	}
+	if !poll.Multiple || poll.ExpiresInSeconds != 2*24*60*60 {
+		t.Errorf("Unexpected poll settings %+v", poll)
+	}
+	if strings.Contains(chain[0].Text, "Cats") || strings.Contains(chain[0].Text, "xx") {
+		t.Errorf("Poll markdown leaked into toot text %q", chain[0].Text)
+	}
+	if chain[1].Poll != nil || len(chain[1].Media) != 1 {
+		t.Fatalf("Expected one video in the second toot, got %+v", chain[1])
+	}
+	tm := chain[1].Media[0]
+	if tm.path != "dog.mp4" || tm.focus != "0.5,-0.25" || tm.thumbnail != "dog.jpg" {
+		t.Errorf("Unexpected media %+v", tm)
+	}
+}
+
+func TestTooter_Split_PollWithMedia(t *testing.T) {
+	tempTootsDir, err := os.MkdirTemp("", "toots")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempTootsDir)
+
+	tootsPath := filepath.Join(tempTootsDir, "toots.md")
+	content := "Vote!\n![cat](cat.png)\n?[poll]\n- Yes\n- No\n"
+	err = os.WriteFile(tootsPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write toots: %v", err)
+	}
+
+	ttr := &Tooter{
+		tootsPath: tootsPath,
+		tokenizer: newTestTokenizer(t),
+	}
+	_, err = ttr.Split()
+	if err == nil {
+		t.Error("Expected an error for a toot with both a poll and media")
+	}
+}
+
+func TestParsePoll(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    string
+		options string
+		wantErr bool
+	}{
+		{name: "defaults", opts: "", options: "- a\n- b\n"},
+		{name: "hours", opts: " expires=6h hide", options: "- a\n- b\n"},
+		{name: "one option", opts: "", options: "- a\n", wantErr: true},
+		{name: "too long", opts: " expires=60d", options: "- a\n- b\n", wantErr: true},
+		{name: "unknown", opts: " secret", options: "- a\n- b\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePoll(tt.opts, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePoll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTooter_UploadMedia_Async(t *testing.T) {
+	var polls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v2/media":
+			r.ParseMultipartForm(1 << 20)
+			if r.FormValue("focus") != "0.1,0.2" {
+				t.Errorf("Expected focus to be sent, got %q", r.FormValue("focus"))
+			}
+			if _, _, err := r.FormFile("thumbnail"); err != nil {
+				t.Errorf("Expected thumbnail to be sent: %v", err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"id":"m1","type":"video","url":null}`)
+		case "/api/v1/media/m1":
+			polls++
+			if polls < 2 {
+				w.WriteHeader(http.StatusPartialContent)
+				fmt.Fprint(w, `{"id":"m1","type":"video","url":null}`)
+				return
+			}
+			fmt.Fprint(w, `{"id":"m1","type":"video","url":"https://example.com/m1.mp4"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tempTootsDir, err := os.MkdirTemp("", "toots")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempTootsDir)
+	for _, name := range []string{"clip.mp4", "cover.jpg"} {
+		err = os.WriteFile(filepath.Join(tempTootsDir, name), []byte("data"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	ttr := &Tooter{
+		mClient:        mdon.NewClient(&mdon.Config{Server: server.URL}),
+		tootsPath:      filepath.Join(tempTootsDir, "toots.md"),
+		mediaPollEvery: time.Millisecond,
+	}
+	id, err := ttr.UploadMedia(&TootMedia{path: "clip.mp4", focus: "0.1,0.2", thumbnail: "cover.jpg"})
+	if err != nil {
+		t.Fatalf("UploadMedia failed: %v", err)
+	}
+	if id != "m1" {
+		t.Errorf("Expected media id m1, got %q", id)
+	}
+	if polls != 2 {
+		t.Errorf("Expected to poll twice for processing, got %d", polls)
+	}
+}
+
+func TestTooter_Toot_ReplyToAndQuote(t *testing.T) {
+	type posted struct {
+		status, inReplyTo, quoted string
+	}
+	var posts []posted
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v2/search":
+			switch r.URL.Query().Get("q") {
+			case "https://remote.example/@bob/1":
+				fmt.Fprint(w, `{"statuses":[{"id":"local-1","account":{"id":"bob","acct":"bob@remote.example"}}]}`)
+			case "https://remote.example/@carol/2":
+				fmt.Fprint(w, `{"statuses":[{"id":"local-2","account":{"id":"carol","acct":"carol@remote.example"}}]}`)
+			default:
+				fmt.Fprint(w, `{"statuses":[]}`)
+			}
+		case "/api/v1/accounts/verify_credentials":
+			fmt.Fprint(w, `{"id":"me","acct":"me"}`)
+		case "/api/v1/statuses":
+			r.ParseForm()
+			posts = append(posts, posted{
+				status:    r.Form.Get("status"),
+				inReplyTo: r.Form.Get("in_reply_to_id"),
+				quoted:    r.Form.Get("quoted_status_id"),
+			})
+			fmt.Fprintf(w, `{"id":"posted-%d"}`, len(posts))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tempTootsDir, err := os.MkdirTemp("", "toots")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempTootsDir)
+
+	tootsPath := filepath.Join(tempTootsDir, "toots.md")
+	content := "I disagree.\n===\nAs Carol put it:\n?[quote](https://remote.example/@carol/2)\n"
+	err = os.WriteFile(tootsPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write toots: %v", err)
+	}
+
+	ttr := &Tooter{
+		mClient:   mdon.NewClient(&mdon.Config{Server: server.URL}),
+		tootsPath: tootsPath,
+		tokenizer: newTestTokenizer(t),
+		replyTo:   "https://remote.example/@bob/1",
+	}
+	err = ttr.Toot()
+	if err != nil {
+		t.Fatalf("Toot failed: %v", err)
+	}
+
+	if len(posts) != 2 {
+		t.Fatalf("Expected 2 posts, got %+v", posts)
+	}
+	if posts[0].inReplyTo != "local-1" || !strings.Contains(posts[0].status, "@bob@remote.example I disagree.") {
+		t.Errorf("Expected the root to reply to and mention bob, got %+v", posts[0])
+	}
+	if posts[0].quoted != "" {
+		t.Errorf("Expected the root not to quote, got %q", posts[0].quoted)
+	}
+	if posts[1].inReplyTo != "posted-1" || posts[1].quoted != "local-2" {
+		t.Errorf("Expected the second post to continue the chain and quote carol, got %+v", posts[1])
+	}
+	if strings.Contains(posts[1].status, "quote") || strings.Contains(posts[1].status, "xx") {
+		t.Errorf("Quote markdown leaked into %q", posts[1].status)
+	}
+}